@@ -1,53 +1,250 @@
 package photoshare
 
 import (
+	"crypto/subtle"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
 )
 
+const (
+	authCodeLength      = 32
+	authCodeExpiry      = 5 // minutes
+	maxUserNameAttempts = 100
+
+	resetSelectorLength = 16
+	resetVerifierLength = 32
+	resetTokenExpiry    = 60 // minutes
+	resetResendInterval = 5  // minutes
+	maxResetAttempts    = 5
+)
+
+// the names of the configured login providers
+func getAuthProviders(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	return renderJSON(w, ctx.auth.providerNames(), http.StatusOK)
+}
+
 func getAuthRedirectURL(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
-	url, err := ctx.auth.getRedirectURL(r, ctx.params.get("provider"))
+	url, err := ctx.auth.getRedirectURL(w, r, ctx.params.get("provider"), 0)
 	if err != nil {
 		return err
 	}
 	return renderString(w, http.StatusOK, url)
 }
 
+// Logs in the user with their provider account, signing up new users. As the client
+// only reads session tokens from headers, it is redirected with a one-time code to
+// exchange for a token. If the user is linking the account, the code confirms the link.
 func authCallback(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
-	info, err := ctx.auth.getUserInfo(r, ctx.params.get("provider"))
+	provider := ctx.params.get("provider")
+
+	info, err := ctx.auth.getUserInfo(w, r, provider)
 	if err != nil {
 		return err
 	}
 
-	// tbd: handle new users
-	user, err := ctx.datamapper.getUserByEmail(info.email)
+	if info.linkUserID != 0 {
+		if info.id == "" {
+			return httpError{http.StatusBadRequest, "Invalid provider account"}
+		}
+		code, err := createAuthCode(ctx, &authCode{
+			UserID:     info.linkUserID,
+			Provider:   provider,
+			ProviderID: info.id,
+			Email:      strings.ToLower(info.email),
+		})
+		if err != nil {
+			return err
+		}
+		http.Redirect(w, r, "/#/identities/?code="+code, http.StatusSeeOther)
+		return nil
+	}
+
+	user, err := getOrCreateOAuthUser(ctx, r, provider, info)
+	if err != nil {
+		return err
+	}
+
+	code, err := createAuthCode(ctx, &authCode{UserID: user.ID})
+	if err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, "/#/oauth2/?code="+code, http.StatusSeeOther)
+	return nil
+}
+
+// stores the hash of a new one-time code and returns the code
+func createAuthCode(ctx *context, code *authCode) (string, error) {
+
+	plain, err := generateRandomString(authCodeLength)
+	if err != nil {
+		return "", err
+	}
+
+	code.CodeHash = hashToken(plain)
+	code.ExpiresAt = time.Now().Add(time.Minute * authCodeExpiry)
+
+	if err := ctx.datamapper.createAuthCode(code); err != nil {
+		return "", err
+	}
+	return plain, nil
+}
+
+// Finds the user linked to the provider account. Otherwise the account is linked to
+// the user with the same email address, or a new user is created.
+func getOrCreateOAuthUser(ctx *context, r *http.Request, provider string, info *authInfo) (*user, error) {
+
+	if info.id == "" {
+		return nil, httpError{http.StatusBadRequest, "Invalid provider account"}
+	}
+
+	existing, err := ctx.datamapper.getUserByIdentity(provider, info.id)
+	if err == nil {
+		if !existing.IsActive {
+			return nil, httpError{http.StatusForbidden, "This account has been disabled"}
+		}
+		return existing, nil
+	}
+	if !isErrSqlNoRows(err) {
+		return nil, err
+	}
+
+	email := strings.ToLower(info.email)
+
+	identity := &userIdentity{
+		Provider:   provider,
+		ProviderID: info.id,
+		Email:      email,
+	}
+
+	if email != "" {
+		existing, err := ctx.datamapper.getUserByEmail(email)
+		if err == nil {
+			// anyone could have signed up with an email they do not own, so only
+			// accounts that have proved it are linked
+			if !existing.EmailVerified {
+				return nil, httpError{http.StatusBadRequest,
+					"An account with this email address already exists. Log in with your password to link it."}
+			}
+			identity.UserID = existing.ID
+			entry := newAuditEntry(r, existing.ID, existing.ID, auditIdentityLinked, provider)
+			if err := ctx.datamapper.createUserIdentity(identity, entry); err != nil {
+				return nil, err
+			}
+			return existing, nil
+		}
+		if !isErrSqlNoRows(err) {
+			return nil, err
+		}
+	}
+
+	if !validateEmail(email) {
+		return nil, httpError{http.StatusBadRequest, "Your provider account has no email address"}
+	}
+
+	name, err := getAvailableUserName(ctx, oauthUserName(info))
 	if err != nil {
+		return nil, err
+	}
+
+	// new users have no password, so they log in with their provider, which has
+	// already verified their email
+	newUser := &user{Name: name, Email: email, EmailVerified: true}
+
+	if err := ctx.datamapper.createUserWithIdentity(newUser, identity); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if err := ctx.mailer.sendWelcomeMail(newUser); err != nil {
+			logError(err)
+		}
+	}()
+
+	return newUser, nil
+}
+
+// the nickname is preferred to the full name, then the email address
+func oauthUserName(info *authInfo) string {
+	for _, name := range []string{info.nickname, info.name, strings.Split(info.email, "@")[0]} {
+		if name = strings.Join(strings.Fields(name), ""); name != "" {
+			return name
+		}
+	}
+	return "user"
+}
+
+// adds a number to the name if it is already taken
+func getAvailableUserName(ctx *context, name string) (string, error) {
+
+	candidate := name
+
+	for i := 2; i < maxUserNameAttempts; i++ {
+		ok, err := ctx.datamapper.isUserNameAvailable(&user{Name: candidate})
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s%d", name, i)
+	}
+
+	suffix, err := generateRandomString(6)
+	if err != nil {
+		return "", err
+	}
+	return name + suffix, nil
+}
+
+func exchangeAuthCode(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Code string `json:"code"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
 		return err
 	}
 
-	authToken, err := ctx.session.createToken(user.ID)
+	var invalidCode = httpError{http.StatusBadRequest, "Invalid or expired code"}
 
+	if s.Code == "" {
+		return invalidCode
+	}
+
+	code, err := ctx.datamapper.useAuthCode(hashToken(s.Code))
 	if err != nil {
+		if isErrSqlNoRows(err) {
+			return invalidCode
+		}
 		return err
 	}
 
-	cookie := &http.Cookie{
-		Name:    "authToken",
-		Value:   authToken,
-		Path:    "/",
-		Expires: time.Now().AddDate(0, 0, 1),
+	// codes for linking accounts cannot be used to log in
+	if code.isLink() {
+		return invalidCode
 	}
-	http.SetCookie(w, cookie)
-	http.Redirect(w, r, "/", http.StatusSeeOther)
-	return nil
+
+	user, err := ctx.datamapper.getActiveUser(code.UserID)
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return invalidCode
+		}
+		return err
+	}
+
+	return completeLogin(ctx, w, r, user)
 }
 
+// revokes the session, so its tokens can no longer be used
 func logout(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
-	if err := ctx.session.writeToken(w, 0); err != nil {
+	if err := ctx.datamapper.revokeSession(ctx.user.SessionID); err != nil {
 		return err
 	}
 
@@ -79,23 +276,31 @@ func login(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
 	user, err := ctx.datamapper.getUserByNameOrEmail(s.Identifier)
 	if err != nil {
-		if isErrSqlNoRows(err) {
-			return invalidLogin
+		if !isErrSqlNoRows(err) {
+			return err
+		}
+		// guesses at accounts are limited by the IP address
+		if _, err := reserveLogin(ctx, w, r, 0); err != nil {
+			return err
+		}
+		if err := ctx.limiter.fail(getRemoteIP(r), time.Now()); err != nil {
+			return err
 		}
-		return err
-	}
-	if !user.checkPassword(s.Password) {
 		return invalidLogin
 	}
 
-	if err := ctx.session.writeToken(w, user.ID); err != nil {
+	attempt, err := reserveLogin(ctx, w, r, user.ID)
+	if err != nil {
 		return err
 	}
+	if !user.checkPassword(s.Password) {
+		if err := failLogin(ctx, r, user, attempt); err != nil {
+			return err
+		}
+		return invalidLogin
+	}
 
-	user.IsAuthenticated = true
-
-	sendMessage(&socketMessage{user.Name, "", 0, "login"})
-	return renderJSON(w, newSessionInfo(user), http.StatusCreated)
+	return completeLogin(ctx, w, r, user)
 }
 
 func signup(ctx *context, w http.ResponseWriter, r *http.Request) error {
@@ -123,27 +328,30 @@ func signup(ctx *context, w http.ResponseWriter, r *http.Request) error {
 	if err := ctx.datamapper.createUser(user); err != nil {
 		return err
 	}
-	if err := ctx.session.writeToken(w, user.ID); err != nil {
+	if err := startSession(ctx, w, r, user); err != nil {
 		return err
 	}
 
 	user.IsAuthenticated = true
 
-	go func() {
-		if err := ctx.mailer.sendWelcomeMail(user); err != nil {
-			logError(err)
-		}
-	}()
+	if err := sendEmailVerification(ctx, r, user, user.Email, true); err != nil {
+		logError(err)
+	}
 
 	return renderJSON(w, newSessionInfo(user), http.StatusCreated)
 
 }
 
+// Changes the password of the logged in user, or of the user with an emailed reset
+// token. All the user's other sessions are revoked, and all of them after a reset
+// as whoever had the old password may still be logged in.
 func changePassword(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
 	var (
-		user *user
-		err  error
+		user            *user
+		exceptSessionID int64
+		action          = auditPasswordChanged
+		err             error
 	)
 
 	s := &struct {
@@ -159,11 +367,14 @@ func changePassword(ctx *context, w http.ResponseWriter, r *http.Request) error
 		if user, err = ctx.authenticate(r, authLevelLogin); err != nil {
 			return err
 		}
+		exceptSessionID = user.SessionID
 	} else {
-		if user, err = ctx.datamapper.getUserByRecoveryCode(s.RecoveryCode); err != nil {
+		if user, err = getUserByResetToken(ctx, s.RecoveryCode); err != nil {
 			return err
 		}
-		user.resetRecoveryCode()
+		// the token was sent to the user's email
+		user.EmailVerified = true
+		action = auditPasswordReset
 	}
 
 	if err = user.changePassword(s.Password); err != nil {
@@ -172,19 +383,37 @@ func changePassword(ctx *context, w http.ResponseWriter, r *http.Request) error
 	if err := ctx.validate(user, r); err != nil {
 		return err
 	}
-	if err := ctx.datamapper.updateUser(user); err != nil {
+	if err := ctx.datamapper.updatePassword(user, exceptSessionID,
+		newAuditEntry(r, user.ID, user.ID, action, "")); err != nil {
 		return err
 	}
+	// the account may have been locked by someone guessing the old password
+	if action == auditPasswordReset {
+		if err := ctx.limiter.reset(user.ID); err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		if err := ctx.mailer.sendPasswordChangedMail(user, r); err != nil {
+			logError(err)
+		}
+	}()
 
 	return renderString(w, http.StatusOK, "Password changed")
 }
 
+// Tells the signup form if the address is taken. This shows whether someone has an
+// account, so lookups are limited by IP address to slow down harvesting addresses.
 func emailExists(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
-	email := r.FormValue("email")
+	email := strings.ToLower(strings.TrimSpace(r.FormValue("email")))
 	if email == "" {
 		return httpError{http.StatusBadRequest, "Missing email address"}
 	}
+	if err := checkEmailLookupLimit(ctx, w, r); err != nil {
+		return err
+	}
 	u := &user{Email: email}
 	used, err := ctx.datamapper.isUserEmailAvailable(u)
 	if err != nil {
@@ -199,6 +428,8 @@ func emailExists(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
 }
 
+// Emails a reset token if there is a user with the address. The response is the
+// same either way, so it cannot be used to find out who has an account.
 func recoverPassword(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
 	s := &struct {
@@ -208,27 +439,100 @@ func recoverPassword(ctx *context, w http.ResponseWriter, r *http.Request) error
 	if err := decodeJSON(r, s); err != nil {
 		return err
 	}
-	if s.Email == "" {
+	if strings.TrimSpace(s.Email) == "" {
 		return httpError{http.StatusBadRequest, "Missing email address"}
 	}
-	user, err := ctx.datamapper.getUserByEmail(s.Email)
+
+	// done in the background so the response time is the same
+	go func() {
+		if err := sendPasswordReset(ctx, r, s.Email); err != nil {
+			logError(err)
+		}
+	}()
+
+	return renderString(w, http.StatusOK,
+		"If an account exists for this email address, you will receive an email to reset your password")
+}
+
+func sendPasswordReset(ctx *context, r *http.Request, email string) error {
+
+	// as stored on signup
+	user, err := ctx.datamapper.getUserByEmail(strings.ToLower(strings.TrimSpace(email)))
 	if err != nil {
 		if isErrSqlNoRows(err) {
-			return httpError{http.StatusBadRequest, "Email address not found"}
+			return nil
 		}
 		return err
 	}
-	code, err := user.generateRecoveryCode()
 
-	if err := ctx.datamapper.updateUser(user); err != nil {
+	now := time.Now()
+
+	// one email every few minutes per address, so it cannot be used to flood an inbox
+	numRecent, err := ctx.datamapper.countPasswordResets(user.ID, now.Add(-time.Minute*resetResendInterval))
+	if err != nil {
 		return err
 	}
+	if numRecent > 0 {
+		return nil
+	}
 
-	go func() {
-		if err := ctx.mailer.sendResetPasswordMail(user, code, r); err != nil {
-			logError(err)
+	selector, err := generateRandomString(resetSelectorLength)
+	if err != nil {
+		return err
+	}
+	verifier, err := generateRandomString(resetVerifierLength)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.createPasswordReset(&passwordReset{
+		Selector:     selector,
+		VerifierHash: hashToken(verifier),
+		UserID:       user.ID,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(time.Minute * resetTokenExpiry),
+	}); err != nil {
+		return err
+	}
+
+	return ctx.mailer.sendResetPasswordMail(user, selector+"."+verifier, r)
+}
+
+// Finds the user of an unexpired reset token. Each wrong verifier counts against
+// the reset, so it cannot be guessed.
+func getUserByResetToken(ctx *context, token string) (*user, error) {
+
+	errInvalid := httpError{http.StatusBadRequest, "Invalid or expired code, please request another email"}
+
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil, errInvalid
+	}
+
+	reset, err := ctx.datamapper.getPasswordReset(parts[0])
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return nil, errInvalid
 		}
-	}()
+		return nil, err
+	}
+	if reset.Attempts >= maxResetAttempts {
+		return nil, errInvalid
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashToken(parts[1])), []byte(reset.VerifierHash)) != 1 {
+		if err := ctx.datamapper.failPasswordReset(reset.Selector); err != nil {
+			return nil, err
+		}
+		return nil, errInvalid
+	}
 
-	return renderString(w, http.StatusOK, "Password reset")
+	user, err := ctx.datamapper.getActiveUser(reset.UserID)
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return nil, errInvalid
+		}
+		return nil, err
+	}
+	return user, nil
 }
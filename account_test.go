@@ -0,0 +1,378 @@
+package photoshare
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type mockAuthenticator struct {
+	info *authInfo
+}
+
+func (a *mockAuthenticator) providerNames() []string {
+	return []string{"google"}
+}
+
+func (a *mockAuthenticator) getRedirectURL(w http.ResponseWriter, r *http.Request, provider string, linkUserID int64) (string, error) {
+	return "", nil
+}
+
+func (a *mockAuthenticator) getUserInfo(w http.ResponseWriter, r *http.Request, provider string) (*authInfo, error) {
+	return a.info, nil
+}
+
+// no existing users, with some names taken
+type oauthDataMapper struct {
+	mockDataMapper
+	taken    map[string]bool
+	created  *user
+	identity *userIdentity
+	code     *authCode
+}
+
+func (m *oauthDataMapper) getUserByEmail(email string) (*user, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *oauthDataMapper) isUserNameAvailable(user *user) (bool, error) {
+	return !m.taken[user.Name], nil
+}
+
+func (m *oauthDataMapper) createUserWithIdentity(user *user, identity *userIdentity) error {
+	user.ID = 1
+	m.created = user
+	m.identity = identity
+	return nil
+}
+
+func (m *oauthDataMapper) createAuthCode(code *authCode) error {
+	m.code = code
+	return nil
+}
+
+func TestOAuthUserName(t *testing.T) {
+	if name := oauthUserName(&authInfo{name: "Dan Jacob", nickname: "danjac"}); name != "danjac" {
+		t.Errorf("Nickname should be used, got %s", name)
+	}
+	if name := oauthUserName(&authInfo{name: "Dan Jacob"}); name != "DanJacob" {
+		t.Errorf("Name should be used without spaces, got %s", name)
+	}
+	if name := oauthUserName(&authInfo{email: "dan@example.com"}); name != "dan" {
+		t.Errorf("Email should be used, got %s", name)
+	}
+}
+
+func TestGetAvailableUserName(t *testing.T) {
+
+	app := &app{
+		datamapper: &oauthDataMapper{taken: map[string]bool{"danjac": true, "danjac2": true}},
+	}
+
+	c := &context{app: app}
+
+	name, err := getAvailableUserName(c, "danjac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "danjac3" {
+		t.Errorf("Name should be danjac3, got %s", name)
+	}
+}
+
+func TestAuthCallbackNewUser(t *testing.T) {
+
+	req, _ := http.NewRequest("GET", "http://localhost/api/auth/oauth2/google/callback/", nil)
+	res := httptest.NewRecorder()
+
+	datamapper := &oauthDataMapper{taken: map[string]bool{"danjac": true}}
+
+	app := &app{
+		datamapper: datamapper,
+		auth:       &mockAuthenticator{&authInfo{id: "123", nickname: "danjac", email: "Dan@example.com"}},
+		mailer:     newMailer(&config{}),
+	}
+
+	c := &context{
+		app:    app,
+		params: &params{map[string]string{"provider": "google"}},
+		user:   &user{},
+	}
+
+	if err := authCallback(c, res, req); err != nil {
+		t.Fatal(err)
+	}
+
+	if datamapper.created == nil || datamapper.created.Name != "danjac2" || datamapper.created.Email != "dan@example.com" {
+		t.Fatal("New user should be created with an available name")
+	}
+	if datamapper.identity.Provider != "google" || datamapper.identity.ProviderID != "123" {
+		t.Error("Provider account should be linked to the user")
+	}
+
+	location := res.Header().Get("Location")
+	if !strings.HasPrefix(location, "/#/oauth2/?code=") {
+		t.Fatalf("Should redirect with code, got %s", location)
+	}
+	if code := strings.TrimPrefix(location, "/#/oauth2/?code="); hashToken(code) != datamapper.code.CodeHash {
+		t.Error("Only the hash of the code should be stored")
+	}
+}
+
+func TestExchangeAuthCodeIfInvalid(t *testing.T) {
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/auth/oauth2/exchange", strings.NewReader(`{"code": "foo"}`))
+	res := httptest.NewRecorder()
+
+	app := &app{
+		datamapper: &mockDataMapper{},
+	}
+
+	c := &context{
+		app:    app,
+		params: &params{make(map[string]string)},
+		user:   &user{},
+	}
+
+	err := exchangeAuthCode(c, res, req)
+	if err, ok := err.(httpError); !ok || err.Status != http.StatusBadRequest {
+		t.Error("Invalid code should not be exchanged")
+	}
+}
+
+// an existing user with the same email
+type existingEmailDataMapper struct {
+	oauthDataMapper
+	verified bool
+}
+
+func (m *existingEmailDataMapper) getUserByEmail(email string) (*user, error) {
+	return &user{ID: 2, Email: email, IsActive: true, EmailVerified: m.verified}, nil
+}
+
+func (m *existingEmailDataMapper) createUserIdentity(identity *userIdentity, entry *auditEntry) error {
+	m.identity = identity
+	return nil
+}
+
+func TestAuthCallbackIfEmailTaken(t *testing.T) {
+
+	req, _ := http.NewRequest("GET", "http://localhost/api/auth/oauth2/google/callback/", nil)
+	res := httptest.NewRecorder()
+
+	datamapper := &existingEmailDataMapper{}
+
+	c := &context{
+		app: &app{
+			datamapper: datamapper,
+			auth:       &mockAuthenticator{&authInfo{id: "123", email: "dan@example.com"}},
+		},
+		params: &params{map[string]string{"provider": "google"}},
+		user:   &user{},
+	}
+
+	err := authCallback(c, res, req)
+	if err, ok := err.(httpError); !ok || err.Status != http.StatusBadRequest {
+		t.Error("Provider account should not be linked by email")
+	}
+	if datamapper.identity != nil || datamapper.created != nil {
+		t.Error("No identity or user should be created")
+	}
+}
+
+type passwordResetDataMapper struct {
+	mockDataMapper
+	user          *user
+	reset         *passwordReset
+	created       *passwordReset
+	failed        bool
+	updated       *user
+	exceptSession int64
+	entry         *auditEntry
+}
+
+func (m *passwordResetDataMapper) getUserByEmail(email string) (*user, error) {
+	if m.user == nil || m.user.Email != email {
+		return nil, sql.ErrNoRows
+	}
+	return m.user, nil
+}
+
+func (m *passwordResetDataMapper) getActiveUser(userID int64) (*user, error) {
+	if m.user == nil || m.user.ID != userID {
+		return nil, sql.ErrNoRows
+	}
+	return m.user, nil
+}
+
+func (m *passwordResetDataMapper) createPasswordReset(reset *passwordReset) error {
+	m.created = reset
+	return nil
+}
+
+func (m *passwordResetDataMapper) getPasswordReset(selector string) (*passwordReset, error) {
+	if m.reset == nil || m.reset.Selector != selector {
+		return nil, sql.ErrNoRows
+	}
+	return m.reset, nil
+}
+
+func (m *passwordResetDataMapper) countPasswordResets(userID int64, since time.Time) (int64, error) {
+	if m.created != nil && m.created.UserID == userID && m.created.CreatedAt.After(since) {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (m *passwordResetDataMapper) failPasswordReset(selector string) error {
+	m.failed = true
+	return nil
+}
+
+func (m *passwordResetDataMapper) updatePassword(user *user, exceptSessionID int64, entry *auditEntry) error {
+	m.updated = user
+	m.exceptSession = exceptSessionID
+	m.entry = entry
+	return nil
+}
+
+func newPasswordResetDataMapper() *passwordResetDataMapper {
+	return &passwordResetDataMapper{
+		user:  &user{ID: 1, Name: "tester", Email: "tester@example.com", IsActive: true},
+		reset: &passwordReset{Selector: "selector", VerifierHash: hashToken("verifier"), UserID: 1},
+	}
+}
+
+func TestRecoverPasswordIfUnknownEmail(t *testing.T) {
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/auth/recoverpass", strings.NewReader(`{"email": "unknown@example.com"}`))
+	res := httptest.NewRecorder()
+
+	c := newTestContext(newPasswordResetDataMapper(), nil)
+
+	if err := recoverPassword(c, res, req); err != nil {
+		t.Fatal(err)
+	}
+	if res.Code != http.StatusOK {
+		t.Error("Response should not show if the account exists")
+	}
+}
+
+func TestSendPasswordReset(t *testing.T) {
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/auth/recoverpass", nil)
+
+	datamapper := newPasswordResetDataMapper()
+	c := newTestContext(datamapper, nil)
+	c.mailer = newMailer(&config{TemplatesDir: "templates"})
+
+	if err := sendPasswordReset(c, req, "unknown@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if datamapper.created != nil {
+		t.Fatal("No reset should be created for an unknown email")
+	}
+
+	if err := sendPasswordReset(c, req, " Tester@Example.com "); err != nil {
+		t.Fatal(err)
+	}
+	if datamapper.created == nil || datamapper.created.UserID != 1 {
+		t.Fatal("Reset should be created")
+	}
+	if len(datamapper.created.VerifierHash) != 64 || !datamapper.created.ExpiresAt.After(datamapper.created.CreatedAt) {
+		t.Error("Reset should store the hashed verifier and expire")
+	}
+
+	first := datamapper.created
+	if err := sendPasswordReset(c, req, "tester@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if datamapper.created != first {
+		t.Error("Another reset should not be sent so soon")
+	}
+}
+
+func TestChangePasswordWithResetToken(t *testing.T) {
+
+	req, _ := http.NewRequest("PUT", "http://localhost/api/auth/changepass", strings.NewReader(`{"password": "newpass", "code": "selector.verifier"}`))
+	res := httptest.NewRecorder()
+
+	datamapper := newPasswordResetDataMapper()
+
+	if err := changePassword(newTestContext(datamapper, nil), res, req); err != nil {
+		t.Fatal(err)
+	}
+	if datamapper.updated == nil || !datamapper.updated.checkPassword("newpass") {
+		t.Fatal("Password should be changed")
+	}
+	if datamapper.exceptSession != 0 {
+		t.Error("All sessions should be revoked")
+	}
+	if !datamapper.updated.EmailVerified {
+		t.Error("Email should be verified by the reset")
+	}
+	if datamapper.entry == nil || datamapper.entry.Action != auditPasswordReset {
+		t.Error("Reset should be audited")
+	}
+}
+
+func TestChangePasswordIfWrongVerifier(t *testing.T) {
+
+	req, _ := http.NewRequest("PUT", "http://localhost/api/auth/changepass", strings.NewReader(`{"password": "newpass", "code": "selector.wrong"}`))
+	res := httptest.NewRecorder()
+
+	datamapper := newPasswordResetDataMapper()
+
+	err := changePassword(newTestContext(datamapper, nil), res, req)
+	if err, ok := err.(httpError); !ok || err.Status != http.StatusBadRequest {
+		t.Error("Wrong verifier should be refused")
+	}
+	if !datamapper.failed {
+		t.Error("Wrong verifier should count against the reset")
+	}
+	if datamapper.updated != nil {
+		t.Error("Password should not be changed")
+	}
+}
+
+func TestChangePasswordIfTooManyAttempts(t *testing.T) {
+
+	req, _ := http.NewRequest("PUT", "http://localhost/api/auth/changepass", strings.NewReader(`{"password": "newpass", "code": "selector.verifier"}`))
+	res := httptest.NewRecorder()
+
+	datamapper := newPasswordResetDataMapper()
+	datamapper.reset.Attempts = maxResetAttempts
+
+	err := changePassword(newTestContext(datamapper, nil), res, req)
+	if err, ok := err.(httpError); !ok || err.Status != http.StatusBadRequest {
+		t.Error("Reset should be refused after too many attempts")
+	}
+	if datamapper.updated != nil {
+		t.Error("Password should not be changed")
+	}
+}
+
+func TestEmailExistsIfTooManyLookups(t *testing.T) {
+
+	c := newTestContext(&mockDataMapper{}, &user{})
+
+	for i := 0; i < emailLookupMaxAttempts; i++ {
+		req, _ := http.NewRequest("GET", "http://localhost/api/auth/emailExists?email=tester@example.com", nil)
+		if err := emailExists(c, httptest.NewRecorder(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost/api/auth/emailExists?email=tester@example.com", nil)
+	res := httptest.NewRecorder()
+
+	if err := emailExists(c, res, req); err != errTooManyEmailLookups {
+		t.Fatalf("Lookups should be limited, got %v", err)
+	}
+	if res.Header().Get("Retry-After") == "" {
+		t.Error("Client should be told when to retry")
+	}
+}
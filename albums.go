@@ -0,0 +1,250 @@
+package photoshare
+
+import (
+	"fmt"
+	"net/http"
+)
+
+func getAlbumToEdit(ctx *context, w http.ResponseWriter, r *http.Request) (*album, error) {
+
+	album, err := ctx.datamapper.getAlbum(ctx.params.getInt("id"))
+	if err != nil {
+		return album, err
+	}
+
+	if !album.canEdit(ctx.user) {
+		return album, httpError{http.StatusForbidden, "You're not allowed to edit this album"}
+	}
+	return album, nil
+}
+
+func createAlbum(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Title       string `json:"title"`
+		Description string `json:"description"`
+		Visibility  string `json:"visibility"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	album := &album{
+		OwnerID:     ctx.user.ID,
+		Title:       s.Title,
+		Description: s.Description,
+		Visibility:  s.Visibility,
+	}
+
+	if album.Visibility == "" {
+		album.Visibility = visibilityPublic
+	}
+
+	if err := ctx.validate(album, r); err != nil {
+		return err
+	}
+	if err := ctx.datamapper.createAlbum(album); err != nil {
+		return err
+	}
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	return renderJSON(w, album, http.StatusCreated)
+}
+
+func editAlbum(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	album, err := getAlbumToEdit(ctx, w, r)
+	if err != nil {
+		return err
+	}
+
+	s := &struct {
+		Title        string `json:"title"`
+		Description  string `json:"description"`
+		Visibility   string `json:"visibility"`
+		CoverPhotoID int64  `json:"coverPhotoId"`
+	}{
+		album.Title,
+		album.Description,
+		album.Visibility,
+		album.CoverPhotoID,
+	}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	album.Title = s.Title
+	album.Description = s.Description
+	album.Visibility = s.Visibility
+
+	if s.CoverPhotoID != album.CoverPhotoID && s.CoverPhotoID != 0 {
+		// as with editAlbumPhotos, the cover must be one of the album's photos
+		inAlbum, err := ctx.datamapper.isPhotoInAlbum(album.ID, s.CoverPhotoID)
+		if err != nil {
+			return err
+		}
+		if !inAlbum {
+			return httpError{http.StatusBadRequest, "Cover photo must be in the album"}
+		}
+		photo, err := ctx.datamapper.getPhoto(s.CoverPhotoID)
+		if err != nil {
+			if isErrSqlNoRows(err) {
+				return httpError{http.StatusBadRequest, "Cover photo not found"}
+			}
+			return err
+		}
+		if !photo.canEdit(ctx.user) {
+			return httpError{http.StatusForbidden, "You're not allowed to use this photo as a cover"}
+		}
+	}
+	album.CoverPhotoID = s.CoverPhotoID
+
+	if err := ctx.validate(album, r); err != nil {
+		return err
+	}
+	if err := ctx.datamapper.updateAlbum(album); err != nil {
+		return err
+	}
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	return renderJSON(w, album, http.StatusOK)
+}
+
+// replaces the photos in an album. The order of the photo IDs is the album order.
+func editAlbumPhotos(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	album, err := getAlbumToEdit(ctx, w, r)
+	if err != nil {
+		return err
+	}
+
+	s := &struct {
+		Photos []int64 `json:"photos"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	var (
+		photoIDs []int64
+		added    = make(map[int64]bool)
+	)
+
+	for _, photoID := range s.Photos {
+		if added[photoID] {
+			continue
+		}
+		photo, err := ctx.datamapper.getPhoto(photoID)
+		if err != nil {
+			if isErrSqlNoRows(err) {
+				return httpError{http.StatusBadRequest, fmt.Sprintf("Photo %d not found", photoID)}
+			}
+			return err
+		}
+		if !photo.canEdit(ctx.user) {
+			return httpError{http.StatusForbidden, fmt.Sprintf("You're not allowed to add photo %d", photoID)}
+		}
+		added[photoID] = true
+		photoIDs = append(photoIDs, photoID)
+	}
+
+	if !added[album.CoverPhotoID] {
+		album.CoverPhotoID = 0
+	}
+
+	if err := ctx.datamapper.updateAlbumPhotos(album, photoIDs); err != nil {
+		return err
+	}
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	return renderString(w, http.StatusOK, "Album updated")
+}
+
+func deleteAlbum(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	album, err := ctx.datamapper.getAlbum(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	if !album.canDelete(ctx.user) {
+		return httpError{http.StatusForbidden, "You're not allowed to delete this album"}
+	}
+	if err := ctx.datamapper.removeAlbum(album); err != nil {
+		return err
+	}
+	if err := ctx.cache.clear(); err != nil {
+		return err
+	}
+
+	return renderString(w, http.StatusOK, "Album deleted")
+}
+
+func getAlbumDetail(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	return renderAlbumDetail(ctx, w, r, ctx.params.getInt("id"), nil)
+}
+
+// renders the album if the user is allowed to see it, or the share grants access to it
+func renderAlbumDetail(ctx *context, w http.ResponseWriter, r *http.Request, albumID int64, grant *share) error {
+
+	album, err := ctx.datamapper.getAlbumDetail(getPage(r), albumID, ctx.user, grant)
+	if err != nil {
+		return err
+	}
+	ctx.media.signList(album.Photos)
+	return renderJSON(w, album, http.StatusOK)
+}
+
+func getAlbums(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	page := getPage(r)
+	cacheKey := fmt.Sprintf("albums:page:%d", page.index)
+
+	return ctx.cache.render(w, http.StatusOK, cacheKey, func() (interface{}, error) {
+		albums, err := ctx.datamapper.getAlbums(page)
+		if err != nil {
+			return albums, err
+		}
+		return albums, nil
+	})
+}
+
+func albumsByOwnerID(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	page := getPage(r)
+	ownerID := ctx.params.getInt("ownerID")
+	visibilities := listedVisibilities(ownerID, ctx.user)
+	cacheKey := fmt.Sprintf("albums:ownerID:%d:%s:page:%d", ownerID, visibilities, page.index)
+
+	return ctx.cache.render(w, http.StatusOK, cacheKey, func() (interface{}, error) {
+		albums, err := ctx.datamapper.getAlbumsByOwnerID(page, ownerID, ctx.user)
+		if err != nil {
+			return albums, err
+		}
+		return albums, nil
+	})
+}
+
+func searchAlbums(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	page := getPage(r)
+	q := r.FormValue("q")
+	cacheKey := fmt.Sprintf("albums:search:%s:page:%d", q, page.index)
+
+	return ctx.cache.render(w, http.StatusOK, cacheKey, func() (interface{}, error) {
+		albums, err := ctx.datamapper.searchAlbums(page, q)
+		if err != nil {
+			return albums, err
+		}
+		return albums, nil
+	})
+}
@@ -0,0 +1,111 @@
+package photoshare
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAlbumCanView(t *testing.T) {
+	user := &user{ID: 1}
+	album := &album{ID: 1, OwnerID: 2, Visibility: visibilityPublic}
+
+	if !album.canView(user) {
+		t.Error("Anyone should be able to view a public album")
+	}
+
+	album.Visibility = visibilityUnlisted
+	if !album.canView(user) {
+		t.Error("Anyone should be able to view an unlisted album")
+	}
+
+	album.Visibility = visibilityPrivate
+	if album.canView(user) {
+		t.Error("Non-owner should not be able to view a private album")
+	}
+
+	user.IsAuthenticated = true
+	album.OwnerID = 1
+	if !album.canView(user) {
+		t.Error("Owner should be able to view a private album")
+	}
+}
+
+func TestAlbumValidate(t *testing.T) {
+	album := &album{OwnerID: 1, Title: "test", Visibility: "secret"}
+	errors := make(map[string]string)
+
+	if err := album.validate(nil, nil, errors); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := errors["visibility"]; !ok {
+		t.Error("Visibility should be invalid")
+	}
+}
+
+// should return a 404
+func TestGetAlbumDetailIfNone(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://localhost/api/albums/1", nil)
+	res := httptest.NewRecorder()
+
+	app := &app{
+		datamapper: &mockDataMapper{},
+	}
+
+	c := &context{
+		app:    app,
+		params: &params{map[string]string{"id": "1"}},
+		user:   &user{},
+	}
+
+	err := getAlbumDetail(c, res, req)
+	if err != sql.ErrNoRows {
+		t.Fail()
+	}
+}
+
+// an album owned by user 1, containing photo 1
+type albumDataMapper struct {
+	mockDataMapper
+	updated bool
+}
+
+func (m *albumDataMapper) getAlbum(albumID int64) (*album, error) {
+	return &album{ID: albumID, OwnerID: 1, Title: "test", Visibility: visibilityPublic}, nil
+}
+
+func (m *albumDataMapper) isPhotoInAlbum(albumID, photoID int64) (bool, error) {
+	return photoID == 1, nil
+}
+
+func (m *albumDataMapper) getPhoto(photoID int64) (*photo, error) {
+	return &photo{ID: photoID, OwnerID: 1}, nil
+}
+
+func (m *albumDataMapper) updateAlbum(album *album) error {
+	m.updated = true
+	return nil
+}
+
+func TestEditAlbumIfCoverNotInAlbum(t *testing.T) {
+	req, _ := http.NewRequest("PATCH", "http://localhost/api/albums/1", strings.NewReader(`{"title": "test", "coverPhotoId": 2}`))
+	res := httptest.NewRecorder()
+
+	datamapper := &albumDataMapper{}
+
+	c := &context{
+		app:    &app{datamapper: datamapper},
+		params: &params{map[string]string{"id": "1"}},
+		user:   &user{ID: 1, IsAuthenticated: true},
+	}
+
+	err := editAlbum(c, res, req)
+	if err, ok := err.(httpError); !ok || err.Status != http.StatusBadRequest {
+		t.Error("Cover photo should be in the album")
+	}
+	if datamapper.updated {
+		t.Error("Album should not be updated")
+	}
+}
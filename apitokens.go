@@ -0,0 +1,153 @@
+package photoshare
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	apiTokenPrefix        = "pat_"
+	apiTokenLength        = 40
+	apiTokenShownLength   = 8 // characters after the prefix shown to tell tokens apart
+	apiTokenTouchInterval = time.Minute
+	maxAPITokenNameLength = 100
+
+	// scopes an API token can be limited to
+	scopePhotosRead  = "photos:read"
+	scopePhotosWrite = "photos:write"
+	scopeAdmin       = "admin"
+)
+
+var (
+	errInvalidAPIToken = httpError{http.StatusUnauthorized, "Invalid or revoked API token"}
+	errAPITokenNotUsed = httpError{http.StatusForbidden, "API tokens cannot be used here, please log in"}
+)
+
+func isValidScope(scope string) bool {
+	switch scope {
+	case scopePhotosRead, scopePhotosWrite, scopeAdmin:
+		return true
+	}
+	return false
+}
+
+// the token from an "Authorization: Bearer" header, if any
+func getBearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(header[7:])
+}
+
+// Finds the user of an API token, which must have all the scopes of the route.
+// Routes without scopes, such as account settings, only accept sessions: those requiring
+// a login refuse tokens, and the others treat the client as anonymous.
+func (app *app) authenticateAPIToken(r *http.Request, tokenString string, scopes []string) (*user, error) {
+
+	if len(scopes) == 0 {
+		return nil, errAPITokenNotUsed
+	}
+
+	token, err := app.datamapper.getAPIToken(hashToken(tokenString))
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return nil, errInvalidAPIToken
+		}
+		return nil, err
+	}
+
+	for _, scope := range scopes {
+		if !token.hasScope(scope) {
+			return nil, httpError{http.StatusForbidden, "This API token needs the " + scope + " scope"}
+		}
+	}
+
+	user, err := app.datamapper.getActiveUser(token.UserID)
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return nil, errInvalidAPIToken
+		}
+		return nil, err
+	}
+	user.IsAuthenticated = true
+
+	if token.LastUsedAt == nil || time.Since(*token.LastUsedAt) > apiTokenTouchInterval {
+		if err := app.datamapper.touchAPIToken(token.ID, getRemoteIP(r)); err != nil {
+			logError(err)
+		}
+	}
+
+	return user, nil
+}
+
+func getAPITokens(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	tokens, err := ctx.datamapper.getAPITokens(ctx.user.ID)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, tokens, http.StatusOK)
+}
+
+// the token is only returned here, as just its hash is stored
+func createAPIToken(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	secret, err := generateRandomString(apiTokenLength)
+	if err != nil {
+		return err
+	}
+
+	token := &apiToken{
+		UserID:    ctx.user.ID,
+		Name:      strings.TrimSpace(s.Name),
+		TokenHash: hashToken(apiTokenPrefix + secret),
+		Prefix:    apiTokenPrefix + secret[:apiTokenShownLength],
+		ScopeList: s.Scopes,
+	}
+
+	if err := ctx.validate(token, r); err != nil {
+		return err
+	}
+
+	entry := newAuditEntry(r, ctx.user.ID, ctx.user.ID, auditAPITokenCreated, token.Name)
+
+	if err := ctx.datamapper.createAPIToken(token, entry); err != nil {
+		return err
+	}
+
+	return renderJSON(w, &struct {
+		*apiToken
+		Token string `json:"token"`
+	}{token, apiTokenPrefix + secret}, http.StatusCreated)
+}
+
+func revokeAPIToken(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	tokens, err := ctx.datamapper.getAPITokens(ctx.user.ID)
+	if err != nil {
+		return err
+	}
+
+	id := ctx.params.getInt("id")
+
+	for i := range tokens {
+		if tokens[i].ID == id {
+			entry := newAuditEntry(r, ctx.user.ID, ctx.user.ID, auditAPITokenRevoked, tokens[i].Name)
+			if err := ctx.datamapper.revokeAPIToken(&tokens[i], entry); err != nil {
+				return err
+			}
+			return renderString(w, http.StatusOK, "API token revoked")
+		}
+	}
+	return httpError{http.StatusNotFound, "API token not found"}
+}
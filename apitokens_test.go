@@ -0,0 +1,193 @@
+package photoshare
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type apiTokenDataMapper struct {
+	mockDataMapper
+	token   *apiToken
+	created *apiToken
+	revoked *apiToken
+	touched bool
+	entry   *auditEntry
+}
+
+func (m *apiTokenDataMapper) getAPIToken(tokenHash string) (*apiToken, error) {
+	if m.token == nil || m.token.TokenHash != tokenHash {
+		return nil, sql.ErrNoRows
+	}
+	return m.token, nil
+}
+
+func (m *apiTokenDataMapper) getAPITokens(userID int64) ([]apiToken, error) {
+	if m.token == nil || m.token.UserID != userID {
+		return []apiToken{}, nil
+	}
+	return []apiToken{*m.token}, nil
+}
+
+func (m *apiTokenDataMapper) getActiveUser(userID int64) (*user, error) {
+	return &user{ID: userID, IsActive: true}, nil
+}
+
+func (m *apiTokenDataMapper) touchAPIToken(tokenID int64, ip string) error {
+	m.touched = true
+	return nil
+}
+
+func (m *apiTokenDataMapper) createAPIToken(token *apiToken, entry *auditEntry) error {
+	m.created = token
+	m.entry = entry
+	return nil
+}
+
+func (m *apiTokenDataMapper) revokeAPIToken(token *apiToken, entry *auditEntry) error {
+	m.revoked = token
+	m.entry = entry
+	return nil
+}
+
+func newTestAPIToken(scopes ...string) *apiToken {
+	return &apiToken{ID: 3, UserID: 1, Name: "uploads", TokenHash: hashToken("pat_foo"), ScopeList: scopes}
+}
+
+func newAPITokenRequest(token string) *http.Request {
+	req, _ := http.NewRequest("GET", "http://localhost/api/photos/1", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func TestGetBearerToken(t *testing.T) {
+
+	req, _ := http.NewRequest("GET", "http://localhost/api/photos/1", nil)
+	if getBearerToken(req) != "" {
+		t.Error("No token should be found without the header")
+	}
+
+	req.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+	if getBearerToken(req) != "" {
+		t.Error("Other schemes should be ignored")
+	}
+
+	req.Header.Set("Authorization", "bearer pat_foo")
+	if getBearerToken(req) != "pat_foo" {
+		t.Error("Scheme should not be case sensitive")
+	}
+}
+
+func TestAuthenticateWithAPIToken(t *testing.T) {
+
+	datamapper := &apiTokenDataMapper{token: newTestAPIToken(scopePhotosRead)}
+	app := &app{datamapper: datamapper, session: &mockSessionManager{}}
+
+	user, err := app.authenticate(newAPITokenRequest("pat_foo"), authLevelLogin, scopePhotosRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.IsAuthenticated || user.ID != 1 {
+		t.Error("User should be logged in with the token")
+	}
+	if !datamapper.touched {
+		t.Error("Token use should be recorded")
+	}
+}
+
+func TestAuthenticateWithAPITokenIfMissingScope(t *testing.T) {
+
+	app := &app{datamapper: &apiTokenDataMapper{token: newTestAPIToken(scopePhotosRead)}, session: &mockSessionManager{}}
+
+	_, err := app.authenticate(newAPITokenRequest("pat_foo"), authLevelLogin, scopePhotosWrite)
+	if err, ok := err.(httpError); !ok || err.Status != http.StatusForbidden {
+		t.Error("Token should need the scope of the route")
+	}
+
+	if _, err := app.authenticate(newAPITokenRequest("pat_foo"), authLevelLogin); err != errAPITokenNotUsed {
+		t.Error("Token should not be accepted by routes without scopes")
+	}
+
+	user, err := app.authenticate(newAPITokenRequest("pat_foo"), authLevelCheck)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.IsAuthenticated {
+		t.Error("Token should be ignored by public routes without scopes")
+	}
+}
+
+func TestAuthenticateWithInvalidAPIToken(t *testing.T) {
+
+	app := &app{datamapper: &apiTokenDataMapper{token: newTestAPIToken(scopePhotosRead)}, session: &mockSessionManager{}}
+
+	if _, err := app.authenticate(newAPITokenRequest("pat_bar"), authLevelCheck, scopePhotosRead); err != errInvalidAPIToken {
+		t.Error("Unknown or revoked token should be refused")
+	}
+}
+
+func TestCreateAPIToken(t *testing.T) {
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/me/tokens", strings.NewReader(`{"name": "uploads", "scopes": ["photos:write"]}`))
+	res := httptest.NewRecorder()
+
+	datamapper := &apiTokenDataMapper{}
+	c := newTestContext(datamapper, &user{ID: 1})
+
+	if err := createAPIToken(c, res, req); err != nil {
+		t.Fatal(err)
+	}
+
+	result := &struct {
+		Token  string   `json:"token"`
+		Prefix string   `json:"prefix"`
+		Scopes []string `json:"scopes"`
+	}{}
+	if err := json.Unmarshal(res.Body.Bytes(), result); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(result.Token, result.Prefix) || len(result.Scopes) != 1 {
+		t.Error("Token should be returned with its prefix and scopes")
+	}
+	if datamapper.created.TokenHash != hashToken(result.Token) {
+		t.Error("Only the hash of the token should be stored")
+	}
+	if datamapper.entry == nil || datamapper.entry.Action != auditAPITokenCreated {
+		t.Error("Token should be recorded in the audit log")
+	}
+}
+
+func TestCreateAPITokenIfNotAdmin(t *testing.T) {
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/me/tokens", strings.NewReader(`{"name": "tags", "scopes": ["admin"]}`))
+
+	datamapper := &apiTokenDataMapper{}
+
+	err := createAPIToken(newTestContext(datamapper, &user{ID: 1}), httptest.NewRecorder(), req)
+	if _, ok := err.(validationFailure); !ok {
+		t.Error("Only admins should create admin tokens")
+	}
+	if datamapper.created != nil {
+		t.Error("Token should not be created")
+	}
+}
+
+func TestRevokeAPITokenOfAnotherUser(t *testing.T) {
+
+	req, _ := http.NewRequest("DELETE", "http://localhost/api/me/tokens/3", nil)
+
+	datamapper := &apiTokenDataMapper{token: newTestAPIToken(scopePhotosRead)}
+	c := newTestContext(datamapper, &user{ID: 2})
+	c.params.vars["id"] = "3"
+
+	err := revokeAPIToken(c, httptest.NewRecorder(), req)
+	if err, ok := err.(httpError); !ok || err.Status != http.StatusNotFound {
+		t.Error("Only the owner should revoke the token")
+	}
+	if datamapper.revoked != nil {
+		t.Error("Token should not be revoked")
+	}
+}
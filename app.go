@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"github.com/gorilla/mux"
 	"net/http"
+	"time"
 )
 
 // authentication behaviours
@@ -25,9 +26,12 @@ type app struct {
 	router     *mux.Router
 	datamapper dataMapper
 	filestore  fileStorage
+	media      *mediaSigner
 	session    sessionManager
 	auth       authenticator
 	cache      cache
+	moderator  commentModerator
+	limiter    *loginLimiter
 }
 
 // our custom handler
@@ -53,9 +57,12 @@ func newApp() (*app, error) {
 		return app, err
 	}
 	app.filestore = newFileStorage(app.cfg)
+	app.media = newMediaSigner(app.cfg)
 	app.mailer = newMailer(app.cfg)
 	app.cache = newCache(app.cfg)
 	app.auth = newAuthenticator(app.cfg)
+	app.moderator = newCommentModerator(app.cfg)
+	app.limiter = newLoginLimiter(app.datamapper)
 
 	app.session, err = newSessionManager(app.cfg)
 	if err != nil {
@@ -85,11 +92,11 @@ func (app *app) initDB() error {
 }
 
 // the handler should create a new context on each request, and handle any returned
-// errors appropriately.
-func (app *app) handler(h handlerFunc, level authLevel) http.HandlerFunc {
+// errors appropriately. The scopes are those an API token needs to use the route.
+func (app *app) handler(h handlerFunc, level authLevel, scopes ...string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		handleError(w, r, func() error {
-			user, err := app.authenticate(r, level)
+			user, err := app.authenticate(r, level, scopes...)
 			if err != nil {
 				return err
 			}
@@ -98,8 +105,10 @@ func (app *app) handler(h handlerFunc, level authLevel) http.HandlerFunc {
 	}
 }
 
-// lazily fetches the current session user
-func (app *app) authenticate(r *http.Request, level authLevel) (*user, error) {
+// Lazily fetches the current session user, or the user of an API token. A token on a
+// route that only checks for a user but takes no tokens is ignored, so the client is
+// treated as anonymous there, as it would be without the header.
+func (app *app) authenticate(r *http.Request, level authLevel, scopes ...string) (*user, error) {
 
 	if level == authLevelIgnore {
 		return &user{}, nil
@@ -124,23 +133,55 @@ func (app *app) authenticate(r *http.Request, level authLevel) (*user, error) {
 		return nil
 	}
 
+	if token := getBearerToken(r); token != "" {
+		if level == authLevelCheck && len(scopes) == 0 {
+			return &user{}, nil
+		}
+		user, err := app.authenticateAPIToken(r, token, scopes)
+		if err != nil {
+			return nil, err
+		}
+		return user, checkAuthLevel(user)
+	}
+
 	user := &user{}
 
-	userID, err := app.session.readToken(r)
+	userID, sessionID, err := app.session.readToken(r)
 	if err != nil {
 		return user, err
 	}
 	if userID == 0 {
 		return user, checkAuthLevel(user)
 	}
+
+	// The token is only valid while its session has not been revoked. The client
+	// sent a token, so it is told to log in again rather than treated as anonymous.
+	session, err := app.datamapper.getSession(sessionID)
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return nil, errInvalidSession
+		}
+		return nil, err
+	}
+	if session.UserID != userID || !session.isActive() {
+		return nil, errInvalidSession
+	}
+
 	user, err = app.datamapper.getActiveUser(userID)
 	if err != nil {
 		if isErrSqlNoRows(err) {
-			return user, checkAuthLevel(user)
+			return nil, errInvalidSession
 		}
 		return nil, err
 	}
 	user.IsAuthenticated = true
+	user.SessionID = session.ID
+
+	if time.Since(session.LastSeenAt) > sessionTouchInterval {
+		if err := app.datamapper.touchSession(session.ID); err != nil {
+			logError(err)
+		}
+	}
 
 	return user, checkAuthLevel(user)
 }
@@ -155,31 +196,122 @@ func (app *app) initRouter() {
 	photos := api.PathPrefix("/photos/").Subrouter()
 
 	photos.HandleFunc("/", app.handler(getPhotos, authLevelIgnore)).Methods("GET").Name("photos")
-	photos.HandleFunc("/", app.handler(upload, authLevelLogin)).Methods("POST").Name("photos")
+	photos.HandleFunc("/", app.handler(upload, authLevelLogin, scopePhotosWrite)).Methods("POST").Name("photos")
+	photos.HandleFunc("/bulk", app.handler(bulkEditPhotos, authLevelLogin, scopePhotosWrite)).Methods("POST").Name("bulkEditPhotos")
 	photos.HandleFunc("/search", app.handler(searchPhotos, authLevelIgnore)).Methods("GET").Name("search")
-	photos.HandleFunc("/owner/{ownerID:[0-9]+}", app.handler(photosByOwnerID, authLevelIgnore)).Methods("GET").Name("owner")
-
-	photos.HandleFunc("/{id:[0-9]+}", app.handler(getPhotoDetail, authLevelCheck)).Methods("GET").Name("photoDetail")
-	photos.HandleFunc("/{id:[0-9]+}", app.handler(deletePhoto, authLevelLogin)).Methods("DELETE").Name("deletePhoto")
-	photos.HandleFunc("/{id:[0-9]+}/title", app.handler(editPhotoTitle, authLevelLogin)).Methods("PATCH").Name("editPhotoTitle")
-	photos.HandleFunc("/{id:[0-9]+}/tags", app.handler(editPhotoTags, authLevelLogin)).Methods("PATCH").Name("editPhotoTags")
-	photos.HandleFunc("/{id:[0-9]+}/upvote", app.handler(voteUp, authLevelLogin)).Methods("PATCH").Name("upvote")
-	photos.HandleFunc("/{id:[0-9]+}/downvote", app.handler(voteDown, authLevelLogin)).Methods("PATCH").Name("downvote")
+	photos.HandleFunc("/geo", app.handler(getGeoPhotos, authLevelIgnore)).Methods("GET").Name("geo")
+	photos.HandleFunc("/owner/{ownerID:[0-9]+}", app.handler(photosByOwnerID, authLevelCheck, scopePhotosRead)).Methods("GET").Name("owner")
+
+	photos.HandleFunc("/{id:[0-9]+}", app.handler(getPhotoDetail, authLevelCheck, scopePhotosRead)).Methods("GET").Name("photoDetail")
+	photos.HandleFunc("/{id:[0-9]+}", app.handler(deletePhoto, authLevelLogin, scopePhotosWrite)).Methods("DELETE").Name("deletePhoto")
+	photos.HandleFunc("/{id:[0-9]+}/title", app.handler(editPhotoTitle, authLevelLogin, scopePhotosWrite)).Methods("PATCH").Name("editPhotoTitle")
+	photos.HandleFunc("/{id:[0-9]+}/tags", app.handler(editPhotoTags, authLevelLogin, scopePhotosWrite)).Methods("PATCH").Name("editPhotoTags")
+	photos.HandleFunc("/{id:[0-9]+}/description", app.handler(editPhotoDescription, authLevelLogin, scopePhotosWrite)).Methods("PATCH").Name("editPhotoDescription")
+	photos.HandleFunc("/{id:[0-9]+}/visibility", app.handler(editPhotoVisibility, authLevelLogin, scopePhotosWrite)).Methods("PATCH").Name("editPhotoVisibility")
+	photos.HandleFunc("/{id:[0-9]+}/location", app.handler(editPhotoLocation, authLevelLogin, scopePhotosWrite)).Methods("PATCH").Name("editPhotoLocation")
+	photos.HandleFunc("/{id:[0-9]+}/upvote", app.handler(voteUp, authLevelLogin, scopePhotosWrite)).Methods("PATCH").Name("upvote")
+	photos.HandleFunc("/{id:[0-9]+}/downvote", app.handler(voteDown, authLevelLogin, scopePhotosWrite)).Methods("PATCH").Name("downvote")
+	photos.HandleFunc("/{id:[0-9]+}/favorite", app.handler(addFavorite, authLevelLogin, scopePhotosWrite)).Methods("PUT").Name("addFavorite")
+	photos.HandleFunc("/{id:[0-9]+}/favorite", app.handler(removeFavorite, authLevelLogin, scopePhotosWrite)).Methods("DELETE").Name("removeFavorite")
+	photos.HandleFunc("/{id:[0-9]+}/related", app.handler(getRelatedPhotos, authLevelCheck, scopePhotosRead)).Methods("GET").Name("relatedPhotos")
+	photos.HandleFunc("/{id:[0-9]+}/comments", app.handler(getComments, authLevelCheck, scopePhotosRead)).Methods("GET").Name("comments")
+	photos.HandleFunc("/{id:[0-9]+}/comments", app.handler(addComment, authLevelLogin, scopePhotosWrite)).Methods("POST").Name("addComment")
+
+	comments := api.PathPrefix("/comments/").Subrouter()
+
+	comments.HandleFunc("/{id:[0-9]+}", app.handler(editComment, authLevelLogin, scopePhotosWrite)).Methods("PATCH").Name("editComment")
+	comments.HandleFunc("/{id:[0-9]+}", app.handler(deleteComment, authLevelLogin, scopePhotosWrite)).Methods("DELETE").Name("deleteComment")
+
+	albums := api.PathPrefix("/albums/").Subrouter()
+
+	albums.HandleFunc("/", app.handler(getAlbums, authLevelIgnore)).Methods("GET").Name("albums")
+	albums.HandleFunc("/", app.handler(createAlbum, authLevelLogin, scopePhotosWrite)).Methods("POST").Name("createAlbum")
+	albums.HandleFunc("/search", app.handler(searchAlbums, authLevelIgnore)).Methods("GET").Name("searchAlbums")
+	albums.HandleFunc("/owner/{ownerID:[0-9]+}", app.handler(albumsByOwnerID, authLevelCheck, scopePhotosRead)).Methods("GET").Name("albumOwner")
+
+	albums.HandleFunc("/{id:[0-9]+}", app.handler(getAlbumDetail, authLevelCheck, scopePhotosRead)).Methods("GET").Name("albumDetail")
+	albums.HandleFunc("/{id:[0-9]+}", app.handler(editAlbum, authLevelLogin, scopePhotosWrite)).Methods("PATCH").Name("editAlbum")
+	albums.HandleFunc("/{id:[0-9]+}", app.handler(deleteAlbum, authLevelLogin, scopePhotosWrite)).Methods("DELETE").Name("deleteAlbum")
+	albums.HandleFunc("/{id:[0-9]+}/photos", app.handler(editAlbumPhotos, authLevelLogin, scopePhotosWrite)).Methods("PUT").Name("editAlbumPhotos")
+
+	users := api.PathPrefix("/users/").Subrouter()
+
+	users.HandleFunc("/{id:[0-9]+}", app.handler(getUserProfile, authLevelCheck)).Methods("GET").Name("userProfile")
+	users.HandleFunc("/{id:[0-9]+}/follow", app.handler(followUser, authLevelLogin)).Methods("PUT").Name("follow")
+	users.HandleFunc("/{id:[0-9]+}/follow", app.handler(unfollowUser, authLevelLogin)).Methods("DELETE").Name("unfollow")
+	users.HandleFunc("/{name}", app.handler(getUserProfileByName, authLevelCheck)).Methods("GET").Name("userProfileByName")
+	users.HandleFunc("/{id:[0-9]+}/2fa", app.handler(resetUserTwoFactor, authLevelAdmin, scopeAdmin)).Methods("DELETE").Name("resetUserTwoFactor")
+	users.HandleFunc("/{id:[0-9]+}/lockout", app.handler(unlockUser, authLevelAdmin, scopeAdmin)).Methods("DELETE").Name("unlockUser")
+	users.HandleFunc("/{id:[0-9]+}/followers", app.handler(getFollowers, authLevelIgnore)).Methods("GET").Name("followers")
+	users.HandleFunc("/{id:[0-9]+}/following", app.handler(getFollowing, authLevelIgnore)).Methods("GET").Name("following")
+
+	me := api.PathPrefix("/me/").Subrouter()
+
+	me.HandleFunc("/profile", app.handler(editProfile, authLevelLogin)).Methods("PUT").Name("editProfile")
+	me.HandleFunc("/avatar", app.handler(uploadAvatar, authLevelLogin)).Methods("POST").Name("uploadAvatar")
+	me.HandleFunc("/avatar", app.handler(deleteAvatar, authLevelLogin)).Methods("DELETE").Name("deleteAvatar")
+	me.HandleFunc("/identities", app.handler(getIdentities, authLevelLogin)).Methods("GET").Name("identities")
+	me.HandleFunc("/identities", app.handler(linkIdentity, authLevelLogin)).Methods("POST").Name("linkIdentity")
+	me.HandleFunc("/identities/{provider}/url", app.handler(getLinkIdentityURL, authLevelLogin)).Methods("GET")
+	me.HandleFunc("/identities/{id:[0-9]+}", app.handler(unlinkIdentity, authLevelLogin)).Methods("DELETE").Name("unlinkIdentity")
+	me.HandleFunc("/sessions", app.handler(getSessions, authLevelLogin)).Methods("GET").Name("sessions")
+	me.HandleFunc("/sessions", app.handler(revokeOtherSessions, authLevelLogin)).Methods("DELETE").Name("revokeOtherSessions")
+	me.HandleFunc("/sessions/{id:[0-9]+}", app.handler(revokeSession, authLevelLogin)).Methods("DELETE").Name("revokeSession")
+	me.HandleFunc("/email", app.handler(changeEmail, authLevelLogin)).Methods("PUT").Name("changeEmail")
+	me.HandleFunc("/email/verify", app.handler(resendVerificationEmail, authLevelLogin)).Methods("POST").Name("resendVerificationEmail")
+	me.HandleFunc("/2fa", app.handler(getTwoFactorStatus, authLevelLogin)).Methods("GET").Name("twoFactorStatus")
+	me.HandleFunc("/2fa", app.handler(disableTwoFactor, authLevelLogin)).Methods("DELETE").Name("disableTwoFactor")
+	me.HandleFunc("/2fa/enroll", app.handler(enrollTwoFactor, authLevelLogin)).Methods("POST").Name("enrollTwoFactor")
+	me.HandleFunc("/2fa/verify", app.handler(verifyTwoFactor, authLevelLogin)).Methods("POST").Name("verifyTwoFactor")
+	me.HandleFunc("/2fa/recovery-codes", app.handler(regenerateRecoveryCodes, authLevelLogin)).Methods("POST").Name("regenerateRecoveryCodes")
+	me.HandleFunc("/tokens", app.handler(getAPITokens, authLevelLogin)).Methods("GET").Name("apiTokens")
+	me.HandleFunc("/tokens", app.handler(createAPIToken, authLevelLogin)).Methods("POST").Name("createAPIToken")
+	me.HandleFunc("/tokens/{id:[0-9]+}", app.handler(revokeAPIToken, authLevelLogin)).Methods("DELETE").Name("revokeAPIToken")
+	me.HandleFunc("/favorites", app.handler(getFavorites, authLevelLogin, scopePhotosRead)).Methods("GET").Name("favorites")
+	me.HandleFunc("/trash", app.handler(getTrash, authLevelLogin, scopePhotosRead)).Methods("GET").Name("trash")
+	me.HandleFunc("/trash/{id:[0-9]+}/restore", app.handler(restorePhoto, authLevelLogin, scopePhotosWrite)).Methods("POST").Name("restorePhoto")
+	me.HandleFunc("/trash/{id:[0-9]+}", app.handler(purgePhoto, authLevelLogin, scopePhotosWrite)).Methods("DELETE").Name("purgePhoto")
+
+	shares := api.PathPrefix("/shares/").Subrouter()
+
+	shares.HandleFunc("/", app.handler(getShares, authLevelLogin, scopePhotosRead)).Methods("GET").Name("shares")
+	shares.HandleFunc("/", app.handler(createShare, authLevelLogin, scopePhotosWrite)).Methods("POST").Name("createShare")
+	shares.HandleFunc("/{id:[0-9]+}", app.handler(deleteShare, authLevelLogin, scopePhotosWrite)).Methods("DELETE").Name("deleteShare")
+
+	api.HandleFunc("/timeline", app.handler(getTimeline, authLevelLogin, scopePhotosRead)).Methods("GET").Name("timeline")
 
 	auth := api.PathPrefix("/auth/").Subrouter()
 
 	auth.HandleFunc("/", app.handler(getSessionInfo, authLevelCheck)).Methods("GET").Name("sessionInfo")
 	auth.HandleFunc("/", app.handler(login, authLevelIgnore)).Methods("POST").Name("login")
 	auth.HandleFunc("/", app.handler(logout, authLevelLogin)).Methods("DELETE").Name("logout")
+	auth.HandleFunc("/verify-email", app.handler(verifyEmail, authLevelIgnore)).Methods("POST").Name("verifyEmail")
+	auth.HandleFunc("/2fa", app.handler(loginWithTwoFactor, authLevelIgnore)).Methods("POST").Name("loginWithTwoFactor")
+	auth.HandleFunc("/refresh", app.handler(refreshSession, authLevelIgnore)).Methods("POST").Name("refreshSession")
 	auth.HandleFunc("/emailExists", app.handler(emailExists, authLevelIgnore)).Methods("GET").Name("emailExists")
 	auth.HandleFunc("/signup", app.handler(signup, authLevelIgnore)).Methods("POST").Name("signup")
 	auth.HandleFunc("/recoverpass", app.handler(recoverPassword, authLevelIgnore)).Methods("PUT").Name("recoverPassword")
 	auth.HandleFunc("/changepass", app.handler(changePassword, authLevelIgnore)).Methods("PUT").Name("changePassword")
 
+	auth.HandleFunc("/oauth2/providers", app.handler(getAuthProviders, authLevelIgnore)).Methods("GET").Name("authProviders")
 	auth.HandleFunc("/oauth2/{provider}/url", app.handler(getAuthRedirectURL, authLevelIgnore)).Methods("GET")
 	auth.HandleFunc("/oauth2/{provider}/callback/", app.handler(authCallback, authLevelIgnore)).Methods("GET")
+	auth.HandleFunc("/oauth2/exchange", app.handler(exchangeAuthCode, authLevelIgnore)).Methods("POST").Name("exchangeAuthCode")
+
+	tags := api.PathPrefix("/tags/").Subrouter()
+
+	tags.HandleFunc("/", app.handler(getTags, authLevelIgnore)).Methods("GET").Name("tags")
+	tags.HandleFunc("/suggest", app.handler(suggestTags, authLevelCheck, scopePhotosRead)).Methods("GET").Name("suggestTags")
+	tags.HandleFunc("/tree", app.handler(getTagTree, authLevelIgnore)).Methods("GET").Name("tagTree")
+	tags.HandleFunc("/{id:[0-9]+}", app.handler(renameTag, authLevelAdmin, scopeAdmin)).Methods("PATCH").Name("renameTag")
+	tags.HandleFunc("/{id:[0-9]+}/merge", app.handler(mergeTag, authLevelAdmin, scopeAdmin)).Methods("POST").Name("mergeTag")
+	tags.HandleFunc("/synonyms/", app.handler(getTagSynonyms, authLevelAdmin, scopeAdmin)).Methods("GET").Name("tagSynonyms")
+	tags.HandleFunc("/synonyms/", app.handler(addTagSynonym, authLevelAdmin, scopeAdmin)).Methods("POST").Name("addTagSynonym")
+	tags.HandleFunc("/synonyms/{id:[0-9]+}", app.handler(removeTagSynonym, authLevelAdmin, scopeAdmin)).Methods("DELETE").Name("removeTagSynonym")
+	tags.HandleFunc("/blocked/", app.handler(getBlockedTags, authLevelAdmin, scopeAdmin)).Methods("GET").Name("blockedTags")
+	tags.HandleFunc("/blocked/", app.handler(blockTag, authLevelAdmin, scopeAdmin)).Methods("POST").Name("blockTag")
+	tags.HandleFunc("/blocked/{id:[0-9]+}", app.handler(unblockTag, authLevelAdmin, scopeAdmin)).Methods("DELETE").Name("unblockTag")
 
-	api.HandleFunc("/tags/", app.handler(getTags, authLevelIgnore)).Methods("GET").Name("tags")
 	api.Handle("/messages/{path:.*}", messageHandler).Name("messages")
 
 	feeds := app.router.PathPrefix("/feeds/").Subrouter()
@@ -187,6 +319,16 @@ func (app *app) initRouter() {
 	feeds.HandleFunc("", app.handler(latestFeed, authLevelIgnore)).Methods("GET").Name("latestFeed")
 	feeds.HandleFunc("popular/", app.handler(popularFeed, authLevelIgnore)).Methods("GET").Name("popularFeed")
 	feeds.HandleFunc("owner/{ownerID:[0-9]+}", app.handler(ownerFeed, authLevelIgnore)).Methods("GET").Name("ownerFeed")
+	feeds.HandleFunc("albums/", app.handler(latestAlbumsFeed, authLevelIgnore)).Methods("GET").Name("latestAlbumsFeed")
+	feeds.HandleFunc("album/{id:[0-9]+}", app.handler(albumFeed, authLevelIgnore)).Methods("GET").Name("albumFeed")
+
+	app.router.HandleFunc("/s/{token:[a-z0-9]+}", app.handler(viewShare, authLevelCheck)).Methods("GET").Name("viewShare")
+	app.router.HandleFunc("/s/{token:[a-z0-9]+}", app.handler(viewShare, authLevelCheck)).Methods("POST")
+
+	app.router.HandleFunc("/.well-known/jwks.json", app.handler(getJWKS, authLevelIgnore)).Methods("GET").Name("jwks")
+
+	app.router.HandleFunc("/media/{kind:originals|thumbnails}/{filename:[A-Za-z0-9]+\\.[a-z]+}",
+		app.handler(serveMedia, authLevelIgnore)).Methods("GET").Name("media")
 
 	app.router.PathPrefix("/").Handler(http.FileServer(http.Dir(app.cfg.PublicDir)))
 
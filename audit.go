@@ -0,0 +1,37 @@
+package photoshare
+
+import "net/http"
+
+// actions recorded in the audit log
+const (
+	auditIdentityLinked   = "identity_linked"
+	auditIdentityUnlinked = "identity_unlinked"
+
+	auditPasswordChanged = "password_changed"
+	auditPasswordReset   = "password_reset"
+	auditAccountLocked   = "account_locked"
+	auditAccountUnlocked = "account_unlocked"
+
+	auditAPITokenCreated = "api_token_created"
+	auditAPITokenRevoked = "api_token_revoked"
+
+	auditEmailVerified = "email_verified"
+	auditEmailChanged  = "email_changed"
+
+	auditTwoFactorEnabled         = "two_factor_enabled"
+	auditTwoFactorDisabled        = "two_factor_disabled"
+	auditTwoFactorReset           = "two_factor_reset"
+	auditRecoveryCodeUsed         = "recovery_code_used"
+	auditRecoveryCodesRegenerated = "recovery_codes_regenerated"
+)
+
+// the actor is the user making the change, usually the user themselves
+func newAuditEntry(r *http.Request, userID, actorID int64, action, details string) *auditEntry {
+	return &auditEntry{
+		UserID:    userID,
+		ActorID:   actorID,
+		Action:    action,
+		Details:   details,
+		IPAddress: getRemoteIP(r),
+	}
+}
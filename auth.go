@@ -1,85 +1,407 @@
 package photoshare
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"github.com/juju/errgo"
-	"github.com/stretchr/gomniauth"
-	"github.com/stretchr/gomniauth/common"
-	"github.com/stretchr/gomniauth/providers/google"
-	"github.com/stretchr/objx"
-	"github.com/stretchr/signature"
+	"io"
+	"log"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
+const (
+	authRequestExpiry  = 10 // minutes
+	authNonceLength    = 32
+	authVerifierLength = 64
+	oauthTimeout       = time.Second * 10
+	maxOAuthResponse   = 1 << 20
+	authCookieName     = "oauth_login"
+	authCookiePath     = "/api/auth/oauth2/"
+
+	googleIssuer = "https://accounts.google.com"
+
+	githubAuthURL  = "https://github.com/login/oauth/authorize"
+	githubTokenURL = "https://github.com/login/oauth/access_token"
+	githubAPIURL   = "https://api.github.com"
+)
+
+var (
+	errUnknownProvider = httpError{http.StatusNotFound, "Unknown login provider"}
+	errOAuthFailed     = httpError{http.StatusBadRequest, "Unable to log in with this provider"}
+)
+
+// the user's account with the provider. The ID is unique for the provider.
+// The email is only set if the provider has verified it. If the login was
+// started by a logged in user to link the account, linkUserID is their ID.
 type authInfo struct {
-	name, email string
+	id, name, nickname, email string
+	linkUserID                int64
 }
 
+// getRedirectURL takes the ID of the user linking the account, or 0 to log in.
+// It sets a cookie binding the login to the browser, checked by getUserInfo.
 type authenticator interface {
-	getRedirectURL(*http.Request, string) (string, error)
-	getUserInfo(*http.Request, string) (*authInfo, error)
+	providerNames() []string
+	getRedirectURL(http.ResponseWriter, *http.Request, string, int64) (string, error)
+	getUserInfo(http.ResponseWriter, *http.Request, string) (*authInfo, error)
+}
+
+// An OAuth2 login provider. The request holds the nonce and PKCE verifier
+// of the login, which are sent to the provider and checked on the callback.
+type oauthProvider interface {
+	authURL(req *authRequest, state, redirectURI string) (string, error)
+	userInfo(req *authRequest, code, redirectURI string) (*authInfo, error)
 }
 
+// A login in progress. It is encrypted into the state param, so the callback
+// can be handled by any server without storing it.
+type authRequest struct {
+	Provider   string `json:"p"`
+	Nonce      string `json:"n"`
+	Verifier   string `json:"v"`
+	Expires    int64  `json:"e"`
+	LinkUserID int64  `json:"l,omitempty"`
+}
+
+// the PKCE S256 code challenge
+func (req *authRequest) challenge() string {
+	sum := sha256.Sum256([]byte(req.Verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Providers are configured once on startup. OpenID Connect discovery is done
+// on first use.
 func newAuthenticator(cfg *config) authenticator {
-	gomniauth.SetSecurityKey(signature.RandomKey(64))
-	a := &defaultAuthenticator{cfg}
+
+	secret := cfg.OAuthSecret
+	if secret == "" {
+		log.Println("WARNING: OAUTH_SECRET not set, logins in progress will fail after a restart")
+		secret, _ = generateRandomString(64)
+	}
+
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+
+	a := &defaultAuthenticator{
+		providers: make(map[string]oauthProvider),
+		aead:      aead,
+	}
+
+	httpClient := &http.Client{Timeout: oauthTimeout}
+
+	if cfg.GoogleClientID != "" {
+		a.providers["google"] = newOIDCProvider(&oauthClient{httpClient, cfg.GoogleClientID, cfg.GoogleSecret, false},
+			googleIssuer, "openid email profile")
+	}
+	if cfg.GithubClientID != "" {
+		a.providers["github"] = newGithubProvider(&oauthClient{httpClient, cfg.GithubClientID, cfg.GithubSecret, false})
+	}
+	if cfg.OIDCIssuer != "" {
+		a.providers[cfg.OIDCName] = newOIDCProvider(&oauthClient{httpClient, cfg.OIDCClientID, cfg.OIDCSecret, false},
+			cfg.OIDCIssuer, "openid email profile")
+	}
 	return a
 }
 
 type defaultAuthenticator struct {
-	cfg *config
+	providers map[string]oauthProvider
+	aead      cipher.AEAD
 }
 
-func (a *defaultAuthenticator) getAuthProvider(r *http.Request, providerName string) (common.Provider, error) {
-	gomniauth.WithProviders(
-		google.New(a.cfg.GoogleClientID,
-			a.cfg.GoogleSecret,
-			getBaseURL(r)+"/api/auth/oauth2/google/callback/",
-		),
-	)
-	provider, err := gomniauth.Provider(providerName)
-	if err != nil {
-		return provider, errgo.Mask(err)
+func (a *defaultAuthenticator) providerNames() []string {
+	names := []string{}
+	for name := range a.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (a *defaultAuthenticator) getProvider(name string) (oauthProvider, error) {
+	provider, ok := a.providers[name]
+	if !ok {
+		return nil, errUnknownProvider
 	}
 	return provider, nil
 }
 
-func (a *defaultAuthenticator) getRedirectURL(r *http.Request, providerName string) (string, error) {
-	provider, err := a.getAuthProvider(r, providerName)
+func callbackURL(r *http.Request, providerName string) string {
+	return getBaseURL(r) + "/api/auth/oauth2/" + providerName + "/callback/"
+}
+
+func (a *defaultAuthenticator) getRedirectURL(w http.ResponseWriter, r *http.Request, providerName string, linkUserID int64) (string, error) {
+
+	provider, err := a.getProvider(providerName)
 	if err != nil {
-		return "", errgo.Mask(err)
+		return "", err
+	}
+
+	req := &authRequest{
+		Provider:   providerName,
+		Expires:    time.Now().Add(time.Minute * authRequestExpiry).Unix(),
+		LinkUserID: linkUserID,
+	}
+	if req.Nonce, err = generateRandomString(authNonceLength); err != nil {
+		return "", err
 	}
-	state := gomniauth.NewState("after", "success")
-	url, err := provider.GetBeginAuthURL(state, nil)
+	if req.Verifier, err = generateRandomString(authVerifierLength); err != nil {
+		return "", err
+	}
+
+	state, err := a.sealRequest(req)
 	if err != nil {
-		return url, errgo.Mask(err)
+		return "", err
 	}
-	return url, nil
+
+	authURL, err := provider.authURL(req, state, callbackURL(r, providerName))
+	if err != nil {
+		logError(err)
+		return "", errOAuthFailed
+	}
+
+	// Otherwise a state issued to an attacker could be used to log the victim
+	// into the attacker's account. The cookie must be sent on the redirect back
+	// from the provider, so it is Lax rather than Strict.
+	http.SetCookie(w, &http.Cookie{
+		Name:     authCookieName,
+		Value:    hashToken(req.Nonce),
+		Path:     authCookiePath,
+		MaxAge:   authRequestExpiry * 60,
+		Secure:   getScheme(r) == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return authURL, nil
 }
 
-func (a *defaultAuthenticator) getUserInfo(r *http.Request, providerName string) (*authInfo, error) {
-	provider, err := a.getAuthProvider(r, providerName)
+func (a *defaultAuthenticator) getUserInfo(w http.ResponseWriter, r *http.Request, providerName string) (*authInfo, error) {
+
+	provider, err := a.getProvider(providerName)
 	if err != nil {
-		return nil, errgo.Mask(err)
+		return nil, err
+	}
+
+	// the user may have refused to log in
+	if r.FormValue("error") != "" {
+		return nil, errOAuthFailed
+	}
+
+	req, err := a.openRequest(r.FormValue("state"))
+	if err != nil || req.Provider != providerName || time.Now().Unix() > req.Expires {
+		return nil, httpError{http.StatusBadRequest, "Invalid or expired login, please try again"}
+	}
+
+	// the login must have been started in this browser
+	cookie, err := r.Cookie(authCookieName)
+	if err != nil || !hmac.Equal([]byte(cookie.Value), []byte(hashToken(req.Nonce))) {
+		return nil, httpError{http.StatusBadRequest, "Invalid or expired login, please try again"}
 	}
-	m := make(objx.Map)
-	if r.Form == nil {
-		r.ParseForm()
+	http.SetCookie(w, &http.Cookie{
+		Name:     authCookieName,
+		Path:     authCookiePath,
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+
+	code := r.FormValue("code")
+	if code == "" {
+		return nil, errOAuthFailed
 	}
-	for k, v := range r.Form {
-		m.Set(k, v)
+
+	info, err := provider.userInfo(req, code, callbackURL(r, providerName))
+	if err != nil {
+		logError(err)
+		return nil, errOAuthFailed
 	}
-	creds, err := provider.CompleteAuth(m)
+	info.linkUserID = req.LinkUserID
+	return info, nil
+}
+
+func (a *defaultAuthenticator) sealRequest(req *authRequest) (string, error) {
+	plaintext, err := json.Marshal(req)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	nonce := make([]byte, a.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errgo.Mask(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(a.aead.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+func (a *defaultAuthenticator) openRequest(state string) (*authRequest, error) {
+	ciphertext, err := base64.RawURLEncoding.DecodeString(state)
+	if err != nil || len(ciphertext) < a.aead.NonceSize() {
+		return nil, errgo.New("invalid state")
+	}
+	size := a.aead.NonceSize()
+	plaintext, err := a.aead.Open(nil, ciphertext[:size], ciphertext[size:], nil)
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-	user, err := provider.GetUser(creds)
+	req := &authRequest{}
+	if err := json.Unmarshal(plaintext, req); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return req, nil
+}
+
+type oauthToken struct {
+	AccessToken      string `json:"access_token"`
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// makes requests to a provider with the app's client credentials
+type oauthClient struct {
+	*http.Client
+	id, secret string
+	basicAuth  bool // send credentials with HTTP Basic auth instead of in the form
+}
+
+// exchanges the authorization code and PKCE verifier for tokens
+func (c *oauthClient) requestToken(tokenURL, code, verifier, redirectURI string) (*oauthToken, error) {
+
+	params := url.Values{}
+	params.Set("grant_type", "authorization_code")
+	params.Set("code", code)
+	params.Set("code_verifier", verifier)
+	params.Set("redirect_uri", redirectURI)
+	params.Set("client_id", c.id)
+	if !c.basicAuth {
+		params.Set("client_secret", c.secret)
+	}
+
+	req, err := http.NewRequest("POST", tokenURL, strings.NewReader(params.Encode()))
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-	info := &authInfo{
-		name:  user.Name(),
-		email: user.Email(),
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if c.basicAuth {
+		req.SetBasicAuth(url.QueryEscape(c.id), url.QueryEscape(c.secret))
+	}
+
+	token := &oauthToken{}
+	if err := c.doJSON(req, token); err != nil && token.Error == "" {
+		return nil, err
+	}
+	if token.Error != "" {
+		return nil, errgo.Newf("token request failed: %s %s", token.Error, token.ErrorDescription)
 	}
+	if token.AccessToken == "" {
+		return nil, errgo.New("no access token returned")
+	}
+	return token, nil
+}
+
+// fetches JSON from the provider, with the access token if not empty
+func (c *oauthClient) getJSON(url, accessToken string, value interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	return c.doJSON(req, value)
+}
 
+func (c *oauthClient) doJSON(req *http.Request, value interface{}) error {
+	resp, err := c.Do(req)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+
+	decodeErr := json.NewDecoder(io.LimitReader(resp.Body, maxOAuthResponse)).Decode(value)
+
+	if resp.StatusCode != http.StatusOK {
+		return errgo.Newf("%s %s returned %s", req.Method, req.URL, resp.Status)
+	}
+	return errgo.Mask(decodeErr)
+}
+
+// GitHub does not support OpenID Connect, so user details come from its API
+type githubProvider struct {
+	client                              *oauthClient
+	authEndpoint, tokenEndpoint, apiURL string
+}
+
+func newGithubProvider(client *oauthClient) *githubProvider {
+	return &githubProvider{client, githubAuthURL, githubTokenURL, githubAPIURL}
+}
+
+func (p *githubProvider) authURL(req *authRequest, state, redirectURI string) (string, error) {
+	q := url.Values{}
+	q.Set("client_id", p.client.id)
+	q.Set("redirect_uri", redirectURI)
+	q.Set("scope", "read:user user:email")
+	q.Set("state", state)
+	q.Set("code_challenge", req.challenge())
+	q.Set("code_challenge_method", "S256")
+	return p.authEndpoint + "?" + q.Encode(), nil
+}
+
+func (p *githubProvider) userInfo(req *authRequest, code, redirectURI string) (*authInfo, error) {
+
+	token, err := p.client.requestToken(p.tokenEndpoint, code, req.Verifier, redirectURI)
+	if err != nil {
+		return nil, err
+	}
+
+	account := &struct {
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+		Name  string `json:"name"`
+	}{}
+
+	if err := p.client.getJSON(p.apiURL+"/user", token.AccessToken, account); err != nil {
+		return nil, err
+	}
+	if account.ID == 0 {
+		return nil, errgo.New("no GitHub user ID returned")
+	}
+
+	// the profile email may not be verified, so we use the primary verified address
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+
+	if err := p.client.getJSON(p.apiURL+"/user/emails", token.AccessToken, &emails); err != nil {
+		return nil, err
+	}
+
+	info := &authInfo{
+		id:       strconv.FormatInt(account.ID, 10),
+		name:     account.Name,
+		nickname: account.Login,
+	}
+	for _, email := range emails {
+		if email.Primary && email.Verified {
+			info.email = email.Email
+		}
+	}
 	return info, nil
 }
@@ -0,0 +1,359 @@
+package photoshare
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// what the fake provider remembers about an authorization
+type fakeAuthorization struct {
+	nonce, challenge string
+}
+
+// an OpenID Connect provider that authorizes every login
+type fakeOIDCServer struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	clientID string
+	alg      string
+	nonce    string // overrides the nonce in the ID token if set
+
+	mutex sync.Mutex
+	codes map[string]fakeAuthorization
+}
+
+func newFakeOIDCServer(t *testing.T) *fakeOIDCServer {
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeOIDCServer{
+		key:      key,
+		clientID: "client",
+		alg:      "RS256",
+		codes:    make(map[string]fakeAuthorization),
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		renderJSON(w, map[string]interface{}{
+			"issuer":                 s.URL,
+			"authorization_endpoint": s.URL + "/authorize",
+			"token_endpoint":         s.URL + "/token",
+			"jwks_uri":               s.URL + "/jwks",
+		}, http.StatusOK)
+	})
+
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		renderJSON(w, map[string]interface{}{
+			"keys": []jsonWebKey{{
+				Kty: "RSA",
+				Kid: "test",
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		}, http.StatusOK)
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+
+		s.mutex.Lock()
+		auth, ok := s.codes[r.FormValue("code")]
+		delete(s.codes, r.FormValue("code"))
+		s.mutex.Unlock()
+
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+
+		if !ok || r.FormValue("client_id") != s.clientID || r.FormValue("client_secret") != "secret" ||
+			base64.RawURLEncoding.EncodeToString(sum[:]) != auth.challenge {
+			renderJSON(w, map[string]string{"error": "invalid_grant"}, http.StatusBadRequest)
+			return
+		}
+
+		nonce := auth.nonce
+		if s.nonce != "" {
+			nonce = s.nonce
+		}
+
+		renderJSON(w, map[string]string{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token": s.signIDToken(t, map[string]interface{}{
+				"iss":            s.URL,
+				"sub":            "user-1",
+				"aud":            s.clientID,
+				"exp":            time.Now().Add(time.Hour).Unix(),
+				"nonce":          nonce,
+				"email":          "tester@example.com",
+				"email_verified": true,
+				"name":           "Tester",
+			}),
+		}, http.StatusOK)
+	})
+
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+func (s *fakeOIDCServer) signIDToken(t *testing.T, claims map[string]interface{}) string {
+
+	encode := func(value interface{}) string {
+		data, err := json.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	input := encode(map[string]string{"alg": s.alg, "kid": "test", "typ": "JWT"}) + "." + encode(claims)
+	if s.alg == "none" {
+		return input + "."
+	}
+
+	digest := sha256.Sum256([]byte(input))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// the user agrees to log in, returning the callback query
+func (s *fakeOIDCServer) authorize(t *testing.T, authURL string) url.Values {
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+
+	if q.Get("code_challenge_method") != "S256" || q.Get("nonce") == "" || q.Get("client_id") != s.clientID {
+		t.Fatalf("Invalid authorization request: %s", authURL)
+	}
+
+	code, _ := generateRandomString(16)
+
+	s.mutex.Lock()
+	s.codes[code] = fakeAuthorization{q.Get("nonce"), q.Get("code_challenge")}
+	s.mutex.Unlock()
+
+	return url.Values{"code": {code}, "state": {q.Get("state")}}
+}
+
+func newTestAuthenticator(issuer string) authenticator {
+	return newAuthenticator(&config{
+		OIDCName:     "test",
+		OIDCIssuer:   issuer,
+		OIDCClientID: "client",
+		OIDCSecret:   "secret",
+		OAuthSecret:  "oauth-secret",
+	})
+}
+
+// starts a login and returns the callback request
+func startTestLogin(t *testing.T, a authenticator, s *fakeOIDCServer) *http.Request {
+
+	req, _ := http.NewRequest("GET", "http://localhost/api/auth/oauth2/test/url", nil)
+
+	res := httptest.NewRecorder()
+
+	authURL, err := a.getRedirectURL(res, req, "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authURL, s.URL+"/authorize?") {
+		t.Fatalf("Should redirect to the provider, got %s", authURL)
+	}
+
+	u, _ := url.Parse(authURL)
+	if redirectURI := u.Query().Get("redirect_uri"); redirectURI != "http://localhost/api/auth/oauth2/test/callback/" {
+		t.Errorf("Invalid redirect URI %s", redirectURI)
+	}
+
+	callback, _ := http.NewRequest("GET",
+		"http://localhost/api/auth/oauth2/test/callback/?"+s.authorize(t, authURL).Encode(), nil)
+	for _, cookie := range res.Result().Cookies() {
+		callback.AddCookie(cookie)
+	}
+	return callback
+}
+
+func TestOIDCLogin(t *testing.T) {
+
+	s := newFakeOIDCServer(t)
+	defer s.Close()
+
+	a := newTestAuthenticator(s.URL)
+
+	if names := a.providerNames(); len(names) != 1 || names[0] != "test" {
+		t.Errorf("Only the OIDC provider should be configured, got %v", names)
+	}
+
+	info, err := a.getUserInfo(httptest.NewRecorder(), startTestLogin(t, a, s), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.id != "user-1" || info.email != "tester@example.com" || info.name != "Tester" {
+		t.Errorf("Invalid user info %+v", info)
+	}
+}
+
+func TestOIDCLoginIfUnknownProvider(t *testing.T) {
+
+	a := newTestAuthenticator("http://localhost")
+
+	req, _ := http.NewRequest("GET", "http://localhost/api/auth/oauth2/facebook/url", nil)
+
+	if _, err := a.getRedirectURL(httptest.NewRecorder(), req, "facebook", 0); err != errUnknownProvider {
+		t.Error("Provider should not be found")
+	}
+}
+
+func TestOIDCLoginIfInvalidState(t *testing.T) {
+
+	s := newFakeOIDCServer(t)
+	defer s.Close()
+
+	a := newTestAuthenticator(s.URL)
+
+	callback := startTestLogin(t, a, s)
+	q := callback.URL.Query()
+	q.Set("state", q.Get("state")[1:])
+	callback.URL.RawQuery = q.Encode()
+
+	if _, err := a.getUserInfo(httptest.NewRecorder(), callback, "test"); err == nil {
+		t.Error("Tampered state should be rejected")
+	}
+
+	// state encrypted with another secret is not valid
+	other := newAuthenticator(&config{
+		OIDCName:     "test",
+		OIDCIssuer:   s.URL,
+		OIDCClientID: "client",
+		OIDCSecret:   "secret",
+		OAuthSecret:  "other",
+	})
+
+	if _, err := other.getUserInfo(httptest.NewRecorder(), startTestLogin(t, a, s), "test"); err == nil {
+		t.Error("State encrypted with another secret should be rejected")
+	}
+}
+
+func TestOIDCLoginIfNoCookie(t *testing.T) {
+
+	s := newFakeOIDCServer(t)
+	defer s.Close()
+
+	a := newTestAuthenticator(s.URL)
+	login := startTestLogin(t, a, s)
+
+	// a callback from another browser, e.g. a link sent by an attacker
+	callback, _ := http.NewRequest("GET", login.URL.String(), nil)
+
+	if _, err := a.getUserInfo(httptest.NewRecorder(), callback, "test"); err == nil {
+		t.Error("Login started in another browser should be rejected")
+	}
+}
+
+func TestOIDCLoginIfCodeReused(t *testing.T) {
+
+	s := newFakeOIDCServer(t)
+	defer s.Close()
+
+	a := newTestAuthenticator(s.URL)
+	callback := startTestLogin(t, a, s)
+
+	if _, err := a.getUserInfo(httptest.NewRecorder(), callback, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.getUserInfo(httptest.NewRecorder(), callback, "test"); err == nil {
+		t.Error("Code should only be exchanged once")
+	}
+}
+
+func TestOIDCLoginIfWrongNonce(t *testing.T) {
+
+	s := newFakeOIDCServer(t)
+	defer s.Close()
+	s.nonce = "replayed"
+
+	a := newTestAuthenticator(s.URL)
+
+	if _, err := a.getUserInfo(httptest.NewRecorder(), startTestLogin(t, a, s), "test"); err == nil {
+		t.Error("ID token with another nonce should be rejected")
+	}
+}
+
+func TestOIDCLoginIfUnsignedToken(t *testing.T) {
+
+	s := newFakeOIDCServer(t)
+	defer s.Close()
+	s.alg = "none"
+
+	a := newTestAuthenticator(s.URL)
+
+	if _, err := a.getUserInfo(httptest.NewRecorder(), startTestLogin(t, a, s), "test"); err == nil {
+		t.Error("Unsigned ID token should be rejected")
+	}
+}
+
+func TestGithubLogin(t *testing.T) {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "code" || r.FormValue("code_verifier") == "" {
+			renderJSON(w, map[string]string{"error": "bad_verification_code"}, http.StatusOK)
+			return
+		}
+		renderJSON(w, map[string]string{"access_token": "access"}, http.StatusOK)
+	})
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		renderJSON(w, map[string]interface{}{"id": 42, "login": "octocat", "name": "The Octocat"}, http.StatusOK)
+	})
+	mux.HandleFunc("/user/emails", func(w http.ResponseWriter, r *http.Request) {
+		renderJSON(w, []map[string]interface{}{
+			{"email": "unverified@example.com", "primary": false, "verified": false},
+			{"email": "octocat@example.com", "primary": true, "verified": true},
+		}, http.StatusOK)
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	p := &githubProvider{&oauthClient{http.DefaultClient, "client", "secret", false},
+		server.URL + "/authorize", server.URL + "/token", server.URL}
+
+	req := &authRequest{Verifier: "verifier"}
+
+	info, err := p.userInfo(req, "code", "http://localhost/callback/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.id != "42" || info.nickname != "octocat" || info.email != "octocat@example.com" {
+		t.Errorf("Invalid user info %+v", info)
+	}
+
+	if _, err := p.userInfo(req, "wrong", "http://localhost/callback/"); err == nil {
+		t.Error("Invalid code should be rejected")
+	}
+}
@@ -0,0 +1,132 @@
+package photoshare
+
+import (
+	"net/http"
+	"time"
+)
+
+// applies an operation to many photos at once. Photos the user cannot change are
+// skipped and reported in the results; the others are changed in a single transaction.
+func bulkEditPhotos(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	op := &bulkOperation{}
+
+	if err := decodeJSON(r, op); err != nil {
+		return err
+	}
+
+	if op.isTagOp() {
+		op.cleanTags()
+	}
+
+	if err := ctx.validate(op, r); err != nil {
+		return err
+	}
+
+	if op.Op == bulkMoveToAlbum {
+		album, err := ctx.datamapper.getAlbum(op.AlbumID)
+		if err != nil {
+			if isErrSqlNoRows(err) {
+				return httpError{http.StatusBadRequest, "Album not found"}
+			}
+			return err
+		}
+		if !album.canEdit(ctx.user) {
+			return httpError{http.StatusForbidden, "You're not allowed to edit this album"}
+		}
+	}
+
+	var (
+		photos  []*photo
+		moved   []*photo
+		checked = make(map[int64]bool)
+		report  = &bulkReport{}
+		now     = time.Now()
+	)
+
+	for _, photoID := range op.IDs {
+		if checked[photoID] {
+			continue
+		}
+		checked[photoID] = true
+
+		photo, err := ctx.datamapper.getPhoto(photoID)
+		if err != nil {
+			if !isErrSqlNoRows(err) {
+				return err
+			}
+			report.Results = append(report.Results, bulkResult{photoID, http.StatusNotFound, "Photo not found"})
+			continue
+		}
+
+		if !photo.canEdit(ctx.user) {
+			report.Results = append(report.Results, bulkResult{photoID, http.StatusForbidden, "You're not allowed to edit this photo"})
+			continue
+		}
+
+		wasHidden := photo.isHidden()
+
+		switch op.Op {
+		case bulkSetVisibility:
+			photo.Visibility = op.Visibility
+		case bulkDelete:
+			photo.DeletedAt = &now
+		}
+
+		if photo.isHidden() != wasHidden {
+			moved = append(moved, photo)
+		}
+
+		photos = append(photos, photo)
+		report.Results = append(report.Results, bulkResult{ID: photoID, Status: http.StatusOK})
+	}
+
+	if len(photos) > 0 {
+
+		// visibility and deletion change all the photos in the same direction
+		hidden := op.Op == bulkDelete || op.Visibility == visibilityPrivate
+
+		if err := movePhotoFiles(ctx, moved, hidden); err != nil {
+			return err
+		}
+
+		if err := ctx.datamapper.bulkUpdatePhotos(op, photos); err != nil {
+			if err := movePhotoFiles(ctx, moved, !hidden); err != nil {
+				logError(err)
+			}
+			return err
+		}
+
+		if err := ctx.cache.clear(); err != nil {
+			logError(err)
+		}
+	}
+
+	msgType := "photo_updated"
+	if op.Op == bulkDelete {
+		msgType = "photo_deleted"
+	}
+
+	for _, photo := range photos {
+		sendMessage(&socketMessage{ctx.user.Name, "", photo.ID, msgType})
+	}
+
+	report.NumUpdated = len(photos)
+	return renderJSON(w, report, http.StatusOK)
+}
+
+// moves the files of the photos in or out of the private directory, undoing the
+// moves already made if one fails
+func movePhotoFiles(ctx *context, photos []*photo, private bool) error {
+	for i, photo := range photos {
+		if err := ctx.filestore.setPrivate(photo.Filename, private); err != nil {
+			for _, moved := range photos[:i] {
+				if err := ctx.filestore.setPrivate(moved.Filename, !private); err != nil {
+					logError(err)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package photoshare
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBulkOperationValidate(t *testing.T) {
+
+	c := &context{}
+
+	op := &bulkOperation{IDs: []int64{1, 2}, Op: bulkSetVisibility, Visibility: visibilityPrivate}
+	if err := c.validate(op, nil); err != nil {
+		t.Error("Operation should be valid")
+	}
+
+	op = &bulkOperation{IDs: []int64{1}, Op: "rename"}
+	if err := c.validate(op, nil); err == nil {
+		t.Error("Unknown operation should be invalid")
+	}
+
+	op = &bulkOperation{Op: bulkDelete}
+	if err := c.validate(op, nil); err == nil {
+		t.Error("Operation without photos should be invalid")
+	}
+
+	op = &bulkOperation{IDs: make([]int64, maxBulkPhotos+1), Op: bulkDelete}
+	if err := c.validate(op, nil); err == nil {
+		t.Error("Operation with too many photos should be invalid")
+	}
+
+	op = &bulkOperation{IDs: []int64{1}, Op: bulkMoveToAlbum}
+	if err := c.validate(op, nil); err == nil {
+		t.Error("Move without album should be invalid")
+	}
+}
+
+func TestBulkOperationCleanTags(t *testing.T) {
+
+	op := &bulkOperation{IDs: []int64{1}, Op: bulkAddTags, Tags: []string{"Travel", "travel", " ", "beach"}}
+	op.cleanTags()
+
+	if len(op.Tags) != 2 || op.Tags[0] != "travel" || op.Tags[1] != "beach" {
+		t.Errorf("Tags should be normalized without duplicates, got %v", op.Tags)
+	}
+
+	op = &bulkOperation{IDs: []int64{1}, Op: bulkRemoveTags, Tags: []string{" "}}
+	op.cleanTags()
+
+	if err := (&context{}).validate(op, nil); err == nil {
+		t.Error("Tag operation without valid tags should be invalid")
+	}
+}
+
+func TestBulkEditPhotosIfNone(t *testing.T) {
+
+	body := `{"ids": [1, 2, 1], "op": "delete"}`
+	req, _ := http.NewRequest("POST", "http://localhost/api/photos/bulk", strings.NewReader(body))
+	res := httptest.NewRecorder()
+
+	app := &app{
+		datamapper: &mockDataMapper{},
+		cache:      &mockCache{},
+	}
+
+	c := &context{
+		app:    app,
+		params: &params{make(map[string]string)},
+		user:   &user{ID: 1, IsAuthenticated: true},
+	}
+
+	if err := bulkEditPhotos(c, res, req); err != nil {
+		t.Fatal(err)
+	}
+
+	report := &bulkReport{}
+	if err := json.NewDecoder(res.Body).Decode(report); err != nil {
+		t.Fatal(err)
+	}
+
+	if report.NumUpdated != 0 {
+		t.Error("No photos should be updated")
+	}
+	if len(report.Results) != 2 {
+		t.Fatalf("Each photo should be reported once, got %d results", len(report.Results))
+	}
+	for _, result := range report.Results {
+		if result.Status != http.StatusNotFound {
+			t.Errorf("Photo %d should not be found", result.ID)
+		}
+	}
+}
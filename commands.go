@@ -23,6 +23,8 @@ func Serve() {
 
 	runtime.GOMAXPROCS((runtime.NumCPU() * 2) + 1)
 
+	app.startTrashPurger()
+
 	n := negroni.Classic()
 	n.UseHandler(app.router)
 	n.Run(fmt.Sprintf(":%d", app.cfg.ServerPort))
@@ -42,7 +44,7 @@ func storeFile(app *app,
 		logError(err)
 	}
 	defer file.Close()
-	err = app.filestore.store(file, name, contentType)
+	err = app.filestore.store(file, name, contentType, false)
 	if err != nil {
 		logError(err)
 	}
@@ -52,6 +54,12 @@ func storeFile(app *app,
 		Tags:     tags,
 		OwnerID:  userID,
 	}
+	if _, err := file.Seek(0, 0); err != nil {
+		return err
+	}
+	if photo.ImageHash, err = readImageHash(file); err != nil {
+		logError(err)
+	}
 	if err := app.datamapper.createPhoto(photo); err != nil {
 		return err
 	}
@@ -59,6 +67,24 @@ func storeFile(app *app,
 	return nil
 }
 
+// turns the directory path relative to the base directory into a
+// hierarchical tag e.g. travel/europe/paris
+func dirTags(baseDir, dirname string) []string {
+	rel, err := filepath.Rel(baseDir, dirname)
+	if err != nil || rel == "." {
+		return nil
+	}
+	var parts []string
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		parts = append(parts, strings.Join(strings.Fields(part), "-"))
+	}
+	name := normalizeTag(strings.Join(parts, tagSeparator))
+	if name == "" {
+		return nil
+	}
+	return []string{name}
+}
+
 func scanDir(app *app, userID int64, baseDir, dirname string) {
 	fileList, err := ioutil.ReadDir(dirname)
 	if err != nil {
@@ -70,7 +96,7 @@ func scanDir(app *app, userID int64, baseDir, dirname string) {
 			scanDir(app, userID, baseDir, filepath.Join(dirname, name))
 		} else {
 			fullPath := filepath.Join(dirname, name)
-			tags := filepath.SplitList(dirname[len(baseDir):])
+			tags := dirTags(baseDir, dirname)
 			ext := strings.ToLower(filepath.Ext(name))
 			if ext != ".jpg" && ext != ".png" {
 				continue
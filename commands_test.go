@@ -0,0 +1,15 @@
+package photoshare
+
+import (
+	"testing"
+)
+
+func TestDirTags(t *testing.T) {
+	tags := dirTags("/photos", "/photos/Travel/Europe/New York")
+	if len(tags) != 1 || tags[0] != "travel/europe/new-york" {
+		t.Errorf("Directories should become a hierarchical tag, got %v", tags)
+	}
+	if tags := dirTags("/photos", "/photos"); len(tags) != 0 {
+		t.Errorf("Base directory should have no tags, got %v", tags)
+	}
+}
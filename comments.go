@@ -0,0 +1,170 @@
+package photoshare
+
+import (
+	"net/http"
+)
+
+// commentModerator is called before a comment is saved, whether new or edited.
+// Returning an error (for example an httpError or validationFailure) rejects the comment.
+type commentModerator interface {
+	moderate(*comment, *user) error
+}
+
+func newCommentModerator(cfg *config) commentModerator {
+	return &defaultCommentModerator{}
+}
+
+// accepts all comments
+type defaultCommentModerator struct{}
+
+func (m *defaultCommentModerator) moderate(comment *comment, user *user) error {
+	return nil
+}
+
+func getCommentToEdit(ctx *context, w http.ResponseWriter, r *http.Request) (*comment, error) {
+
+	comment, err := ctx.datamapper.getComment(ctx.params.getInt("id"))
+	if err != nil {
+		return comment, err
+	}
+
+	if !comment.canEdit(ctx.user) {
+		return comment, httpError{http.StatusForbidden, "You're not allowed to edit this comment"}
+	}
+	return comment, nil
+}
+
+func getComments(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := getPhotoToView(ctx, w, r)
+	if err != nil {
+		return err
+	}
+
+	comments, err := ctx.datamapper.getComments(getPage(r), photo.ID, ctx.user)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, comments, http.StatusOK)
+}
+
+func addComment(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	if err := ctx.checkVerified(restrictComment); err != nil {
+		return err
+	}
+
+	photo, err := getPhotoToView(ctx, w, r)
+	if err != nil {
+		return err
+	}
+
+	s := &struct {
+		Body     string `json:"body"`
+		ParentID int64  `json:"parentId"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	comment := &comment{
+		PhotoID: photo.ID,
+		OwnerID: ctx.user.ID,
+		Body:    s.Body,
+	}
+
+	if s.ParentID != 0 {
+		parent, err := ctx.datamapper.getComment(s.ParentID)
+		if err != nil {
+			if isErrSqlNoRows(err) {
+				return httpError{http.StatusBadRequest, "Comment not found"}
+			}
+			return err
+		}
+		if parent.PhotoID != photo.ID {
+			return httpError{http.StatusBadRequest, "Comment not found"}
+		}
+		// we only allow one level of replies, so replies to replies go to the parent
+		if parent.ParentID != 0 {
+			comment.ParentID = parent.ParentID
+		} else {
+			comment.ParentID = parent.ID
+		}
+	}
+
+	if err := ctx.validate(comment, r); err != nil {
+		return err
+	}
+	if err := ctx.moderator.moderate(comment, ctx.user); err != nil {
+		return err
+	}
+	if err := ctx.datamapper.createComment(comment); err != nil {
+		return err
+	}
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	sendMessage(&socketMessage{ctx.user.Name, "", photo.ID, "comment_added"})
+	return renderJSON(w, &commentDetail{
+		comment:   *comment,
+		OwnerName: ctx.user.Name,
+		Permissions: &permissions{
+			Edit:   true,
+			Delete: true,
+		},
+	}, http.StatusCreated)
+}
+
+func editComment(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	comment, err := getCommentToEdit(ctx, w, r)
+	if err != nil {
+		return err
+	}
+
+	s := &struct {
+		Body string `json:"body"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	comment.Body = s.Body
+
+	if err := ctx.validate(comment, r); err != nil {
+		return err
+	}
+	if err := ctx.moderator.moderate(comment, ctx.user); err != nil {
+		return err
+	}
+	if err := ctx.datamapper.updateComment(comment); err != nil {
+		return err
+	}
+
+	sendMessage(&socketMessage{ctx.user.Name, "", comment.PhotoID, "comment_updated"})
+	return renderString(w, http.StatusOK, "Comment updated")
+}
+
+func deleteComment(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	comment, err := ctx.datamapper.getComment(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	if !comment.canDelete(ctx.user) {
+		return httpError{http.StatusForbidden, "You're not allowed to delete this comment"}
+	}
+	if err := ctx.datamapper.removeComment(comment); err != nil {
+		return err
+	}
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	sendMessage(&socketMessage{ctx.user.Name, "", comment.PhotoID, "comment_deleted"})
+	return renderString(w, http.StatusOK, "Comment deleted")
+}
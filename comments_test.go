@@ -0,0 +1,43 @@
+package photoshare
+
+import (
+	"testing"
+)
+
+func TestCommentCanEdit(t *testing.T) {
+	user := &user{ID: 1}
+	comment := &comment{ID: 1, OwnerID: 1}
+
+	if comment.canEdit(user) {
+		t.Error("Non-authenticated should not be able to edit")
+	}
+
+	user.IsAuthenticated = true
+
+	if !comment.canEdit(user) {
+		t.Error("Author should be able to edit")
+	}
+
+	comment.OwnerID = 2
+
+	if comment.canDelete(user) {
+		t.Error("User should not be able to delete")
+	}
+
+	user.IsAdmin = true
+	if !comment.canDelete(user) {
+		t.Error("Admin should be able to delete")
+	}
+}
+
+func TestCommentValidate(t *testing.T) {
+	comment := &comment{PhotoID: 1, OwnerID: 1, Body: "   "}
+	errors := make(map[string]string)
+
+	if err := comment.validate(nil, nil, errors); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := errors["body"]; !ok {
+		t.Error("Empty comment should be invalid")
+	}
+}
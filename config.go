@@ -5,6 +5,7 @@ import (
 	"github.com/danryan/env"
 	"os"
 	"path"
+	"strings"
 )
 
 type config struct {
@@ -33,17 +34,47 @@ type config struct {
 	ThumbnailsDir string `env:"key=THUMBNAILS_DIR"`
 	TemplatesDir  string `env:"key=TEMPLATES_DIR"`
 
-	PrivateKey string `env:"key=PRIVATE_KEY required=true"`
-	PublicKey  string `env:"key=PUBLIC_KEY required=true"`
+	PrivateUploadsDir    string `env:"key=PRIVATE_UPLOADS_DIR"`
+	PrivateThumbnailsDir string `env:"key=PRIVATE_THUMBNAILS_DIR"`
+	MediaSecret          string `env:"key=MEDIA_SECRET"`
+
+	TrashRetentionDays int `env:"key=TRASH_RETENTION_DAYS default=30"`
+
+	UnverifiedRestrictions string `env:"key=UNVERIFIED_RESTRICTIONS default=upload"`
+
+	PrivateKey   string `env:"key=PRIVATE_KEY"`
+	PublicKey    string `env:"key=PUBLIC_KEY"`
+	KeysDir      string `env:"key=KEYS_DIR"`
+	SigningKeyID string `env:"key=SIGNING_KEY_ID"`
 
 	MemcacheHost string `env:"key=MEMCACHE_HOST default=0.0.0.0:11211"`
 
 	GoogleClientID string `env:"key=GOOGLE_CLIENT_ID"`
 	GoogleSecret   string `env:"key=GOOGLE_SECRET"`
 
+	GithubClientID string `env:"key=GITHUB_CLIENT_ID"`
+	GithubSecret   string `env:"key=GITHUB_SECRET"`
+
+	OIDCName     string `env:"key=OIDC_NAME default=oidc"`
+	OIDCIssuer   string `env:"key=OIDC_ISSUER"`
+	OIDCClientID string `env:"key=OIDC_CLIENT_ID"`
+	OIDCSecret   string `env:"key=OIDC_SECRET"`
+
+	OAuthSecret string `env:"key=OAUTH_SECRET"`
+
 	ServerPort int `env:"key=PORT default=5000"`
 }
 
+// whether users must verify their email before the action
+func (cfg *config) restrictsUnverified(action string) bool {
+	for _, restricted := range strings.Split(cfg.UnverifiedRestrictions, ",") {
+		if strings.TrimSpace(restricted) == action {
+			return true
+		}
+	}
+	return false
+}
+
 func newConfig() (*config, error) {
 	cfg := &config{}
 	if err := env.Process(cfg); err != nil {
@@ -86,6 +117,14 @@ func newConfig() (*config, error) {
 		cfg.ThumbnailsDir = path.Join(cfg.UploadsDir, "thumbnails")
 	}
 
+	if cfg.PrivateUploadsDir == "" {
+		cfg.PrivateUploadsDir = path.Join(cfg.BaseDir, "private_uploads")
+	}
+
+	if cfg.PrivateThumbnailsDir == "" {
+		cfg.PrivateThumbnailsDir = path.Join(cfg.PrivateUploadsDir, "thumbnails")
+	}
+
 	if cfg.TemplatesDir == "" {
 		cfg.TemplatesDir = path.Join(cfg.BaseDir, "templates")
 	}
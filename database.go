@@ -9,6 +9,7 @@ import (
 	"log"
 	"os"
 	"strings"
+	"time"
 )
 
 func dbConnect(user, pwd, name, host string) (*sql.DB, error) {
@@ -38,6 +39,14 @@ func initDB(db *sql.DB, logSql bool) (*gorp.DbMap, error) {
 	dbMap.AddTableWithName(user{}, "users").SetKeys(true, "ID")
 	dbMap.AddTableWithName(photo{}, "photos").SetKeys(true, "ID")
 	dbMap.AddTableWithName(tag{}, "tags").SetKeys(true, "ID")
+	dbMap.AddTableWithName(album{}, "albums").SetKeys(true, "ID")
+	dbMap.AddTableWithName(comment{}, "comments").SetKeys(true, "ID")
+	dbMap.AddTableWithName(share{}, "shares").SetKeys(true, "ID")
+	dbMap.AddTableWithName(blockedTag{}, "blocked_tags").SetKeys(true, "ID")
+	dbMap.AddTableWithName(userIdentity{}, "user_identities").SetKeys(true, "ID")
+	dbMap.AddTableWithName(auditEntry{}, "audit_log").SetKeys(true, "ID")
+	dbMap.AddTableWithName(userSession{}, "sessions").SetKeys(true, "ID")
+	dbMap.AddTableWithName(apiToken{}, "api_tokens").SetKeys(true, "ID")
 
 	return dbMap, nil
 }
@@ -47,6 +56,8 @@ type dataMapper interface {
 	removePhoto(*photo) error
 	updatePhoto(*photo) error
 	updateTags(*photo) error
+	addTags(*photo, []string) error
+	bulkUpdatePhotos(*bulkOperation, []*photo) error
 
 	createUser(*user) error
 	updateUser(*user) error
@@ -54,18 +65,132 @@ type dataMapper interface {
 	updateMany(...interface{}) error
 
 	getPhoto(int64) (*photo, error)
-	getPhotoDetail(int64, *user) (*photoDetail, error)
+	getTrashedPhoto(int64) (*photo, error)
+	getTrash(*page, int64) (*photoList, error)
+	getExpiredTrash(time.Time, int64, int) ([]photo, error)
+	getPhotoDetail(int64, *user, *share) (*photoDetail, error)
 	getTagCounts() ([]tagCount, error)
+	getTag(int64) (*tag, error)
+	getTagHierarchy() ([]tag, error)
+	suggestTags(string, int64, int) ([]tagSuggestion, error)
+	getTagByName(string) (*tag, error)
+	getTagDescendants(*tag) ([]tag, error)
+	renameTag(*tag, string) error
+	mergeTags(*tag, *tag) error
+	getTagSynonym(int64) (*tagSynonym, error)
+	getTagSynonyms() ([]tagSynonym, error)
+	getTagSynonymByName(string) (*tagSynonym, error)
+	addTagSynonym(*tagSynonym) error
+	removeTagSynonym(*tagSynonym) error
+	getBlockedTag(int64) (*blockedTag, error)
+	getBlockedTags() ([]blockedTag, error)
+	isTagBlocked(string) (bool, error)
+	blockTag(*blockedTag) error
+	unblockTag(*blockedTag) error
 	getPhotos(*page, string) (*photoList, error)
-	getPhotosByOwnerID(*page, int64) (*photoList, error)
+	getPhotosByOwnerID(*page, int64, *user) (*photoList, error)
 	searchPhotos(*page, string) (*photoList, error)
+	getPhotosInBounds(*geoBounds, int) ([]photo, error)
+	getRelatedPhotos(*photo, int) (*photoList, error)
+	getPhotoClusters(*geoBounds, float64) ([]geoCluster, error)
+
+	addFavorite(int64, int64) error
+	removeFavorite(int64, int64) error
+	getFavorites(*page, int64) (*photoList, error)
+
+	createComment(*comment) error
+	removeComment(*comment) error
+	updateComment(*comment) error
+
+	getComment(int64) (*comment, error)
+	getComments(*page, int64, *user) (*commentList, error)
+
+	createShare(*share) error
+	removeShare(*share) error
+	registerShareView(*share) (bool, error)
+
+	getShare(int64) (*share, error)
+	getShareByToken(string) (*share, error)
+	getSharesByOwnerID(*page, int64) (*shareList, error)
+
+	createAlbum(*album) error
+	removeAlbum(*album) error
+	updateAlbum(*album) error
+	updateAlbumPhotos(*album, []int64) error
+	isPhotoInAlbum(int64, int64) (bool, error)
+
+	getAlbum(int64) (*album, error)
+	getAlbumDetail(*page, int64, *user, *share) (*albumDetail, error)
+	getAlbums(*page) (*albumList, error)
+	getAlbumsByOwnerID(*page, int64, *user) (*albumList, error)
+	searchAlbums(*page, string) (*albumList, error)
+
+	follow(int64, int64) error
+	unfollow(int64, int64) error
+
+	getUserProfile(int64, *user) (*userProfile, error)
+	getUserProfileByName(string, *user) (*userProfile, error)
+	getFollowers(*page, int64) (*userList, error)
+	getFollowing(*page, int64) (*userList, error)
+	getTimeline(int64, *timelineCursor) (*timeline, error)
 
 	isUserNameAvailable(*user) (bool, error)
 	isUserEmailAvailable(*user) (bool, error)
 	getActiveUser(userID int64) (*user, error)
-	getUserByRecoveryCode(string) (*user, error)
 	getUserByEmail(string) (*user, error)
 	getUserByNameOrEmail(identifier string) (*user, error)
+	getUsersByNames([]string) ([]user, error)
+	getUserByIdentity(string, string) (*user, error)
+
+	getUserIdentities(int64) ([]userIdentity, error)
+	createUserIdentity(*userIdentity, *auditEntry) error
+	createUserWithIdentity(*user, *userIdentity) error
+	removeUserIdentity(*userIdentity, *auditEntry) error
+
+	createAuthCode(*authCode) error
+	useAuthCode(string) (*authCode, error)
+
+	addAuditEntry(*auditEntry) error
+
+	createSession(*userSession) error
+	getSession(int64) (*userSession, error)
+	getSessionByRefreshHash(string) (*userSession, error)
+	getActiveSessions(int64) ([]userSession, error)
+	rotateSession(*userSession, string) error
+	touchSession(int64) error
+	revokeSession(int64) error
+	revokeSessions(int64, int64) error
+
+	enableTwoFactor(*user, []string, *auditEntry) error
+	resetTwoFactor(*user, *auditEntry) error
+	useTOTPStep(int64, int64) error
+	useRecoveryCode(int64, string) error
+	countRecoveryCodes(int64) (int64, error)
+
+	createPasswordReset(*passwordReset) error
+	getPasswordReset(string) (*passwordReset, error)
+	failPasswordReset(string) error
+	countPasswordResets(int64, time.Time) (int64, error)
+	updatePassword(*user, int64, *auditEntry) error
+
+	createAPIToken(*apiToken, *auditEntry) error
+	getAPITokens(int64) ([]apiToken, error)
+	getAPIToken(string) (*apiToken, error)
+	touchAPIToken(int64, string) error
+	revokeAPIToken(*apiToken, *auditEntry) error
+
+	getLoginFailures(string) (*loginFailures, error)
+	addLoginFailure(string, time.Time, time.Time) (*loginFailures, error)
+	clearLoginFailures(string) error
+
+	createEmailVerification(*emailVerification) error
+	getEmailVerification(string) (*emailVerification, error)
+	countEmailVerifications(int64, time.Time) (int64, error)
+	verifyEmail(*user, *auditEntry) error
+
+	createLoginChallenge(*loginChallenge) error
+	attemptLoginChallenge(string, int) (*loginChallenge, error)
+	removeLoginChallenge(string) error
 }
 
 type defaultDataMapper struct {
@@ -85,11 +210,10 @@ func (t *transaction) updateTags(photo *photo) error {
 		counter = 1
 	)
 	for _, name := range photo.Tags {
-		name = strings.TrimSpace(name)
-		if name != "" {
+		if name = normalizeTag(name); name != "" {
 			counter++
 			args = append(args, fmt.Sprintf("$%d", counter))
-			params = append(params, interface{}(strings.ToLower(name)))
+			params = append(params, interface{}(normalizeTag(name)))
 			isEmpty = false
 		}
 	}
@@ -105,6 +229,149 @@ func (t *transaction) updateTags(photo *photo) error {
 
 }
 
+// adds the tags to the photo, keeping its existing tags
+func (t *transaction) addTags(photo *photo, names []string) error {
+	for _, name := range names {
+		if _, err := t.Exec("INSERT INTO photo_tags (photo_id, tag_id) SELECT $1, tid FROM add_tag($2) AS tid "+
+			"WHERE tid IS NOT NULL AND NOT EXISTS (SELECT 1 FROM photo_tags WHERE photo_id=$1 AND tag_id=tid)",
+			photo.ID, name); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+func (t *transaction) bulkUpdatePhoto(op *bulkOperation, photo *photo) error {
+	switch op.Op {
+	case bulkAddTags:
+		return t.addTags(photo, op.Tags)
+	case bulkRemoveTags:
+		for _, name := range op.Tags {
+			if _, err := t.Exec("DELETE FROM photo_tags WHERE photo_id=$1 AND tag_id=resolve_tag($2)",
+				photo.ID, name); err != nil {
+				return errgo.Mask(err)
+			}
+		}
+	case bulkMoveToAlbum:
+		// new photos go to the end of the album
+		if _, err := t.Exec("INSERT INTO album_photos (album_id, photo_id, position) "+
+			"SELECT $1, $2, (SELECT COALESCE(MAX(position) + 1, 0) FROM album_photos WHERE album_id=$1) "+
+			"WHERE NOT EXISTS (SELECT 1 FROM album_photos WHERE album_id=$1 AND photo_id=$2)",
+			op.AlbumID, photo.ID); err != nil {
+			return errgo.Mask(err)
+		}
+	default:
+		if _, err := t.Update(photo); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+// Moves all photos, synonyms and child tags of the source tag to the target, and keeps
+// the source name as a synonym of the target. Descendants are moved under the target's
+// name, shallowest first so their parents already exist, and merged into any tag that
+// already has their new name.
+func (t *transaction) mergeTags(source *tag, target *tag) error {
+	var descendants []tag
+	if _, err := t.Select(&descendants, "SELECT * FROM tags WHERE LEFT(name, LENGTH($1::text)) = $1::text "+
+		"ORDER BY LENGTH(name)", source.Name+tagSeparator); err != nil {
+		return errgo.Mask(err)
+	}
+	for i := range descendants {
+		if err := t.moveTag(&descendants[i], target.Name+strings.TrimPrefix(descendants[i].Name, source.Name)); err != nil {
+			return err
+		}
+	}
+	return t.mergeTag(source, target.ID)
+}
+
+// merges a single tag into the target, without touching the names of its descendants
+func (t *transaction) mergeTag(source *tag, targetID int64) error {
+	return t.execAll(
+		statement{"INSERT INTO photo_tags (photo_id, tag_id) SELECT photo_id, $2 FROM photo_tags " +
+			"WHERE tag_id=$1 AND photo_id NOT IN (SELECT photo_id FROM photo_tags WHERE tag_id=$2)",
+			[]interface{}{source.ID, targetID}},
+		statement{"DELETE FROM photo_tags WHERE tag_id=$1", []interface{}{source.ID}},
+		statement{"UPDATE tag_synonyms SET tag_id=$2 WHERE tag_id=$1", []interface{}{source.ID, targetID}},
+		statement{"UPDATE tags SET parent_id=$2 WHERE parent_id=$1", []interface{}{source.ID, targetID}},
+		statement{"DELETE FROM tags WHERE id=$1", []interface{}{source.ID}},
+		statement{"INSERT INTO tag_synonyms (name, tag_id) VALUES ($1, $2)", []interface{}{source.Name, targetID}},
+	)
+}
+
+// renames a tag whose new parent already exists, keeping the old name as a synonym.
+// If a tag with the new name exists the tag is merged into it instead.
+func (t *transaction) moveTag(moved *tag, name string) error {
+	existing := &tag{}
+	err := t.SelectOne(existing, "SELECT * FROM tags WHERE name=$1", name)
+	if err == nil {
+		return t.mergeTag(moved, existing.ID)
+	}
+	if err != sql.ErrNoRows {
+		return errgo.Mask(err)
+	}
+	parentID, err := t.SelectInt("SELECT id FROM tags WHERE name=$1", parentTagName(name))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return t.execAll(
+		statement{"DELETE FROM tag_synonyms WHERE name=$1 AND tag_id=$2", []interface{}{name, moved.ID}},
+		statement{"INSERT INTO tag_synonyms (name, tag_id) VALUES ($1, $2)", []interface{}{moved.Name, moved.ID}},
+		statement{"UPDATE tags SET name=$1, parent_id=$2 WHERE id=$3", []interface{}{name, parentID, moved.ID}},
+	)
+}
+
+// Postgres cannot prepare statements with unused params, so each statement has its own
+type statement struct {
+	query  string
+	params []interface{}
+}
+
+// runs the statements in order, stopping at the first error
+func (t *transaction) execAll(stmts ...statement) error {
+	for _, stmt := range stmts {
+		if _, err := t.Exec(stmt.query, stmt.params...); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+// Returns the visibilities (as a Postgres array) of the owner's photos and albums
+// the user can see in listings: everything if the user is the owner or an admin,
+// otherwise only public items.
+func listedVisibilities(ownerID int64, user *user) string {
+	if user != nil && user.IsAuthenticated && (user.IsAdmin || user.ID == ownerID) {
+		return "{" + strings.Join([]string{
+			visibilityPublic,
+			visibilityUnlisted,
+			visibilityPrivate}, ",") + "}"
+	}
+	return "{" + visibilityPublic + "}"
+}
+
+// Returns the SQL clause matching photos inside the bounds, with params
+// numbered from num.
+func boundsClause(bounds *geoBounds, num int) (string, []interface{}) {
+	clause := fmt.Sprintf("latitude BETWEEN $%d AND $%d AND ", num, num+1)
+	if bounds.crossesAntimeridian() {
+		clause += fmt.Sprintf("(longitude >= $%d OR longitude <= $%d)", num+2, num+3)
+	} else {
+		clause += fmt.Sprintf("longitude BETWEEN $%d AND $%d", num+2, num+3)
+	}
+	return clause, []interface{}{bounds.MinLat, bounds.MaxLat, bounds.MinLon, bounds.MaxLon}
+}
+
+// matches photos within radius km of a point, using the haversine formula.
+// The latitude range is checked first so the location index can be used.
+const nearSql = "SELECT p.* FROM photos p " +
+	"WHERE p.latitude BETWEEN $%[1]d AND $%[2]d AND " +
+	"2 * %[6]f * ASIN(SQRT(" +
+	"POWER(SIN(RADIANS(p.latitude - $%[3]d) / 2), 2) + " +
+	"COS(RADIANS($%[3]d)) * COS(RADIANS(p.latitude)) * " +
+	"POWER(SIN(RADIANS(p.longitude - $%[4]d) / 2), 2))) <= $%[5]d"
+
 func newDataMapper(db *sql.DB, logSql bool) (dataMapper, error) {
 	dbMap, err := initDB(db, logSql)
 	if err != nil {
@@ -155,10 +422,21 @@ func (d *defaultDataMapper) updateUser(user *user) error {
 }
 
 func (d *defaultDataMapper) removePhoto(photo *photo) error {
-	if _, err := d.Delete(photo); err != nil {
+	t, err := d.begin()
+	if err != nil {
 		return errgo.Mask(err)
 	}
-	return nil
+	for _, table := range []string{"comments", "favorites", "shares", "album_photos"} {
+		if _, err := t.Exec("DELETE FROM "+table+" WHERE photo_id=$1", photo.ID); err != nil {
+			t.Rollback()
+			return errgo.Mask(err)
+		}
+	}
+	if _, err := t.Delete(photo); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(t.Commit())
 }
 
 func (d *defaultDataMapper) updateTags(photo *photo) error {
@@ -173,6 +451,54 @@ func (d *defaultDataMapper) updateTags(photo *photo) error {
 	return errgo.Mask(tx.Commit())
 }
 
+func (d *defaultDataMapper) addTags(photo *photo, names []string) error {
+	tx, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := tx.addTags(photo, names); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return errgo.Mask(tx.Commit())
+}
+
+// applies the operation to all the photos in a single transaction. Visibility and
+// deletion changes should already be set on the photos.
+func (d *defaultDataMapper) bulkUpdatePhotos(op *bulkOperation, photos []*photo) error {
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, photo := range photos {
+		if err := t.bulkUpdatePhoto(op, photo); err != nil {
+			t.Rollback()
+			return err
+		}
+	}
+	if op.Op == bulkMoveToAlbum {
+		if _, err := t.Exec("UPDATE albums SET updated_at=NOW() WHERE id=$1", op.AlbumID); err != nil {
+			t.Rollback()
+			return errgo.Mask(err)
+		}
+	}
+	return errgo.Mask(t.Commit())
+}
+
+func (d *defaultDataMapper) insertMany(items ...interface{}) error {
+	tx, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, item := range items {
+		if err := tx.Insert(item); err != nil {
+			tx.Rollback()
+			return errgo.Mask(err)
+		}
+	}
+	return errgo.Mask(tx.Commit())
+}
+
 func (d *defaultDataMapper) updateMany(items ...interface{}) error {
 	tx, err := d.begin()
 	if err != nil {
@@ -202,10 +528,58 @@ func (d *defaultDataMapper) getPhoto(photoID int64) (*photo, error) {
 	if obj == nil {
 		return p, sql.ErrNoRows
 	}
-	return obj.(*photo), nil
+	// photos in the trash can only be fetched with getTrashedPhoto
+	p = obj.(*photo)
+	if p.isTrashed() {
+		return p, sql.ErrNoRows
+	}
+	return p, nil
+}
+
+func (d *defaultDataMapper) getTrashedPhoto(photoID int64) (*photo, error) {
+	photo := &photo{}
+	if err := d.SelectOne(photo, "SELECT * FROM photos WHERE id=$1 AND deleted_at IS NOT NULL", photoID); err != nil {
+		return photo, errgo.Mask(err)
+	}
+	return photo, nil
+}
+
+// the owner's photos in the trash, most recently deleted first
+func (d *defaultDataMapper) getTrash(page *page, ownerID int64) (*photoList, error) {
+
+	var (
+		photos []photo
+		total  int64
+		err    error
+	)
+
+	if total, err = d.SelectInt("SELECT COUNT(id) FROM photos "+
+		"WHERE owner_id=$1 AND deleted_at IS NOT NULL", ownerID); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	if _, err = d.Select(&photos,
+		"SELECT * FROM photos WHERE owner_id=$1 AND deleted_at IS NOT NULL "+
+			"ORDER BY deleted_at DESC LIMIT $2 OFFSET $3",
+		ownerID, page.size, page.offset); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return newPhotoList(photos, total, page.index), nil
+}
+
+// photos deleted before the given time, due to be purged, in batches after the given ID
+func (d *defaultDataMapper) getExpiredTrash(before time.Time, afterID int64, limit int) ([]photo, error) {
+	var photos []photo
+	if _, err := d.Select(&photos,
+		"SELECT * FROM photos WHERE deleted_at < $1 AND id > $2 ORDER BY id LIMIT $3",
+		before, afterID, limit); err != nil {
+		return photos, errgo.Mask(err)
+	}
+	return photos, nil
 }
 
-func (d *defaultDataMapper) getPhotoDetail(photoID int64, user *user) (*photoDetail, error) {
+// returns the photo if the user can see it, or it has been shared
+func (d *defaultDataMapper) getPhotoDetail(photoID int64, user *user, grant *share) (*photoDetail, error) {
 
 	photo := &photoDetail{}
 
@@ -213,14 +587,19 @@ func (d *defaultDataMapper) getPhotoDetail(photoID int64, user *user) (*photoDet
 		return photo, sql.ErrNoRows
 	}
 
-	q := "SELECT p.*, u.name AS owner_name " +
+	q := "SELECT p.*, u.name AS owner_name, " +
+		"EXISTS(SELECT 1 FROM favorites f WHERE f.photo_id = p.id AND f.user_id = $2) AS favorited " +
 		"FROM photos p JOIN users u ON u.id = p.owner_id " +
-		"WHERE p.id=$1"
+		"WHERE p.id=$1 AND p.deleted_at IS NULL"
 
-	if err := d.SelectOne(photo, q, photoID); err != nil {
+	if err := d.SelectOne(photo, q, photoID, user.ID); err != nil {
 		return photo, errgo.Mask(err)
 	}
 
+	if !photo.canView(user) && !grant.grantsPhoto(photo.ID) {
+		return photo, sql.ErrNoRows
+	}
+
 	var tags []tag
 
 	if _, err := d.Select(&tags,
@@ -233,32 +612,36 @@ func (d *defaultDataMapper) getPhotoDetail(photoID int64, user *user) (*photoDet
 	}
 
 	photo.Permissions = &permissions{
-		photo.canEdit(user),
-		photo.canDelete(user),
-		photo.canVote(user),
+		Edit:     photo.canEdit(user),
+		Delete:   photo.canDelete(user),
+		Vote:     photo.canVote(user),
+		Favorite: photo.canFavorite(user),
 	}
 	return photo, nil
 
 }
 
-func (d *defaultDataMapper) getPhotosByOwnerID(page *page, ownerID int64) (*photoList, error) {
+// returns all the owner's photos if the user can edit them, otherwise just the public ones
+func (d *defaultDataMapper) getPhotosByOwnerID(page *page, ownerID int64, user *user) (*photoList, error) {
 	var (
-		photos []photo
-		err    error
-		total  int64
+		photos       []photo
+		err          error
+		total        int64
+		visibilities = listedVisibilities(ownerID, user)
 	)
 
 	if ownerID == 0 {
 		return nil, sql.ErrNoRows
 	}
-	if total, err = d.SelectInt("SELECT COUNT(id) FROM photos WHERE owner_id=$1", ownerID); err != nil {
+	if total, err = d.SelectInt("SELECT COUNT(id) FROM photos "+
+		"WHERE owner_id=$1 AND visibility = ANY($2::text[]) AND deleted_at IS NULL", ownerID, visibilities); err != nil {
 		return nil, errgo.Mask(err)
 	}
 
 	if _, err = d.Select(&photos,
-		"SELECT * FROM photos WHERE owner_id = $1"+
-			"ORDER BY (up_votes - down_votes) DESC, created_at DESC LIMIT $2 OFFSET $3",
-		ownerID, page.size, page.offset); err != nil {
+		"SELECT * FROM photos WHERE owner_id = $1 AND visibility = ANY($2::text[]) AND deleted_at IS NULL "+
+			"ORDER BY (up_votes - down_votes) DESC, created_at DESC LIMIT $3 OFFSET $4",
+		ownerID, visibilities, page.size, page.offset); err != nil {
 		return nil, errgo.Mask(err)
 	}
 	return newPhotoList(photos, total, page.index), nil
@@ -279,13 +662,21 @@ func (d *defaultDataMapper) searchPhotos(page *page, q string) (*photoList, erro
 		return nil, nil
 	}
 
-	for num, word := range strings.Split(q, " ") {
+	for i, word := range strings.Split(q, " ") {
 		word = strings.TrimSpace(word)
-		if word == "" || num > 6 {
+		if word == "" || i > 6 {
 			break
 		}
 
-		num++
+		num := len(params) + 1
+
+		if lat, lon, radius, ok := parseNear(word); ok {
+			// one degree of latitude is about 111km
+			delta := radius / 111.0
+			clauses = append(clauses, fmt.Sprintf(nearSql, num, num+1, num+2, num+3, num+4, earthRadius))
+			params = append(params, lat-delta, lat+delta, lat, lon, radius)
+			continue
+		}
 
 		if strings.HasPrefix(word, "@") {
 			word = word[1:]
@@ -298,8 +689,7 @@ func (d *defaultDataMapper) searchPhotos(page *page, q string) (*photoList, erro
 			clauses = append(clauses, fmt.Sprintf(
 				"SELECT p.* FROM photos p "+
 					"INNER JOIN photo_tags pt ON pt.photo_id = p.id "+
-					"INNER JOIN tags t ON pt.tag_id=t.id "+
-					"WHERE UPPER(t.name::text) = UPPER($%d)", num))
+					"WHERE pt.tag_id IN ("+descendantTagsSql+")", num))
 		} else {
 			word = "%" + word + "%"
 			clauses = append(clauses, fmt.Sprintf(
@@ -308,8 +698,9 @@ func (d *defaultDataMapper) searchPhotos(page *page, q string) (*photoList, erro
 					"LEFT JOIN photo_tags pt ON pt.photo_id = p.id "+
 					"LEFT JOIN tags t ON pt.tag_id=t.id "+
 					"WHERE UPPER(p.title::text) LIKE UPPER($%d) OR "+
+					"UPPER(p.description) LIKE UPPER($%d) OR "+
 					"UPPER(u.name::text) LIKE UPPER($%d) OR t.name LIKE $%d",
-				num, num, num))
+				num, num, num, num))
 		}
 
 		params = append(params, interface{}(word))
@@ -317,6 +708,10 @@ func (d *defaultDataMapper) searchPhotos(page *page, q string) (*photoList, erro
 
 	clausesSql := strings.Join(clauses, " INTERSECT ")
 
+	// only public photos show up in search results
+	clausesSql = fmt.Sprintf("SELECT * FROM (%s) v WHERE v.visibility = '%s' AND v.deleted_at IS NULL",
+		clausesSql, visibilityPublic)
+
 	countSql := fmt.Sprintf("SELECT COUNT(id) FROM (%s) q", clausesSql)
 
 	if total, err = d.SelectInt(countSql, params...); err != nil {
@@ -337,6 +732,105 @@ func (d *defaultDataMapper) searchPhotos(page *page, q string) (*photoList, erro
 	return newPhotoList(photos, total, page.index), nil
 }
 
+// Scores public photos by shared tags, owner, location and image hash, and
+// returns the best matches. Each relation adds its weight to the score.
+func (d *defaultDataMapper) getRelatedPhotos(source *photo, limit int) (*photoList, error) {
+
+	var photos []photo
+
+	params := []interface{}{source.ID, source.OwnerID}
+
+	clauses := []string{
+		fmt.Sprintf("SELECT pt2.photo_id, COUNT(pt2.tag_id) * %d AS score FROM photo_tags pt1 "+
+			"JOIN photo_tags pt2 ON pt2.tag_id = pt1.tag_id "+
+			"WHERE pt1.photo_id = $1 AND pt2.photo_id <> $1 GROUP BY pt2.photo_id", relatedTagWeight),
+		fmt.Sprintf("(SELECT id AS photo_id, %d AS score FROM photos "+
+			"WHERE owner_id = $2 AND id <> $1 ORDER BY created_at DESC LIMIT %d)",
+			relatedOwnerWeight, relatedOwnerPhotos),
+	}
+
+	if source.hasLocation() {
+		bounds := &geoBounds{
+			MinLon: *source.Longitude - relatedLocationDistance,
+			MinLat: *source.Latitude - relatedLocationDistance,
+			MaxLon: *source.Longitude + relatedLocationDistance,
+			MaxLat: *source.Latitude + relatedLocationDistance,
+		}
+		// wrap around the antimeridian
+		if bounds.MinLon < -180 {
+			bounds.MinLon += 360
+		}
+		if bounds.MaxLon > 180 {
+			bounds.MaxLon -= 360
+		}
+		clause, boundsParams := boundsClause(bounds, len(params)+1)
+		clauses = append(clauses, fmt.Sprintf(
+			"SELECT id AS photo_id, %d AS score FROM photos WHERE id <> $1 AND %s",
+			relatedLocationWeight, clause))
+		params = append(params, boundsParams...)
+	}
+
+	if source.ImageHash != 0 {
+		clauses = append(clauses, fmt.Sprintf(
+			"SELECT id AS photo_id, %d AS score FROM photos WHERE id <> $1 AND image_hash <> 0 AND "+
+				"LENGTH(REPLACE((image_hash # $%d)::bit(64)::text, '0', '')) <= %d",
+			relatedVisualWeight, len(params)+1, relatedVisualDistance))
+		params = append(params, source.ImageHash)
+	}
+
+	params = append(params, limit)
+
+	q := fmt.Sprintf("SELECT p.* FROM ("+
+		"SELECT photo_id, SUM(score) AS score FROM (%s) c GROUP BY photo_id) r "+
+		"JOIN photos p ON p.id = r.photo_id WHERE p.visibility = '%s' AND p.deleted_at IS NULL "+
+		"ORDER BY r.score DESC, p.created_at DESC LIMIT $%d",
+		strings.Join(clauses, " UNION ALL "), visibilityPublic, len(params))
+
+	if _, err := d.Select(&photos, q, params...); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return newPhotoList(photos, int64(len(photos)), 1), nil
+}
+
+// returns the latest public photos inside the bounds
+func (d *defaultDataMapper) getPhotosInBounds(bounds *geoBounds, limit int) ([]photo, error) {
+
+	var photos []photo
+
+	clause, params := boundsClause(bounds, 2)
+	params = append([]interface{}{visibilityPublic}, params...)
+	params = append(params, limit)
+
+	if _, err := d.Select(&photos,
+		"SELECT * FROM photos WHERE visibility=$1 AND deleted_at IS NULL AND "+clause+
+			" ORDER BY created_at DESC LIMIT $6", params...); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return photos, nil
+}
+
+// groups public photos inside the bounds into grid cells of cellSize degrees.
+// Each cluster is represented by its latest photo.
+func (d *defaultDataMapper) getPhotoClusters(bounds *geoBounds, cellSize float64) ([]geoCluster, error) {
+
+	var clusters []geoCluster
+
+	clause, params := boundsClause(bounds, 2)
+	params = append([]interface{}{visibilityPublic}, params...)
+	params = append(params, cellSize)
+
+	if _, err := d.Select(&clusters,
+		"SELECT c.*, p.photo FROM ("+
+			"SELECT COUNT(id) AS num_photos, AVG(latitude) AS latitude, "+
+			"AVG(longitude) AS longitude, MAX(id) AS photo_id "+
+			"FROM photos WHERE visibility=$1 AND deleted_at IS NULL AND "+clause+
+			" GROUP BY FLOOR(latitude / $6), FLOOR(longitude / $6)) c "+
+			"INNER JOIN photos p ON p.id = c.photo_id", params...); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return clusters, nil
+}
+
 func (d *defaultDataMapper) getPhotos(page *page, orderBy string) (*photoList, error) {
 
 	var (
@@ -350,13 +844,14 @@ func (d *defaultDataMapper) getPhotos(page *page, orderBy string) (*photoList, e
 		orderBy = "created_at"
 	}
 
-	if total, err = d.SelectInt("SELECT COUNT(id) FROM photos"); err != nil {
+	if total, err = d.SelectInt("SELECT COUNT(id) FROM photos "+
+		"WHERE visibility=$1 AND deleted_at IS NULL", visibilityPublic); err != nil {
 		return nil, errgo.Mask(err)
 	}
 
 	if _, err = d.Select(&photos,
-		"SELECT * FROM photos "+
-			"ORDER BY "+orderBy+" DESC LIMIT $1 OFFSET $2", page.size, page.offset); err != nil {
+		"SELECT * FROM photos WHERE visibility=$1 AND deleted_at IS NULL "+
+			"ORDER BY "+orderBy+" DESC LIMIT $2 OFFSET $3", visibilityPublic, page.size, page.offset); err != nil {
 		return nil, errgo.Mask(err)
 	}
 	return newPhotoList(photos, total, page.index), nil
@@ -364,84 +859,1462 @@ func (d *defaultDataMapper) getPhotos(page *page, orderBy string) (*photoList, e
 
 func (d *defaultDataMapper) getTagCounts() ([]tagCount, error) {
 	var tags []tagCount
-	if _, err := d.Select(&tags, "SELECT name, photo, num_photos FROM tag_counts"); err != nil {
+	if _, err := d.Select(&tags, "SELECT id, name, photo, num_photos FROM tag_counts"); err != nil {
 		return tags, errgo.Mask(err)
 	}
 	return tags, nil
 }
 
-func (d *defaultDataMapper) isUserNameAvailable(user *user) (bool, error) {
-	var (
-		num int64
-		err error
-	)
-	q := "SELECT COUNT(id) FROM users WHERE name=$1"
-	if user.ID == 0 {
-		num, err = d.SelectInt(q, user.Name)
-	} else {
-		q += " AND id != $2"
-		num, err = d.SelectInt(q, user.Name, user.ID)
+func (d *defaultDataMapper) getTag(tagID int64) (*tag, error) {
+	tag := &tag{}
+	if err := d.SelectOne(tag, "SELECT * FROM tags WHERE id=$1", tagID); err != nil {
+		return tag, errgo.Mask(err)
 	}
-	if err != nil {
-		return false, errgo.Mask(err)
+	return tag, nil
+}
+
+func (d *defaultDataMapper) getTagByName(name string) (*tag, error) {
+	tag := &tag{}
+	if err := d.SelectOne(tag, "SELECT * FROM tags WHERE name=$1", name); err != nil {
+		return tag, errgo.Mask(err)
 	}
-	return num == 0, nil
+	return tag, nil
 }
 
-func (d *defaultDataMapper) isUserEmailAvailable(user *user) (bool, error) {
-	var (
-		num int64
-		err error
-	)
-	q := "SELECT COUNT(id) FROM users WHERE email=$1"
-	if user.ID == 0 {
-		num, err = d.SelectInt(q, user.Email)
-	} else {
-		q += " AND id != $2"
-		num, err = d.SelectInt(q, user.Email, user.ID)
+// returns all tags below the tag, shallowest first
+func (d *defaultDataMapper) getTagDescendants(ancestor *tag) ([]tag, error) {
+	var tags []tag
+	if _, err := d.Select(&tags, "SELECT * FROM tags WHERE LEFT(name, LENGTH($1::text)) = $1::text "+
+		"ORDER BY LENGTH(name), name", ancestor.Name+tagSeparator); err != nil {
+		return tags, errgo.Mask(err)
 	}
-	if err != nil {
-		return false, errgo.Mask(err)
+	return tags, nil
+}
+
+// Returns the IDs of a tag (or synonym) and all its descendants. Takes the tag name as param.
+const descendantTagsSql = "WITH RECURSIVE d(id) AS (" +
+	"SELECT resolve_tag($%[1]d) UNION " +
+	"SELECT t.id FROM tags t JOIN d ON t.parent_id = d.id) " +
+	"SELECT id FROM d"
+
+// all tags with their parents, ordered by name
+func (d *defaultDataMapper) getTagHierarchy() ([]tag, error) {
+	var tags []tag
+	if _, err := d.Select(&tags, "SELECT * FROM tags ORDER BY name"); err != nil {
+		return tags, errgo.Mask(err)
 	}
-	return num == 0, nil
+	return tags, nil
 }
 
-func (d *defaultDataMapper) getActiveUser(userID int64) (*user, error) {
+// minimum query length for fuzzy matches: trigrams of shorter strings match too much
+const fuzzyTagMinLength = 3
 
-	user := &user{}
-	if err := d.SelectOne(user, "SELECT * FROM users WHERE active=$1 AND id=$2", true, userID); err != nil {
-		return user, errgo.Mask(err)
+// Returns tags starting with q, or matching synonyms starting with q, then tags
+// similar to q. Tags the user has used come first, then the most popular.
+func (d *defaultDataMapper) suggestTags(q string, userID int64, limit int) ([]tagSuggestion, error) {
+
+	var tags []tagSuggestion
+
+	prefix := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(q) + "%"
+
+	match := "t.name LIKE $1 OR t.id IN (SELECT tag_id FROM tag_synonyms WHERE name LIKE $1)"
+	if len(q) >= fuzzyTagMinLength {
+		match += " OR t.name % $2"
 	}
-	return user, nil
 
+	sql := "SELECT t.*, COALESCE(u.num_uses, 0) AS num_uses FROM tags t " +
+		"LEFT JOIN (SELECT pt.tag_id, COUNT(pt.photo_id) AS num_uses FROM photo_tags pt " +
+		"JOIN photos p ON p.id = pt.photo_id WHERE p.owner_id = $3 AND p.deleted_at IS NULL " +
+		"GROUP BY pt.tag_id) u " +
+		"ON u.tag_id = t.id " +
+		"WHERE (" + match + ") AND (t.num_photos > 0 OR u.num_uses > 0) " +
+		"ORDER BY (t.name LIKE $1) DESC, COALESCE(u.num_uses, 0) DESC, t.num_photos DESC, " +
+		"similarity(t.name, $2) DESC, t.name LIMIT $4"
+
+	if _, err := d.Select(&tags, sql, prefix, q, userID, limit); err != nil {
+		return tags, errgo.Mask(err)
+	}
+	return tags, nil
 }
 
-func (d *defaultDataMapper) getUserByRecoveryCode(code string) (*user, error) {
+// Renames the tag, keeping the old name as a synonym so existing links and habits still work.
+// Descendants are renamed along with it, keeping their old names as synonyms too, and the
+// tag is moved under its new parent.
+func (d *defaultDataMapper) renameTag(tag *tag, name string) error {
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := t.execAll(
+		statement{"DELETE FROM tag_synonyms WHERE name=$1 AND tag_id=$2", []interface{}{name, tag.ID}},
+		statement{"DELETE FROM tag_synonyms s USING tags t WHERE s.tag_id = t.id AND " +
+			"LEFT(t.name, LENGTH($2::text)) = $2::text AND s.name = $1::text || SUBSTRING(t.name FROM LENGTH($2::text) + 1)",
+			[]interface{}{name + tagSeparator, tag.Name + tagSeparator}},
+		statement{"INSERT INTO tag_synonyms (name, tag_id) VALUES ($1, $2)", []interface{}{tag.Name, tag.ID}},
+		statement{"INSERT INTO tag_synonyms (name, tag_id) SELECT name, id FROM tags " +
+			"WHERE LEFT(name, LENGTH($1::text)) = $1::text",
+			[]interface{}{tag.Name + tagSeparator}},
+		statement{"UPDATE tags SET name=$1 WHERE id=$2", []interface{}{name, tag.ID}},
+		statement{"UPDATE tags SET name = $1::text || SUBSTRING(name FROM LENGTH($2::text) + 1) " +
+			"WHERE LEFT(name, LENGTH($2::text)) = $2::text",
+			[]interface{}{name + tagSeparator, tag.Name + tagSeparator}},
+	); err != nil {
+		t.Rollback()
+		return err
+	}
 
-	user := &user{}
-	if code == "" {
-		return user, sql.ErrNoRows
+	var parentID int64
+	if parent := parentTagName(name); parent != "" {
+		if parentID, err = t.SelectInt("SELECT COALESCE(add_tag($1), 0)", parent); err != nil {
+			t.Rollback()
+			return errgo.Mask(err)
+		}
 	}
-	if err := d.SelectOne(user, "SELECT * FROM users WHERE active=$1 AND recovery_code=$2", true, code); err != nil {
-		return user, errgo.Mask(err)
+	if _, err := t.Exec("UPDATE tags SET parent_id=$1 WHERE id=$2", parentID, tag.ID); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
 	}
-	return user, nil
 
+	tag.Name = name
+	tag.ParentID = parentID
+	return errgo.Mask(t.Commit())
 }
-func (d *defaultDataMapper) getUserByEmail(email string) (*user, error) {
-	user := &user{}
-	if err := d.SelectOne(user, "SELECT * FROM users WHERE active=$1 AND email=$2", true, email); err != nil {
-		return user, errgo.Mask(err)
+
+func (d *defaultDataMapper) mergeTags(source *tag, target *tag) error {
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
 	}
-	return user, nil
+	if err := t.mergeTags(source, target); err != nil {
+		t.Rollback()
+		return err
+	}
+	return errgo.Mask(t.Commit())
 }
 
-func (d *defaultDataMapper) getUserByNameOrEmail(identifier string) (*user, error) {
-	user := &user{}
+const tagSynonymSql = "SELECT s.*, t.name AS tag_name FROM tag_synonyms s " +
+	"JOIN tags t ON t.id = s.tag_id "
 
-	if err := d.SelectOne(user, "SELECT * FROM users WHERE active=$1 AND (email=$2 OR name=$2)", true, identifier); err != nil {
-		return user, errgo.Mask(err)
+func (d *defaultDataMapper) getTagSynonym(synonymID int64) (*tagSynonym, error) {
+	synonym := &tagSynonym{}
+	if err := d.SelectOne(synonym, tagSynonymSql+"WHERE s.id=$1", synonymID); err != nil {
+		return synonym, errgo.Mask(err)
 	}
+	return synonym, nil
+}
 
-	return user, nil
+func (d *defaultDataMapper) getTagSynonyms() ([]tagSynonym, error) {
+	var synonyms []tagSynonym
+	if _, err := d.Select(&synonyms, tagSynonymSql+"ORDER BY t.name, s.name"); err != nil {
+		return synonyms, errgo.Mask(err)
+	}
+	return synonyms, nil
+}
+
+func (d *defaultDataMapper) getTagSynonymByName(name string) (*tagSynonym, error) {
+	synonym := &tagSynonym{}
+	if err := d.SelectOne(synonym, tagSynonymSql+"WHERE s.name=$1", name); err != nil {
+		return synonym, errgo.Mask(err)
+	}
+	return synonym, nil
+}
+
+// adds or replaces a synonym. If a tag with the same name exists it is merged into the target.
+func (d *defaultDataMapper) addTagSynonym(synonym *tagSynonym) error {
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := t.Exec("DELETE FROM tag_synonyms WHERE name=$1", synonym.Name); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	existing := &tag{}
+	err = t.SelectOne(existing, "SELECT * FROM tags WHERE name=$1", synonym.Name)
+	switch {
+	case err == nil:
+		target := &tag{}
+		if err = t.SelectOne(target, "SELECT * FROM tags WHERE id=$1", synonym.TagID); err == nil {
+			err = t.mergeTags(existing, target)
+		}
+	case err == sql.ErrNoRows:
+		_, err = t.Exec("INSERT INTO tag_synonyms (name, tag_id) VALUES ($1, $2)", synonym.Name, synonym.TagID)
+	}
+	if err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	if err := t.SelectOne(synonym, tagSynonymSql+"WHERE s.name=$1", synonym.Name); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(t.Commit())
+}
+
+func (d *defaultDataMapper) removeTagSynonym(synonym *tagSynonym) error {
+	_, err := d.Exec("DELETE FROM tag_synonyms WHERE id=$1", synonym.ID)
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) getBlockedTag(blockedID int64) (*blockedTag, error) {
+	blocked := &blockedTag{}
+	if err := d.SelectOne(blocked, "SELECT * FROM blocked_tags WHERE id=$1", blockedID); err != nil {
+		return blocked, errgo.Mask(err)
+	}
+	return blocked, nil
+}
+
+func (d *defaultDataMapper) getBlockedTags() ([]blockedTag, error) {
+	var blocked []blockedTag
+	if _, err := d.Select(&blocked, "SELECT * FROM blocked_tags ORDER BY name"); err != nil {
+		return blocked, errgo.Mask(err)
+	}
+	return blocked, nil
+}
+
+func (d *defaultDataMapper) isTagBlocked(name string) (bool, error) {
+	num, err := d.SelectInt("SELECT COUNT(*) FROM blocked_tags WHERE name=$1", name)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return num > 0, nil
+}
+
+// blocks the name and removes the tag (and any synonym with that name) from all photos
+func (d *defaultDataMapper) blockTag(blocked *blockedTag) error {
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := t.Insert(blocked); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	for _, q := range []string{
+		"DELETE FROM tag_synonyms WHERE name=$1",
+		"DELETE FROM photo_tags WHERE tag_id IN (SELECT id FROM tags WHERE name=$1)",
+		"UPDATE tags SET parent_id=0 WHERE parent_id IN (SELECT id FROM tags WHERE name=$1)",
+		"DELETE FROM tags WHERE name=$1",
+	} {
+		if _, err := t.Exec(q, blocked.Name); err != nil {
+			t.Rollback()
+			return errgo.Mask(err)
+		}
+	}
+	return errgo.Mask(t.Commit())
+}
+
+func (d *defaultDataMapper) unblockTag(blocked *blockedTag) error {
+	if _, err := d.Delete(blocked); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+func (d *defaultDataMapper) isUserNameAvailable(user *user) (bool, error) {
+	var (
+		num int64
+		err error
+	)
+	// names are unique ignoring case, as profiles can be looked up by name
+	q := "SELECT COUNT(id) FROM users WHERE LOWER(name)=LOWER($1)"
+	if user.ID == 0 {
+		num, err = d.SelectInt(q, user.Name)
+	} else {
+		q += " AND id != $2"
+		num, err = d.SelectInt(q, user.Name, user.ID)
+	}
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return num == 0, nil
+}
+
+func (d *defaultDataMapper) isUserEmailAvailable(user *user) (bool, error) {
+	var (
+		num int64
+		err error
+	)
+	q := "SELECT COUNT(id) FROM users WHERE email=$1"
+	if user.ID == 0 {
+		num, err = d.SelectInt(q, user.Email)
+	} else {
+		q += " AND id != $2"
+		num, err = d.SelectInt(q, user.Email, user.ID)
+	}
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return num == 0, nil
+}
+
+func (d *defaultDataMapper) getActiveUser(userID int64) (*user, error) {
+
+	user := &user{}
+	if err := d.SelectOne(user, "SELECT * FROM users WHERE active=$1 AND id=$2", true, userID); err != nil {
+		return user, errgo.Mask(err)
+	}
+	return user, nil
+
+}
+
+func (d *defaultDataMapper) getUserByEmail(email string) (*user, error) {
+	user := &user{}
+	if err := d.SelectOne(user, "SELECT * FROM users WHERE active=$1 AND email=$2", true, email); err != nil {
+		return user, errgo.Mask(err)
+	}
+	return user, nil
+}
+
+func (d *defaultDataMapper) getUserByNameOrEmail(identifier string) (*user, error) {
+	user := &user{}
+
+	if err := d.SelectOne(user, "SELECT * FROM users WHERE active=$1 AND (email=$2 OR name=$2)", true, identifier); err != nil {
+		return user, errgo.Mask(err)
+	}
+
+	return user, nil
+}
+
+// returns the user linked to the provider account, whether active or not
+func (d *defaultDataMapper) getUserByIdentity(provider, providerID string) (*user, error) {
+	user := &user{}
+	if err := d.SelectOne(user, "SELECT u.* FROM users u "+
+		"INNER JOIN user_identities i ON i.user_id = u.id "+
+		"WHERE i.provider=$1 AND i.provider_id=$2", provider, providerID); err != nil {
+		return user, errgo.Mask(err)
+	}
+	return user, nil
+}
+
+func (d *defaultDataMapper) getUserIdentities(userID int64) ([]userIdentity, error) {
+	var identities []userIdentity
+	if _, err := d.Select(&identities, "SELECT * FROM user_identities WHERE user_id=$1 ORDER BY created_at", userID); err != nil {
+		return identities, errgo.Mask(err)
+	}
+	return identities, nil
+}
+
+// links the identity to the user, recording the change
+func (d *defaultDataMapper) createUserIdentity(identity *userIdentity, entry *auditEntry) error {
+	return d.insertMany(identity, entry)
+}
+
+// Unlinks the identity unless it is the user's last way to log in. The user is locked
+// so concurrent unlinks cannot each see the other's identity and remove both.
+func (d *defaultDataMapper) removeUserIdentity(identity *userIdentity, entry *auditEntry) error {
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := t.Exec("SELECT id FROM users WHERE id=$1 FOR UPDATE", identity.UserID); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	result, err := t.Exec("DELETE FROM user_identities WHERE id=$1 AND user_id=$2 AND "+
+		"((SELECT COALESCE(password, '') FROM users WHERE id=$2) != '' OR "+
+		"(SELECT COUNT(*) FROM user_identities WHERE user_id=$2) > 1)",
+		identity.ID, identity.UserID)
+	if err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	if numRows, err := result.RowsAffected(); err != nil || numRows == 0 {
+		t.Rollback()
+		return errLastLoginMethod
+	}
+	if err := t.Insert(entry); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(t.Commit())
+}
+
+func (d *defaultDataMapper) addAuditEntry(entry *auditEntry) error {
+	return errgo.Mask(d.Insert(entry))
+}
+
+func (d *defaultDataMapper) createSession(s *userSession) error {
+	return errgo.Mask(d.Insert(s))
+}
+
+func (d *defaultDataMapper) getSession(sessionID int64) (*userSession, error) {
+	s := &userSession{}
+	if err := d.SelectOne(s, "SELECT * FROM sessions WHERE id=$1", sessionID); err != nil {
+		return s, errgo.Mask(err)
+	}
+	return s, nil
+}
+
+// matches the current or previous refresh token, so reuse of an old token can be detected
+func (d *defaultDataMapper) getSessionByRefreshHash(hash string) (*userSession, error) {
+	s := &userSession{}
+	if err := d.SelectOne(s, "SELECT * FROM sessions WHERE refresh_hash=$1 OR previous_hash=$1", hash); err != nil {
+		return s, errgo.Mask(err)
+	}
+	return s, nil
+}
+
+func (d *defaultDataMapper) getActiveSessions(userID int64) ([]userSession, error) {
+	var sessions []userSession
+	if _, err := d.Select(&sessions, "SELECT * FROM sessions "+
+		"WHERE user_id=$1 AND revoked_at IS NULL AND expires_at > $2 "+
+		"ORDER BY last_seen_at DESC", userID, time.Now()); err != nil {
+		return sessions, errgo.Mask(err)
+	}
+	return sessions, nil
+}
+
+// Replaces the refresh token of the session. Fails with sql.ErrNoRows if the token
+// was already replaced by a concurrent refresh, so each token is used only once.
+func (d *defaultDataMapper) rotateSession(s *userSession, previousHash string) error {
+	result, err := d.Exec("UPDATE sessions SET refresh_hash=$1, previous_hash=$2, "+
+		"ip_address=$3, user_agent=$4, last_seen_at=$5, expires_at=$6 "+
+		"WHERE id=$7 AND refresh_hash=$2 AND revoked_at IS NULL",
+		s.RefreshHash, previousHash, s.IPAddress, s.UserAgent, s.LastSeenAt, s.ExpiresAt, s.ID)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if numRows, err := result.RowsAffected(); err != nil || numRows == 0 {
+		return sql.ErrNoRows
+	}
+	s.PreviousHash = previousHash
+	return nil
+}
+
+func (d *defaultDataMapper) touchSession(sessionID int64) error {
+	_, err := d.Exec("UPDATE sessions SET last_seen_at=$1 WHERE id=$2", time.Now(), sessionID)
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) revokeSession(sessionID int64) error {
+	_, err := d.Exec("UPDATE sessions SET revoked_at=$1 WHERE id=$2 AND revoked_at IS NULL", time.Now(), sessionID)
+	return errgo.Mask(err)
+}
+
+// saves the user with two-factor auth enabled, replacing any recovery codes
+func (d *defaultDataMapper) enableTwoFactor(user *user, codeHashes []string, entry *auditEntry) error {
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	statements := []statement{
+		{"DELETE FROM recovery_codes WHERE user_id=$1", []interface{}{user.ID}},
+	}
+	for _, hash := range codeHashes {
+		statements = append(statements, statement{
+			"INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)",
+			[]interface{}{user.ID, hash},
+		})
+	}
+	if err := t.execAll(statements...); err != nil {
+		t.Rollback()
+		return err
+	}
+	if _, err := t.Update(user); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	if err := t.Insert(entry); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(t.Commit())
+}
+
+// saves the user with two-factor auth disabled, removing their recovery codes and
+// any logins waiting for a code
+func (d *defaultDataMapper) resetTwoFactor(user *user, entry *auditEntry) error {
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := t.execAll(
+		statement{"DELETE FROM recovery_codes WHERE user_id=$1", []interface{}{user.ID}},
+		statement{"DELETE FROM login_challenges WHERE user_id=$1", []interface{}{user.ID}},
+	); err != nil {
+		t.Rollback()
+		return err
+	}
+	if _, err := t.Update(user); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	if err := t.Insert(entry); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(t.Commit())
+}
+
+// records the step of a valid code. Fails with sql.ErrNoRows if the step or a
+// later one was already used, so a code cannot be replayed.
+func (d *defaultDataMapper) useTOTPStep(userID, step int64) error {
+	result, err := d.Exec("UPDATE users SET totp_last_step=$1 WHERE id=$2 AND totp_last_step < $1", step, userID)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if numRows, err := result.RowsAffected(); err != nil || numRows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// marks the code as used. Fails with sql.ErrNoRows if not found or already used.
+func (d *defaultDataMapper) useRecoveryCode(userID int64, codeHash string) error {
+	result, err := d.Exec("UPDATE recovery_codes SET used_at=$1 "+
+		"WHERE user_id=$2 AND code_hash=$3 AND used_at IS NULL", time.Now(), userID, codeHash)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if numRows, err := result.RowsAffected(); err != nil || numRows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (d *defaultDataMapper) countRecoveryCodes(userID int64) (int64, error) {
+	numCodes, err := d.SelectInt("SELECT COUNT(id) FROM recovery_codes WHERE user_id=$1 AND used_at IS NULL", userID)
+	return numCodes, errgo.Mask(err)
+}
+
+// stores the reset, replacing any earlier resets for the user
+func (d *defaultDataMapper) createPasswordReset(reset *passwordReset) error {
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := t.execAll(
+		statement{"DELETE FROM password_resets WHERE user_id=$1 OR expires_at < $2",
+			[]interface{}{reset.UserID, time.Now()}},
+		statement{"INSERT INTO password_resets (selector, verifier_hash, user_id, created_at, expires_at) " +
+			"VALUES ($1, $2, $3, $4, $5)",
+			[]interface{}{reset.Selector, reset.VerifierHash, reset.UserID, reset.CreatedAt, reset.ExpiresAt}},
+	); err != nil {
+		t.Rollback()
+		return err
+	}
+	return errgo.Mask(t.Commit())
+}
+
+func (d *defaultDataMapper) getPasswordReset(selector string) (*passwordReset, error) {
+	reset := &passwordReset{}
+	if err := d.SelectOne(reset, "SELECT * FROM password_resets WHERE selector=$1 AND expires_at > $2",
+		selector, time.Now()); err != nil {
+		return reset, errgo.Mask(err)
+	}
+	return reset, nil
+}
+
+// counts a wrong verifier against the reset
+func (d *defaultDataMapper) failPasswordReset(selector string) error {
+	_, err := d.Exec("UPDATE password_resets SET attempts=attempts+1 WHERE selector=$1", selector)
+	return errgo.Mask(err)
+}
+
+// counts resets for the user created since the given time
+func (d *defaultDataMapper) countPasswordResets(userID int64, since time.Time) (int64, error) {
+	num, err := d.SelectInt("SELECT COUNT(*) FROM password_resets WHERE user_id=$1 AND created_at > $2",
+		userID, since)
+	return num, errgo.Mask(err)
+}
+
+// Saves the user's new password, removing their password resets and revoking all
+// their sessions except the given one, which may be 0.
+func (d *defaultDataMapper) updatePassword(user *user, exceptSessionID int64, entry *auditEntry) error {
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := t.execAll(
+		statement{"DELETE FROM password_resets WHERE user_id=$1", []interface{}{user.ID}},
+		statement{"UPDATE sessions SET revoked_at=$1 WHERE user_id=$2 AND id != $3 AND revoked_at IS NULL",
+			[]interface{}{time.Now(), user.ID, exceptSessionID}},
+	); err != nil {
+		t.Rollback()
+		return err
+	}
+	if _, err := t.Update(user); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	if err := t.Insert(entry); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(t.Commit())
+}
+
+func (d *defaultDataMapper) createAPIToken(token *apiToken, entry *auditEntry) error {
+	return d.insertMany(token, entry)
+}
+
+func (d *defaultDataMapper) getAPITokens(userID int64) ([]apiToken, error) {
+	var tokens []apiToken
+	if _, err := d.Select(&tokens, "SELECT * FROM api_tokens "+
+		"WHERE user_id=$1 AND revoked_at IS NULL ORDER BY created_at DESC", userID); err != nil {
+		return tokens, errgo.Mask(err)
+	}
+	return tokens, nil
+}
+
+// finds an unrevoked token by its hash
+func (d *defaultDataMapper) getAPIToken(tokenHash string) (*apiToken, error) {
+	token := &apiToken{}
+	if err := d.SelectOne(token, "SELECT * FROM api_tokens WHERE token_hash=$1 AND revoked_at IS NULL",
+		tokenHash); err != nil {
+		return token, errgo.Mask(err)
+	}
+	return token, nil
+}
+
+func (d *defaultDataMapper) touchAPIToken(tokenID int64, ip string) error {
+	_, err := d.Exec("UPDATE api_tokens SET last_used_at=$1, last_used_ip=$2 WHERE id=$3", time.Now(), ip, tokenID)
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) revokeAPIToken(token *apiToken, entry *auditEntry) error {
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := t.execAll(statement{"UPDATE api_tokens SET revoked_at=$1 WHERE id=$2 AND revoked_at IS NULL",
+		[]interface{}{time.Now(), token.ID}}); err != nil {
+		t.Rollback()
+		return err
+	}
+	if err := t.Insert(entry); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(t.Commit())
+}
+
+func (d *defaultDataMapper) getLoginFailures(key string) (*loginFailures, error) {
+	f := &loginFailures{}
+	if err := d.SelectOne(f, "SELECT * FROM login_failures WHERE login_key=$1", key); err != nil {
+		if isErrSqlNoRows(err) {
+			return &loginFailures{Key: key}, nil
+		}
+		return f, errgo.Mask(err)
+	}
+	return f, nil
+}
+
+// Counts the failure, starting again if the last one was before the given time.
+// A concurrent first failure may insert the row first, so the update is retried.
+func (d *defaultDataMapper) addLoginFailure(key string, now, since time.Time) (*loginFailures, error) {
+	for retried := false; ; retried = true {
+
+		f := &loginFailures{}
+		err := d.SelectOne(f, "UPDATE login_failures SET "+
+			"failures=CASE WHEN last_failed_at < $3 THEN 1 ELSE failures + 1 END, "+
+			"previous_failed_at=last_failed_at, last_failed_at=$2 "+
+			"WHERE login_key=$1 RETURNING *", key, now, since)
+		if err == nil {
+			return f, nil
+		}
+		if !isErrSqlNoRows(err) {
+			return f, errgo.Mask(err)
+		}
+
+		// forgotten failures are removed when a new key is added
+		if _, err := d.Exec("DELETE FROM login_failures WHERE last_failed_at < $1", since); err != nil {
+			return f, errgo.Mask(err)
+		}
+
+		f = &loginFailures{Key: key, Failures: 1, LastFailedAt: now, PreviousFailedAt: now}
+		if _, err = d.Exec("INSERT INTO login_failures (login_key, failures, last_failed_at, previous_failed_at) "+
+			"VALUES ($1, $2, $3, $4)", f.Key, f.Failures, f.LastFailedAt, f.PreviousFailedAt); err == nil {
+			return f, nil
+		}
+		if retried {
+			return f, errgo.Mask(err)
+		}
+	}
+}
+
+func (d *defaultDataMapper) clearLoginFailures(key string) error {
+	_, err := d.Exec("DELETE FROM login_failures WHERE login_key=$1", key)
+	return errgo.Mask(err)
+}
+
+// stores the verification, removing those no longer needed to throttle resends
+func (d *defaultDataMapper) createEmailVerification(v *emailVerification) error {
+	if _, err := d.Exec("DELETE FROM email_verifications WHERE expires_at < $1 AND created_at < $2",
+		time.Now(), time.Now().Add(-emailVerificationWindow)); err != nil {
+		return errgo.Mask(err)
+	}
+	_, err := d.Exec("INSERT INTO email_verifications (token_hash, user_id, email, created_at, expires_at) "+
+		"VALUES ($1, $2, $3, $4, $5)", v.TokenHash, v.UserID, v.Email, v.CreatedAt, v.ExpiresAt)
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) getEmailVerification(tokenHash string) (*emailVerification, error) {
+	v := &emailVerification{}
+	if err := d.SelectOne(v, "SELECT * FROM email_verifications WHERE token_hash=$1 AND expires_at > $2",
+		tokenHash, time.Now()); err != nil {
+		return v, errgo.Mask(err)
+	}
+	return v, nil
+}
+
+// the number of verification emails sent to the user since the time
+func (d *defaultDataMapper) countEmailVerifications(userID int64, since time.Time) (int64, error) {
+	num, err := d.SelectInt("SELECT COUNT(*) FROM email_verifications WHERE user_id=$1 AND created_at > $2",
+		userID, since)
+	return num, errgo.Mask(err)
+}
+
+// saves the user with their verified email, removing their outstanding tokens
+func (d *defaultDataMapper) verifyEmail(user *user, entry *auditEntry) error {
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := t.Exec("DELETE FROM email_verifications WHERE user_id=$1", user.ID); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	if _, err := t.Update(user); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	if err := t.Insert(entry); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(t.Commit())
+}
+
+// stores the challenge, removing any expired challenges
+func (d *defaultDataMapper) createLoginChallenge(challenge *loginChallenge) error {
+	if _, err := d.Exec("DELETE FROM login_challenges WHERE expires_at < $1", time.Now()); err != nil {
+		return errgo.Mask(err)
+	}
+	_, err := d.Exec("INSERT INTO login_challenges (token_hash, user_id, expires_at) VALUES ($1, $2, $3)",
+		challenge.TokenHash, challenge.UserID, challenge.ExpiresAt)
+	return errgo.Mask(err)
+}
+
+// counts an attempt to answer the challenge, returning sql.ErrNoRows if it has
+// expired or has no attempts left
+func (d *defaultDataMapper) attemptLoginChallenge(tokenHash string, maxAttempts int) (*loginChallenge, error) {
+	challenge := &loginChallenge{}
+	if err := d.SelectOne(challenge, "UPDATE login_challenges SET attempts=attempts+1 "+
+		"WHERE token_hash=$1 AND expires_at > $2 AND attempts < $3 RETURNING *",
+		tokenHash, time.Now(), maxAttempts); err != nil {
+		return challenge, errgo.Mask(err)
+	}
+	return challenge, nil
+}
+
+func (d *defaultDataMapper) removeLoginChallenge(tokenHash string) error {
+	_, err := d.Exec("DELETE FROM login_challenges WHERE token_hash=$1", tokenHash)
+	return errgo.Mask(err)
+}
+
+// revokes all the user's sessions except the given one, which may be 0
+func (d *defaultDataMapper) revokeSessions(userID, exceptID int64) error {
+	_, err := d.Exec("UPDATE sessions SET revoked_at=$1 WHERE user_id=$2 AND id != $3 AND revoked_at IS NULL",
+		time.Now(), userID, exceptID)
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) createUserWithIdentity(user *user, identity *userIdentity) error {
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := t.Insert(user); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	identity.UserID = user.ID
+	if err := t.Insert(identity); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(t.Commit())
+}
+
+// stores the code, removing any expired codes
+func (d *defaultDataMapper) createAuthCode(code *authCode) error {
+	if _, err := d.Exec("DELETE FROM auth_codes WHERE expires_at < $1", time.Now()); err != nil {
+		return errgo.Mask(err)
+	}
+	_, err := d.Exec("INSERT INTO auth_codes (code_hash, user_id, provider, provider_id, email, expires_at) "+
+		"VALUES ($1, $2, $3, $4, $5, $6)",
+		code.CodeHash, code.UserID, code.Provider, code.ProviderID, code.Email, code.ExpiresAt)
+	return errgo.Mask(err)
+}
+
+// removes the code and returns it if it had not expired. Codes can only be used once.
+func (d *defaultDataMapper) useAuthCode(codeHash string) (*authCode, error) {
+	code := &authCode{}
+	if err := d.SelectOne(code, "DELETE FROM auth_codes WHERE code_hash=$1 AND expires_at > $2 RETURNING *",
+		codeHash, time.Now()); err != nil {
+		return code, errgo.Mask(err)
+	}
+	return code, nil
+}
+
+// finds active users by name, ignoring case
+func (d *defaultDataMapper) getUsersByNames(names []string) ([]user, error) {
+
+	var (
+		users  []user
+		args   []string
+		params = []interface{}{interface{}(true)}
+	)
+
+	if len(names) == 0 {
+		return users, nil
+	}
+
+	for _, name := range names {
+		params = append(params, interface{}(name))
+		args = append(args, fmt.Sprintf("LOWER($%d)", len(params)))
+	}
+
+	if _, err := d.Select(&users, fmt.Sprintf("SELECT * FROM users WHERE active=$1 AND LOWER(name) IN (%s)",
+		strings.Join(args, ",")), params...); err != nil {
+		return users, errgo.Mask(err)
+	}
+	return users, nil
+}
+
+func (d *defaultDataMapper) addFavorite(userID, photoID int64) error {
+	return d.changeFavorite(userID, photoID,
+		"INSERT INTO favorites(user_id, photo_id, created_at) "+
+			"SELECT $1, $2, NOW() WHERE NOT EXISTS "+
+			"(SELECT 1 FROM favorites WHERE user_id=$1 AND photo_id=$2)",
+		"UPDATE photos SET num_favorites = num_favorites + 1 WHERE id=$1")
+}
+
+func (d *defaultDataMapper) removeFavorite(userID, photoID int64) error {
+	return d.changeFavorite(userID, photoID,
+		"DELETE FROM favorites WHERE user_id=$1 AND photo_id=$2",
+		"UPDATE photos SET num_favorites = GREATEST(num_favorites - 1, 0) WHERE id=$1")
+}
+
+// runs the favorite insert/delete and only updates the photo count if anything changed
+func (d *defaultDataMapper) changeFavorite(userID, photoID int64, q, updateCount string) error {
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	result, err := t.Exec(q, userID, photoID)
+	if err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	numChanged, err := result.RowsAffected()
+	if err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	if numChanged > 0 {
+		if _, err := t.Exec(updateCount, photoID); err != nil {
+			t.Rollback()
+			return errgo.Mask(err)
+		}
+	}
+	return errgo.Mask(t.Commit())
+}
+
+// photos favorited by the user, most recently favorited first
+func (d *defaultDataMapper) getFavorites(page *page, userID int64) (*photoList, error) {
+	var (
+		photos []photo
+		err    error
+		total  int64
+	)
+
+	// photos made private since being favorited are hidden
+	where := "WHERE f.user_id=$1 AND (p.visibility != $2 OR p.owner_id = $1) AND p.deleted_at IS NULL "
+
+	if total, err = d.SelectInt("SELECT COUNT(*) FROM favorites f "+
+		"JOIN photos p ON p.id = f.photo_id "+where, userID, visibilityPrivate); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	if _, err = d.Select(&photos,
+		"SELECT p.* FROM photos p JOIN favorites f ON f.photo_id = p.id "+
+			where+"ORDER BY f.created_at DESC LIMIT $3 OFFSET $4",
+		userID, visibilityPrivate, page.size, page.offset); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return newPhotoList(photos, total, page.index), nil
+}
+
+func (d *defaultDataMapper) createComment(comment *comment) error {
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := t.Insert(comment); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	if _, err := t.Exec("UPDATE photos SET num_comments = num_comments + 1 WHERE id=$1",
+		comment.PhotoID); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(t.Commit())
+}
+
+func (d *defaultDataMapper) updateComment(comment *comment) error {
+	if _, err := d.Update(comment); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// removes the comment along with any replies
+func (d *defaultDataMapper) removeComment(comment *comment) error {
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	result, err := t.Exec("DELETE FROM comments WHERE id=$1 OR parent_id=$1", comment.ID)
+	if err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	numDeleted, err := result.RowsAffected()
+	if err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	if _, err := t.Exec("UPDATE photos SET num_comments = GREATEST(num_comments - $1, 0) WHERE id=$2",
+		numDeleted, comment.PhotoID); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(t.Commit())
+}
+
+func (d *defaultDataMapper) getComment(commentID int64) (*comment, error) {
+
+	c := &comment{}
+
+	if commentID == 0 {
+		return c, sql.ErrNoRows
+	}
+
+	obj, err := d.Get(c, commentID)
+	if err != nil {
+		return c, errgo.Mask(err)
+	}
+	if obj == nil {
+		return c, sql.ErrNoRows
+	}
+	return obj.(*comment), nil
+}
+
+// returns a page of top-level comments, oldest first, each with all its replies
+func (d *defaultDataMapper) getComments(page *page, photoID int64, user *user) (*commentList, error) {
+
+	var (
+		comments []commentDetail
+		replies  []commentDetail
+		total    int64
+		err      error
+	)
+
+	if photoID == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	if total, err = d.SelectInt("SELECT COUNT(id) FROM comments WHERE photo_id=$1 AND parent_id=0",
+		photoID); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	if _, err = d.Select(&comments,
+		"SELECT c.*, u.name AS owner_name FROM comments c "+
+			"JOIN users u ON u.id = c.owner_id "+
+			"WHERE c.photo_id=$1 AND c.parent_id=0 "+
+			"ORDER BY c.created_at, c.id LIMIT $2 OFFSET $3",
+		photoID, page.size, page.offset); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	if len(comments) == 0 {
+		return newCommentList(comments, total, page.index), nil
+	}
+
+	var parentIDs []int64
+	for _, comment := range comments {
+		parentIDs = append(parentIDs, comment.ID)
+	}
+
+	if _, err = d.Select(&replies,
+		"SELECT c.*, u.name AS owner_name FROM comments c "+
+			"JOIN users u ON u.id = c.owner_id "+
+			"WHERE c.parent_id = ANY($1::int[]) "+
+			"ORDER BY c.created_at, c.id",
+		intSliceToPgArr(parentIDs)); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	for i := range replies {
+		reply := &replies[i]
+		reply.Permissions = &permissions{
+			Edit:   reply.canEdit(user),
+			Delete: reply.canDelete(user),
+		}
+	}
+
+	for i := range comments {
+		comment := &comments[i]
+		comment.Permissions = &permissions{
+			Edit:   comment.canEdit(user),
+			Delete: comment.canDelete(user),
+		}
+		for _, reply := range replies {
+			if reply.ParentID == comment.ID {
+				comment.Replies = append(comment.Replies, reply)
+			}
+		}
+	}
+
+	return newCommentList(comments, total, page.index), nil
+}
+
+func (d *defaultDataMapper) createShare(share *share) error {
+	return errgo.Mask(d.Insert(share))
+}
+
+func (d *defaultDataMapper) removeShare(share *share) error {
+	if _, err := d.Delete(share); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// counts a view of the share, returning false if the share has used up its views
+func (d *defaultDataMapper) registerShareView(share *share) (bool, error) {
+	result, err := d.Exec("UPDATE shares SET num_views = num_views + 1 "+
+		"WHERE id=$1 AND (max_views = 0 OR num_views < max_views)", share.ID)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	numUpdated, err := result.RowsAffected()
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	if numUpdated == 0 {
+		return false, nil
+	}
+	share.NumViews++
+	return true, nil
+}
+
+func (d *defaultDataMapper) getShare(shareID int64) (*share, error) {
+
+	s := &share{}
+
+	if shareID == 0 {
+		return s, sql.ErrNoRows
+	}
+
+	obj, err := d.Get(s, shareID)
+	if err != nil {
+		return s, errgo.Mask(err)
+	}
+	if obj == nil {
+		return s, sql.ErrNoRows
+	}
+	return obj.(*share), nil
+}
+
+func (d *defaultDataMapper) getShareByToken(token string) (*share, error) {
+
+	share := &share{}
+
+	if token == "" {
+		return share, sql.ErrNoRows
+	}
+	if err := d.SelectOne(share, "SELECT * FROM shares WHERE token_hash=$1", hashToken(token)); err != nil {
+		return share, errgo.Mask(err)
+	}
+	share.HasPassword = share.Password != ""
+	return share, nil
+}
+
+func (d *defaultDataMapper) getSharesByOwnerID(page *page, ownerID int64) (*shareList, error) {
+
+	var (
+		shares []share
+		total  int64
+		err    error
+	)
+
+	if total, err = d.SelectInt("SELECT COUNT(id) FROM shares WHERE owner_id=$1", ownerID); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	if _, err = d.Select(&shares,
+		"SELECT * FROM shares WHERE owner_id=$1 ORDER BY created_at DESC LIMIT $2 OFFSET $3",
+		ownerID, page.size, page.offset); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	for i := range shares {
+		shares[i].HasPassword = shares[i].Password != ""
+	}
+	return newShareList(shares, total, page.index), nil
+}
+
+// selects album columns along with the cover photo (falling back to the first
+// photo in the album) and number of photos. Private or trashed photos are never used as covers.
+const albumSummarySql = "SELECT a.*, " +
+	"COALESCE((SELECT p.photo FROM photos p WHERE p.id = a.cover_photo_id " +
+	"AND p.visibility != 'private' AND p.deleted_at IS NULL), " +
+	"(SELECT p.photo FROM photos p JOIN album_photos ap ON ap.photo_id = p.id " +
+	"WHERE ap.album_id = a.id AND p.visibility != 'private' AND p.deleted_at IS NULL " +
+	"ORDER BY ap.position LIMIT 1), '') AS cover, " +
+	"(SELECT COUNT(*) FROM album_photos ap JOIN photos p ON p.id = ap.photo_id " +
+	"WHERE ap.album_id = a.id AND p.deleted_at IS NULL) AS num_photos " +
+	"FROM albums a "
+
+func (d *defaultDataMapper) createAlbum(album *album) error {
+	return errgo.Mask(d.Insert(album))
+}
+
+func (d *defaultDataMapper) updateAlbum(album *album) error {
+	if _, err := d.Update(album); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+func (d *defaultDataMapper) removeAlbum(album *album) error {
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, table := range []string{"shares", "album_photos"} {
+		if _, err := t.Exec("DELETE FROM "+table+" WHERE album_id=$1", album.ID); err != nil {
+			t.Rollback()
+			return errgo.Mask(err)
+		}
+	}
+	if _, err := t.Delete(album); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(t.Commit())
+}
+
+// replaces the photos in the album; the order of the IDs determines the album order
+func (d *defaultDataMapper) updateAlbumPhotos(album *album, photoIDs []int64) error {
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := t.Exec("DELETE FROM album_photos WHERE album_id=$1", album.ID); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	for position, photoID := range photoIDs {
+		if _, err := t.Exec("INSERT INTO album_photos(album_id, photo_id, position) VALUES($1, $2, $3)",
+			album.ID, photoID, position); err != nil {
+			t.Rollback()
+			return errgo.Mask(err)
+		}
+	}
+	if _, err := t.Update(album); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(t.Commit())
+}
+
+func (d *defaultDataMapper) isPhotoInAlbum(albumID, photoID int64) (bool, error) {
+	num, err := d.SelectInt("SELECT COUNT(*) FROM album_photos WHERE album_id=$1 AND photo_id=$2", albumID, photoID)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return num > 0, nil
+}
+
+func (d *defaultDataMapper) getAlbum(albumID int64) (*album, error) {
+
+	a := &album{}
+
+	if albumID == 0 {
+		return a, sql.ErrNoRows
+	}
+
+	obj, err := d.Get(a, albumID)
+	if err != nil {
+		return a, errgo.Mask(err)
+	}
+	if obj == nil {
+		return a, sql.ErrNoRows
+	}
+	return obj.(*album), nil
+}
+
+// returns the album if the user can see it, or it has been shared
+func (d *defaultDataMapper) getAlbumDetail(page *page, albumID int64, user *user, grant *share) (*albumDetail, error) {
+
+	var (
+		album  = &albumDetail{}
+		photos []photo
+		total  int64
+		err    error
+	)
+
+	if albumID == 0 {
+		return album, sql.ErrNoRows
+	}
+
+	q := "SELECT q.*, u.name AS owner_name " +
+		"FROM (" + albumSummarySql + "WHERE a.id=$1) q " +
+		"JOIN users u ON u.id = q.owner_id"
+
+	if err := d.SelectOne(album, q, albumID); err != nil {
+		return album, errgo.Mask(err)
+	}
+
+	if !album.canView(user) && !grant.grantsAlbum(album.ID) {
+		return album, sql.ErrNoRows
+	}
+
+	// private photos in the album are only shown to those who can edit them,
+	// or if the owner has shared the album
+	where := "WHERE ap.album_id=$1 AND p.visibility = ANY($2::text[]) AND p.deleted_at IS NULL "
+	visibilities := "{" + visibilityPublic + "," + visibilityUnlisted + "}"
+	if album.canEdit(user) || grant.grantsAlbum(album.ID) {
+		visibilities = "{" + visibilityPublic + "," + visibilityUnlisted + "," + visibilityPrivate + "}"
+	}
+
+	if total, err = d.SelectInt("SELECT COUNT(*) FROM album_photos ap "+
+		"JOIN photos p ON p.id = ap.photo_id "+where, album.ID, visibilities); err != nil {
+		return album, errgo.Mask(err)
+	}
+
+	if _, err = d.Select(&photos,
+		"SELECT p.* FROM photos p JOIN album_photos ap ON ap.photo_id = p.id "+
+			where+"ORDER BY ap.position LIMIT $3 OFFSET $4",
+		album.ID, visibilities, page.size, page.offset); err != nil {
+		return album, errgo.Mask(err)
+	}
+
+	album.Photos = newPhotoList(photos, total, page.index)
+	album.Permissions = &permissions{
+		Edit:   album.canEdit(user),
+		Delete: album.canDelete(user),
+	}
+	return album, nil
+}
+
+func (d *defaultDataMapper) getAlbums(page *page) (*albumList, error) {
+
+	var (
+		total  int64
+		albums []albumSummary
+		err    error
+	)
+
+	if total, err = d.SelectInt("SELECT COUNT(id) FROM albums WHERE visibility=$1", visibilityPublic); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	if _, err = d.Select(&albums,
+		albumSummarySql+"WHERE a.visibility=$1 "+
+			"ORDER BY a.updated_at DESC LIMIT $2 OFFSET $3",
+		visibilityPublic, page.size, page.offset); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return newAlbumList(albums, total, page.index), nil
+}
+
+// returns all the owner's albums if the user can edit them, otherwise just the public ones
+func (d *defaultDataMapper) getAlbumsByOwnerID(page *page, ownerID int64, user *user) (*albumList, error) {
+
+	var (
+		total  int64
+		albums []albumSummary
+		err    error
+	)
+
+	if ownerID == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	visibilities := listedVisibilities(ownerID, user)
+
+	if total, err = d.SelectInt("SELECT COUNT(id) FROM albums "+
+		"WHERE owner_id=$1 AND visibility = ANY($2::text[])", ownerID, visibilities); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	if _, err = d.Select(&albums,
+		albumSummarySql+"WHERE a.owner_id=$1 AND a.visibility = ANY($2::text[]) "+
+			"ORDER BY a.updated_at DESC LIMIT $3 OFFSET $4",
+		ownerID, visibilities, page.size, page.offset); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return newAlbumList(albums, total, page.index), nil
+}
+
+func (d *defaultDataMapper) searchAlbums(page *page, q string) (*albumList, error) {
+
+	var (
+		total  int64
+		albums []albumSummary
+		err    error
+	)
+
+	q = strings.TrimSpace(q)
+	if q == "" {
+		return newAlbumList(albums, 0, page.index), nil
+	}
+	q = "%" + q + "%"
+
+	where := "WHERE a.visibility=$1 AND " +
+		"(UPPER(a.title::text) LIKE UPPER($2) OR UPPER(a.description::text) LIKE UPPER($2)) "
+
+	if total, err = d.SelectInt("SELECT COUNT(a.id) FROM albums a "+where, visibilityPublic, q); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	if _, err = d.Select(&albums,
+		albumSummarySql+where+"ORDER BY a.updated_at DESC LIMIT $3 OFFSET $4",
+		visibilityPublic, q, page.size, page.offset); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return newAlbumList(albums, total, page.index), nil
+}
+
+func (d *defaultDataMapper) follow(followerID, followeeID int64) error {
+	if _, err := d.Exec("INSERT INTO follows(follower_id, followee_id, created_at) "+
+		"SELECT $1, $2, NOW() WHERE NOT EXISTS "+
+		"(SELECT 1 FROM follows WHERE follower_id=$1 AND followee_id=$2)",
+		followerID, followeeID); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+func (d *defaultDataMapper) unfollow(followerID, followeeID int64) error {
+	if _, err := d.Exec("DELETE FROM follows WHERE follower_id=$1 AND followee_id=$2",
+		followerID, followeeID); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+func (d *defaultDataMapper) getUserProfile(userID int64, viewer *user) (*userProfile, error) {
+	if userID == 0 {
+		return &userProfile{}, sql.ErrNoRows
+	}
+	return d.selectUserProfile("u.id=$1", userID, viewer)
+}
+
+// names are matched ignoring case
+func (d *defaultDataMapper) getUserProfileByName(name string, viewer *user) (*userProfile, error) {
+	return d.selectUserProfile("LOWER(u.name)=LOWER($1)", name, viewer)
+}
+
+func (d *defaultDataMapper) selectUserProfile(where string, key interface{}, viewer *user) (*userProfile, error) {
+
+	profile := &userProfile{}
+
+	// stats only count photos the viewer is allowed to see in the owner's list
+	photosSql := "FROM photos WHERE owner_id = u.id AND deleted_at IS NULL AND " +
+		"(visibility = $4 OR (owner_id = $2 OR $5))"
+
+	q := "SELECT u.id, u.name, u.created_at, u.display_name, u.bio, u.website, u.avatar, " +
+		"(SELECT COUNT(*) FROM follows WHERE followee_id = u.id) AS num_followers, " +
+		"(SELECT COUNT(*) FROM follows WHERE follower_id = u.id) AS num_following, " +
+		"EXISTS(SELECT 1 FROM follows WHERE follower_id = $2 AND followee_id = u.id) AS is_following, " +
+		"(SELECT COUNT(*) " + photosSql + ") AS num_photos, " +
+		"(SELECT COALESCE(SUM(up_votes + down_votes), 0) " + photosSql + ") AS num_votes " +
+		"FROM users u WHERE u.active=$3 AND " + where + " ORDER BY u.id LIMIT 1"
+
+	if err := d.SelectOne(profile, q, key, viewer.ID, true, visibilityPublic, viewer.IsAdmin); err != nil {
+		return profile, errgo.Mask(err)
+	}
+	profile.CanFollow = profile.canFollow(viewer)
+	profile.CanEdit = profile.canEdit(viewer)
+	return profile, nil
+}
+
+func (d *defaultDataMapper) getFollowers(page *page, userID int64) (*userList, error) {
+	return d.getFollows(page, userID, "followee_id", "follower_id")
+}
+
+func (d *defaultDataMapper) getFollowing(page *page, userID int64) (*userList, error) {
+	return d.getFollows(page, userID, "follower_id", "followee_id")
+}
+
+func (d *defaultDataMapper) getFollows(page *page, userID int64, matchCol, userCol string) (*userList, error) {
+
+	var (
+		users []userSummary
+		total int64
+		err   error
+	)
+
+	if userID == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	if total, err = d.SelectInt("SELECT COUNT(*) FROM follows f "+
+		"JOIN users u ON u.id = f."+userCol+" "+
+		"WHERE u.active=$1 AND f."+matchCol+"=$2", true, userID); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	if _, err = d.Select(&users,
+		"SELECT u.id, u.name FROM follows f "+
+			"JOIN users u ON u.id = f."+userCol+" "+
+			"WHERE u.active=$1 AND f."+matchCol+"=$2 "+
+			"ORDER BY f.created_at DESC LIMIT $3 OFFSET $4",
+		true, userID, page.size, page.offset); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return newUserList(users, total, page.index), nil
+}
+
+// returns the most recent photos from users followed by the user, starting after the cursor if any
+func (d *defaultDataMapper) getTimeline(userID int64, cursor *timelineCursor) (*timeline, error) {
+
+	var (
+		photos []photo
+		err    error
+		params = []interface{}{userID}
+	)
+
+	q := "SELECT p.* FROM photos p " +
+		"WHERE p.owner_id IN (SELECT followee_id FROM follows WHERE follower_id=$1) " +
+		"AND p.visibility = '" + visibilityPublic + "' AND p.deleted_at IS NULL "
+
+	if cursor != nil {
+		q += "AND (p.created_at, p.id) < ($2, $3) "
+		params = append(params, cursor.createdAt, cursor.id)
+	}
+
+	// fetch an extra row so we know if there is a next page
+	q += fmt.Sprintf("ORDER BY p.created_at DESC, p.id DESC LIMIT $%d", len(params)+1)
+	params = append(params, pageSize+1)
+
+	if _, err = d.Select(&photos, q, params...); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	result := &timeline{Items: photos}
+
+	if len(photos) > pageSize {
+		result.Items = photos[:pageSize]
+		last := result.Items[pageSize-1]
+		result.NextCursor = (&timelineCursor{last.CreatedAt, last.ID}).String()
+	}
+	return result, nil
 }
@@ -3,6 +3,7 @@ package photoshare
 import (
 	"database/sql"
 	"testing"
+	"time"
 )
 
 func TestGetIfNotNone(t *testing.T) {
@@ -131,6 +132,44 @@ func TestCanEdit(t *testing.T) {
 	}
 }
 
+func TestCanView(t *testing.T) {
+	user := &user{ID: 1}
+	photo := &photo{ID: 1, OwnerID: 2, Visibility: visibilityUnlisted}
+
+	if !photo.canView(user) {
+		t.Error("Anyone should be able to view an unlisted photo")
+	}
+
+	photo.Visibility = visibilityPrivate
+	if photo.canView(user) {
+		t.Error("User should not be able to view a private photo")
+	}
+
+	user.IsAuthenticated = true
+	if photo.canVote(user) {
+		t.Error("User should not be able to vote on a private photo")
+	}
+
+	photo.OwnerID = 1
+	if !photo.canView(user) {
+		t.Error("Owner should be able to view a private photo")
+	}
+}
+
+func TestListedVisibilities(t *testing.T) {
+	user := &user{ID: 1}
+	if listedVisibilities(1, user) != "{public}" {
+		t.Error("Anonymous user should only see public items")
+	}
+	user.IsAuthenticated = true
+	if listedVisibilities(1, user) != "{public,unlisted,private}" {
+		t.Error("Owner should see all items")
+	}
+	if listedVisibilities(2, user) != "{public}" {
+		t.Error("Other users should only see public items")
+	}
+}
+
 func TestHasVoted(t *testing.T) {
 
 	u := &user{}
@@ -143,3 +182,770 @@ func TestHasVoted(t *testing.T) {
 		t.Error("The user should have voted")
 	}
 }
+
+func TestFavorites(t *testing.T) {
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	user := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
+	if err := datamapper.createUser(user); err != nil {
+		t.Error(err)
+		return
+	}
+	photo := &photo{Title: "test", OwnerID: user.ID, Filename: "test.jpg"}
+	if err := datamapper.createPhoto(photo); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// adding twice should only count once
+	for i := 0; i < 2; i++ {
+		if err := datamapper.addFavorite(user.ID, photo.ID); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	user.IsAuthenticated = true
+	detail, err := datamapper.getPhotoDetail(photo.ID, user, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !detail.Favorited || detail.NumFavorites != 1 {
+		t.Error("Photo should have been favorited once")
+	}
+
+	result, err := datamapper.getFavorites(newPage(1), user.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(result.Items) != 1 {
+		t.Error("There should be 1 favorite")
+	}
+
+	if err := datamapper.removeFavorite(user.ID, photo.ID); err != nil {
+		t.Error(err)
+		return
+	}
+	detail, err = datamapper.getPhotoDetail(photo.ID, user, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if detail.Favorited || detail.NumFavorites != 0 {
+		t.Error("Photo should no longer be favorited")
+	}
+}
+
+func TestSearchPhotosNear(t *testing.T) {
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	user := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
+	if err := datamapper.createUser(user); err != nil {
+		t.Fatal(err)
+	}
+	photo := &photo{Title: "eiffel", OwnerID: user.ID, Filename: "test.jpg"}
+	photo.setLocation(48.8584, 2.2945)
+	if err := datamapper.createPhoto(photo); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := datamapper.searchPhotos(newPage(1), "near:48.8566,2.3522,10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Items) != 1 {
+		t.Error("There should be 1 photo near Paris")
+	}
+
+	result, err = datamapper.searchPhotos(newPage(1), "near:51.5074,-0.1278,10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Items) != 0 {
+		t.Error("There should be no photos near London")
+	}
+}
+
+func TestTagSynonymsAndBlocklist(t *testing.T) {
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	user := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
+	if err := datamapper.createUser(user); err != nil {
+		t.Fatal(err)
+	}
+	photo := &photo{Title: "test", OwnerID: user.ID, Filename: "test.jpg", Tags: []string{"newyork", "nyc"}}
+	if err := datamapper.createPhoto(photo); err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := datamapper.getTagByName("newyork")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nyc already exists, so it is merged into newyork
+	if err := datamapper.addTagSynonym(&tagSynonym{Name: "nyc", TagID: target.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := datamapper.getTagByName("nyc"); !isErrSqlNoRows(err) {
+		t.Error("Merged tag should be removed")
+	}
+
+	result, err := datamapper.searchPhotos(newPage(1), "#nyc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Items) != 1 {
+		t.Error("Synonym should be resolved in search")
+	}
+
+	if err := datamapper.blockTag(&blockedTag{Name: "newyork"}); err != nil {
+		t.Fatal(err)
+	}
+	photo.Tags = []string{"newyork", "manhattan"}
+	if err := datamapper.updateTags(photo); err != nil {
+		t.Fatal(err)
+	}
+	detail, err := datamapper.getPhotoDetail(photo.ID, user, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(detail.Tags) != 1 || detail.Tags[0] != "manhattan" {
+		t.Errorf("Blocked tag should not be added, got %v", detail.Tags)
+	}
+}
+
+func TestSuggestTagsIfPublic(t *testing.T) {
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	user := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
+	if err := datamapper.createUser(user); err != nil {
+		t.Fatal(err)
+	}
+	photo := &photo{Title: "test", OwnerID: user.ID, Filename: "test.jpg", Tags: []string{"travel", "trains"}}
+	if err := datamapper.createPhoto(photo); err != nil {
+		t.Fatal(err)
+	}
+	private := *photo
+	private.ID = 0
+	private.Filename = "test2.jpg"
+	private.Visibility = visibilityPrivate
+	private.Tags = []string{"tractor"}
+	if err := datamapper.createPhoto(&private); err != nil {
+		t.Fatal(err)
+	}
+
+	tags, err := datamapper.suggestTags("tra", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 2 {
+		t.Errorf("Only tags of public photos should be suggested, got %v", tags)
+	}
+
+	tags, err = datamapper.suggestTags("tra", user.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 3 {
+		t.Errorf("Owner's own tags should be suggested, got %v", tags)
+	}
+}
+
+func TestSearchTagDescendants(t *testing.T) {
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	user := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
+	if err := datamapper.createUser(user); err != nil {
+		t.Fatal(err)
+	}
+	photo := &photo{Title: "test", OwnerID: user.ID, Filename: "test.jpg", Tags: []string{"travel/europe/paris"}}
+	if err := datamapper.createPhoto(photo); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, q := range []string{"#travel", "#travel/europe", "#travel/europe/paris"} {
+		result, err := datamapper.searchPhotos(newPage(1), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Items) != 1 {
+			t.Errorf("%s should include descendants", q)
+		}
+	}
+
+	parent, err := datamapper.getTagByName("travel/europe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent.ParentID == 0 {
+		t.Error("Parent tags should be created")
+	}
+}
+
+func TestTrashedPhotosNotListed(t *testing.T) {
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	user := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
+	if err := datamapper.createUser(user); err != nil {
+		t.Fatal(err)
+	}
+	photo := &photo{Title: "test", OwnerID: user.ID, Filename: "test.jpg"}
+	if err := datamapper.createPhoto(photo); err != nil {
+		t.Fatal(err)
+	}
+
+	deletedAt := time.Now().Add(-time.Hour)
+	photo.DeletedAt = &deletedAt
+	if err := datamapper.updatePhoto(photo); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := datamapper.getPhoto(photo.ID); err != sql.ErrNoRows {
+		t.Error("Trashed photo should not be found")
+	}
+
+	result, err := datamapper.getPhotos(newPage(1), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Items) != 0 {
+		t.Error("Trashed photo should not be listed")
+	}
+
+	trash, err := datamapper.getTrash(newPage(1), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash.Items) != 1 {
+		t.Error("Photo should be in the trash")
+	}
+
+	expired, err := datamapper.getExpiredTrash(time.Now(), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 {
+		t.Error("Photo should be due to be purged")
+	}
+}
+
+func TestBulkUpdatePhotos(t *testing.T) {
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	user := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
+	if err := datamapper.createUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	var photos []*photo
+	for i := 0; i < 2; i++ {
+		p := &photo{Title: "test", OwnerID: user.ID, Filename: "test.jpg", Tags: []string{"beach"}}
+		if err := datamapper.createPhoto(p); err != nil {
+			t.Fatal(err)
+		}
+		photos = append(photos, p)
+	}
+
+	op := &bulkOperation{Op: bulkAddTags, Tags: []string{"travel", "beach"}}
+	if err := datamapper.bulkUpdatePhotos(op, photos); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := datamapper.searchPhotos(newPage(1), "#travel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Total != 2 {
+		t.Errorf("Both photos should be tagged, got %d", result.Total)
+	}
+
+	op = &bulkOperation{Op: bulkRemoveTags, Tags: []string{"beach"}}
+	if err := datamapper.bulkUpdatePhotos(op, photos[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err = datamapper.searchPhotos(newPage(1), "#beach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Total != 1 {
+		t.Errorf("Tag should be removed from one photo, got %d", result.Total)
+	}
+
+	album := &album{Title: "test", OwnerID: user.ID}
+	if err := datamapper.createAlbum(album); err != nil {
+		t.Fatal(err)
+	}
+
+	op = &bulkOperation{Op: bulkMoveToAlbum, AlbumID: album.ID}
+	for i := 0; i < 2; i++ {
+		if err := datamapper.bulkUpdatePhotos(op, photos); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	detail, err := datamapper.getAlbumDetail(newPage(1), album.ID, user, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detail.Photos.Total != 2 {
+		t.Errorf("Album should have each photo once, got %d", detail.Photos.Total)
+	}
+}
+
+func TestSearchPhotosByDescription(t *testing.T) {
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	user := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
+	if err := datamapper.createUser(user); err != nil {
+		t.Fatal(err)
+	}
+	photo := &photo{Title: "test", Description: "A sunset over the *harbour*", OwnerID: user.ID, Filename: "test.jpg"}
+	if err := datamapper.createPhoto(photo); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := datamapper.searchPhotos(newPage(1), "harbour")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Total != 1 {
+		t.Error("Photo should be found by description")
+	}
+
+	users, err := datamapper.getUsersByNames([]string{"TESTER", "nobody"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].ID != user.ID {
+		t.Error("Users should be found by name ignoring case")
+	}
+}
+
+func TestUserProfileStats(t *testing.T) {
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	owner := &user{Name: "Tester", Email: "tester@gmail.com", Password: "test"}
+	if err := datamapper.createUser(owner); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, visibility := range []string{visibilityPublic, visibilityPrivate} {
+		p := &photo{Title: "test", OwnerID: owner.ID, Filename: "test.jpg", Visibility: visibility, UpVotes: 2, DownVotes: 1}
+		if err := datamapper.createPhoto(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	profile, err := datamapper.getUserProfileByName("tester", &user{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.ID != owner.ID {
+		t.Error("Profile should be found by name ignoring case")
+	}
+	if profile.NumPhotos != 1 || profile.NumVotes != 3 {
+		t.Errorf("Anonymous users should only see public stats, got %d photos and %d votes",
+			profile.NumPhotos, profile.NumVotes)
+	}
+
+	owner.IsAuthenticated = true
+	profile, err = datamapper.getUserProfile(owner.ID, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.NumPhotos != 2 || !profile.CanEdit {
+		t.Error("Owner should see all their photos and be able to edit their profile")
+	}
+}
+
+func TestAuthCodeIsSingleUse(t *testing.T) {
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	newUser := &user{Name: "tester", Email: "tester@gmail.com"}
+	identity := &userIdentity{Provider: "google", ProviderID: "123", Email: newUser.Email}
+	if err := datamapper.createUserWithIdentity(newUser, identity); err != nil {
+		t.Fatal(err)
+	}
+
+	linked, err := datamapper.getUserByIdentity("google", "123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linked.ID != newUser.ID {
+		t.Error("User should be found by identity")
+	}
+
+	if err := datamapper.createAuthCode(&authCode{CodeHash: hashToken("code"), UserID: newUser.ID,
+		ExpiresAt: time.Now().Add(time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	code, err := datamapper.useAuthCode(hashToken("code"))
+	if err != nil || code.UserID != newUser.ID || code.isLink() {
+		t.Error("Code should be exchanged for the user ID")
+	}
+	if _, err := datamapper.useAuthCode(hashToken("code")); !isErrSqlNoRows(err) {
+		t.Error("Code should only be used once")
+	}
+}
+
+func TestLinkAndUnlinkUserIdentity(t *testing.T) {
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	newUser := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
+	if err := datamapper.createUser(newUser); err != nil {
+		t.Fatal(err)
+	}
+
+	identity := &userIdentity{UserID: newUser.ID, Provider: "github", ProviderID: "42"}
+	entry := &auditEntry{UserID: newUser.ID, ActorID: newUser.ID, Action: auditIdentityLinked, Details: "github"}
+	if err := datamapper.createUserIdentity(identity, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	identities, err := datamapper.getUserIdentities(newUser.ID)
+	if err != nil || len(identities) != 1 || identities[0].Provider != "github" {
+		t.Fatal("Identity should be linked to the user")
+	}
+
+	// without a password the identity is the only way to log in
+	if _, err := tdb.dbMap.Exec("UPDATE users SET password='' WHERE id=$1", newUser.ID); err != nil {
+		t.Fatal(err)
+	}
+	entry = &auditEntry{UserID: newUser.ID, ActorID: newUser.ID, Action: auditIdentityUnlinked, Details: "github"}
+	if err := datamapper.removeUserIdentity(&identities[0], entry); err != errLastLoginMethod {
+		t.Fatal("Last login method should not be removed")
+	}
+	if _, err := tdb.dbMap.Exec("UPDATE users SET password='test' WHERE id=$1", newUser.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	entry = &auditEntry{UserID: newUser.ID, ActorID: newUser.ID, Action: auditIdentityUnlinked, Details: "github"}
+	if err := datamapper.removeUserIdentity(&identities[0], entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if identities, _ := datamapper.getUserIdentities(newUser.ID); len(identities) != 0 {
+		t.Error("Identity should be unlinked")
+	}
+
+	numEntries, err := tdb.dbMap.SelectInt("SELECT COUNT(*) FROM audit_log WHERE user_id=$1", newUser.ID)
+	if err != nil || numEntries != 2 {
+		t.Error("Both changes should be in the audit log")
+	}
+}
+
+func TestRotateSessionOnlyOnce(t *testing.T) {
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	newUser := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
+	if err := datamapper.createUser(newUser); err != nil {
+		t.Fatal(err)
+	}
+
+	session := &userSession{UserID: newUser.ID, RefreshHash: hashToken("first"), ExpiresAt: time.Now().Add(time.Hour)}
+	if err := datamapper.createSession(session); err != nil {
+		t.Fatal(err)
+	}
+
+	session.RefreshHash = hashToken("second")
+	if err := datamapper.rotateSession(session, hashToken("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	session.RefreshHash = hashToken("third")
+	if err := datamapper.rotateSession(session, hashToken("first")); !isErrSqlNoRows(err) {
+		t.Error("Refresh token should only be replaced once")
+	}
+
+	found, err := datamapper.getSessionByRefreshHash(hashToken("first"))
+	if err != nil || found.ID != session.ID || found.RefreshHash != hashToken("second") {
+		t.Error("Session should be found by the previous token")
+	}
+
+	if err := datamapper.revokeSessions(newUser.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if sessions, _ := datamapper.getActiveSessions(newUser.ID); len(sessions) != 0 {
+		t.Error("All sessions should be revoked")
+	}
+}
+
+func TestTwoFactorCodesAreSingleUse(t *testing.T) {
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	newUser := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
+	if err := datamapper.createUser(newUser); err != nil {
+		t.Fatal(err)
+	}
+
+	newUser.TOTPSecret = "secret"
+	newUser.TOTPEnabled = true
+	entry := &auditEntry{UserID: newUser.ID, ActorID: newUser.ID, Action: auditTwoFactorEnabled}
+	if err := datamapper.enableTwoFactor(newUser, []string{hashToken("first"), hashToken("second")}, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := datamapper.useRecoveryCode(newUser.ID, hashToken("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := datamapper.useRecoveryCode(newUser.ID, hashToken("first")); !isErrSqlNoRows(err) {
+		t.Error("Recovery code should only be used once")
+	}
+	if numCodes, _ := datamapper.countRecoveryCodes(newUser.ID); numCodes != 1 {
+		t.Errorf("One recovery code should be left, got %d", numCodes)
+	}
+
+	if err := datamapper.useTOTPStep(newUser.ID, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := datamapper.useTOTPStep(newUser.ID, 100); !isErrSqlNoRows(err) {
+		t.Error("Step should only be used once")
+	}
+
+	challenge := &loginChallenge{TokenHash: hashToken("challenge"), UserID: newUser.ID, ExpiresAt: time.Now().Add(time.Minute)}
+	if err := datamapper.createLoginChallenge(challenge); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := datamapper.attemptLoginChallenge(hashToken("challenge"), 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := datamapper.attemptLoginChallenge(hashToken("challenge"), 2); !isErrSqlNoRows(err) {
+		t.Error("Challenge should have no attempts left")
+	}
+
+	newUser.resetTwoFactor()
+	entry = &auditEntry{UserID: newUser.ID, ActorID: newUser.ID, Action: auditTwoFactorDisabled}
+	if err := datamapper.resetTwoFactor(newUser, entry); err != nil {
+		t.Fatal(err)
+	}
+	if numCodes, _ := datamapper.countRecoveryCodes(newUser.ID); numCodes != 0 {
+		t.Error("Recovery codes should be removed")
+	}
+}
+
+func TestVerifyEmailRemovesTokens(t *testing.T) {
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	newUser := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
+	if err := datamapper.createUser(newUser); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	v := &emailVerification{TokenHash: hashToken("token"), UserID: newUser.ID, Email: "new@gmail.com",
+		CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	if err := datamapper.createEmailVerification(v); err != nil {
+		t.Fatal(err)
+	}
+
+	if num, _ := datamapper.countEmailVerifications(newUser.ID, now.Add(-time.Minute)); num != 1 {
+		t.Errorf("One email should have been sent, got %d", num)
+	}
+
+	found, err := datamapper.getEmailVerification(hashToken("token"))
+	if err != nil || found.Email != "new@gmail.com" {
+		t.Fatal("Verification should be found by token")
+	}
+
+	newUser.Email = found.Email
+	newUser.EmailVerified = true
+	entry := &auditEntry{UserID: newUser.ID, ActorID: newUser.ID, Action: auditEmailChanged}
+	if err := datamapper.verifyEmail(newUser, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := datamapper.getEmailVerification(hashToken("token")); !isErrSqlNoRows(err) {
+		t.Error("Token should only be used once")
+	}
+	if verified, _ := datamapper.getActiveUser(newUser.ID); !verified.EmailVerified || verified.Email != "new@gmail.com" {
+		t.Error("Email should be changed and verified")
+	}
+}
+
+func TestPasswordResetRevokesSessions(t *testing.T) {
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	newUser := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
+	if err := datamapper.createUser(newUser); err != nil {
+		t.Fatal(err)
+	}
+
+	session := &userSession{UserID: newUser.ID, RefreshHash: hashToken("refresh"), ExpiresAt: time.Now().Add(time.Hour)}
+	if err := datamapper.createSession(session); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	reset := &passwordReset{Selector: "selector", VerifierHash: hashToken("verifier"), UserID: newUser.ID,
+		CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	if err := datamapper.createPasswordReset(reset); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := datamapper.failPasswordReset("selector"); err != nil {
+		t.Fatal(err)
+	}
+	found, err := datamapper.getPasswordReset("selector")
+	if err != nil || found.Attempts != 1 {
+		t.Fatal("Reset should be found with the failed attempt")
+	}
+
+	newUser.changePassword("newpass")
+	entry := &auditEntry{UserID: newUser.ID, ActorID: newUser.ID, Action: auditPasswordReset}
+	if err := datamapper.updatePassword(newUser, 0, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := datamapper.getPasswordReset("selector"); !isErrSqlNoRows(err) {
+		t.Error("Reset should only be used once")
+	}
+	if revoked, _ := datamapper.getSession(session.ID); revoked.isActive() {
+		t.Error("Sessions should be revoked")
+	}
+}
+
+func TestAddLoginFailure(t *testing.T) {
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	now := time.Now()
+	since := now.Add(-loginFailureWindow)
+
+	if f, err := datamapper.getLoginFailures("ip:127.0.0.1"); err != nil || f.Failures != 0 {
+		t.Fatal("There should be no failures")
+	}
+
+	for i := 1; i <= 3; i++ {
+		f, err := datamapper.addLoginFailure("ip:127.0.0.1", now, since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Failures != i {
+			t.Errorf("Failures should be counted, expected %d got %d", i, f.Failures)
+		}
+	}
+
+	if f, _ := datamapper.addLoginFailure("ip:127.0.0.1", now.Add(time.Minute), since); !f.PreviousFailedAt.Before(f.LastFailedAt) {
+		t.Error("Time of the failure before the last should be kept")
+	}
+
+	later := now.Add(loginFailureWindow + time.Minute)
+	if f, _ := datamapper.addLoginFailure("ip:127.0.0.1", later, later.Add(-loginFailureWindow)); f.Failures != 1 {
+		t.Error("Old failures should be forgotten")
+	}
+
+	if err := datamapper.clearLoginFailures("ip:127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if f, _ := datamapper.getLoginFailures("ip:127.0.0.1"); f.Failures != 0 {
+		t.Error("Failures should be cleared")
+	}
+}
+
+func TestRevokedAPITokenIsNotFound(t *testing.T) {
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	newUser := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
+	if err := datamapper.createUser(newUser); err != nil {
+		t.Fatal(err)
+	}
+
+	token := &apiToken{UserID: newUser.ID, Name: "uploads", TokenHash: hashToken("pat_foo"),
+		Prefix: "pat_foo", ScopeList: []string{scopePhotosRead, scopePhotosWrite}}
+	entry := &auditEntry{UserID: newUser.ID, ActorID: newUser.ID, Action: auditAPITokenCreated}
+	if err := datamapper.createAPIToken(token, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := datamapper.getAPIToken(hashToken("pat_foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found.hasScope(scopePhotosWrite) {
+		t.Error("Token should be found with its scopes")
+	}
+
+	entry = &auditEntry{UserID: newUser.ID, ActorID: newUser.ID, Action: auditAPITokenRevoked}
+	if err := datamapper.revokeAPIToken(found, entry); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := datamapper.getAPIToken(hashToken("pat_foo")); !isErrSqlNoRows(err) {
+		t.Error("Revoked token should not be found")
+	}
+	if tokens, _ := datamapper.getAPITokens(newUser.ID); len(tokens) != 0 {
+		t.Error("Revoked token should not be listed")
+	}
+}
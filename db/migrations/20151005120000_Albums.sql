@@ -0,0 +1,32 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE albums (
+    id SERIAL PRIMARY KEY,
+    owner_id integer NOT NULL REFERENCES users(id),
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    title text NOT NULL,
+    description text NOT NULL DEFAULT '',
+    cover_photo_id integer NOT NULL DEFAULT 0,
+    visibility VARCHAR(10) NOT NULL DEFAULT 'public'
+);
+
+CREATE TABLE album_photos (
+    album_id integer NOT NULL REFERENCES albums(id) ON DELETE CASCADE,
+    photo_id integer NOT NULL REFERENCES photos(id) ON DELETE CASCADE,
+    position integer NOT NULL DEFAULT 0,
+    PRIMARY KEY (album_id, photo_id)
+);
+
+CREATE INDEX idx_albums_owner_id ON albums (owner_id);
+CREATE INDEX idx_albums_visibility_updated_at ON albums (visibility, updated_at DESC);
+CREATE INDEX idx_album_photos_position ON album_photos (album_id, position);
+CREATE INDEX idx_album_photos_photo_id ON album_photos (photo_id);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE album_photos;
+DROP TABLE albums;
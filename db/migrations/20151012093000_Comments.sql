@@ -0,0 +1,24 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE comments (
+    id SERIAL PRIMARY KEY,
+    photo_id integer NOT NULL REFERENCES photos(id) ON DELETE CASCADE,
+    parent_id integer NOT NULL DEFAULT 0,
+    owner_id integer NOT NULL REFERENCES users(id),
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    body text NOT NULL
+);
+
+CREATE INDEX idx_comments_photo_id ON comments (photo_id, parent_id, created_at);
+CREATE INDEX idx_comments_parent_id ON comments (parent_id);
+
+ALTER TABLE photos ADD COLUMN num_comments int DEFAULT 0;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE photos DROP COLUMN num_comments;
+DROP TABLE comments;
@@ -0,0 +1,21 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE favorites (
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    photo_id integer NOT NULL REFERENCES photos(id) ON DELETE CASCADE,
+    created_at timestamp with time zone,
+    PRIMARY KEY (user_id, photo_id)
+);
+
+CREATE INDEX idx_favorites_user_id_created_at ON favorites (user_id, created_at DESC);
+CREATE INDEX idx_favorites_photo_id ON favorites (photo_id);
+
+ALTER TABLE photos ADD COLUMN num_favorites int DEFAULT 0;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE photos DROP COLUMN num_favorites;
+DROP TABLE favorites;
@@ -0,0 +1,26 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE shares (
+    id SERIAL PRIMARY KEY,
+    owner_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    photo_id integer NOT NULL DEFAULT 0,
+    album_id integer NOT NULL DEFAULT 0,
+    created_at timestamp with time zone,
+    expires_at timestamp with time zone NULL,
+    max_views integer NOT NULL DEFAULT 0,
+    num_views integer NOT NULL DEFAULT 0,
+    token_hash VARCHAR(64) NOT NULL,
+    password text NOT NULL DEFAULT ''
+);
+
+CREATE UNIQUE INDEX idx_shares_token_hash ON shares (token_hash);
+CREATE INDEX idx_shares_owner_id ON shares (owner_id, created_at DESC);
+CREATE INDEX idx_shares_photo_id ON shares (photo_id);
+CREATE INDEX idx_shares_album_id ON shares (album_id);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE shares;
@@ -0,0 +1,16 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE photos ADD COLUMN latitude double precision NULL;
+ALTER TABLE photos ADD COLUMN longitude double precision NULL;
+
+CREATE INDEX idx_photos_location ON photos (latitude, longitude) WHERE latitude IS NOT NULL;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP INDEX idx_photos_location;
+
+ALTER TABLE photos DROP COLUMN longitude;
+ALTER TABLE photos DROP COLUMN latitude;
@@ -0,0 +1,126 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE tag_synonyms (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(200) NOT NULL,
+    tag_id integer NOT NULL REFERENCES tags(id) ON DELETE CASCADE
+);
+
+CREATE UNIQUE INDEX idx_tag_synonyms_name ON tag_synonyms (name);
+CREATE INDEX idx_tag_synonyms_tag_id ON tag_synonyms (tag_id);
+
+CREATE TABLE blocked_tags (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(200) NOT NULL,
+    created_at timestamp with time zone
+);
+
+CREATE UNIQUE INDEX idx_blocked_tags_name ON blocked_tags (name);
+
+-- returns the tag ID for a name or synonym, or NULL if not found
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION resolve_tag(name character varying) RETURNS bigint
+    LANGUAGE sql
+    AS $_$
+    SELECT COALESCE(
+        (SELECT tag_id FROM tag_synonyms WHERE name=LOWER($1)),
+        (SELECT id FROM tags WHERE name=LOWER($1)));
+$_$;
+-- +goose StatementEnd
+
+-- synonyms resolve to their tag, blocked tags return NULL
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION add_tag(name character varying) RETURNS bigint
+    LANGUAGE plpgsql
+    AS $$DECLARE
+tid BIGINT;
+BEGIN
+IF EXISTS (SELECT 1 FROM blocked_tags b WHERE b.name=add_tag.name) THEN
+    RETURN NULL;
+END IF;
+tid := resolve_tag(add_tag.name);
+IF tid IS NULL THEN
+    INSERT INTO tags (name) VALUES (add_tag.name) RETURNING id INTO tid;
+END IF;
+RETURN tid;
+END;$$;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION add_tags(pid bigint, VARIADIC names character varying[]) RETURNS void
+    LANGUAGE plpgsql
+    AS $$DECLARE
+tag VARCHAR(200);
+tid BIGINT;
+BEGIN
+DELETE FROM photo_tags WHERE photo_id=pid;
+FOREACH tag IN ARRAY names
+LOOP
+     tid := add_tag(tag);
+
+        IF tid IS NOT NULL AND (SELECT 1 FROM photo_tags WHERE photo_id=pid AND tag_id=tid) IS NULL THEN
+
+		INSERT INTO photo_tags(photo_id, tag_id) VALUES(pid, tid);
+        END IF;
+END LOOP;
+RETURN;
+END;$$;
+-- +goose StatementEnd
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION add_tags(pid bigint, VARIADIC names character varying[]) RETURNS void
+    LANGUAGE plpgsql
+    AS $$DECLARE
+tag VARCHAR(200);
+tid BIGINT;
+BEGIN
+DELETE FROM photo_tags WHERE photo_id=pid;
+FOREACH tag IN ARRAY names
+LOOP
+     tid := add_tag(tag);
+
+        IF (SELECT 1 FROM photo_tags WHERE photo_id=pid AND tag_id=tid) IS NULL THEN
+
+		INSERT INTO photo_tags(photo_id, tag_id) VALUES(pid, tid);
+        END IF;
+END LOOP;
+RETURN;
+END;$$;
+-- +goose StatementEnd
+
+DROP FUNCTION add_tag(character varying);
+
+-- +goose StatementBegin
+CREATE FUNCTION add_tag(name character varying) RETURNS bigint
+    LANGUAGE sql
+    AS $_$WITH s AS (
+    SELECT id
+    FROM tags
+    WHERE name=$1
+ ), i AS (
+INSERT INTO tags (name)
+SELECT $1
+WHERE NOT EXISTS (
+    (SELECT 1 FROM s)
+    )
+    RETURNING id
+    )
+    SELECT id
+    FROM i
+    UNION ALL
+    SELECT id
+    FROM s;
+$_$;
+-- +goose StatementEnd
+
+DROP FUNCTION resolve_tag(character varying);
+
+DROP TABLE blocked_tags;
+DROP TABLE tag_synonyms;
@@ -0,0 +1,84 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+-- number of public photos with the tag, kept up to date by triggers
+
+ALTER TABLE tags ADD COLUMN num_photos integer NOT NULL DEFAULT 0;
+
+UPDATE tags t SET num_photos = (
+    SELECT COUNT(*) FROM photo_tags pt
+    JOIN photos p ON p.id = pt.photo_id
+    WHERE pt.tag_id = t.id AND p.visibility = 'public');
+
+-- +goose StatementBegin
+CREATE FUNCTION photo_tags_num_photos() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$BEGIN
+IF TG_OP = 'INSERT' THEN
+    UPDATE tags SET num_photos = num_photos + 1
+    WHERE id = NEW.tag_id AND EXISTS (
+        SELECT 1 FROM photos WHERE id = NEW.photo_id AND visibility = 'public');
+    RETURN NEW;
+END IF;
+UPDATE tags SET num_photos = num_photos - 1
+WHERE id = OLD.tag_id AND EXISTS (
+    SELECT 1 FROM photos WHERE id = OLD.photo_id AND visibility = 'public');
+RETURN OLD;
+END;$$;
+-- +goose StatementEnd
+
+CREATE TRIGGER photo_tags_num_photos AFTER INSERT OR DELETE ON photo_tags
+    FOR EACH ROW EXECUTE PROCEDURE photo_tags_num_photos();
+
+-- photo_tags rows are deleted by cascade after the photo is gone, so we
+-- update the counts before the photo is deleted or when visibility changes
+
+-- +goose StatementBegin
+CREATE FUNCTION photos_num_photos() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$BEGIN
+IF TG_OP = 'DELETE' THEN
+    IF OLD.visibility = 'public' THEN
+        UPDATE tags SET num_photos = num_photos - 1
+        WHERE id IN (SELECT tag_id FROM photo_tags WHERE photo_id = OLD.id);
+    END IF;
+    RETURN OLD;
+END IF;
+IF (OLD.visibility = 'public') <> (NEW.visibility = 'public') THEN
+    UPDATE tags SET num_photos = num_photos + (CASE WHEN NEW.visibility = 'public' THEN 1 ELSE -1 END)
+    WHERE id IN (SELECT tag_id FROM photo_tags WHERE photo_id = NEW.id);
+END IF;
+RETURN NEW;
+END;$$;
+-- +goose StatementEnd
+
+CREATE TRIGGER photos_delete_num_photos BEFORE DELETE ON photos
+    FOR EACH ROW EXECUTE PROCEDURE photos_num_photos();
+
+CREATE TRIGGER photos_visibility_num_photos AFTER UPDATE OF visibility ON photos
+    FOR EACH ROW EXECUTE PROCEDURE photos_num_photos();
+
+-- prefix matches use the btree, fuzzy matches the trigram index
+
+CREATE INDEX idx_tags_name_prefix ON tags (name varchar_pattern_ops);
+CREATE INDEX idx_tags_name_trgm ON tags USING gin (name gin_trgm_ops);
+CREATE INDEX idx_tag_synonyms_name_prefix ON tag_synonyms (name varchar_pattern_ops);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP INDEX idx_tag_synonyms_name_prefix;
+DROP INDEX idx_tags_name_trgm;
+DROP INDEX idx_tags_name_prefix;
+
+DROP TRIGGER photos_visibility_num_photos ON photos;
+DROP TRIGGER photos_delete_num_photos ON photos;
+DROP TRIGGER photo_tags_num_photos ON photo_tags;
+
+DROP FUNCTION photos_num_photos();
+DROP FUNCTION photo_tags_num_photos();
+
+ALTER TABLE tags DROP COLUMN num_photos;
@@ -0,0 +1,59 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- tag names are full paths e.g. travel/europe/paris, with parent_id pointing
+-- to travel/europe, or 0 for top level tags
+
+ALTER TABLE tags ADD COLUMN parent_id integer NOT NULL DEFAULT 0;
+
+CREATE INDEX idx_tags_parent_id ON tags (parent_id);
+
+UPDATE tags c SET parent_id = p.id FROM tags p
+WHERE c.name LIKE '%/%' AND p.name = regexp_replace(c.name, '/[^/]*$', '');
+
+-- parents are created as needed
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION add_tag(name character varying) RETURNS bigint
+    LANGUAGE plpgsql
+    AS $$DECLARE
+tid BIGINT;
+pid BIGINT;
+BEGIN
+IF EXISTS (SELECT 1 FROM blocked_tags b WHERE b.name=add_tag.name) THEN
+    RETURN NULL;
+END IF;
+tid := resolve_tag(add_tag.name);
+IF tid IS NULL THEN
+    IF position('/' in add_tag.name) > 0 THEN
+        pid := add_tag(regexp_replace(add_tag.name, '/[^/]*$', ''));
+    END IF;
+    INSERT INTO tags (name, parent_id) VALUES (add_tag.name, COALESCE(pid, 0)) RETURNING id INTO tid;
+END IF;
+RETURN tid;
+END;$$;
+-- +goose StatementEnd
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION add_tag(name character varying) RETURNS bigint
+    LANGUAGE plpgsql
+    AS $$DECLARE
+tid BIGINT;
+BEGIN
+IF EXISTS (SELECT 1 FROM blocked_tags b WHERE b.name=add_tag.name) THEN
+    RETURN NULL;
+END IF;
+tid := resolve_tag(add_tag.name);
+IF tid IS NULL THEN
+    INSERT INTO tags (name) VALUES (add_tag.name) RETURNING id INTO tid;
+END IF;
+RETURN tid;
+END;$$;
+-- +goose StatementEnd
+
+DROP INDEX idx_tags_parent_id;
+ALTER TABLE tags DROP COLUMN parent_id;
@@ -0,0 +1,12 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- difference hash of the image for finding similar photos, 0 if unknown
+
+ALTER TABLE photos ADD COLUMN image_hash bigint NOT NULL DEFAULT 0;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE photos DROP COLUMN image_hash;
@@ -0,0 +1,142 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- photos in the trash have deleted_at set, and are purged after the retention period
+
+ALTER TABLE photos ADD COLUMN deleted_at timestamp with time zone NULL;
+
+CREATE INDEX idx_photos_deleted_at ON photos (deleted_at) WHERE deleted_at IS NOT NULL;
+
+-- trashed photos are not counted in tags
+
+CREATE OR REPLACE VIEW tag_counts AS
+ SELECT t.id, t.name, ( SELECT count(*) AS count
+           FROM photo_tags pt
+      JOIN photos p ON pt.photo_id = p.id
+          WHERE t.id = pt.tag_id AND p.visibility = 'public' AND p.deleted_at IS NULL) AS num_photos, ( SELECT p.photo
+           FROM photos p
+      JOIN photo_tags pt ON pt.photo_id = p.id
+     WHERE pt.tag_id = t.id AND p.visibility = 'public' AND p.deleted_at IS NULL
+     ORDER BY (p.up_votes - p.down_votes) DESC, p.created_at DESC
+    LIMIT 1) AS photo
+   FROM tags t
+  GROUP BY t.id
+ HAVING (( SELECT count(*) AS count
+           FROM photo_tags pt
+      JOIN photos p ON pt.photo_id = p.id
+          WHERE t.id = pt.tag_id AND p.visibility = 'public' AND p.deleted_at IS NULL)) > 0
+  ORDER BY ( SELECT count(*) AS count
+           FROM photo_tags pt
+      JOIN photos p ON pt.photo_id = p.id
+          WHERE t.id = pt.tag_id AND p.visibility = 'public' AND p.deleted_at IS NULL) DESC;
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION photo_tags_num_photos() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$BEGIN
+IF TG_OP = 'INSERT' THEN
+    UPDATE tags SET num_photos = num_photos + 1
+    WHERE id = NEW.tag_id AND EXISTS (
+        SELECT 1 FROM photos WHERE id = NEW.photo_id AND visibility = 'public' AND deleted_at IS NULL);
+    RETURN NEW;
+END IF;
+UPDATE tags SET num_photos = num_photos - 1
+WHERE id = OLD.tag_id AND EXISTS (
+    SELECT 1 FROM photos WHERE id = OLD.photo_id AND visibility = 'public' AND deleted_at IS NULL);
+RETURN OLD;
+END;$$;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION photos_num_photos() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$BEGIN
+IF TG_OP = 'DELETE' THEN
+    IF OLD.visibility = 'public' AND OLD.deleted_at IS NULL THEN
+        UPDATE tags SET num_photos = num_photos - 1
+        WHERE id IN (SELECT tag_id FROM photo_tags WHERE photo_id = OLD.id);
+    END IF;
+    RETURN OLD;
+END IF;
+IF (OLD.visibility = 'public' AND OLD.deleted_at IS NULL) <> (NEW.visibility = 'public' AND NEW.deleted_at IS NULL) THEN
+    UPDATE tags SET num_photos = num_photos +
+        (CASE WHEN NEW.visibility = 'public' AND NEW.deleted_at IS NULL THEN 1 ELSE -1 END)
+    WHERE id IN (SELECT tag_id FROM photo_tags WHERE photo_id = NEW.id);
+END IF;
+RETURN NEW;
+END;$$;
+-- +goose StatementEnd
+
+DROP TRIGGER photos_visibility_num_photos ON photos;
+
+CREATE TRIGGER photos_visibility_num_photos AFTER UPDATE OF visibility, deleted_at ON photos
+    FOR EACH ROW EXECUTE PROCEDURE photos_num_photos();
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TRIGGER photos_visibility_num_photos ON photos;
+
+CREATE TRIGGER photos_visibility_num_photos AFTER UPDATE OF visibility ON photos
+    FOR EACH ROW EXECUTE PROCEDURE photos_num_photos();
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION photos_num_photos() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$BEGIN
+IF TG_OP = 'DELETE' THEN
+    IF OLD.visibility = 'public' THEN
+        UPDATE tags SET num_photos = num_photos - 1
+        WHERE id IN (SELECT tag_id FROM photo_tags WHERE photo_id = OLD.id);
+    END IF;
+    RETURN OLD;
+END IF;
+IF (OLD.visibility = 'public') <> (NEW.visibility = 'public') THEN
+    UPDATE tags SET num_photos = num_photos + (CASE WHEN NEW.visibility = 'public' THEN 1 ELSE -1 END)
+    WHERE id IN (SELECT tag_id FROM photo_tags WHERE photo_id = NEW.id);
+END IF;
+RETURN NEW;
+END;$$;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION photo_tags_num_photos() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$BEGIN
+IF TG_OP = 'INSERT' THEN
+    UPDATE tags SET num_photos = num_photos + 1
+    WHERE id = NEW.tag_id AND EXISTS (
+        SELECT 1 FROM photos WHERE id = NEW.photo_id AND visibility = 'public');
+    RETURN NEW;
+END IF;
+UPDATE tags SET num_photos = num_photos - 1
+WHERE id = OLD.tag_id AND EXISTS (
+    SELECT 1 FROM photos WHERE id = OLD.photo_id AND visibility = 'public');
+RETURN OLD;
+END;$$;
+-- +goose StatementEnd
+
+CREATE OR REPLACE VIEW tag_counts AS
+ SELECT t.id, t.name, ( SELECT count(*) AS count
+           FROM photo_tags pt
+      JOIN photos p ON pt.photo_id = p.id
+          WHERE t.id = pt.tag_id AND p.visibility = 'public') AS num_photos, ( SELECT p.photo
+           FROM photos p
+      JOIN photo_tags pt ON pt.photo_id = p.id
+     WHERE pt.tag_id = t.id AND p.visibility = 'public'
+     ORDER BY (p.up_votes - p.down_votes) DESC, p.created_at DESC
+    LIMIT 1) AS photo
+   FROM tags t
+  GROUP BY t.id
+ HAVING (( SELECT count(*) AS count
+           FROM photo_tags pt
+      JOIN photos p ON pt.photo_id = p.id
+          WHERE t.id = pt.tag_id AND p.visibility = 'public')) > 0
+  ORDER BY ( SELECT count(*) AS count
+           FROM photo_tags pt
+      JOIN photos p ON pt.photo_id = p.id
+          WHERE t.id = pt.tag_id AND p.visibility = 'public') DESC;
+
+DROP INDEX idx_photos_deleted_at;
+ALTER TABLE photos DROP COLUMN deleted_at;
@@ -0,0 +1,16 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE photos ADD COLUMN description text NOT NULL DEFAULT '';
+ALTER TABLE photos ADD COLUMN description_html text NOT NULL DEFAULT '';
+
+CREATE INDEX idx_photos_description_trgm ON photos USING gin (UPPER(description) gin_trgm_ops);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP INDEX idx_photos_description_trgm;
+
+ALTER TABLE photos DROP COLUMN description_html;
+ALTER TABLE photos DROP COLUMN description;
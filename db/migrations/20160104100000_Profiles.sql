@@ -0,0 +1,21 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE users ADD COLUMN display_name text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN bio text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN website text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN avatar text NOT NULL DEFAULT '';
+
+-- profiles can be looked up by name, ignoring case
+CREATE INDEX idx_users_lower_name ON users (LOWER(name));
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP INDEX idx_users_lower_name;
+
+ALTER TABLE users DROP COLUMN avatar;
+ALTER TABLE users DROP COLUMN website;
+ALTER TABLE users DROP COLUMN bio;
+ALTER TABLE users DROP COLUMN display_name;
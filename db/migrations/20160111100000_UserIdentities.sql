@@ -0,0 +1,29 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- accounts with OAuth2 providers used to log in
+CREATE TABLE user_identities (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    provider varchar(30) NOT NULL,
+    provider_id text NOT NULL,
+    email text NOT NULL DEFAULT '',
+    created_at timestamp NOT NULL DEFAULT now(),
+    UNIQUE (provider, provider_id)
+);
+
+CREATE INDEX idx_user_identities_user_id ON user_identities (user_id);
+
+-- one-time codes exchanged by the client for a session token after OAuth2 login
+CREATE TABLE auth_codes (
+    code_hash varchar(64) PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    expires_at timestamp NOT NULL
+);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE auth_codes;
+DROP TABLE user_identities;
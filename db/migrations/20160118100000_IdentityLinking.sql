@@ -0,0 +1,30 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- changes to accounts, such as linking a login provider
+CREATE TABLE audit_log (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    actor_id integer NOT NULL DEFAULT 0,
+    action varchar(50) NOT NULL,
+    details text NOT NULL DEFAULT '',
+    ip_address varchar(50) NOT NULL DEFAULT '',
+    created_at timestamp NOT NULL DEFAULT now()
+);
+
+CREATE INDEX idx_audit_log_user_id ON audit_log (user_id, created_at DESC);
+
+-- codes with a provider account link the account to the user when exchanged
+ALTER TABLE auth_codes ADD COLUMN provider varchar(30) NOT NULL DEFAULT '';
+ALTER TABLE auth_codes ADD COLUMN provider_id text NOT NULL DEFAULT '';
+ALTER TABLE auth_codes ADD COLUMN email text NOT NULL DEFAULT '';
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE auth_codes DROP COLUMN email;
+ALTER TABLE auth_codes DROP COLUMN provider_id;
+ALTER TABLE auth_codes DROP COLUMN provider;
+
+DROP TABLE audit_log;
@@ -0,0 +1,26 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- a login on a device. The refresh token is replaced on each refresh; the previous
+-- token is kept to detect reuse of a stolen token.
+CREATE TABLE sessions (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    refresh_hash varchar(64) NOT NULL UNIQUE,
+    previous_hash varchar(64) NOT NULL DEFAULT '',
+    user_agent text NOT NULL DEFAULT '',
+    ip_address varchar(50) NOT NULL DEFAULT '',
+    created_at timestamp NOT NULL DEFAULT now(),
+    last_seen_at timestamp NOT NULL DEFAULT now(),
+    expires_at timestamp NOT NULL,
+    revoked_at timestamp NULL
+);
+
+CREATE INDEX idx_sessions_user_id ON sessions (user_id);
+CREATE INDEX idx_sessions_previous_hash ON sessions (previous_hash);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE sessions;
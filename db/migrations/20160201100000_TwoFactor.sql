@@ -0,0 +1,36 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- the secret is set on enrollment and only used once two-factor auth is enabled.
+-- The last step stops a code being used twice.
+ALTER TABLE users ADD COLUMN totp_secret varchar(64) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN totp_enabled boolean NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN totp_last_step bigint NOT NULL DEFAULT 0;
+
+CREATE TABLE recovery_codes (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash varchar(64) NOT NULL,
+    used_at timestamp NULL
+);
+
+CREATE INDEX idx_recovery_codes_user_id ON recovery_codes (user_id);
+
+-- issued when the password is correct, to be exchanged with a code for a session
+CREATE TABLE login_challenges (
+    token_hash varchar(64) PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    attempts integer NOT NULL DEFAULT 0,
+    expires_at timestamp NOT NULL
+);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE login_challenges;
+DROP TABLE recovery_codes;
+
+ALTER TABLE users DROP COLUMN totp_last_step;
+ALTER TABLE users DROP COLUMN totp_enabled;
+ALTER TABLE users DROP COLUMN totp_secret;
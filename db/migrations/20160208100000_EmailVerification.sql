@@ -0,0 +1,28 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE users ADD COLUMN email_verified boolean NOT NULL DEFAULT false;
+
+-- existing users keep the actions they already have: their addresses were accepted
+-- before verification existed
+UPDATE users SET email_verified = true;
+
+-- the email is the address to verify, which is a new address when the user
+-- changes their email. Old rows are kept for an hour to throttle resends.
+CREATE TABLE email_verifications (
+    token_hash varchar(64) PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    email text NOT NULL,
+    created_at timestamp NOT NULL DEFAULT now(),
+    expires_at timestamp NOT NULL
+);
+
+CREATE INDEX idx_email_verifications_user_id ON email_verifications (user_id, created_at);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE email_verifications;
+
+ALTER TABLE users DROP COLUMN email_verified;
@@ -0,0 +1,25 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- the selector finds the reset; only the hash of the verifier is stored
+CREATE TABLE password_resets (
+    selector varchar(16) PRIMARY KEY,
+    verifier_hash varchar(64) NOT NULL,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    attempts integer NOT NULL DEFAULT 0,
+    created_at timestamp NOT NULL DEFAULT now(),
+    expires_at timestamp NOT NULL
+);
+
+CREATE INDEX idx_password_resets_user_id ON password_resets (user_id);
+
+-- plaintext codes that never expired
+ALTER TABLE users DROP COLUMN recovery_code;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE users ADD COLUMN recovery_code VARCHAR(30) NULL;
+
+DROP TABLE password_resets;
@@ -0,0 +1,18 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- consecutive failed logins for an account or IP address, until a login succeeds
+CREATE TABLE login_failures (
+    login_key varchar(64) PRIMARY KEY,
+    failures integer NOT NULL DEFAULT 0,
+    last_failed_at timestamp NOT NULL,
+    previous_failed_at timestamp NOT NULL
+);
+
+CREATE INDEX idx_login_failures_last_failed_at ON login_failures (last_failed_at);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE login_failures;
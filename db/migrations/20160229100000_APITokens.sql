@@ -0,0 +1,25 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- long-lived tokens for scripts. Only the hash is stored, with a prefix to tell
+-- them apart. Scopes are separated by spaces.
+CREATE TABLE api_tokens (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name varchar(100) NOT NULL,
+    token_hash varchar(64) NOT NULL UNIQUE,
+    prefix varchar(12) NOT NULL,
+    scopes varchar(200) NOT NULL,
+    created_at timestamp NOT NULL DEFAULT now(),
+    last_used_at timestamp NULL,
+    last_used_ip varchar(45) NOT NULL DEFAULT '',
+    revoked_at timestamp NULL
+);
+
+CREATE INDEX idx_api_tokens_user_id ON api_tokens (user_id);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE api_tokens;
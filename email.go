@@ -154,6 +154,50 @@ func (m *mailer) sendResetPasswordMail(user *user, recoveryCode string, r *http.
 	return m.send(msg)
 }
 
+// lets the user know if someone else changed their password
+func (m *mailer) sendPasswordChangedMail(user *user, r *http.Request) error {
+	msg, err := m.messageFromTemplate(
+		"Your password has been changed",
+		[]string{user.Email},
+		m.defaultFromAddress,
+		"password_changed",
+		&struct {
+			Name string
+			URL  string
+		}{
+			user.Name,
+			getBaseURL(r),
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return m.send(msg)
+}
+
+// warns the user that their account was locked, with the address of the last attempt
+func (m *mailer) sendAccountLockedMail(user *user, ip string, r *http.Request) error {
+	msg, err := m.messageFromTemplate(
+		"Your account has been locked",
+		[]string{user.Email},
+		m.defaultFromAddress,
+		"account_locked",
+		&struct {
+			Name      string
+			IPAddress string
+			URL       string
+		}{
+			user.Name,
+			ip,
+			getBaseURL(r),
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return m.send(msg)
+}
+
 func (m *mailer) sendWelcomeMail(user *user) error {
 	msg, err := m.messageFromTemplate(
 		"Welcome to photoshare!",
@@ -167,3 +211,58 @@ func (m *mailer) sendWelcomeMail(user *user) error {
 	}
 	return m.send(msg)
 }
+
+// the email may be a new address the user is changing to
+func (m *mailer) sendVerificationMail(user *user, email, token string, isNew bool, r *http.Request) error {
+	subject := "Verify your email address"
+	if isNew {
+		subject = "Welcome to photoshare! Please verify your email address"
+	}
+	msg, err := m.messageFromTemplate(
+		subject,
+		[]string{email},
+		m.defaultFromAddress,
+		"verify_email",
+		&struct {
+			Name  string
+			IsNew bool
+			Token string
+			URL   string
+		}{
+			user.Name,
+			isNew,
+			token,
+			getBaseURL(r),
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return m.send(msg)
+}
+
+func (m *mailer) sendMentionMail(user *user, sender string, photo *photo, r *http.Request) error {
+	msg, err := m.messageFromTemplate(
+		fmt.Sprintf("%s mentioned you on photoshare", sender),
+		[]string{user.Email},
+		m.defaultFromAddress,
+		"mention",
+		&struct {
+			Name    string
+			Sender  string
+			Title   string
+			PhotoID int64
+			URL     string
+		}{
+			user.Name,
+			sender,
+			photo.Title,
+			photo.ID,
+			getBaseURL(r),
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return m.send(msg)
+}
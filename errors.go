@@ -20,6 +20,8 @@ func (h httpError) Error() string {
 	return h.Description
 }
 
+var errInvalidCursor = httpError{http.StatusBadRequest, "Invalid cursor"}
+
 func isErrSqlNoRows(err error) bool {
 	if err == sql.ErrNoRows {
 		return true
@@ -3,6 +3,7 @@ package photoshare
 import (
 	"fmt"
 	"github.com/gorilla/feeds"
+	"html"
 	"net/http"
 	"strconv"
 	"time"
@@ -43,6 +44,45 @@ func photoFeed(w http.ResponseWriter,
 	return nil
 }
 
+func albumsFeed(w http.ResponseWriter,
+	r *http.Request,
+	title string,
+	description string,
+	link string,
+	albums *albumList) error {
+
+	baseURL := getBaseURL(r)
+
+	feed := &feeds.Feed{
+		Title:       title,
+		Link:        &feeds.Link{Href: baseURL + link},
+		Description: description,
+		Created:     time.Now(),
+	}
+
+	for _, album := range albums.Items {
+
+		item := &feeds.Item{
+			Id:          strconv.FormatInt(album.ID, 10),
+			Title:       album.Title,
+			Link:        &feeds.Link{Href: fmt.Sprintf("%s/#/album/%d", baseURL, album.ID)},
+			Description: html.EscapeString(album.Description),
+			Created:     album.CreatedAt,
+		}
+		if album.Cover != "" {
+			item.Description = fmt.Sprintf("<img src=\"%s/uploads/thumbnails/%s\"><p>%s</p>",
+				baseURL, album.Cover, html.EscapeString(album.Description))
+		}
+		feed.Add(item)
+	}
+	atom, err := feed.ToAtom()
+	if err != nil {
+		return err
+	}
+	writeBody(w, []byte(atom), http.StatusOK, "application/atom+xml")
+	return nil
+}
+
 func latestFeed(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
 	photos, err := ctx.datamapper.getPhotos(newPage(1), "")
@@ -76,10 +116,34 @@ func ownerFeed(ctx *context, w http.ResponseWriter, r *http.Request) error {
 	description := "List of feeds for " + owner.Name
 	link := fmt.Sprintf("/owner/%d/%s", ownerID, owner.Name)
 
-	photos, err := ctx.datamapper.getPhotosByOwnerID(newPage(1), ownerID)
+	photos, err := ctx.datamapper.getPhotosByOwnerID(newPage(1), ownerID, ctx.user)
 
 	if err != nil {
 		return err
 	}
 	return photoFeed(w, r, title, description, link, photos)
 }
+
+func latestAlbumsFeed(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	albums, err := ctx.datamapper.getAlbums(newPage(1))
+
+	if err != nil {
+		return err
+	}
+
+	return albumsFeed(w, r, "Latest albums", "Most recently updated albums", "/albums", albums)
+}
+
+func albumFeed(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	album, err := ctx.datamapper.getAlbumDetail(newPage(1), ctx.params.getInt("id"), ctx.user, nil)
+	if err != nil {
+		return err
+	}
+
+	title := "Album: " + album.Title
+	link := fmt.Sprintf("/album/%d", album.ID)
+
+	return photoFeed(w, r, title, album.Description, link, album.Photos)
+}
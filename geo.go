@@ -0,0 +1,250 @@
+package photoshare
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	earthRadius    = 6371.0 // km
+	maxNearRadius  = 1000.0 // km
+	maxZoom        = 22
+	clusterMaxZoom = 16  // from this zoom level we return individual photos
+	maxGeoPhotos   = 500 // max photos returned for a bounding box
+)
+
+var (
+	errInvalidBoundingBox = httpError{http.StatusBadRequest, "Invalid bounding box"}
+	errInvalidZoom        = httpError{http.StatusBadRequest, "Invalid zoom level"}
+)
+
+// parses "minLon,minLat,maxLon,maxLat". If minLon > maxLon the box crosses the antimeridian.
+func parseBoundingBox(s string) (*geoBounds, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, errInvalidBoundingBox
+	}
+	values := make([]float64, 4)
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, errInvalidBoundingBox
+		}
+		values[i] = value
+	}
+	bounds := &geoBounds{values[0], values[1], values[2], values[3]}
+	if !isValidLongitude(bounds.MinLon) || !isValidLongitude(bounds.MaxLon) ||
+		!isValidLatitude(bounds.MinLat) || !isValidLatitude(bounds.MaxLat) ||
+		bounds.MinLat > bounds.MaxLat {
+		return nil, errInvalidBoundingBox
+	}
+	return bounds, nil
+}
+
+func isValidLatitude(lat float64) bool {
+	return lat >= -90 && lat <= 90
+}
+
+func isValidLongitude(lon float64) bool {
+	return lon >= -180 && lon <= 180
+}
+
+// size in degrees of the grid cells photos are clustered into, roughly 64px on a 256px tile
+func clusterCellSize(zoom int) float64 {
+	return 360.0 / (math.Pow(2, float64(zoom)) * 4)
+}
+
+// parses a "near:lat,lon,radius" search term, radius in km
+func parseNear(word string) (lat, lon, radius float64, ok bool) {
+	if !strings.HasPrefix(word, "near:") {
+		return
+	}
+	parts := strings.Split(word[5:], ",")
+	if len(parts) != 3 {
+		return
+	}
+	var err error
+	if lat, err = strconv.ParseFloat(parts[0], 64); err != nil || !isValidLatitude(lat) {
+		return
+	}
+	if lon, err = strconv.ParseFloat(parts[1], 64); err != nil || !isValidLongitude(lon) {
+		return
+	}
+	if radius, err = strconv.ParseFloat(parts[2], 64); err != nil || radius <= 0 || radius > maxNearRadius {
+		return
+	}
+	return lat, lon, radius, true
+}
+
+// reads the GPS position from the EXIF data of a JPEG, if any
+func readExifLocation(r io.Reader) (lat, lon float64, ok bool) {
+
+	var marker [2]byte
+	if _, err := io.ReadFull(r, marker[:]); err != nil || marker[0] != 0xFF || marker[1] != 0xD8 {
+		return
+	}
+
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil || hdr[0] != 0xFF {
+			return
+		}
+		// start of scan: no more metadata
+		if hdr[1] == 0xDA {
+			return
+		}
+		length := int64(binary.BigEndian.Uint16(hdr[2:])) - 2
+		if length < 0 {
+			return
+		}
+		if hdr[1] != 0xE1 {
+			if _, err := io.CopyN(ioutil.Discard, r, length); err != nil {
+				return
+			}
+			continue
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return
+		}
+		if bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return parseExifGPS(segment[6:])
+		}
+	}
+}
+
+// finds the GPS IFD in a TIFF structure and reads latitude and longitude
+func parseExifGPS(tiff []byte) (lat, lon float64, ok bool) {
+
+	if len(tiff) < 8 {
+		return
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return
+	}
+
+	// returns the offset of each IFD entry
+	entries := func(offset uint32) []uint32 {
+		if int(offset)+2 > len(tiff) {
+			return nil
+		}
+		count := int(order.Uint16(tiff[offset:]))
+		var result []uint32
+		for i := 0; i < count; i++ {
+			entry := offset + 2 + uint32(i*12)
+			if int(entry)+12 > len(tiff) {
+				break
+			}
+			result = append(result, entry)
+		}
+		return result
+	}
+
+	var gpsOffset uint32
+	for _, entry := range entries(order.Uint32(tiff[4:])) {
+		if order.Uint16(tiff[entry:]) == 0x8825 {
+			gpsOffset = order.Uint32(tiff[entry+8:])
+		}
+	}
+	if gpsOffset == 0 {
+		return
+	}
+
+	// degrees, minutes and seconds as 3 rationals
+	readCoord := func(entry uint32) (float64, bool) {
+		if order.Uint16(tiff[entry+2:]) != 5 || order.Uint32(tiff[entry+4:]) != 3 {
+			return 0, false
+		}
+		offset := int(order.Uint32(tiff[entry+8:]))
+		if offset+24 > len(tiff) {
+			return 0, false
+		}
+		var value float64
+		for i, unit := range []float64{1, 60, 3600} {
+			num := order.Uint32(tiff[offset+i*8:])
+			denom := order.Uint32(tiff[offset+i*8+4:])
+			if denom == 0 {
+				return 0, false
+			}
+			value += float64(num) / float64(denom) / unit
+		}
+		return value, true
+	}
+
+	var latRef, lonRef byte
+	var hasLat, hasLon bool
+
+	for _, entry := range entries(gpsOffset) {
+		switch order.Uint16(tiff[entry:]) {
+		case 1:
+			latRef = tiff[entry+8]
+		case 2:
+			lat, hasLat = readCoord(entry)
+		case 3:
+			lonRef = tiff[entry+8]
+		case 4:
+			lon, hasLon = readCoord(entry)
+		}
+	}
+
+	if !hasLat || !hasLon {
+		return 0, 0, false
+	}
+	if latRef == 'S' {
+		lat = -lat
+	}
+	if lonRef == 'W' {
+		lon = -lon
+	}
+	if !isValidLatitude(lat) || !isValidLongitude(lon) {
+		return 0, 0, false
+	}
+	return lat, lon, true
+}
+
+// returns public photos inside the bounding box, or clusters of photos if a zoom level is given
+func getGeoPhotos(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	bounds, err := parseBoundingBox(r.FormValue("bbox"))
+	if err != nil {
+		return err
+	}
+
+	zoom := maxZoom
+	if value := r.FormValue("zoom"); value != "" {
+		if zoom, err = strconv.Atoi(value); err != nil || zoom < 0 || zoom > maxZoom {
+			return errInvalidZoom
+		}
+	}
+
+	cacheKey := fmt.Sprintf("photos:geo:%s:zoom:%d", bounds, zoom)
+
+	return ctx.cache.render(w, http.StatusOK, cacheKey, func() (interface{}, error) {
+		if zoom >= clusterMaxZoom {
+			photos, err := ctx.datamapper.getPhotosInBounds(bounds, maxGeoPhotos)
+			if err != nil {
+				return nil, err
+			}
+			return &geoResult{Photos: photos}, nil
+		}
+		clusters, err := ctx.datamapper.getPhotoClusters(bounds, clusterCellSize(zoom))
+		if err != nil {
+			return nil, err
+		}
+		return &geoResult{Clusters: clusters}, nil
+	})
+}
@@ -0,0 +1,138 @@
+package photoshare
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// builds a minimal JPEG with an EXIF GPS IFD
+func makeExifJPEG(latRef byte, lat [3]uint32, lonRef byte, lon [3]uint32) []byte {
+
+	tiff := new(bytes.Buffer)
+	order := binary.LittleEndian
+	write := func(v interface{}) { binary.Write(tiff, order, v) }
+
+	tiff.WriteString("II")
+	write(uint16(42))
+	write(uint32(8))
+
+	// IFD0 at 8: a single entry pointing to the GPS IFD at 26
+	write(uint16(1))
+	write([]uint16{0x8825, 4})
+	write([]uint32{1, 26})
+	write(uint32(0))
+
+	// GPS IFD at 26: 4 entries, rationals start at 26 + 2 + 4*12 + 4 = 80
+	write(uint16(4))
+	write([]uint16{1, 2})
+	write(uint32(2))
+	tiff.Write([]byte{latRef, 0, 0, 0})
+	write([]uint16{2, 5})
+	write([]uint32{3, 80})
+	write([]uint16{3, 2})
+	write(uint32(2))
+	tiff.Write([]byte{lonRef, 0, 0, 0})
+	write([]uint16{4, 5})
+	write([]uint32{3, 104})
+	write(uint32(0))
+
+	for _, v := range append(lat[:], lon[:]...) {
+		write([]uint32{v, 1})
+	}
+
+	segment := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+
+	jpeg := new(bytes.Buffer)
+	jpeg.Write([]byte{0xFF, 0xD8})
+	// an unrelated segment before the EXIF data
+	jpeg.Write([]byte{0xFF, 0xE0, 0, 4, 0, 0})
+	jpeg.Write([]byte{0xFF, 0xE1})
+	binary.Write(jpeg, binary.BigEndian, uint16(len(segment)+2))
+	jpeg.Write(segment)
+	jpeg.Write([]byte{0xFF, 0xDA, 0, 2})
+	return jpeg.Bytes()
+}
+
+func TestReadExifLocation(t *testing.T) {
+	data := makeExifJPEG('N', [3]uint32{48, 51, 36}, 'E', [3]uint32{2, 17, 24})
+
+	lat, lon, ok := readExifLocation(bytes.NewReader(data))
+	if !ok {
+		t.Fatal("Location should be found")
+	}
+	if math.Abs(lat-48.86) > 0.0001 || math.Abs(lon-2.29) > 0.0001 {
+		t.Errorf("Wrong location %f,%f", lat, lon)
+	}
+
+	data = makeExifJPEG('S', [3]uint32{33, 51, 0}, 'W', [3]uint32{70, 30, 0})
+
+	lat, lon, ok = readExifLocation(bytes.NewReader(data))
+	if !ok || lat >= 0 || lon >= 0 {
+		t.Errorf("South and west should be negative, got %f,%f", lat, lon)
+	}
+}
+
+func TestReadExifLocationIfNone(t *testing.T) {
+	if _, _, ok := readExifLocation(bytes.NewReader([]byte{0xFF, 0xD8, 0xFF, 0xDA, 0, 2})); ok {
+		t.Error("JPEG without EXIF should have no location")
+	}
+	if _, _, ok := readExifLocation(bytes.NewReader([]byte("not a jpeg"))); ok {
+		t.Error("Non-JPEG should have no location")
+	}
+}
+
+func TestParseBoundingBox(t *testing.T) {
+	bounds, err := parseBoundingBox("-10.5,40,20,60")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bounds.MinLon != -10.5 || bounds.MaxLat != 60 || bounds.crossesAntimeridian() {
+		t.Errorf("Wrong bounds %s", bounds)
+	}
+
+	bounds, err = parseBoundingBox("170,-20,-170,20")
+	if err != nil || !bounds.crossesAntimeridian() {
+		t.Error("Bounds should cross the antimeridian")
+	}
+
+	for _, s := range []string{"", "1,2,3", "a,b,c,d", "0,80,10,100", "0,60,10,40"} {
+		if _, err := parseBoundingBox(s); err != errInvalidBoundingBox {
+			t.Errorf("%q should be invalid", s)
+		}
+	}
+}
+
+func TestParseNear(t *testing.T) {
+	lat, lon, radius, ok := parseNear("near:48.85,2.35,10")
+	if !ok || lat != 48.85 || lon != 2.35 || radius != 10 {
+		t.Error("Should parse near term")
+	}
+	for _, word := range []string{"paris", "near:48.85,2.35", "near:100,2.35,10", "near:48.85,2.35,0"} {
+		if _, _, _, ok := parseNear(word); ok {
+			t.Errorf("%q should not be a near term", word)
+		}
+	}
+}
+
+func TestPhotoValidateLocation(t *testing.T) {
+	photo := &photo{OwnerID: 1, Title: "test", Filename: "test.jpg"}
+	lat := 48.85
+	photo.Latitude = &lat
+
+	errors := make(map[string]string)
+	if err := photo.validate(nil, nil, errors); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := errors["location"]; !ok {
+		t.Error("Latitude without longitude should be invalid")
+	}
+
+	photo.setLocation(48.85, 200)
+	errors = make(map[string]string)
+	photo.validate(nil, nil, errors)
+	if _, ok := errors["location"]; !ok {
+		t.Error("Longitude out of range should be invalid")
+	}
+}
@@ -0,0 +1,130 @@
+package photoshare
+
+import (
+	"net/http"
+	"strings"
+)
+
+var errLastLoginMethod = httpError{http.StatusBadRequest, "You cannot remove your only way to log in. Set a password first."}
+
+// the provider accounts the user can log in with
+type identityList struct {
+	Identities  []userIdentity `json:"identities"`
+	Providers   []string       `json:"providers"`
+	HasPassword bool           `json:"hasPassword"`
+}
+
+func getIdentities(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	identities, err := ctx.datamapper.getUserIdentities(ctx.user.ID)
+	if err != nil {
+		return err
+	}
+
+	list := &identityList{
+		Identities:  identities,
+		Providers:   ctx.auth.providerNames(),
+		HasPassword: ctx.user.Password != "",
+	}
+	return renderJSON(w, list, http.StatusOK)
+}
+
+// starts the login with the provider. The callback returns the user to the client
+// with a code to confirm the link, so the account is only linked to a logged in user.
+func getLinkIdentityURL(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	url, err := ctx.auth.getRedirectURL(w, r, ctx.params.get("provider"), ctx.user.ID)
+	if err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, url)
+}
+
+func linkIdentity(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Code string `json:"code"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	var invalidCode = httpError{http.StatusBadRequest, "Invalid or expired code"}
+
+	if s.Code == "" {
+		return invalidCode
+	}
+
+	code, err := ctx.datamapper.useAuthCode(hashToken(s.Code))
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return invalidCode
+		}
+		return err
+	}
+
+	// the code must have been issued to this user to link an account
+	if !code.isLink() || code.UserID != ctx.user.ID {
+		return invalidCode
+	}
+
+	existing, err := ctx.datamapper.getUserByIdentity(code.Provider, code.ProviderID)
+	if err == nil {
+		if existing.ID == ctx.user.ID {
+			return httpError{http.StatusBadRequest, "This account is already linked"}
+		}
+		return httpError{http.StatusBadRequest, "This account is linked to another user"}
+	}
+	if !isErrSqlNoRows(err) {
+		return err
+	}
+
+	identity := &userIdentity{
+		UserID:     ctx.user.ID,
+		Provider:   code.Provider,
+		ProviderID: code.ProviderID,
+		Email:      strings.ToLower(code.Email),
+	}
+
+	entry := newAuditEntry(r, ctx.user.ID, ctx.user.ID, auditIdentityLinked, code.Provider)
+
+	if err := ctx.datamapper.createUserIdentity(identity, entry); err != nil {
+		return err
+	}
+	return renderJSON(w, identity, http.StatusCreated)
+}
+
+// Removes the provider account. Users without a password must keep at least
+// one account, otherwise they could no longer log in.
+func unlinkIdentity(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	identities, err := ctx.datamapper.getUserIdentities(ctx.user.ID)
+	if err != nil {
+		return err
+	}
+
+	var identity *userIdentity
+
+	for i := range identities {
+		if identities[i].ID == ctx.params.getInt("id") {
+			identity = &identities[i]
+		}
+	}
+
+	if identity == nil {
+		return httpError{http.StatusNotFound, "Account not found"}
+	}
+
+	// checked again when removed, in case another login method is removed meanwhile
+	if ctx.user.Password == "" && len(identities) == 1 {
+		return errLastLoginMethod
+	}
+
+	entry := newAuditEntry(r, ctx.user.ID, ctx.user.ID, auditIdentityUnlinked, identity.Provider)
+
+	if err := ctx.datamapper.removeUserIdentity(identity, entry); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Account removed")
+}
@@ -0,0 +1,239 @@
+package photoshare
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type identityDataMapper struct {
+	mockDataMapper
+	code       *authCode
+	identities []userIdentity
+	linkedTo   *user
+	created    *userIdentity
+	removed    *userIdentity
+	entry      *auditEntry
+}
+
+func (m *identityDataMapper) useAuthCode(_ string) (*authCode, error) {
+	if m.code == nil {
+		return nil, sql.ErrNoRows
+	}
+	return m.code, nil
+}
+
+func (m *identityDataMapper) getUserByIdentity(provider, providerID string) (*user, error) {
+	if m.linkedTo == nil {
+		return nil, sql.ErrNoRows
+	}
+	return m.linkedTo, nil
+}
+
+func (m *identityDataMapper) getUserIdentities(_ int64) ([]userIdentity, error) {
+	return m.identities, nil
+}
+
+func (m *identityDataMapper) createUserIdentity(identity *userIdentity, entry *auditEntry) error {
+	m.created = identity
+	m.entry = entry
+	return nil
+}
+
+func (m *identityDataMapper) removeUserIdentity(identity *userIdentity, entry *auditEntry) error {
+	m.removed = identity
+	m.entry = entry
+	return nil
+}
+
+func TestAuthCallbackLinksIdentity(t *testing.T) {
+
+	req, _ := http.NewRequest("GET", "http://localhost/api/auth/oauth2/google/callback/", nil)
+	res := httptest.NewRecorder()
+
+	datamapper := &oauthDataMapper{}
+
+	app := &app{
+		datamapper: datamapper,
+		auth:       &mockAuthenticator{&authInfo{id: "123", email: "Dan@example.com", linkUserID: 2}},
+	}
+
+	c := &context{
+		app:    app,
+		params: &params{map[string]string{"provider": "google"}},
+		user:   &user{},
+	}
+
+	if err := authCallback(c, res, req); err != nil {
+		t.Fatal(err)
+	}
+
+	if datamapper.created != nil {
+		t.Error("No user should be created when linking")
+	}
+	if !strings.HasPrefix(res.Header().Get("Location"), "/#/identities/?code=") {
+		t.Fatalf("Should redirect with code to confirm link, got %s", res.Header().Get("Location"))
+	}
+	code := datamapper.code
+	if !code.isLink() || code.UserID != 2 || code.ProviderID != "123" || code.Email != "dan@example.com" {
+		t.Error("Code should hold the account to link")
+	}
+}
+
+func TestExchangeAuthCodeIfLinkCode(t *testing.T) {
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/auth/oauth2/exchange", strings.NewReader(`{"code": "foo"}`))
+	res := httptest.NewRecorder()
+
+	app := &app{
+		datamapper: &identityDataMapper{code: &authCode{UserID: 2, Provider: "google", ProviderID: "123"}},
+	}
+
+	c := &context{
+		app:    app,
+		params: &params{make(map[string]string)},
+		user:   &user{},
+	}
+
+	err := exchangeAuthCode(c, res, req)
+	if err, ok := err.(httpError); !ok || err.Status != http.StatusBadRequest {
+		t.Error("Code for linking an account should not log in")
+	}
+}
+
+func TestLinkIdentity(t *testing.T) {
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/me/identities", strings.NewReader(`{"code": "foo"}`))
+	req.RemoteAddr = "10.0.0.1:4000"
+	res := httptest.NewRecorder()
+
+	datamapper := &identityDataMapper{code: &authCode{UserID: 2, Provider: "google", ProviderID: "123"}}
+
+	c := &context{
+		app:    &app{datamapper: datamapper},
+		params: &params{make(map[string]string)},
+		user:   &user{ID: 2, IsAuthenticated: true},
+	}
+
+	if err := linkIdentity(c, res, req); err != nil {
+		t.Fatal(err)
+	}
+	if res.Code != http.StatusCreated {
+		t.Errorf("Should return 201, got %d", res.Code)
+	}
+	if datamapper.created == nil || datamapper.created.UserID != 2 || datamapper.created.ProviderID != "123" {
+		t.Fatal("Account should be linked to the user")
+	}
+	if datamapper.entry.Action != auditIdentityLinked || datamapper.entry.IPAddress != "10.0.0.1" {
+		t.Error("Link should be recorded in the audit log")
+	}
+}
+
+func TestLinkIdentityIfCodeForAnotherUser(t *testing.T) {
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/me/identities", strings.NewReader(`{"code": "foo"}`))
+	res := httptest.NewRecorder()
+
+	datamapper := &identityDataMapper{code: &authCode{UserID: 3, Provider: "google", ProviderID: "123"}}
+
+	c := &context{
+		app:    &app{datamapper: datamapper},
+		params: &params{make(map[string]string)},
+		user:   &user{ID: 2, IsAuthenticated: true},
+	}
+
+	err := linkIdentity(c, res, req)
+	if err, ok := err.(httpError); !ok || err.Status != http.StatusBadRequest {
+		t.Error("Code issued to another user should be refused")
+	}
+	if datamapper.created != nil {
+		t.Error("Account should not be linked")
+	}
+}
+
+func TestLinkIdentityIfLinkedToAnotherUser(t *testing.T) {
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/me/identities", strings.NewReader(`{"code": "foo"}`))
+	res := httptest.NewRecorder()
+
+	datamapper := &identityDataMapper{
+		code:     &authCode{UserID: 2, Provider: "google", ProviderID: "123"},
+		linkedTo: &user{ID: 3},
+	}
+
+	c := &context{
+		app:    &app{datamapper: datamapper},
+		params: &params{make(map[string]string)},
+		user:   &user{ID: 2, IsAuthenticated: true},
+	}
+
+	err := linkIdentity(c, res, req)
+	if err, ok := err.(httpError); !ok || err.Status != http.StatusBadRequest {
+		t.Error("Account linked to another user should be refused")
+	}
+}
+
+func TestUnlinkIdentityIfOnlyLogin(t *testing.T) {
+
+	req, _ := http.NewRequest("DELETE", "http://localhost/api/me/identities/1", nil)
+	res := httptest.NewRecorder()
+
+	datamapper := &identityDataMapper{identities: []userIdentity{{ID: 1, UserID: 2, Provider: "google"}}}
+
+	c := &context{
+		app:    &app{datamapper: datamapper},
+		params: &params{map[string]string{"id": "1"}},
+		user:   &user{ID: 2, IsAuthenticated: true},
+	}
+
+	err := unlinkIdentity(c, res, req)
+	if err, ok := err.(httpError); !ok || err.Status != http.StatusBadRequest {
+		t.Error("Last login method should not be removed")
+	}
+	if datamapper.removed != nil {
+		t.Error("Account should not be unlinked")
+	}
+}
+
+func TestUnlinkIdentityIfHasPassword(t *testing.T) {
+
+	req, _ := http.NewRequest("DELETE", "http://localhost/api/me/identities/1", nil)
+	res := httptest.NewRecorder()
+
+	datamapper := &identityDataMapper{identities: []userIdentity{{ID: 1, UserID: 2, Provider: "google"}}}
+
+	c := &context{
+		app:    &app{datamapper: datamapper},
+		params: &params{map[string]string{"id": "1"}},
+		user:   &user{ID: 2, Password: "hashed", IsAuthenticated: true},
+	}
+
+	if err := unlinkIdentity(c, res, req); err != nil {
+		t.Fatal(err)
+	}
+	if datamapper.removed == nil || datamapper.removed.ID != 1 {
+		t.Fatal("Account should be unlinked")
+	}
+	if datamapper.entry.Action != auditIdentityUnlinked || datamapper.entry.Details != "google" {
+		t.Error("Unlink should be recorded in the audit log")
+	}
+}
+
+func TestUnlinkIdentityIfNotFound(t *testing.T) {
+
+	req, _ := http.NewRequest("DELETE", "http://localhost/api/me/identities/5", nil)
+	res := httptest.NewRecorder()
+
+	c := &context{
+		app:    &app{datamapper: &identityDataMapper{}},
+		params: &params{map[string]string{"id": "5"}},
+		user:   &user{ID: 2, Password: "hashed", IsAuthenticated: true},
+	}
+
+	err := unlinkIdentity(c, res, req)
+	if err, ok := err.(httpError); !ok || err.Status != http.StatusNotFound {
+		t.Error("Other users' accounts should not be found")
+	}
+}
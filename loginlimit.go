@@ -0,0 +1,297 @@
+package photoshare
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	loginFailureWindow = time.Hour * 24 // failures are forgotten after a day without one
+	loginBackoffBase   = time.Second
+	loginBackoffMax    = time.Minute * 15
+
+	accountFreeFailures = 3 // before each failure doubles the wait
+	accountMaxFailures  = 10
+	accountLockout      = time.Hour
+
+	// higher, as many users may share an address
+	ipFreeFailures = 20
+
+	emailLookupMaxAttempts = 30
+	emailLookupWindow      = time.Hour // lookups are forgotten after an hour without one
+)
+
+var (
+	errTooManyLogins       = httpError{http.StatusTooManyRequests, "Too many failed logins, please try again later"}
+	errTooManyEmailLookups = httpError{http.StatusTooManyRequests, "Too many requests, please try again later"}
+	errAccountLocked       = httpError{http.StatusTooManyRequests,
+		"This account has been locked after too many failed logins, please try again later or reset your password"}
+)
+
+// Stores failed logins by key. The datamapper keeps them in the database, so the
+// limits hold across servers.
+type loginAttemptStore interface {
+	// returns no failures if the key has none
+	getLoginFailures(string) (*loginFailures, error)
+	// adds a failure at the time, forgetting those before the second time
+	addLoginFailure(string, time.Time, time.Time) (*loginFailures, error)
+	clearLoginFailures(string) error
+}
+
+// the time left before another login is allowed, and whether it is a lockout.
+// A maxFailures of 0 never locks.
+func (f *loginFailures) wait(freeFailures, maxFailures int, now time.Time) (time.Duration, bool) {
+	if maxFailures > 0 && f.Failures >= maxFailures {
+		if wait := f.LastFailedAt.Add(accountLockout).Sub(now); wait > 0 {
+			return wait, true
+		}
+		return 0, false
+	}
+	return f.LastFailedAt.Add(loginBackoff(f.Failures, freeFailures)).Sub(now), false
+}
+
+func loginBackoff(failures, freeFailures int) time.Duration {
+	if failures < freeFailures {
+		return 0
+	}
+	n := uint(failures - freeFailures)
+	if n > 16 {
+		return loginBackoffMax
+	}
+	if backoff := loginBackoffBase << n; backoff < loginBackoffMax {
+		return backoff
+	}
+	return loginBackoffMax
+}
+
+func accountLoginKey(userID int64) string {
+	return "user:" + strconv.FormatInt(userID, 10)
+}
+
+func ipLoginKey(ip string) string {
+	return "ip:" + ip
+}
+
+func shareLoginKey(shareID int64) string {
+	return "share:" + strconv.FormatInt(shareID, 10)
+}
+
+func emailLookupKey(ip string) string {
+	return "lookup:" + ip
+}
+
+// Slows down password guessing. After a few failures each one doubles the wait
+// before the next login, for both the account and the IP address, and after too
+// many the account is locked for a while.
+type loginLimiter struct {
+	store loginAttemptStore
+}
+
+func newLoginLimiter(store loginAttemptStore) *loginLimiter {
+	return &loginLimiter{store}
+}
+
+// a login attempt, counted against the account before the password is checked
+type loginAttempt struct {
+	failures int // of the account, including this attempt
+	wait     time.Duration
+	locked   bool
+}
+
+// Counts the attempt as a failure of the account before the password is checked,
+// so concurrent guesses cannot all be checked before any of them is counted. The
+// attempt is allowed if the failures before it allow a login. A refused attempt
+// still counts, so retrying too soon makes the wait longer. The IP address is only
+// checked here, as logins to other accounts from it must not count against it.
+// The user ID is 0 if no account was found.
+func (l *loginLimiter) reserve(userID int64, ip string, now time.Time) (*loginAttempt, error) {
+	if userID == 0 {
+		return l.reserveKey("", 0, ip, now)
+	}
+	return l.reserveKey(accountLoginKey(userID), accountMaxFailures, ip, now)
+}
+
+// Counts an attempt at the password of a share, as reserve does for accounts.
+// Shares are never locked, as anyone with the link could lock them.
+func (l *loginLimiter) reserveShare(shareID int64, ip string, now time.Time) (*loginAttempt, error) {
+	return l.reserveKey(shareLoginKey(shareID), 0, ip, now)
+}
+
+// only checks the IP address if the key is empty
+func (l *loginLimiter) reserveKey(key string, maxFailures int, ip string, now time.Time) (*loginAttempt, error) {
+
+	f, err := l.store.getLoginFailures(ipLoginKey(ip))
+	if err != nil {
+		return nil, err
+	}
+	attempt := &loginAttempt{}
+	if attempt.wait, _ = f.wait(ipFreeFailures, 0, now); attempt.wait > 0 || key == "" {
+		return attempt, nil
+	}
+
+	if f, err = l.store.addLoginFailure(key, now, now.Add(-loginFailureWindow)); err != nil {
+		return nil, err
+	}
+	before := &loginFailures{Failures: f.Failures - 1, LastFailedAt: f.PreviousFailedAt}
+	attempt.failures = f.Failures
+	attempt.wait, attempt.locked = before.wait(accountFreeFailures, maxFailures, now)
+	return attempt, nil
+}
+
+// records a failure from the IP address, the account's was counted by reserve
+func (l *loginLimiter) fail(ip string, now time.Time) error {
+	_, err := l.store.addLoginFailure(ipLoginKey(ip), now, now.Add(-loginFailureWindow))
+	return err
+}
+
+// Clears the account's failures after a login or unlock. Failures from the IP
+// address are kept, so an attacker cannot clear them by logging in to their own
+// account.
+func (l *loginLimiter) reset(userID int64) error {
+	return l.store.clearLoginFailures(accountLoginKey(userID))
+}
+
+func (l *loginLimiter) resetShare(shareID int64) error {
+	return l.store.clearLoginFailures(shareLoginKey(shareID))
+}
+
+// Counts a lookup of whether an email address is taken, returning true if the IP
+// address has made too many. Every lookup counts, as each one tells whether there
+// is an account for the address.
+func (l *loginLimiter) lookup(ip string, now time.Time) (bool, error) {
+	f, err := l.store.addLoginFailure(emailLookupKey(ip), now, now.Add(-emailLookupWindow))
+	if err != nil {
+		return false, err
+	}
+	return f.Failures > emailLookupMaxAttempts, nil
+}
+
+// keeps failures in memory, for tests
+type memoryLoginAttemptStore struct {
+	mutex    sync.Mutex
+	failures map[string]loginFailures
+}
+
+func newMemoryLoginAttemptStore() *memoryLoginAttemptStore {
+	return &memoryLoginAttemptStore{failures: make(map[string]loginFailures)}
+}
+
+func (s *memoryLoginAttemptStore) getLoginFailures(key string) (*loginFailures, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	f, ok := s.failures[key]
+	if !ok {
+		f = loginFailures{Key: key}
+	}
+	return &f, nil
+}
+
+func (s *memoryLoginAttemptStore) addLoginFailure(key string, now, since time.Time) (*loginFailures, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	f := s.failures[key]
+	if f.LastFailedAt.Before(since) {
+		f.Failures = 0
+	}
+	f.Key = key
+	f.Failures++
+	f.PreviousFailedAt = f.LastFailedAt
+	f.LastFailedAt = now
+	s.failures[key] = f
+	return &f, nil
+}
+
+func (s *memoryLoginAttemptStore) clearLoginFailures(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.failures, key)
+	return nil
+}
+
+// Counts the login attempt against the account, refusing it if the account or IP
+// address must wait and telling the client how long. The attempt is cleared by
+// resetting the limiter when the login succeeds.
+func reserveLogin(ctx *context, w http.ResponseWriter, r *http.Request, userID int64) (*loginAttempt, error) {
+
+	attempt, err := ctx.limiter.reserve(userID, getRemoteIP(r), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if err := refuseLoginAttempt(w, attempt); err != nil {
+		return nil, err
+	}
+	return attempt, nil
+}
+
+// returns an error if the attempt must wait, telling the client how long
+func refuseLoginAttempt(w http.ResponseWriter, attempt *loginAttempt) error {
+	if attempt.wait <= 0 {
+		return nil
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(attempt.wait/time.Second)+1))
+	if attempt.locked {
+		return errAccountLocked
+	}
+	return errTooManyLogins
+}
+
+func checkEmailLookupLimit(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	tooMany, err := ctx.limiter.lookup(getRemoteIP(r), time.Now())
+	if err != nil {
+		return err
+	}
+	if !tooMany {
+		return nil
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(emailLookupWindow/time.Second)))
+	return errTooManyEmailLookups
+}
+
+// Records a failed password or two-factor code. If the attempt has locked the
+// account the user is emailed, as someone else may be trying to log in as them.
+func failLogin(ctx *context, r *http.Request, user *user, attempt *loginAttempt) error {
+
+	ip := getRemoteIP(r)
+
+	if err := ctx.limiter.fail(ip, time.Now()); err != nil {
+		return err
+	}
+	if attempt.failures != accountMaxFailures {
+		return nil
+	}
+
+	if err := ctx.datamapper.addAuditEntry(newAuditEntry(r, user.ID, 0, auditAccountLocked, ip)); err != nil {
+		return err
+	}
+
+	go func() {
+		if err := ctx.mailer.sendAccountLockedMail(user, ip, r); err != nil {
+			logError(err)
+		}
+	}()
+
+	return nil
+}
+
+// lets an admin unlock an account before the lockout ends
+func unlockUser(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	user, err := ctx.datamapper.getActiveUser(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.limiter.reset(user.ID); err != nil {
+		return err
+	}
+	if err := ctx.datamapper.addAuditEntry(newAuditEntry(r, user.ID, ctx.user.ID, auditAccountUnlocked, "")); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Account unlocked")
+}
@@ -0,0 +1,204 @@
+package photoshare
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type loginDataMapper struct {
+	mockDataMapper
+	user  *user
+	entry *auditEntry
+}
+
+func (m *loginDataMapper) getUserByNameOrEmail(identifier string) (*user, error) {
+	if identifier != m.user.Name {
+		return nil, sql.ErrNoRows
+	}
+	return m.user, nil
+}
+
+func (m *loginDataMapper) getActiveUser(userID int64) (*user, error) {
+	if userID != m.user.ID {
+		return nil, sql.ErrNoRows
+	}
+	return m.user, nil
+}
+
+func (m *loginDataMapper) addAuditEntry(entry *auditEntry) error {
+	m.entry = entry
+	return nil
+}
+
+func newLoginUser() *user {
+	u := &user{ID: 1, Name: "tester", Email: "tester@example.com", Password: "test", IsActive: true}
+	u.encryptPassword()
+	return u
+}
+
+func TestLoginBackoff(t *testing.T) {
+
+	if loginBackoff(accountFreeFailures-1, accountFreeFailures) != 0 {
+		t.Error("First failures should not wait")
+	}
+	if loginBackoff(accountFreeFailures, accountFreeFailures) != loginBackoffBase {
+		t.Error("Backoff should start at the base")
+	}
+	if loginBackoff(accountFreeFailures+3, accountFreeFailures) != loginBackoffBase*8 {
+		t.Error("Backoff should double on each failure")
+	}
+	if loginBackoff(1000, accountFreeFailures) != loginBackoffMax {
+		t.Error("Backoff should be capped")
+	}
+}
+
+func TestLoginLimiterLocksAccount(t *testing.T) {
+
+	limiter := newLoginLimiter(newMemoryLoginAttemptStore())
+	now := time.Now()
+
+	for i := 1; i <= accountMaxFailures; i++ {
+		// waits out the backoff before each attempt
+		now = now.Add(loginBackoffMax)
+		attempt, err := limiter.reserve(1, "127.0.0.1", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempt.wait > 0 || attempt.failures != i {
+			t.Fatalf("Attempt %d should be allowed, got %+v", i, attempt)
+		}
+	}
+
+	attempt, err := limiter.reserve(1, "127.0.0.1", now.Add(time.Minute*30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !attempt.locked || attempt.wait != time.Minute*30 {
+		t.Errorf("Account should be locked for another 30 minutes, got %v", attempt.wait)
+	}
+
+	if attempt, _ := limiter.reserve(2, "127.0.0.1", now.Add(time.Minute)); attempt.wait > 0 {
+		t.Error("Other accounts from the address should not wait")
+	}
+
+	if err := limiter.reset(1); err != nil {
+		t.Fatal(err)
+	}
+	if attempt, _ := limiter.reserve(1, "127.0.0.1", now.Add(time.Minute)); attempt.wait > 0 || attempt.locked {
+		t.Error("Account should be unlocked")
+	}
+}
+
+func TestLoginLimiterCountsConcurrentAttempts(t *testing.T) {
+
+	limiter := newLoginLimiter(newMemoryLoginAttemptStore())
+	now := time.Now()
+
+	// all started before any password is checked
+	for i := 0; i < accountFreeFailures; i++ {
+		if attempt, _ := limiter.reserve(1, "127.0.0.1", now); attempt.wait > 0 {
+			t.Fatalf("First attempts should not wait, got %v", attempt.wait)
+		}
+	}
+	if attempt, _ := limiter.reserve(1, "127.0.0.1", now); attempt.wait != loginBackoffBase {
+		t.Errorf("Attempt should wait while the others are checked, got %v", attempt.wait)
+	}
+}
+
+func TestLoginLimiterForgetsOldFailures(t *testing.T) {
+
+	store := newMemoryLoginAttemptStore()
+	limiter := newLoginLimiter(store)
+	now := time.Now()
+
+	for i := 0; i < accountMaxFailures-1; i++ {
+		limiter.reserve(1, "127.0.0.1", now)
+	}
+
+	later := now.Add(loginFailureWindow + time.Minute)
+	if attempt, _ := limiter.reserve(1, "127.0.0.1", later); attempt.wait > 0 || attempt.failures != 1 {
+		t.Errorf("Old failures should be forgotten, got %+v", attempt)
+	}
+}
+
+func TestLoginIfTooManyFailures(t *testing.T) {
+
+	datamapper := &loginDataMapper{user: newLoginUser()}
+	c := newTestContext(datamapper, &user{})
+
+	for i := 0; i < accountFreeFailures; i++ {
+		req, _ := http.NewRequest("POST", "http://localhost/api/auth/", strings.NewReader(`{"identifier": "tester", "password": "wrong"}`))
+		err := login(c, httptest.NewRecorder(), req)
+		if err, ok := err.(httpError); !ok || err.Status != http.StatusBadRequest {
+			t.Fatalf("Wrong password should be refused, got %v", err)
+		}
+	}
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/auth/", strings.NewReader(`{"identifier": "tester", "password": "test"}`))
+	res := httptest.NewRecorder()
+
+	if err := login(c, res, req); err != errTooManyLogins {
+		t.Fatalf("Login should wait after too many failures, got %v", err)
+	}
+	if res.Header().Get("Retry-After") == "" {
+		t.Error("Client should be told when to retry")
+	}
+}
+
+func TestLoginIfAccountLocked(t *testing.T) {
+
+	store := newMemoryLoginAttemptStore()
+	store.failures[accountLoginKey(1)] = loginFailures{
+		Key:          accountLoginKey(1),
+		Failures:     accountMaxFailures - 1,
+		LastFailedAt: time.Now().Add(-time.Hour),
+	}
+
+	datamapper := &loginDataMapper{user: newLoginUser()}
+	c := newTestContext(datamapper, &user{})
+	c.limiter = newLoginLimiter(store)
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/auth/", strings.NewReader(`{"identifier": "tester", "password": "wrong"}`))
+	if err := login(c, httptest.NewRecorder(), req); err == nil {
+		t.Fatal("Wrong password should be refused")
+	}
+	if datamapper.entry == nil || datamapper.entry.Action != auditAccountLocked {
+		t.Error("Lockout should be recorded in the audit log")
+	}
+
+	req, _ = http.NewRequest("POST", "http://localhost/api/auth/", strings.NewReader(`{"identifier": "tester", "password": "test"}`))
+	if err := login(c, httptest.NewRecorder(), req); err != errAccountLocked {
+		t.Errorf("Locked account should not log in with the right password, got %v", err)
+	}
+}
+
+func TestUnlockUser(t *testing.T) {
+
+	store := newMemoryLoginAttemptStore()
+	limiter := newLoginLimiter(store)
+	for i := 0; i < accountMaxFailures; i++ {
+		limiter.reserve(1, "127.0.0.1", time.Now())
+	}
+
+	datamapper := &loginDataMapper{user: newLoginUser()}
+	c := newTestContext(datamapper, &user{})
+	c.limiter = newLoginLimiter(store)
+	c.user = &user{ID: 2, IsAdmin: true}
+	c.params.vars["id"] = "1"
+
+	req, _ := http.NewRequest("DELETE", "http://localhost/api/users/1/lockout", nil)
+
+	if err := unlockUser(c, httptest.NewRecorder(), req); err != nil {
+		t.Fatal(err)
+	}
+	if attempt, _ := limiter.reserve(1, "127.0.0.1", time.Now()); attempt.wait > 0 || attempt.locked {
+		t.Error("Account should be unlocked")
+	}
+	if datamapper.entry == nil || datamapper.entry.Action != auditAccountUnlocked || datamapper.entry.ActorID != 2 {
+		t.Error("Unlock should be recorded in the audit log")
+	}
+}
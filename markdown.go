@@ -0,0 +1,175 @@
+package photoshare
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const maxDescriptionLength = 5000
+
+var (
+	inlineMarkdownRegex = regexp.MustCompile("`([^`]+)`" +
+		`|\*\*([^*]+)\*\*` +
+		`|\*([^*\s][^*]*)\*` +
+		`|\[([^\]]+)\]\(([^)\s]+)\)` +
+		`|(^|[^\w@])@(\w(?:[\w.-]*\w)?)` +
+		`|(^|[^\w&#/])#(\w(?:[\w/-]*\w)?)`)
+
+	allowedLinkSchemes = map[string]bool{"http": true, "https": true, "mailto": true}
+)
+
+// Renders a safe subset of Markdown to HTML: paragraphs, line breaks, lists,
+// quotes, strong, emphasis, code and links. Raw HTML is always escaped.
+// Mentions of known users are linked to their pages and hashtags to tag searches.
+type markdown struct {
+	users    map[string]user
+	mentions []string
+	hashtags []string
+}
+
+// users are the mentioned users that should be linked
+func newMarkdown(users []user) *markdown {
+	md := &markdown{users: make(map[string]user)}
+	for _, user := range users {
+		md.users[strings.ToLower(user.Name)] = user
+	}
+	return md
+}
+
+func markdownBlockType(line string) string {
+	switch {
+	case line == "":
+		return ""
+	case strings.HasPrefix(line, "- ") || strings.HasPrefix(line, "* "):
+		return "li"
+	case strings.HasPrefix(line, ">"):
+		return "blockquote"
+	}
+	return "p"
+}
+
+// renders the source, collecting the mentions and hashtags found outside code
+func (md *markdown) render(src string) string {
+
+	md.mentions, md.hashtags = nil, nil
+
+	var (
+		b     = &bytes.Buffer{}
+		lines = strings.Split(strings.Replace(src, "\r\n", "\n", -1), "\n")
+	)
+
+	for i := 0; i < len(lines); {
+
+		kind := markdownBlockType(strings.TrimSpace(lines[i]))
+		if kind == "" {
+			i++
+			continue
+		}
+
+		var block []string
+		for ; i < len(lines); i++ {
+			line := strings.TrimSpace(lines[i])
+			if markdownBlockType(line) != kind {
+				break
+			}
+			switch kind {
+			case "li":
+				line = line[2:]
+			case "blockquote":
+				line = strings.TrimPrefix(line, ">")
+			}
+			block = append(block, md.inline(strings.TrimSpace(line)))
+		}
+
+		switch kind {
+		case "li":
+			b.WriteString("<ul><li>" + strings.Join(block, "</li><li>") + "</li></ul>")
+		case "blockquote":
+			b.WriteString("<blockquote><p>" + strings.Join(block, "<br>") + "</p></blockquote>")
+		default:
+			b.WriteString("<p>" + strings.Join(block, "<br>") + "</p>")
+		}
+	}
+	return b.String()
+}
+
+func (md *markdown) inline(text string) string {
+
+	var (
+		b    = &bytes.Buffer{}
+		last = 0
+	)
+
+	for _, m := range inlineMarkdownRegex.FindAllStringSubmatchIndex(text, -1) {
+
+		group := func(n int) string {
+			if m[n*2] < 0 {
+				return ""
+			}
+			return text[m[n*2]:m[n*2+1]]
+		}
+
+		b.WriteString(html.EscapeString(text[last:m[0]]))
+		last = m[1]
+
+		switch {
+		case m[2] >= 0:
+			b.WriteString("<code>" + html.EscapeString(group(1)) + "</code>")
+		case m[4] >= 0:
+			b.WriteString("<strong>" + md.inline(group(2)) + "</strong>")
+		case m[6] >= 0:
+			b.WriteString("<em>" + md.inline(group(3)) + "</em>")
+		case m[8] >= 0:
+			b.WriteString(md.link(group(4), group(5), text[m[0]:m[1]]))
+		case m[14] >= 0:
+			b.WriteString(html.EscapeString(group(6)) + md.mention(group(7)))
+		default:
+			b.WriteString(html.EscapeString(group(8)) + md.hashtag(group(9)))
+		}
+	}
+
+	b.WriteString(html.EscapeString(text[last:]))
+	return b.String()
+}
+
+// links with unsafe schemes such as javascript: are left as text
+func (md *markdown) link(text, href, src string) string {
+	u, err := url.Parse(href)
+	if err != nil || !allowedLinkSchemes[strings.ToLower(u.Scheme)] {
+		return html.EscapeString(src)
+	}
+	return fmt.Sprintf(`<a href="%s" rel="nofollow">%s</a>`, html.EscapeString(href), html.EscapeString(text))
+}
+
+func (md *markdown) mention(name string) string {
+	md.mentions = appendUnique(md.mentions, strings.ToLower(name))
+	user, ok := md.users[strings.ToLower(name)]
+	if !ok {
+		return html.EscapeString("@" + name)
+	}
+	return fmt.Sprintf(`<a href="/#/user/%d/%s" class="mention">@%s</a>`,
+		user.ID, url.QueryEscape(user.Name), html.EscapeString(name))
+}
+
+func (md *markdown) hashtag(name string) string {
+	tag := normalizeTag(name)
+	if validateTagName(tag) != "" {
+		return html.EscapeString("#" + name)
+	}
+	md.hashtags = appendUnique(md.hashtags, tag)
+	return fmt.Sprintf(`<a href="/#/search/?q=%s" class="hashtag">#%s</a>`,
+		url.QueryEscape("#"+tag), html.EscapeString(name))
+}
+
+func appendUnique(items []string, item string) []string {
+	for _, existing := range items {
+		if existing == item {
+			return items
+		}
+	}
+	return append(items, item)
+}
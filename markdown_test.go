@@ -0,0 +1,69 @@
+package photoshare
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMarkdownEscapesHTML(t *testing.T) {
+	md := newMarkdown(nil)
+	result := md.render(`<script>alert("hi")</script> **<b>bold</b>**`)
+	expected := "<p>&lt;script&gt;alert(&#34;hi&#34;)&lt;/script&gt; <strong>&lt;b&gt;bold&lt;/b&gt;</strong></p>"
+	if result != expected {
+		t.Errorf("Expected %s, got %s", expected, result)
+	}
+}
+
+func TestMarkdownInline(t *testing.T) {
+	md := newMarkdown(nil)
+	result := md.render("**bold** *em* `x *y*` [site](https://example.com/?a=1&b=2)")
+	expected := `<p><strong>bold</strong> <em>em</em> <code>x *y*</code> ` +
+		`<a href="https://example.com/?a=1&amp;b=2" rel="nofollow">site</a></p>`
+	if result != expected {
+		t.Errorf("Expected %s, got %s", expected, result)
+	}
+}
+
+func TestMarkdownUnsafeLink(t *testing.T) {
+	md := newMarkdown(nil)
+	result := md.render("[click](javascript:alert(1))")
+	if strings.Contains(result, "<a") {
+		t.Errorf("Unsafe link should not be rendered, got %s", result)
+	}
+}
+
+func TestMarkdownBlocks(t *testing.T) {
+	md := newMarkdown(nil)
+	result := md.render("first\nline\n\n- one\n- two\n\n> quoted")
+	expected := "<p>first<br>line</p><ul><li>one</li><li>two</li></ul><blockquote><p>quoted</p></blockquote>"
+	if result != expected {
+		t.Errorf("Expected %s, got %s", expected, result)
+	}
+}
+
+func TestMarkdownMentions(t *testing.T) {
+	md := newMarkdown([]user{{ID: 3, Name: "Danjac"}})
+	result := md.render("Taken by @danjac with @nobody, mail me@example.com `@ignored`")
+
+	if !strings.Contains(result, `<a href="/#/user/3/Danjac" class="mention">@danjac</a>`) {
+		t.Errorf("Mention of existing user should be linked, got %s", result)
+	}
+	if !strings.Contains(result, "with @nobody,") {
+		t.Errorf("Mention of unknown user should be left as text, got %s", result)
+	}
+	if len(md.mentions) != 2 || md.mentions[0] != "danjac" || md.mentions[1] != "nobody" {
+		t.Errorf("Mentions should not include emails or code, got %v", md.mentions)
+	}
+}
+
+func TestMarkdownHashtags(t *testing.T) {
+	md := newMarkdown(nil)
+	result := md.render("Sunset #Beach #travel/Spain and #beach again, see page#anchor")
+
+	if !strings.Contains(result, `<a href="/#/search/?q=%23beach" class="hashtag">#Beach</a>`) {
+		t.Errorf("Hashtag should link to search, got %s", result)
+	}
+	if len(md.hashtags) != 2 || md.hashtags[0] != "beach" || md.hashtags[1] != "travel/spain" {
+		t.Errorf("Hashtags should be normalized without duplicates, got %v", md.hashtags)
+	}
+}
@@ -0,0 +1,86 @@
+package photoshare
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/dchest/uniuri"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const mediaURLExpiry = 60 // minutes
+
+// Private photos are not under the public directory, so we hand out signed,
+// expiring links to those allowed to see them.
+type mediaSigner struct {
+	secret []byte
+}
+
+func newMediaSigner(cfg *config) *mediaSigner {
+	secret := cfg.MediaSecret
+	if secret == "" {
+		log.Println("WARNING: MEDIA_SECRET not set, private photo links will not survive a restart")
+		secret = uniuri.NewLen(64)
+	}
+	return &mediaSigner{[]byte(secret)}
+}
+
+func (m *mediaSigner) signature(kind, filename string, expires int64) string {
+	mac := hmac.New(sha256.New, m.secret)
+	fmt.Fprintf(mac, "%s/%s:%d", kind, filename, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (m *mediaSigner) signURL(kind, filename string) string {
+	expires := time.Now().Add(time.Minute * mediaURLExpiry).Unix()
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	q.Set("sig", m.signature(kind, filename, expires))
+	return fmt.Sprintf("/media/%s/%s?%s", kind, filename, q.Encode())
+}
+
+func (m *mediaSigner) verify(kind, filename, expires, sig string) bool {
+	timestamp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > timestamp {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(m.signature(kind, filename, timestamp)))
+}
+
+// sets signed URLs on private and trashed photos. Public and unlisted photos are served from /uploads/.
+func (m *mediaSigner) sign(photo *photo) {
+	if !photo.isHidden() {
+		return
+	}
+	photo.MediaURL = m.signURL("originals", photo.Filename)
+	photo.ThumbnailURL = m.signURL("thumbnails", photo.Filename)
+}
+
+func (m *mediaSigner) signList(photos *photoList) {
+	if photos == nil {
+		return
+	}
+	for i := range photos.Items {
+		m.sign(&photos.Items[i])
+	}
+}
+
+// serves private photos from signed URLs
+func serveMedia(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	kind := ctx.params.get("kind")
+	filename := ctx.params.get("filename")
+
+	if !ctx.media.verify(kind, filename, r.FormValue("expires"), r.FormValue("sig")) {
+		return httpError{http.StatusForbidden, "Invalid or expired link"}
+	}
+
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	http.ServeFile(w, r, ctx.filestore.path(filename, kind == "thumbnails", true))
+	return nil
+}
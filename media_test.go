@@ -0,0 +1,50 @@
+package photoshare
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMediaSignURL(t *testing.T) {
+	m := &mediaSigner{[]byte("secret")}
+
+	signed, err := url.Parse(m.signURL("thumbnails", "test.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signed.Path != "/media/thumbnails/test.jpg" {
+		t.Errorf("Invalid path %s", signed.Path)
+	}
+
+	expires, sig := signed.Query().Get("expires"), signed.Query().Get("sig")
+
+	if !m.verify("thumbnails", "test.jpg", expires, sig) {
+		t.Error("Signature should be valid")
+	}
+	if m.verify("originals", "test.jpg", expires, sig) {
+		t.Error("Signature should not be valid for another kind")
+	}
+	if m.verify("thumbnails", "other.jpg", expires, sig) {
+		t.Error("Signature should not be valid for another file")
+	}
+	if m.verify("thumbnails", "test.jpg", "1", m.signature("thumbnails", "test.jpg", 1)) {
+		t.Error("Signature should have expired")
+	}
+}
+
+func TestMediaSignPrivateOnly(t *testing.T) {
+	m := &mediaSigner{[]byte("secret")}
+
+	photo := &photo{Filename: "test.jpg", Visibility: visibilityPublic}
+	m.sign(photo)
+	if photo.ThumbnailURL != "" {
+		t.Error("Public photos should not be signed")
+	}
+
+	photo.Visibility = visibilityPrivate
+	m.sign(photo)
+	if !strings.HasPrefix(photo.ThumbnailURL, "/media/thumbnails/test.jpg?") {
+		t.Error("Private photos should be signed")
+	}
+}
@@ -1,22 +1,39 @@
 package photoshare
 
 import (
-	"bytes"
 	"code.google.com/p/go.crypto/bcrypt"
-	"crypto/rand"
-	"database/sql"
+	"fmt"
 	"github.com/coopernurse/gorp"
 	"math"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const (
-	pageSize               = 20
-	recoveryCodeLength     = 30
-	recoveryCodeCharacters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	pageSize         = 20
+	shareTokenLength = 32
+	tagSeparator     = "/"
 )
 
+// visibility settings
+
+const (
+	visibilityPublic   = "public"   // listed everywhere
+	visibilityUnlisted = "unlisted" // anyone with the link, but not listed
+	visibilityPrivate  = "private"  // owner and admins only
+)
+
+func isValidVisibility(visibility string) bool {
+	switch visibility {
+	case visibilityPublic, visibilityUnlisted, visibilityPrivate:
+		return true
+	}
+	return false
+}
+
 type photoList struct {
 	Items       []photo `json:"photos"`
 	Total       int64   `json:"total"`
@@ -36,29 +53,181 @@ func newPhotoList(photos []photo, total int64, page int64) *photoList {
 }
 
 type tag struct {
-	ID   int64  `db:"id" json:"id"`
-	Name string `db:"name" json:"name"`
+	ID        int64  `db:"id" json:"id"`
+	ParentID  int64  `db:"parent_id" json:"parentId"`
+	Name      string `db:"name" json:"name"`
+	NumPhotos int64  `db:"num_photos" json:"numPhotos"`
+}
+
+// a tag in the tag tree. Label is the last part of the name.
+type tagNode struct {
+	ID        int64      `json:"id"`
+	Name      string     `json:"name"`
+	Label     string     `json:"label"`
+	NumPhotos int64      `json:"numPhotos"`
+	Children  []*tagNode `json:"children,omitempty"`
+}
+
+// Builds the tag tree, leaving out branches without any photos. Tags should be ordered by name.
+func newTagTree(tags []tag) []*tagNode {
+
+	var (
+		nodes    = make(map[int64]*tagNode)
+		children = make(map[int64][]*tagNode)
+	)
+
+	for _, tag := range tags {
+		nodes[tag.ID] = &tagNode{
+			ID:        tag.ID,
+			Name:      tag.Name,
+			Label:     tag.Name[strings.LastIndex(tag.Name, tagSeparator)+1:],
+			NumPhotos: tag.NumPhotos,
+		}
+	}
+
+	for _, tag := range tags {
+		parentID := tag.ParentID
+		if _, ok := nodes[parentID]; !ok || parentID == tag.ID {
+			parentID = 0
+		}
+		children[parentID] = append(children[parentID], nodes[tag.ID])
+	}
+
+	var prune func(int64) []*tagNode
+	prune = func(parentID int64) []*tagNode {
+		var result []*tagNode
+		for _, node := range children[parentID] {
+			node.Children = prune(node.ID)
+			if node.NumPhotos > 0 || len(node.Children) > 0 {
+				result = append(result, node)
+			}
+		}
+		return result
+	}
+	return prune(0)
+}
+
+// NumUses is the number of the user's own photos with the tag
+type tagSuggestion struct {
+	tag
+	NumUses int64 `db:"num_uses" json:"numUses"`
+}
+
+// tags are stored lowercase, without surrounding whitespace. Hierarchical
+// tags are separated by "/" e.g. travel/europe/paris.
+func normalizeTag(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !strings.Contains(name, tagSeparator) {
+		return name
+	}
+	var parts []string
+	for _, part := range strings.Split(name, tagSeparator) {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, tagSeparator)
+}
+
+// returns the name of the parent tag, or an empty string for top level tags
+func parentTagName(name string) string {
+	if i := strings.LastIndex(name, tagSeparator); i >= 0 {
+		return name[:i]
+	}
+	return ""
+}
+
+func isDescendantTag(name, ancestor string) bool {
+	return strings.HasPrefix(name, ancestor+tagSeparator)
+}
+
+func validateTagName(name string) string {
+	if name == "" {
+		return "Name is missing"
+	}
+	if len(name) > 200 {
+		return "Name is too long"
+	}
+	if strings.ContainsAny(name, " \t\n") {
+		return "Name cannot contain spaces"
+	}
+	return ""
+}
+
+// another name for a tag, resolved when photos are tagged or searched
+type tagSynonym struct {
+	ID      int64  `db:"id" json:"id"`
+	Name    string `db:"name" json:"name"`
+	TagID   int64  `db:"tag_id" json:"tagId"`
+	TagName string `db:"tag_name" json:"tagName"`
+}
+
+func (synonym *tagSynonym) validate(ctx *context, r *http.Request, errors map[string]string) error {
+	if msg := validateTagName(synonym.Name); msg != "" {
+		errors["name"] = msg
+	}
+	if synonym.TagID == 0 {
+		errors["tagId"] = "Tag is missing"
+	}
+	if synonym.Name == synonym.TagName {
+		errors["name"] = "Synonym cannot be the same as the tag"
+	}
+	return nil
+}
+
+// tags nobody is allowed to use
+type blockedTag struct {
+	ID        int64     `db:"id" json:"id"`
+	Name      string    `db:"name" json:"name"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+func (blocked *blockedTag) PreInsert(s gorp.SqlExecutor) error {
+	blocked.CreatedAt = time.Now()
+	return nil
+}
+
+func (blocked *blockedTag) validate(ctx *context, r *http.Request, errors map[string]string) error {
+	if msg := validateTagName(blocked.Name); msg != "" {
+		errors["name"] = msg
+	}
+	return nil
 }
 
 type tagCount struct {
+	ID        int64  `db:"id" json:"id"`
 	Name      string `db:"name" json:"name"`
 	Photo     string `db:"photo" json:"photo"`
 	NumPhotos int64  `db:"num_photos" json:"numPhotos"`
 }
 
 type photo struct {
-	ID        int64     `db:"id" json:"id"`
-	OwnerID   int64     `db:"owner_id" json:"ownerId"`
-	CreatedAt time.Time `db:"created_at" json:"createdAt"`
-	Title     string    `db:"title" json:"title"`
-	Filename  string    `db:"photo" json:"photo"`
-	Tags      []string  `db:"-" json:"tags,omitempty"`
-	UpVotes   int64     `db:"up_votes" json:"upVotes"`
-	DownVotes int64     `db:"down_votes" json:"downVotes"`
+	ID              int64      `db:"id" json:"id"`
+	OwnerID         int64      `db:"owner_id" json:"ownerId"`
+	CreatedAt       time.Time  `db:"created_at" json:"createdAt"`
+	Title           string     `db:"title" json:"title"`
+	Description     string     `db:"description" json:"description,omitempty"`
+	DescriptionHTML string     `db:"description_html" json:"descriptionHtml,omitempty"`
+	Filename        string     `db:"photo" json:"photo"`
+	Tags            []string   `db:"-" json:"tags,omitempty"`
+	UpVotes         int64      `db:"up_votes" json:"upVotes"`
+	DownVotes       int64      `db:"down_votes" json:"downVotes"`
+	NumComments     int64      `db:"num_comments" json:"numComments"`
+	NumFavorites    int64      `db:"num_favorites" json:"numFavorites"`
+	Visibility      string     `db:"visibility" json:"visibility"`
+	Latitude        *float64   `db:"latitude" json:"latitude,omitempty"`
+	Longitude       *float64   `db:"longitude" json:"longitude,omitempty"`
+	ImageHash       int64      `db:"image_hash" json:"-"`
+	DeletedAt       *time.Time `db:"deleted_at" json:"deletedAt,omitempty"`
+	MediaURL        string     `db:"-" json:"mediaUrl,omitempty"`
+	ThumbnailURL    string     `db:"-" json:"thumbnailUrl,omitempty"`
 }
 
 func (photo *photo) PreInsert(s gorp.SqlExecutor) error {
 	photo.CreatedAt = time.Now()
+	if photo.Visibility == "" {
+		photo.Visibility = visibilityPublic
+	}
 	return nil
 }
 
@@ -72,12 +241,58 @@ func (photo *photo) validate(ctx *context, r *http.Request, errors map[string]st
 	if len(photo.Title) > 200 {
 		errors["title"] = "Title is too long"
 	}
+	if len(photo.Description) > maxDescriptionLength {
+		errors["description"] = "Description is too long"
+	}
 	if photo.Filename == "" {
 		errors["photo"] = "Photo filename not set"
 	}
+	if photo.Visibility != "" && !isValidVisibility(photo.Visibility) {
+		errors["visibility"] = "Invalid visibility"
+	}
+	if (photo.Latitude == nil) != (photo.Longitude == nil) {
+		errors["location"] = "Both latitude and longitude are required"
+	} else if photo.hasLocation() &&
+		(!isValidLatitude(*photo.Latitude) || !isValidLongitude(*photo.Longitude)) {
+		errors["location"] = "Invalid location"
+	}
 	return nil
 }
 
+func (photo *photo) hasLocation() bool {
+	return photo.Latitude != nil && photo.Longitude != nil
+}
+
+func (photo *photo) setLocation(lat, lon float64) {
+	photo.Latitude = &lat
+	photo.Longitude = &lon
+}
+
+func (photo *photo) isPrivate() bool {
+	return photo.Visibility == visibilityPrivate
+}
+
+func (photo *photo) isTrashed() bool {
+	return photo.DeletedAt != nil
+}
+
+// files of hidden photos are kept outside the public directory
+func (photo *photo) isHidden() bool {
+	return photo.isPrivate() || photo.isTrashed()
+}
+
+// photos can be restored from the trash until the retention period is over
+func (photo *photo) canRestore(user *user, retention time.Duration) bool {
+	return photo.isTrashed() && photo.canEdit(user) && time.Since(*photo.DeletedAt) < retention
+}
+
+func (photo *photo) canView(user *user) bool {
+	if !photo.isPrivate() {
+		return true
+	}
+	return photo.canEdit(user)
+}
+
 func (photo *photo) canEdit(user *user) bool {
 	if user == nil || !user.IsAuthenticated {
 		return false
@@ -90,7 +305,7 @@ func (photo *photo) canDelete(user *user) bool {
 }
 
 func (photo *photo) canVote(user *user) bool {
-	if user == nil || !user.IsAuthenticated {
+	if user == nil || !user.IsAuthenticated || !photo.canView(user) {
 		return false
 	}
 	if photo.OwnerID == user.ID {
@@ -100,30 +315,397 @@ func (photo *photo) canVote(user *user) bool {
 	return !user.hasVoted(photo.ID)
 }
 
+func (photo *photo) canFavorite(user *user) bool {
+	return user != nil && user.IsAuthenticated && photo.canView(user)
+}
+
+const (
+	bulkAddTags       = "add_tags"
+	bulkRemoveTags    = "remove_tags"
+	bulkSetVisibility = "set_visibility"
+	bulkMoveToAlbum   = "move_to_album"
+	bulkDelete        = "delete"
+
+	maxBulkPhotos = 500
+)
+
+// an operation applied to many photos at once
+type bulkOperation struct {
+	IDs        []int64  `json:"ids"`
+	Op         string   `json:"op"`
+	Tags       []string `json:"tags"`
+	Visibility string   `json:"visibility"`
+	AlbumID    int64    `json:"albumId"`
+}
+
+func (op *bulkOperation) isTagOp() bool {
+	return op.Op == bulkAddTags || op.Op == bulkRemoveTags
+}
+
+// removes invalid and duplicate tag names
+func (op *bulkOperation) cleanTags() {
+	var (
+		names []string
+		added = make(map[string]bool)
+	)
+	for _, name := range op.Tags {
+		if name = normalizeTag(name); name != "" && !added[name] && validateTagName(name) == "" {
+			added[name] = true
+			names = append(names, name)
+		}
+	}
+	op.Tags = names
+}
+
+func (op *bulkOperation) validate(ctx *context, r *http.Request, errors map[string]string) error {
+	if len(op.IDs) == 0 {
+		errors["ids"] = "No photos selected"
+	}
+	if len(op.IDs) > maxBulkPhotos {
+		errors["ids"] = fmt.Sprintf("No more than %d photos can be changed at once", maxBulkPhotos)
+	}
+	switch op.Op {
+	case bulkAddTags, bulkRemoveTags:
+		if len(op.Tags) == 0 {
+			errors["tags"] = "No valid tags"
+		}
+	case bulkSetVisibility:
+		if !isValidVisibility(op.Visibility) {
+			errors["visibility"] = "Invalid visibility"
+		}
+	case bulkMoveToAlbum:
+		if op.AlbumID == 0 {
+			errors["albumId"] = "Album is missing"
+		}
+	case bulkDelete:
+	default:
+		errors["op"] = "Invalid operation"
+	}
+	return nil
+}
+
+// the outcome of a bulk operation for a single photo
+type bulkResult struct {
+	ID     int64  `json:"id"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type bulkReport struct {
+	Results    []bulkResult `json:"results"`
+	NumUpdated int          `json:"numUpdated"`
+}
+
 type permissions struct {
-	Edit   bool `json:"edit"`
-	Delete bool `json:"delete"`
-	Vote   bool `json:"vote"`
+	Edit     bool `json:"edit"`
+	Delete   bool `json:"delete"`
+	Vote     bool `json:"vote"`
+	Favorite bool `json:"favorite"`
 }
 
 type photoDetail struct {
 	photo       `db:"-"`
 	OwnerName   string       `db:"owner_name" json:"ownerName"`
+	Favorited   bool         `db:"favorited" json:"favorited"`
 	Permissions *permissions `db:"-" json:"perms"`
 }
 
+const maxCommentLength = 2000
+
+type comment struct {
+	ID        int64     `db:"id" json:"id"`
+	PhotoID   int64     `db:"photo_id" json:"photoId"`
+	ParentID  int64     `db:"parent_id" json:"parentId"` // 0 if top-level comment
+	OwnerID   int64     `db:"owner_id" json:"ownerId"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+	UpdatedAt time.Time `db:"updated_at" json:"updatedAt"`
+	Body      string    `db:"body" json:"body"`
+}
+
+func (comment *comment) PreInsert(s gorp.SqlExecutor) error {
+	comment.CreatedAt = time.Now()
+	comment.UpdatedAt = comment.CreatedAt
+	return nil
+}
+
+func (comment *comment) PreUpdate(s gorp.SqlExecutor) error {
+	comment.UpdatedAt = time.Now()
+	return nil
+}
+
+func (comment *comment) validate(ctx *context, r *http.Request, errors map[string]string) error {
+	if comment.OwnerID == 0 {
+		errors["ownerID"] = "Owner ID is missing"
+	}
+	if comment.PhotoID == 0 {
+		errors["photoID"] = "Photo ID is missing"
+	}
+	if strings.TrimSpace(comment.Body) == "" {
+		errors["body"] = "Comment is empty"
+	}
+	if len(comment.Body) > maxCommentLength {
+		errors["body"] = "Comment is too long"
+	}
+	return nil
+}
+
+func (comment *comment) canEdit(user *user) bool {
+	if user == nil || !user.IsAuthenticated {
+		return false
+	}
+	return user.IsAdmin || comment.OwnerID == user.ID
+}
+
+func (comment *comment) canDelete(user *user) bool {
+	return comment.canEdit(user)
+}
+
+type commentDetail struct {
+	comment     `db:"-"`
+	OwnerName   string          `db:"owner_name" json:"ownerName"`
+	Replies     []commentDetail `db:"-" json:"replies,omitempty"`
+	Permissions *permissions    `db:"-" json:"perms"`
+}
+
+type commentList struct {
+	Items       []commentDetail `json:"comments"`
+	Total       int64           `json:"total"`
+	CurrentPage int64           `json:"currentPage"`
+	NumPages    int64           `json:"numPages"`
+}
+
+func newCommentList(comments []commentDetail, total int64, page int64) *commentList {
+	numPages := int64(math.Ceil(float64(total) / float64(pageSize)))
+
+	return &commentList{
+		Items:       comments,
+		Total:       total,
+		CurrentPage: page,
+		NumPages:    numPages,
+	}
+}
+
+// Share links give people without an account read access to a photo or album
+type share struct {
+	ID          int64      `db:"id" json:"id"`
+	OwnerID     int64      `db:"owner_id" json:"ownerId"`
+	PhotoID     int64      `db:"photo_id" json:"photoId"`
+	AlbumID     int64      `db:"album_id" json:"albumId"`
+	CreatedAt   time.Time  `db:"created_at" json:"createdAt"`
+	ExpiresAt   *time.Time `db:"expires_at" json:"expiresAt"`
+	MaxViews    int64      `db:"max_views" json:"maxViews"` // 0 if unlimited
+	NumViews    int64      `db:"num_views" json:"numViews"`
+	TokenHash   string     `db:"token_hash" json:"-"`
+	Password    string     `db:"password" json:"-"`
+	HasPassword bool       `db:"-" json:"hasPassword"`
+}
+
+func (share *share) PreInsert(s gorp.SqlExecutor) error {
+	share.CreatedAt = time.Now()
+	share.HasPassword = share.Password != ""
+	if share.HasPassword {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(share.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		share.Password = string(hashed)
+	}
+	return nil
+}
+
+func (share *share) PostGet(s gorp.SqlExecutor) error {
+	share.HasPassword = share.Password != ""
+	return nil
+}
+
+func (share *share) validate(ctx *context, r *http.Request, errors map[string]string) error {
+	if share.OwnerID == 0 {
+		errors["ownerID"] = "Owner ID is missing"
+	}
+	if (share.PhotoID == 0) == (share.AlbumID == 0) {
+		errors["photoID"] = "Share must be for either a photo or an album"
+	}
+	if share.ExpiresAt != nil && share.ExpiresAt.Before(time.Now()) {
+		errors["expiresAt"] = "Expiry date is in the past"
+	}
+	if share.MaxViews < 0 {
+		errors["maxViews"] = "Invalid number of views"
+	}
+	return nil
+}
+
+// generates a new token; only the hash is stored so the token must be shown to the user now
+func (share *share) generateToken() (string, error) {
+	token, err := generateRandomString(shareTokenLength)
+	if err != nil {
+		return "", err
+	}
+	share.TokenHash = hashToken(token)
+	return token, nil
+}
+
+func (share *share) isExpired() bool {
+	if share.ExpiresAt != nil && share.ExpiresAt.Before(time.Now()) {
+		return true
+	}
+	return share.MaxViews > 0 && share.NumViews >= share.MaxViews
+}
+
+func (share *share) checkPassword(password string) bool {
+	if share.Password == "" {
+		return true
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(share.Password), []byte(password))
+	return err == nil
+}
+
+func (share *share) canDelete(user *user) bool {
+	if user == nil || !user.IsAuthenticated {
+		return false
+	}
+	return user.IsAdmin || share.OwnerID == user.ID
+}
+
+// a nil share grants nothing
+func (share *share) grantsPhoto(photoID int64) bool {
+	return share != nil && share.PhotoID != 0 && share.PhotoID == photoID
+}
+
+func (share *share) grantsAlbum(albumID int64) bool {
+	return share != nil && share.AlbumID != 0 && share.AlbumID == albumID
+}
+
+type shareList struct {
+	Items       []share `json:"shares"`
+	Total       int64   `json:"total"`
+	CurrentPage int64   `json:"currentPage"`
+	NumPages    int64   `json:"numPages"`
+}
+
+func newShareList(shares []share, total int64, page int64) *shareList {
+	numPages := int64(math.Ceil(float64(total) / float64(pageSize)))
+
+	return &shareList{
+		Items:       shares,
+		Total:       total,
+		CurrentPage: page,
+		NumPages:    numPages,
+	}
+}
+
+type album struct {
+	ID           int64     `db:"id" json:"id"`
+	OwnerID      int64     `db:"owner_id" json:"ownerId"`
+	CreatedAt    time.Time `db:"created_at" json:"createdAt"`
+	UpdatedAt    time.Time `db:"updated_at" json:"updatedAt"`
+	Title        string    `db:"title" json:"title"`
+	Description  string    `db:"description" json:"description"`
+	CoverPhotoID int64     `db:"cover_photo_id" json:"coverPhotoId"`
+	Visibility   string    `db:"visibility" json:"visibility"`
+}
+
+func (album *album) PreInsert(s gorp.SqlExecutor) error {
+	album.CreatedAt = time.Now()
+	album.UpdatedAt = album.CreatedAt
+	if album.Visibility == "" {
+		album.Visibility = visibilityPublic
+	}
+	return nil
+}
+
+func (album *album) PreUpdate(s gorp.SqlExecutor) error {
+	album.UpdatedAt = time.Now()
+	return nil
+}
+
+func (album *album) validate(ctx *context, r *http.Request, errors map[string]string) error {
+	if album.OwnerID == 0 {
+		errors["ownerID"] = "Owner ID is missing"
+	}
+	if album.Title == "" {
+		errors["title"] = "Title is missing"
+	}
+	if len(album.Title) > 200 {
+		errors["title"] = "Title is too long"
+	}
+	if len(album.Description) > 2000 {
+		errors["description"] = "Description is too long"
+	}
+	if !isValidVisibility(album.Visibility) {
+		errors["visibility"] = "Invalid visibility"
+	}
+	return nil
+}
+
+func (album *album) canEdit(user *user) bool {
+	if user == nil || !user.IsAuthenticated {
+		return false
+	}
+	return user.IsAdmin || album.OwnerID == user.ID
+}
+
+func (album *album) canDelete(user *user) bool {
+	return album.canEdit(user)
+}
+
+func (album *album) canView(user *user) bool {
+	if album.Visibility != visibilityPrivate {
+		return true
+	}
+	return album.canEdit(user)
+}
+
+type albumSummary struct {
+	album     `db:"-"`
+	Cover     string `db:"cover" json:"cover"`
+	NumPhotos int64  `db:"num_photos" json:"numPhotos"`
+}
+
+type albumList struct {
+	Items       []albumSummary `json:"albums"`
+	Total       int64          `json:"total"`
+	CurrentPage int64          `json:"currentPage"`
+	NumPages    int64          `json:"numPages"`
+}
+
+func newAlbumList(albums []albumSummary, total int64, page int64) *albumList {
+	numPages := int64(math.Ceil(float64(total) / float64(pageSize)))
+
+	return &albumList{
+		Items:       albums,
+		Total:       total,
+		CurrentPage: page,
+		NumPages:    numPages,
+	}
+}
+
+type albumDetail struct {
+	albumSummary `db:"-"`
+	OwnerName    string       `db:"owner_name" json:"ownerName"`
+	Photos       *photoList   `db:"-" json:"photos"`
+	Permissions  *permissions `db:"-" json:"perms"`
+}
+
 // User represents users in database
 type user struct {
-	ID              int64          `db:"id" json:"id"`
-	CreatedAt       time.Time      `db:"created_at" json:"createdAt"`
-	Name            string         `db:"name" json:"name"`
-	Password        string         `db:"password" json:""`
-	Email           string         `db:"email" json:"email"`
-	Votes           string         `db:"votes" json:""`
-	IsAdmin         bool           `db:"admin" json:"isAdmin"`
-	IsActive        bool           `db:"active" json:"isActive"`
-	RecoveryCode    sql.NullString `db:"recovery_code" json:""`
-	IsAuthenticated bool           `db:"-" json:"isAuthenticated"`
+	ID              int64     `db:"id" json:"id"`
+	CreatedAt       time.Time `db:"created_at" json:"createdAt"`
+	Name            string    `db:"name" json:"name"`
+	Password        string    `db:"password" json:""`
+	Email           string    `db:"email" json:"email"`
+	EmailVerified   bool      `db:"email_verified" json:"emailVerified"`
+	Votes           string    `db:"votes" json:""`
+	IsAdmin         bool      `db:"admin" json:"isAdmin"`
+	IsActive        bool      `db:"active" json:"isActive"`
+	DisplayName     string    `db:"display_name" json:"displayName"`
+	Bio             string    `db:"bio" json:"bio"`
+	Website         string    `db:"website" json:"website"`
+	Avatar          string    `db:"avatar" json:"avatar"`
+	TOTPSecret      string    `db:"totp_secret" json:"-"`
+	TOTPEnabled     bool      `db:"totp_enabled" json:"twoFactorEnabled"`
+	TOTPLastStep    int64     `db:"totp_last_step" json:"-"`
+	IsAuthenticated bool      `db:"-" json:"isAuthenticated"`
+	SessionID       int64     `db:"-" json:"-"`
 }
 
 // PreInsert hook
@@ -172,30 +754,11 @@ func (user *user) validate(ctx *context, r *http.Request, errors map[string]stri
 	return nil
 
 }
-func (user *user) generateRecoveryCode() (string, error) {
-
-	buf := bytes.Buffer{}
-	randbytes := make([]byte, recoveryCodeLength)
-
-	if _, err := rand.Read(randbytes); err != nil {
-		return "", err
-	}
-
-	numChars := len(recoveryCodeCharacters)
-
-	for i := 0; i < recoveryCodeLength; i++ {
-		index := int(randbytes[i]) % numChars
-		char := recoveryCodeCharacters[index]
-		buf.WriteString(string(char))
-	}
-
-	code := buf.String()
-	user.RecoveryCode = sql.NullString{String: code, Valid: true}
-	return code, nil
-}
 
-func (user *user) resetRecoveryCode() {
-	user.RecoveryCode = sql.NullString{String: "", Valid: false}
+// removes the secret, so the user must enroll again to re-enable two-factor auth
+func (user *user) resetTwoFactor() {
+	user.TOTPSecret = ""
+	user.TOTPEnabled = false
 }
 
 func (user *user) changePassword(password string) error {
@@ -244,6 +807,290 @@ func (user *user) setVotes(votes []int64) {
 	user.Votes = intSliceToPgArr(votes)
 }
 
+type userSummary struct {
+	ID   int64  `db:"id" json:"id"`
+	Name string `db:"name" json:"name"`
+}
+
+type userList struct {
+	Items       []userSummary `json:"users"`
+	Total       int64         `json:"total"`
+	CurrentPage int64         `json:"currentPage"`
+	NumPages    int64         `json:"numPages"`
+}
+
+func newUserList(users []userSummary, total int64, page int64) *userList {
+	numPages := int64(math.Ceil(float64(total) / float64(pageSize)))
+
+	return &userList{
+		Items:       users,
+		Total:       total,
+		CurrentPage: page,
+		NumPages:    numPages,
+	}
+}
+
+// links a user to their account with an OAuth2 provider
+type userIdentity struct {
+	ID         int64     `db:"id" json:"id"`
+	UserID     int64     `db:"user_id" json:"-"`
+	Provider   string    `db:"provider" json:"provider"`
+	ProviderID string    `db:"provider_id" json:"-"`
+	Email      string    `db:"email" json:"email"`
+	CreatedAt  time.Time `db:"created_at" json:"createdAt"`
+}
+
+func (identity *userIdentity) PreInsert(s gorp.SqlExecutor) error {
+	identity.CreatedAt = time.Now()
+	return nil
+}
+
+// A login on a device. Only the hashes of the current and previous refresh
+// tokens are stored.
+type userSession struct {
+	ID           int64      `db:"id" json:"id"`
+	UserID       int64      `db:"user_id" json:"-"`
+	RefreshHash  string     `db:"refresh_hash" json:"-"`
+	PreviousHash string     `db:"previous_hash" json:"-"`
+	UserAgent    string     `db:"user_agent" json:"userAgent"`
+	IPAddress    string     `db:"ip_address" json:"ipAddress"`
+	CreatedAt    time.Time  `db:"created_at" json:"createdAt"`
+	LastSeenAt   time.Time  `db:"last_seen_at" json:"lastSeenAt"`
+	ExpiresAt    time.Time  `db:"expires_at" json:"expiresAt"`
+	RevokedAt    *time.Time `db:"revoked_at" json:"-"`
+	IsCurrent    bool       `db:"-" json:"isCurrent"`
+}
+
+func (s *userSession) PreInsert(_ gorp.SqlExecutor) error {
+	s.CreatedAt = time.Now()
+	s.LastSeenAt = s.CreatedAt
+	return nil
+}
+
+func (s *userSession) isActive() bool {
+	return s.RevokedAt == nil && s.ExpiresAt.After(time.Now())
+}
+
+// A long-lived token for scripts, limited to its scopes. Only the hash is
+// stored, the token itself is shown once when created.
+type apiToken struct {
+	ID         int64      `db:"id" json:"id"`
+	UserID     int64      `db:"user_id" json:"-"`
+	Name       string     `db:"name" json:"name"`
+	TokenHash  string     `db:"token_hash" json:"-"`
+	Prefix     string     `db:"prefix" json:"prefix"`
+	Scopes     string     `db:"scopes" json:"-"`
+	CreatedAt  time.Time  `db:"created_at" json:"createdAt"`
+	LastUsedAt *time.Time `db:"last_used_at" json:"lastUsedAt"`
+	LastUsedIP string     `db:"last_used_ip" json:"lastUsedIp"`
+	RevokedAt  *time.Time `db:"revoked_at" json:"-"`
+	ScopeList  []string   `db:"-" json:"scopes"`
+}
+
+func (token *apiToken) PreInsert(s gorp.SqlExecutor) error {
+	token.CreatedAt = time.Now()
+	token.Scopes = strings.Join(token.ScopeList, " ")
+	return nil
+}
+
+func (token *apiToken) PostGet(s gorp.SqlExecutor) error {
+	token.ScopeList = strings.Fields(token.Scopes)
+	return nil
+}
+
+func (token *apiToken) hasScope(scope string) bool {
+	for _, value := range token.ScopeList {
+		if value == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (token *apiToken) validate(ctx *context, r *http.Request, errors map[string]string) error {
+	if token.Name == "" {
+		errors["name"] = "Name is missing"
+	} else if len(token.Name) > maxAPITokenNameLength {
+		errors["name"] = "Name is too long"
+	}
+	if len(token.ScopeList) == 0 {
+		errors["scopes"] = "At least one scope is required"
+	}
+	for _, scope := range token.ScopeList {
+		if !isValidScope(scope) {
+			errors["scopes"] = "Unknown scope " + scope
+		} else if scope == scopeAdmin && !ctx.user.IsAdmin {
+			errors["scopes"] = "Only admins can create tokens with the admin scope"
+		}
+	}
+	return nil
+}
+
+// A password reset emailed to the user. The token is a selector, to find the
+// reset, and a verifier, of which only the hash is stored.
+type passwordReset struct {
+	Selector     string    `db:"selector"`
+	VerifierHash string    `db:"verifier_hash"`
+	UserID       int64     `db:"user_id"`
+	Attempts     int       `db:"attempts"`
+	CreatedAt    time.Time `db:"created_at"`
+	ExpiresAt    time.Time `db:"expires_at"`
+}
+
+// Consecutive failed logins for an account or IP address. The time of the failure
+// before the last is kept, so an attempt counted before the password is checked
+// can be checked against the failures before it.
+type loginFailures struct {
+	Key              string    `db:"login_key"`
+	Failures         int       `db:"failures"`
+	LastFailedAt     time.Time `db:"last_failed_at"`
+	PreviousFailedAt time.Time `db:"previous_failed_at"`
+}
+
+// a token emailed to the user to prove they own the address
+type emailVerification struct {
+	TokenHash string    `db:"token_hash"`
+	UserID    int64     `db:"user_id"`
+	Email     string    `db:"email"`
+	CreatedAt time.Time `db:"created_at"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// Issued after the password of a user with two-factor auth is checked. The client
+// sends it back with a code to log in. Attempts are counted to limit guessing.
+type loginChallenge struct {
+	TokenHash string    `db:"token_hash"`
+	UserID    int64     `db:"user_id"`
+	Attempts  int       `db:"attempts"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// A one-time code the client exchanges after returning from a login provider.
+// Codes with a provider account link it to the user instead of logging them in.
+type authCode struct {
+	CodeHash   string    `db:"code_hash"`
+	UserID     int64     `db:"user_id"`
+	Provider   string    `db:"provider"`
+	ProviderID string    `db:"provider_id"`
+	Email      string    `db:"email"`
+	ExpiresAt  time.Time `db:"expires_at"`
+}
+
+func (code *authCode) isLink() bool {
+	return code.Provider != ""
+}
+
+// a change to a user's account. The actor is the user making the change,
+// which may be an admin.
+type auditEntry struct {
+	ID        int64     `db:"id" json:"id"`
+	UserID    int64     `db:"user_id" json:"userId"`
+	ActorID   int64     `db:"actor_id" json:"actorId"`
+	Action    string    `db:"action" json:"action"`
+	Details   string    `db:"details" json:"details"`
+	IPAddress string    `db:"ip_address" json:"ipAddress"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+func (entry *auditEntry) PreInsert(s gorp.SqlExecutor) error {
+	entry.CreatedAt = time.Now()
+	return nil
+}
+
+// Public user info
+type userProfile struct {
+	ID           int64     `db:"id" json:"id"`
+	Name         string    `db:"name" json:"name"`
+	CreatedAt    time.Time `db:"created_at" json:"createdAt"`
+	NumFollowers int64     `db:"num_followers" json:"numFollowers"`
+	NumFollowing int64     `db:"num_following" json:"numFollowing"`
+	IsFollowing  bool      `db:"is_following" json:"isFollowing"`
+	CanFollow    bool      `db:"-" json:"canFollow"`
+	CanEdit      bool      `db:"-" json:"canEdit"`
+	DisplayName  string    `db:"display_name" json:"displayName"`
+	Bio          string    `db:"bio" json:"bio"`
+	Website      string    `db:"website" json:"website"`
+	Avatar       string    `db:"avatar" json:"avatar"`
+	NumPhotos    int64     `db:"num_photos" json:"numPhotos"`
+	NumVotes     int64     `db:"num_votes" json:"numVotes"`
+}
+
+func (profile *userProfile) canEdit(user *user) bool {
+	return user != nil && user.IsAuthenticated && profile.ID == user.ID
+}
+
+const (
+	maxDisplayNameLength = 100
+	maxBioLength         = 1000
+	maxWebsiteLength     = 200
+)
+
+// the parts of their profile users can edit
+type profileUpdate struct {
+	DisplayName string `json:"displayName"`
+	Bio         string `json:"bio"`
+	Website     string `json:"website"`
+}
+
+func (update *profileUpdate) validate(ctx *context, r *http.Request, errors map[string]string) error {
+	if len(update.DisplayName) > maxDisplayNameLength {
+		errors["displayName"] = "Display name is too long"
+	}
+	if len(update.Bio) > maxBioLength {
+		errors["bio"] = "Bio is too long"
+	}
+	if len(update.Website) > maxWebsiteLength {
+		errors["website"] = "Website is too long"
+	} else if update.Website != "" && !validateWebsite(update.Website) {
+		errors["website"] = "Website must be a http or https address"
+	}
+	return nil
+}
+
+// websites are linked from profiles, so only allow web addresses
+func validateWebsite(website string) bool {
+	u, err := url.Parse(website)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func (profile *userProfile) canFollow(user *user) bool {
+	if user == nil || !user.IsAuthenticated {
+		return false
+	}
+	return profile.ID != user.ID
+}
+
+// Position in the timeline: photos are ordered newest first, with the ID as tie-breaker
+type timelineCursor struct {
+	createdAt time.Time
+	id        int64
+}
+
+func (c *timelineCursor) String() string {
+	return fmt.Sprintf("%d-%d", c.createdAt.UnixNano()/int64(time.Microsecond), c.id)
+}
+
+func parseTimelineCursor(s string) (*timelineCursor, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return nil, errInvalidCursor
+	}
+	micros, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	return &timelineCursor{time.Unix(0, micros*int64(time.Microsecond)), id}, nil
+}
+
+type timeline struct {
+	Items      []photo `json:"photos"`
+	NextCursor string  `json:"nextCursor"`
+}
+
 type page struct {
 	index  int64
 	offset int64
@@ -257,3 +1104,29 @@ func newPage(index int64) *page {
 	}
 	return &page{index, offset, pageSize}
 }
+
+type geoBounds struct {
+	MinLon, MinLat, MaxLon, MaxLat float64
+}
+
+func (b *geoBounds) crossesAntimeridian() bool {
+	return b.MinLon > b.MaxLon
+}
+
+func (b *geoBounds) String() string {
+	return fmt.Sprintf("%.6f,%.6f,%.6f,%.6f", b.MinLon, b.MinLat, b.MaxLon, b.MaxLat)
+}
+
+// a group of photos close to each other at the current zoom level
+type geoCluster struct {
+	Latitude  float64 `db:"latitude" json:"latitude"`
+	Longitude float64 `db:"longitude" json:"longitude"`
+	NumPhotos int64   `db:"num_photos" json:"numPhotos"`
+	PhotoID   int64   `db:"photo_id" json:"photoId"`
+	Filename  string  `db:"photo" json:"photo"`
+}
+
+type geoResult struct {
+	Photos   []photo      `json:"photos,omitempty"`
+	Clusters []geoCluster `json:"clusters,omitempty"`
+}
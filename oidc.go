@@ -0,0 +1,348 @@
+package photoshare
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/juju/errgo"
+	"math/big"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcClockSkew      = time.Minute
+	oidcKeysRefetchMin = time.Minute
+)
+
+// the parts of the OpenID Connect discovery document we use
+type oidcDiscovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	TokenAuthMethods      []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// an RSA key from a JSON Web Key Set
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func newJSONWebKey(kid, alg string, key *rsa.PublicKey) jsonWebKey {
+	return jsonWebKey{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		Alg: alg,
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func (key *jsonWebKey) rsaPublicKey() (*rsa.PublicKey, error) {
+	if key.Kty != "RSA" {
+		return nil, errgo.Newf("unsupported key type %s", key.Kty)
+	}
+	n, err := base64.RawURLEncoding.DecodeString(key.N)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(key.E)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	exponent := new(big.Int).SetBytes(e)
+	if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+		return nil, errgo.New("invalid key exponent")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+}
+
+// the audience may be a single client ID or a list
+type audience []string
+
+func (aud *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*aud = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*aud = audience(list)
+	return nil
+}
+
+func (aud audience) contains(clientID string) bool {
+	for _, value := range aud {
+		if value == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+type idTokenClaims struct {
+	Issuer            string      `json:"iss"`
+	Subject           string      `json:"sub"`
+	Audience          audience    `json:"aud"`
+	AuthorizedParty   string      `json:"azp"`
+	Expires           int64       `json:"exp"`
+	Nonce             string      `json:"nonce"`
+	Email             string      `json:"email"`
+	EmailVerified     interface{} `json:"email_verified"`
+	Name              string      `json:"name"`
+	PreferredUsername string      `json:"preferred_username"`
+}
+
+// some providers send email_verified as a string
+func (claims *idTokenClaims) isEmailVerified() bool {
+	switch value := claims.EmailVerified.(type) {
+	case bool:
+		return value
+	case string:
+		return value == "true"
+	}
+	return false
+}
+
+// Logs in with any OpenID Connect issuer. The discovery document and signing
+// keys are fetched on first use and cached.
+type oidcProvider struct {
+	client *oauthClient
+	issuer string
+	scope  string
+
+	mutex         sync.Mutex
+	discovery     *oidcDiscovery
+	keys          map[string]*rsa.PublicKey
+	keysFetchedAt time.Time
+}
+
+func newOIDCProvider(client *oauthClient, issuer, scope string) *oidcProvider {
+	return &oidcProvider{
+		client: client,
+		issuer: strings.TrimRight(issuer, "/"),
+		scope:  scope,
+	}
+}
+
+func (p *oidcProvider) discover() (*oidcDiscovery, error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	d := &oidcDiscovery{}
+	if err := p.client.getJSON(p.issuer+"/.well-known/openid-configuration", "", d); err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(d.Issuer, "/") != p.issuer {
+		return nil, errgo.Newf("discovery issuer %s does not match %s", d.Issuer, p.issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errgo.Newf("incomplete discovery document for %s", p.issuer)
+	}
+
+	// credentials go in the form unless only HTTP Basic auth is supported
+	if len(d.TokenAuthMethods) > 0 {
+		p.client.basicAuth = true
+		for _, method := range d.TokenAuthMethods {
+			if method == "client_secret_post" {
+				p.client.basicAuth = false
+			}
+		}
+	}
+
+	p.discovery = d
+	return d, nil
+}
+
+func (p *oidcProvider) authURL(req *authRequest, state, redirectURI string) (string, error) {
+
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.client.id)
+	q.Set("redirect_uri", redirectURI)
+	q.Set("scope", p.scope)
+	q.Set("state", state)
+	q.Set("nonce", req.Nonce)
+	q.Set("code_challenge", req.challenge())
+	q.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return d.AuthorizationEndpoint + separator + q.Encode(), nil
+}
+
+func (p *oidcProvider) userInfo(req *authRequest, code, redirectURI string) (*authInfo, error) {
+
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := p.client.requestToken(d.TokenEndpoint, code, req.Verifier, redirectURI)
+	if err != nil {
+		return nil, err
+	}
+	if token.IDToken == "" {
+		return nil, errgo.New("no ID token returned")
+	}
+
+	claims, err := p.verifyIDToken(d, token.IDToken, req.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &authInfo{
+		id:       claims.Subject,
+		name:     claims.Name,
+		nickname: claims.PreferredUsername,
+	}
+	if claims.isEmailVerified() {
+		info.email = claims.Email
+	}
+	return info, nil
+}
+
+// checks the signature and claims of the ID token. Only RS256 is accepted.
+func (p *oidcProvider) verifyIDToken(d *oidcDiscovery, idToken, nonce string) (*idTokenClaims, error) {
+
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errgo.New("malformed ID token")
+	}
+
+	header := &struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := decodeJWTPart(parts[0], header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, errgo.Newf("unsupported ID token algorithm %s", header.Alg)
+	}
+
+	key, err := p.getKey(d, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errgo.New("invalid ID token signature")
+	}
+
+	claims := &idTokenClaims{}
+	if err := decodeJWTPart(parts[1], claims); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case strings.TrimRight(claims.Issuer, "/") != p.issuer:
+		return nil, errgo.Newf("ID token issuer %s does not match", claims.Issuer)
+	case !claims.Audience.contains(p.client.id):
+		return nil, errgo.New("ID token is for another client")
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != p.client.id:
+		return nil, errgo.New("ID token is for another party")
+	case time.Unix(claims.Expires, 0).Add(oidcClockSkew).Before(time.Now()):
+		return nil, errgo.New("ID token has expired")
+	case claims.Nonce != nonce:
+		return nil, errgo.New("ID token nonce does not match")
+	case claims.Subject == "":
+		return nil, errgo.New("ID token has no subject")
+	}
+	return claims, nil
+}
+
+// finds the signing key, refetching the key set if the key is unknown as the
+// provider may have rotated its keys
+func (p *oidcProvider) getKey(d *oidcDiscovery, kid string) (*rsa.PublicKey, error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if key := p.findKey(kid); key != nil {
+		return key, nil
+	}
+
+	if time.Since(p.keysFetchedAt) < oidcKeysRefetchMin {
+		return nil, errgo.Newf("unknown signing key %s", kid)
+	}
+
+	keySet := &struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	if err := p.client.getJSON(d.JWKSURI, "", keySet); err != nil {
+		return nil, err
+	}
+
+	p.keys = make(map[string]*rsa.PublicKey)
+	p.keysFetchedAt = time.Now()
+
+	for _, jwk := range keySet.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		key, err := jwk.rsaPublicKey()
+		if err != nil {
+			logError(err)
+			continue
+		}
+		p.keys[jwk.Kid] = key
+	}
+
+	if key := p.findKey(kid); key != nil {
+		return key, nil
+	}
+	return nil, errgo.Newf("unknown signing key %s", kid)
+}
+
+// a token without a key ID can use the only key in the set
+func (p *oidcProvider) findKey(kid string) *rsa.PublicKey {
+	if key, ok := p.keys[kid]; ok {
+		return key
+	}
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key
+		}
+	}
+	return nil
+}
+
+func decodeJWTPart(part string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(json.Unmarshal(data, value))
+}
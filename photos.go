@@ -1,12 +1,15 @@
 package photoshare
 
 import (
+	"database/sql"
 	"fmt"
-	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// moves the photo to the trash. It is removed for good by purgeTrash.
 func deletePhoto(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
 	photo, err := ctx.datamapper.getPhoto(ctx.params.getInt("id"))
@@ -17,34 +20,76 @@ func deletePhoto(ctx *context, w http.ResponseWriter, r *http.Request) error {
 	if !photo.canDelete(ctx.user) {
 		return httpError{http.StatusForbidden, "You're not allowed to delete this photo"}
 	}
-	if err := ctx.datamapper.removePhoto(photo); err != nil {
+
+	wasHidden := photo.isHidden()
+	now := time.Now()
+	photo.DeletedAt = &now
+
+	if err := savePhoto(ctx, photo, wasHidden); err != nil {
 		return err
 	}
 
-	go func() {
-		if err := ctx.filestore.clean(photo.Filename); err != nil {
-			log.Println(err)
-		}
-	}()
-
 	if err := ctx.cache.clear(); err != nil {
 		return err
 	}
 
 	sendMessage(&socketMessage{ctx.user.Name, "", photo.ID, "photo_deleted"})
-	return renderString(w, http.StatusOK, "Photo deleted")
+	return renderString(w, http.StatusOK, "Photo moved to trash")
+}
+
+// Updates the photo, first moving its files if it has been hidden (made private
+// or trashed) or made visible, so a hidden photo is never left in the public directory.
+func savePhoto(ctx *context, photo *photo, wasHidden bool) error {
+
+	moved := photo.isHidden() != wasHidden
+
+	if moved {
+		if err := ctx.filestore.setPrivate(photo.Filename, photo.isHidden()); err != nil {
+			return err
+		}
+	}
+
+	if err := ctx.datamapper.updatePhoto(photo); err != nil {
+		if moved {
+			if err := ctx.filestore.setPrivate(photo.Filename, wasHidden); err != nil {
+				logError(err)
+			}
+		}
+		return err
+	}
+	return nil
 }
 
 func getPhotoDetail(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	return renderPhotoDetail(ctx, w, ctx.params.getInt("id"), nil)
+}
 
-	photo, err := ctx.datamapper.getPhotoDetail(ctx.params.getInt("id"), ctx.user)
+// renders the photo if the user is allowed to see it, or the share grants access to it
+func renderPhotoDetail(ctx *context, w http.ResponseWriter, photoID int64, grant *share) error {
+
+	photo, err := ctx.datamapper.getPhotoDetail(photoID, ctx.user, grant)
 	if err != nil {
 		return err
 	}
+	ctx.media.sign(&photo.photo)
 	return renderJSON(w, photo, http.StatusOK)
 
 }
 
+// fetches the photo, returning not found if the user cannot see it
+func getPhotoToView(ctx *context, w http.ResponseWriter, r *http.Request) (*photo, error) {
+
+	photo, err := ctx.datamapper.getPhoto(ctx.params.getInt("id"))
+	if err != nil {
+		return photo, err
+	}
+
+	if !photo.canView(ctx.user) {
+		return photo, sql.ErrNoRows
+	}
+	return photo, nil
+}
+
 func getPhotoToEdit(ctx *context, w http.ResponseWriter, r *http.Request) (*photo, error) {
 
 	photo, err := ctx.datamapper.getPhoto(ctx.params.getInt("id"))
@@ -89,6 +134,112 @@ func editPhotoTitle(ctx *context, w http.ResponseWriter, r *http.Request) error
 	return renderString(w, http.StatusOK, "Photo updated")
 }
 
+// sets the Markdown description. Hashtags in the description are added to the photo
+// tags, and newly mentioned users are notified.
+func editPhotoDescription(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := getPhotoToEdit(ctx, w, r)
+	if err != nil {
+		return err
+	}
+
+	s := &struct {
+		Description string `json:"description"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	previous := &markdown{}
+	previous.render(photo.Description)
+
+	md, err := renderDescription(ctx, photo, s.Description)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.validate(photo, r); err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.updatePhoto(photo); err != nil {
+		return err
+	}
+	if len(md.hashtags) > 0 {
+		if err := ctx.datamapper.addTags(photo, md.hashtags); err != nil {
+			return err
+		}
+	}
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	notifyMentions(ctx, r, photo, md, previous.mentions)
+
+	ctx.media.sign(photo)
+
+	sendMessage(&socketMessage{ctx.user.Name, "", photo.ID, "photo_updated"})
+	return renderJSON(w, photo, http.StatusOK)
+}
+
+// sets the description and its HTML, linking mentions of existing users
+func renderDescription(ctx *context, photo *photo, description string) (*markdown, error) {
+
+	// first pass finds the mentioned names
+	md := &markdown{}
+	md.render(description)
+
+	users, err := ctx.datamapper.getUsersByNames(md.mentions)
+	if err != nil {
+		return md, err
+	}
+
+	md = newMarkdown(users)
+	photo.Description = description
+	photo.DescriptionHTML = md.render(description)
+	return md, nil
+}
+
+// tells mentioned users about the photo, unless they were already mentioned
+// or are not allowed to see it
+func notifyMentions(ctx *context, r *http.Request, photo *photo, md *markdown, previous []string) {
+
+	if photo.isPrivate() {
+		return
+	}
+
+	var (
+		notify    []user
+		mentioned = make(map[string]bool)
+	)
+
+	for _, name := range previous {
+		mentioned[name] = true
+	}
+
+	for _, name := range md.mentions {
+		user, ok := md.users[name]
+		if !ok || user.ID == ctx.user.ID || mentioned[name] {
+			continue
+		}
+		notify = append(notify, user)
+		sendMessage(&socketMessage{ctx.user.Name, user.Name, photo.ID, "mentioned"})
+	}
+
+	if len(notify) == 0 {
+		return
+	}
+
+	go func() {
+		for _, user := range notify {
+			if err := ctx.mailer.sendMentionMail(&user, ctx.user.Name, photo, r); err != nil {
+				logError(err)
+			}
+		}
+	}()
+}
+
 func editPhotoTags(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
 	photo, err := getPhotoToEdit(ctx, w, r)
@@ -114,11 +265,89 @@ func editPhotoTags(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
 }
 
+func editPhotoVisibility(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := getPhotoToEdit(ctx, w, r)
+	if err != nil {
+		return err
+	}
+
+	s := &struct {
+		Visibility string `json:"visibility"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	wasHidden := photo.isHidden()
+	photo.Visibility = s.Visibility
+
+	if err := ctx.validate(photo, r); err != nil {
+		return err
+	}
+
+	if err := savePhoto(ctx, photo, wasHidden); err != nil {
+		return err
+	}
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	sendMessage(&socketMessage{ctx.user.Name, "", photo.ID, "photo_updated"})
+	return renderString(w, http.StatusOK, "Photo updated")
+}
+
+// sets or clears the location of the photo
+func editPhotoLocation(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := getPhotoToEdit(ctx, w, r)
+	if err != nil {
+		return err
+	}
+
+	s := &struct {
+		Latitude  *float64 `json:"latitude"`
+		Longitude *float64 `json:"longitude"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	photo.Latitude = s.Latitude
+	photo.Longitude = s.Longitude
+
+	if err := ctx.validate(photo, r); err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.updatePhoto(photo); err != nil {
+		return err
+	}
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	sendMessage(&socketMessage{ctx.user.Name, "", photo.ID, "photo_updated"})
+	return renderString(w, http.StatusOK, "Photo updated")
+}
+
 func upload(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
+	if err := ctx.checkVerified(restrictUpload); err != nil {
+		return err
+	}
+
 	title := r.FormValue("title")
+	description := r.FormValue("description")
 	taglist := r.FormValue("taglist")
 	tags := strings.Split(taglist, " ")
+	visibility := r.FormValue("visibility")
+
+	if visibility == "" {
+		visibility = visibilityPublic
+	}
 
 	src, hdr, err := r.FormFile("photo")
 	if err != nil {
@@ -138,18 +367,51 @@ func upload(ctx *context, w http.ResponseWriter, r *http.Request) error {
 	filename := generateRandomFilename(contentType)
 
 	photo := &photo{Title: title,
-		OwnerID:  ctx.user.ID,
-		Filename: filename,
-		Tags:     tags,
+		OwnerID:    ctx.user.ID,
+		Filename:   filename,
+		Tags:       tags,
+		Visibility: visibility,
+	}
+
+	// a location set by the user overrides any location in the EXIF data
+	if lat, lon := r.FormValue("latitude"), r.FormValue("longitude"); lat != "" || lon != "" {
+		latitude, err := strconv.ParseFloat(lat, 64)
+		if err != nil {
+			return httpError{http.StatusBadRequest, "Invalid latitude"}
+		}
+		longitude, err := strconv.ParseFloat(lon, 64)
+		if err != nil {
+			return httpError{http.StatusBadRequest, "Invalid longitude"}
+		}
+		photo.setLocation(latitude, longitude)
+	} else if contentType == "image/jpeg" {
+		if latitude, longitude, ok := readExifLocation(src); ok {
+			photo.setLocation(latitude, longitude)
+		}
+		if _, err := src.Seek(0, 0); err != nil {
+			return err
+		}
 	}
 
-	if err := ctx.filestore.store(src, photo.Filename, contentType); err != nil {
+	md, err := renderDescription(ctx, photo, description)
+	if err != nil {
 		return err
 	}
+	photo.Tags = append(photo.Tags, md.hashtags...)
+
+	// used to find visually similar photos
+	if photo.ImageHash, err = readImageHash(src); err != nil {
+		return httpError{http.StatusBadRequest, "Invalid photo"}
+	}
 
 	if err := ctx.validate(photo, r); err != nil {
 		return err
 	}
+
+	if err := ctx.filestore.store(src, photo.Filename, contentType, photo.isPrivate()); err != nil {
+		return err
+	}
+
 	if err := ctx.datamapper.createPhoto(photo); err != nil {
 		return err
 	}
@@ -157,6 +419,10 @@ func upload(ctx *context, w http.ResponseWriter, r *http.Request) error {
 		logError(err)
 	}
 
+	notifyMentions(ctx, r, photo, md, nil)
+
+	ctx.media.sign(photo)
+
 	sendMessage(&socketMessage{ctx.user.Name, "", photo.ID, "photo_uploaded"})
 	return renderJSON(w, photo, http.StatusCreated)
 }
@@ -181,13 +447,15 @@ func photosByOwnerID(ctx *context, w http.ResponseWriter, r *http.Request) error
 
 	page := getPage(r)
 	ownerID := ctx.params.getInt("ownerID")
-	cacheKey := fmt.Sprintf("photos:ownerID:%d:page:%d", ownerID, page.index)
+	visibilities := listedVisibilities(ownerID, ctx.user)
+	cacheKey := fmt.Sprintf("photos:ownerID:%d:%s:page:%d", ownerID, visibilities, page.index)
 
 	return ctx.cache.render(w, http.StatusOK, cacheKey, func() (interface{}, error) {
-		photos, err := ctx.datamapper.getPhotosByOwnerID(page, ownerID)
+		photos, err := ctx.datamapper.getPhotosByOwnerID(page, ownerID, ctx.user)
 		if err != nil {
 			return photos, err
 		}
+		ctx.media.signList(photos)
 		return photos, nil
 	})
 }
@@ -228,7 +496,7 @@ func voteUp(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
 func vote(ctx *context, w http.ResponseWriter, r *http.Request, fn func(photo *photo)) error {
 
-	photo, err := ctx.datamapper.getPhoto(ctx.params.getInt("id"))
+	photo, err := getPhotoToView(ctx, w, r)
 	if err != nil {
 		return err
 	}
@@ -247,3 +515,39 @@ func vote(ctx *context, w http.ResponseWriter, r *http.Request, fn func(photo *p
 
 	return renderString(w, http.StatusOK, "Voting successful")
 }
+
+func addFavorite(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := getPhotoToView(ctx, w, r)
+	if err != nil {
+		return err
+	}
+
+	if !photo.canFavorite(ctx.user) {
+		return httpError{http.StatusForbidden, "You're not allowed to favorite this photo"}
+	}
+
+	if err := ctx.datamapper.addFavorite(ctx.user.ID, photo.ID); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Photo added to favorites")
+}
+
+func removeFavorite(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	if err := ctx.datamapper.removeFavorite(ctx.user.ID, ctx.params.getInt("id")); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Photo removed from favorites")
+}
+
+// favorites are private, so we don't cache them
+func getFavorites(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photos, err := ctx.datamapper.getFavorites(getPage(r), ctx.user.ID)
+	if err != nil {
+		return err
+	}
+	ctx.media.signList(photos)
+	return renderJSON(w, photos, http.StatusOK)
+}
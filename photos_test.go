@@ -6,7 +6,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 type mockCache struct{}
@@ -38,18 +40,37 @@ func (m *mockCache) render(w http.ResponseWriter, status int, key string, fn fun
 type mockSessionManager struct {
 }
 
-func (m *mockSessionManager) readToken(r *http.Request) (int64, error) {
-	return 0, nil
+func (m *mockSessionManager) readToken(r *http.Request) (int64, int64, error) {
+	return 0, 0, nil
 }
 
-func (m *mockSessionManager) createToken(userID int64) (string, error) {
+func (m *mockSessionManager) createToken(userID, sessionID int64) (string, error) {
 	return strconv.FormatInt(userID, 10), nil
 }
 
-func (m *mockSessionManager) writeToken(w http.ResponseWriter, userID int64) error {
+func (m *mockSessionManager) writeToken(w http.ResponseWriter, userID, sessionID int64) error {
 	return nil
 }
 
+func (m *mockSessionManager) publicKeys() []jsonWebKey {
+	return []jsonWebKey{}
+}
+
+// a context for handlers that log in, send mail or check the user is verified
+func newTestContext(datamapper dataMapper, user *user) *context {
+	return &context{
+		app: &app{
+			cfg:        &config{UnverifiedRestrictions: "upload"},
+			datamapper: datamapper,
+			session:    &mockSessionManager{},
+			mailer:     newMailer(&config{TemplatesDir: "templates"}),
+			limiter:    newLoginLimiter(newMemoryLoginAttemptStore()),
+		},
+		params: &params{make(map[string]string)},
+		user:   user,
+	}
+}
+
 type mockDataMapper struct {
 }
 
@@ -57,7 +78,19 @@ func (m *mockDataMapper) getPhoto(photoID int64) (*photo, error) {
 	return nil, sql.ErrNoRows
 }
 
-func (m *mockDataMapper) getPhotoDetail(photoID int64, user *user) (*photoDetail, error) {
+func (m *mockDataMapper) getTrashedPhoto(photoID int64) (*photo, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getTrash(page *page, ownerID int64) (*photoList, error) {
+	return newPhotoList([]photo{}, 0, 1), nil
+}
+
+func (m *mockDataMapper) getExpiredTrash(before time.Time, afterID int64, limit int) ([]photo, error) {
+	return []photo{}, nil
+}
+
+func (m *mockDataMapper) getPhotoDetail(photoID int64, user *user, grant *share) (*photoDetail, error) {
 	canEdit := user.ID == 1
 	photo := &photoDetail{
 		photo: photo{
@@ -83,10 +116,90 @@ func (m *mockDataMapper) getPhotos(page *page, orderBy string) (*photoList, erro
 	return newPhotoList(photos, 1, 1), nil
 }
 
-func (m *mockDataMapper) getPhotosByOwnerID(page *page, ownerID int64) (*photoList, error) {
+func (m *mockDataMapper) getPhotosByOwnerID(page *page, ownerID int64, user *user) (*photoList, error) {
 	return &photoList{}, nil
 }
 
+func (m *mockDataMapper) getRelatedPhotos(source *photo, limit int) (*photoList, error) {
+	return newPhotoList([]photo{}, 0, 1), nil
+}
+
+func (m *mockDataMapper) getPhotosInBounds(bounds *geoBounds, limit int) ([]photo, error) {
+	return []photo{}, nil
+}
+
+func (m *mockDataMapper) getPhotoClusters(bounds *geoBounds, cellSize float64) ([]geoCluster, error) {
+	return []geoCluster{}, nil
+}
+
+func (m *mockDataMapper) getTag(tagID int64) (*tag, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) suggestTags(q string, userID int64, limit int) ([]tagSuggestion, error) {
+	return []tagSuggestion{{tag: tag{ID: 1, Name: q + "s", NumPhotos: 1}}}, nil
+}
+
+func (m *mockDataMapper) getTagHierarchy() ([]tag, error) {
+	return []tag{}, nil
+}
+
+func (m *mockDataMapper) getTagByName(name string) (*tag, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getTagDescendants(ancestor *tag) ([]tag, error) {
+	return []tag{}, nil
+}
+
+func (m *mockDataMapper) renameTag(tag *tag, name string) error {
+	return nil
+}
+
+func (m *mockDataMapper) mergeTags(source *tag, target *tag) error {
+	return nil
+}
+
+func (m *mockDataMapper) getTagSynonym(synonymID int64) (*tagSynonym, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getTagSynonyms() ([]tagSynonym, error) {
+	return []tagSynonym{}, nil
+}
+
+func (m *mockDataMapper) getTagSynonymByName(name string) (*tagSynonym, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) addTagSynonym(synonym *tagSynonym) error {
+	return nil
+}
+
+func (m *mockDataMapper) removeTagSynonym(synonym *tagSynonym) error {
+	return nil
+}
+
+func (m *mockDataMapper) getBlockedTag(blockedID int64) (*blockedTag, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getBlockedTags() ([]blockedTag, error) {
+	return []blockedTag{}, nil
+}
+
+func (m *mockDataMapper) isTagBlocked(name string) (bool, error) {
+	return false, nil
+}
+
+func (m *mockDataMapper) blockTag(blocked *blockedTag) error {
+	return nil
+}
+
+func (m *mockDataMapper) unblockTag(blocked *blockedTag) error {
+	return nil
+}
+
 func (m *mockDataMapper) searchPhotos(page *page, q string) (*photoList, error) {
 	return &photoList{}, nil
 }
@@ -95,6 +208,130 @@ func (m *mockDataMapper) getTagCounts() ([]tagCount, error) {
 	return []tagCount{}, nil
 }
 
+func (m *mockDataMapper) addFavorite(userID, photoID int64) error {
+	return nil
+}
+
+func (m *mockDataMapper) removeFavorite(userID, photoID int64) error {
+	return nil
+}
+
+func (m *mockDataMapper) getFavorites(page *page, userID int64) (*photoList, error) {
+	return &photoList{}, nil
+}
+
+func (m *mockDataMapper) createComment(_ *comment) error {
+	return nil
+}
+
+func (m *mockDataMapper) removeComment(_ *comment) error {
+	return nil
+}
+
+func (m *mockDataMapper) updateComment(_ *comment) error {
+	return nil
+}
+
+func (m *mockDataMapper) getComment(commentID int64) (*comment, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getComments(page *page, photoID int64, user *user) (*commentList, error) {
+	return &commentList{}, nil
+}
+
+func (m *mockDataMapper) createShare(_ *share) error {
+	return nil
+}
+
+func (m *mockDataMapper) removeShare(_ *share) error {
+	return nil
+}
+
+func (m *mockDataMapper) registerShareView(_ *share) (bool, error) {
+	return true, nil
+}
+
+func (m *mockDataMapper) getShare(shareID int64) (*share, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getShareByToken(token string) (*share, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getSharesByOwnerID(page *page, ownerID int64) (*shareList, error) {
+	return &shareList{}, nil
+}
+
+func (m *mockDataMapper) createAlbum(_ *album) error {
+	return nil
+}
+
+func (m *mockDataMapper) removeAlbum(_ *album) error {
+	return nil
+}
+
+func (m *mockDataMapper) updateAlbum(_ *album) error {
+	return nil
+}
+
+func (m *mockDataMapper) updateAlbumPhotos(_ *album, _ []int64) error {
+	return nil
+}
+
+func (m *mockDataMapper) isPhotoInAlbum(albumID, photoID int64) (bool, error) {
+	return false, nil
+}
+
+func (m *mockDataMapper) getAlbum(albumID int64) (*album, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getAlbumDetail(page *page, albumID int64, user *user, grant *share) (*albumDetail, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getAlbums(page *page) (*albumList, error) {
+	return &albumList{}, nil
+}
+
+func (m *mockDataMapper) getAlbumsByOwnerID(page *page, ownerID int64, user *user) (*albumList, error) {
+	return &albumList{}, nil
+}
+
+func (m *mockDataMapper) searchAlbums(page *page, q string) (*albumList, error) {
+	return &albumList{}, nil
+}
+
+func (m *mockDataMapper) follow(followerID, followeeID int64) error {
+	return nil
+}
+
+func (m *mockDataMapper) unfollow(followerID, followeeID int64) error {
+	return nil
+}
+
+func (m *mockDataMapper) getUserProfileByName(name string, viewer *user) (*userProfile, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getUserProfile(userID int64, viewer *user) (*userProfile, error) {
+	return &userProfile{ID: userID, Name: "tester"}, nil
+}
+
+func (m *mockDataMapper) getFollowers(page *page, userID int64) (*userList, error) {
+	return &userList{}, nil
+}
+
+func (m *mockDataMapper) getFollowing(page *page, userID int64) (*userList, error) {
+	return &userList{}, nil
+}
+
+func (m *mockDataMapper) getTimeline(userID int64, cursor *timelineCursor) (*timeline, error) {
+	return &timeline{}, nil
+}
+
 func (m *mockDataMapper) getActiveUser(userID int64) (*user, error) {
 	return &user{}, nil
 }
@@ -103,6 +340,170 @@ func (m *mockDataMapper) getUserByEmail(email string) (*user, error) {
 	return &user{}, nil
 }
 
+func (m *mockDataMapper) getUserByIdentity(provider, providerID string) (*user, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getUserIdentities(_ int64) ([]userIdentity, error) {
+	return []userIdentity{}, nil
+}
+
+func (m *mockDataMapper) createUserIdentity(_ *userIdentity, _ *auditEntry) error {
+	return nil
+}
+
+func (m *mockDataMapper) removeUserIdentity(_ *userIdentity, _ *auditEntry) error {
+	return nil
+}
+
+func (m *mockDataMapper) addAuditEntry(_ *auditEntry) error {
+	return nil
+}
+
+func (m *mockDataMapper) createSession(_ *userSession) error {
+	return nil
+}
+
+func (m *mockDataMapper) getSession(_ int64) (*userSession, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getSessionByRefreshHash(_ string) (*userSession, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getActiveSessions(_ int64) ([]userSession, error) {
+	return []userSession{}, nil
+}
+
+func (m *mockDataMapper) rotateSession(_ *userSession, _ string) error {
+	return nil
+}
+
+func (m *mockDataMapper) touchSession(_ int64) error {
+	return nil
+}
+
+func (m *mockDataMapper) revokeSession(_ int64) error {
+	return nil
+}
+
+func (m *mockDataMapper) revokeSessions(_, _ int64) error {
+	return nil
+}
+
+func (m *mockDataMapper) enableTwoFactor(_ *user, _ []string, _ *auditEntry) error {
+	return nil
+}
+
+func (m *mockDataMapper) resetTwoFactor(_ *user, _ *auditEntry) error {
+	return nil
+}
+
+func (m *mockDataMapper) useTOTPStep(_, _ int64) error {
+	return nil
+}
+
+func (m *mockDataMapper) useRecoveryCode(_ int64, _ string) error {
+	return sql.ErrNoRows
+}
+
+func (m *mockDataMapper) countRecoveryCodes(_ int64) (int64, error) {
+	return 0, nil
+}
+
+func (m *mockDataMapper) createPasswordReset(_ *passwordReset) error {
+	return nil
+}
+
+func (m *mockDataMapper) getPasswordReset(_ string) (*passwordReset, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) countPasswordResets(_ int64, _ time.Time) (int64, error) {
+	return 0, nil
+}
+
+func (m *mockDataMapper) failPasswordReset(_ string) error {
+	return nil
+}
+
+func (m *mockDataMapper) updatePassword(_ *user, _ int64, _ *auditEntry) error {
+	return nil
+}
+
+func (m *mockDataMapper) createAPIToken(_ *apiToken, _ *auditEntry) error {
+	return nil
+}
+
+func (m *mockDataMapper) getAPITokens(_ int64) ([]apiToken, error) {
+	return []apiToken{}, nil
+}
+
+func (m *mockDataMapper) getAPIToken(_ string) (*apiToken, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) touchAPIToken(_ int64, _ string) error {
+	return nil
+}
+
+func (m *mockDataMapper) revokeAPIToken(_ *apiToken, _ *auditEntry) error {
+	return nil
+}
+
+func (m *mockDataMapper) getLoginFailures(key string) (*loginFailures, error) {
+	return &loginFailures{Key: key}, nil
+}
+
+func (m *mockDataMapper) addLoginFailure(key string, now, since time.Time) (*loginFailures, error) {
+	return &loginFailures{Key: key, Failures: 1, LastFailedAt: now}, nil
+}
+
+func (m *mockDataMapper) clearLoginFailures(_ string) error {
+	return nil
+}
+
+func (m *mockDataMapper) createEmailVerification(_ *emailVerification) error {
+	return nil
+}
+
+func (m *mockDataMapper) getEmailVerification(_ string) (*emailVerification, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) countEmailVerifications(_ int64, _ time.Time) (int64, error) {
+	return 0, nil
+}
+
+func (m *mockDataMapper) verifyEmail(_ *user, _ *auditEntry) error {
+	return nil
+}
+
+func (m *mockDataMapper) createLoginChallenge(_ *loginChallenge) error {
+	return nil
+}
+
+func (m *mockDataMapper) attemptLoginChallenge(_ string, _ int) (*loginChallenge, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) removeLoginChallenge(_ string) error {
+	return nil
+}
+
+func (m *mockDataMapper) createUserWithIdentity(_ *user, _ *userIdentity) error {
+	return nil
+}
+
+func (m *mockDataMapper) createAuthCode(_ *authCode) error {
+	return nil
+}
+
+func (m *mockDataMapper) useAuthCode(_ string) (*authCode, error) {
+	return nil, sql.ErrNoRows
+}
+
 func (m *mockDataMapper) isUserNameAvailable(user *user) (bool, error) {
 	return true, nil
 }
@@ -115,10 +516,6 @@ func (m *mockDataMapper) getUserByNameOrEmail(identifier string) (*user, error)
 	return &user{}, nil
 }
 
-func (m *mockDataMapper) getUserByRecoveryCode(code string) (*user, error) {
-	return &user{}, nil
-}
-
 func (m *mockDataMapper) createPhoto(_ *photo) error {
 	return nil
 }
@@ -135,6 +532,18 @@ func (m *mockDataMapper) updateTags(_ *photo) error {
 	return nil
 }
 
+func (m *mockDataMapper) addTags(_ *photo, _ []string) error {
+	return nil
+}
+
+func (m *mockDataMapper) getUsersByNames(_ []string) ([]user, error) {
+	return []user{}, nil
+}
+
+func (m *mockDataMapper) bulkUpdatePhotos(_ *bulkOperation, _ []*photo) error {
+	return nil
+}
+
 func (m *mockDataMapper) createUser(_ *user) error {
 	return nil
 }
@@ -156,7 +565,7 @@ func (m *emptyDataStore) getPhotos(page *page, orderBy string) (*photoList, erro
 	return &photoList{photos, 0, 1, 0}, nil
 }
 
-func (m *emptyDataStore) getPhotoDetail(photoID int64, user *user) (*photoDetail, error) {
+func (m *emptyDataStore) getPhotoDetail(photoID int64, user *user, grant *share) (*photoDetail, error) {
 	return nil, sql.ErrNoRows
 }
 
@@ -236,3 +645,64 @@ func TestGetPhotos(t *testing.T) {
 	}
 
 }
+
+// lists the private photos of the owner only to those who can see them
+type ownerPhotosDataMapper struct {
+	sessionDataMapper
+}
+
+func (m *ownerPhotosDataMapper) getPhotosByOwnerID(page *page, ownerID int64, user *user) (*photoList, error) {
+	photos := []photo{{ID: 1, OwnerID: ownerID, Visibility: visibilityPublic}}
+	if strings.Contains(listedVisibilities(ownerID, user), visibilityPrivate) {
+		photos = append(photos, photo{ID: 2, OwnerID: ownerID, Visibility: visibilityPrivate})
+	}
+	return newPhotoList(photos, int64(len(photos)), 1), nil
+}
+
+// authenticates the user as the route does before listing the photos of user 1
+func getOwnerPhotos(t *testing.T, userID int64) *photoList {
+
+	cfg := &config{MediaSecret: "secret"}
+	app := &app{
+		cfg:        cfg,
+		datamapper: &ownerPhotosDataMapper{sessionDataMapper{session: newTestSession("foo")}},
+		session:    &tokenSessionManager{userID: userID, sessionID: 3},
+		cache:      &mockCache{},
+		media:      newMediaSigner(cfg),
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost/api/photos/owner/1", nil)
+	res := httptest.NewRecorder()
+
+	user, err := app.authenticate(req, authLevelCheck, scopePhotosRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &context{
+		app:    app,
+		params: &params{map[string]string{"ownerID": "1"}},
+		user:   user,
+	}
+
+	if err := photosByOwnerID(c, res, req); err != nil {
+		t.Fatal(err)
+	}
+	photos := &photoList{}
+	if err := json.Unmarshal(res.Body.Bytes(), photos); err != nil {
+		t.Fatal(err)
+	}
+	return photos
+}
+
+func TestPhotosByOwnerIDIfOwner(t *testing.T) {
+	if photos := getOwnerPhotos(t, 1); len(photos.Items) != 2 {
+		t.Error("Owner should see their private photos")
+	}
+}
+
+func TestPhotosByOwnerIDIfAnonymous(t *testing.T) {
+	if photos := getOwnerPhotos(t, 0); len(photos.Items) != 1 {
+		t.Error("Anonymous users should only see public photos")
+	}
+}
@@ -0,0 +1,101 @@
+package photoshare
+
+import (
+	"fmt"
+	"image"
+	"net/http"
+)
+
+// weights of each kind of relation between photos
+const (
+	relatedTagWeight      = 3 // per shared tag
+	relatedOwnerWeight    = 1
+	relatedLocationWeight = 2
+	relatedVisualWeight   = 4
+
+	relatedLocationDistance = 0.25 // degrees, about 25km
+	relatedVisualDistance   = 10   // max differing bits of the image hashes
+	relatedOwnerPhotos      = 50   // only the owner's latest photos are considered
+	maxRelatedPhotos        = 12
+)
+
+// Computes a 64 bit difference hash of the image: the image is reduced to
+// 9x8 grayscale cells, and each bit is set if a cell is brighter than the
+// cell to its right. Similar images have hashes differing by few bits.
+func imageHash(img image.Image) int64 {
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return 0
+	}
+
+	var cells [8][9]float64
+
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 9; x++ {
+			x0, x1 := bounds.Min.X+x*width/9, bounds.Min.X+(x+1)*width/9
+			y0, y1 := bounds.Min.Y+y*height/8, bounds.Min.Y+(y+1)*height/8
+			if x1 == x0 {
+				x1++
+			}
+			if y1 == y0 {
+				y1++
+			}
+			var sum float64
+			// sample at most 8x8 pixels of each cell, enough for a hash
+			stepX, stepY := (x1-x0+7)/8, (y1-y0+7)/8
+			var n int
+			for py := y0; py < y1; py += stepY {
+				for px := x0; px < x1; px += stepX {
+					r, g, b, _ := img.At(px, py).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+					n++
+				}
+			}
+			cells[y][x] = sum / float64(n)
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if cells[y][x] > cells[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return int64(hash)
+}
+
+// decodes the image to compute its hash, then rewinds it
+func readImageHash(src readable) (int64, error) {
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := src.Seek(0, 0); err != nil {
+		return 0, err
+	}
+	return imageHash(img), nil
+}
+
+// recommends public photos sharing tags, owner, location or looks with the photo
+func getRelatedPhotos(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := getPhotoToView(ctx, w, r)
+	if err != nil {
+		return err
+	}
+
+	cacheKey := fmt.Sprintf("photos:related:%d", photo.ID)
+
+	return ctx.cache.render(w, http.StatusOK, cacheKey, func() (interface{}, error) {
+		photos, err := ctx.datamapper.getRelatedPhotos(photo, maxRelatedPhotos)
+		if err != nil {
+			return photos, err
+		}
+		return photos, nil
+	})
+}
@@ -0,0 +1,72 @@
+package photoshare
+
+import (
+	"database/sql"
+	"image"
+	"image/color"
+	"math"
+	"math/bits"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// a smooth pattern which looks the same at any size, optionally inverted
+func makeTestImage(width, height int, invert bool) image.Image {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			fx, fy := float64(x)/float64(width), float64(y)/float64(height)
+			v := uint8(127 + 127*math.Sin(fx*3*math.Pi)*math.Cos(fy*2*math.Pi))
+			if invert {
+				v = 255 - v
+			}
+			img.SetGray(x, y, color.Gray{v})
+		}
+	}
+	return img
+}
+
+func TestImageHash(t *testing.T) {
+	small := imageHash(makeTestImage(90, 80, false))
+	large := imageHash(makeTestImage(900, 800, false))
+
+	if small == 0 {
+		t.Fatal("Image should have a hash")
+	}
+
+	if d := bits.OnesCount64(uint64(small ^ large)); d > relatedVisualDistance {
+		t.Errorf("Resized images should have similar hashes, distance %d", d)
+	}
+
+	reversed := imageHash(makeTestImage(90, 80, true))
+	if d := bits.OnesCount64(uint64(small ^ reversed)); d <= relatedVisualDistance {
+		t.Errorf("Different images should have different hashes, distance %d", d)
+	}
+
+	if hash := imageHash(image.NewGray(image.Rect(0, 0, 0, 0))); hash != 0 {
+		t.Error("Empty image should have no hash")
+	}
+}
+
+func TestGetRelatedPhotosIfNone(t *testing.T) {
+
+	req := &http.Request{}
+	res := httptest.NewRecorder()
+
+	app := &app{
+		datamapper: &mockDataMapper{},
+		cache:      &mockCache{},
+	}
+
+	c := &context{
+		app:    app,
+		params: &params{map[string]string{"id": "1"}},
+		user:   &user{},
+	}
+
+	err := getRelatedPhotos(c, res, req)
+	if err != sql.ErrNoRows {
+		t.Fail()
+	}
+}
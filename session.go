@@ -1,32 +1,45 @@
 package photoshare
 
 import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/juju/errgo"
 	"io/ioutil"
 	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
 const (
-	tokenHeader = "X-Auth-Token"
-	expiry      = 60 // minutes
+	tokenHeader        = "X-Auth-Token"
+	refreshTokenHeader = "X-Refresh-Token"
+	expiry             = 15 // minutes
+	publicKeyExt       = ".pub"
 )
 
+// Access tokens are short-lived and carry the user and session IDs. The session
+// is checked on each request, so revoking it logs out the device.
 type sessionManager interface {
-	readToken(*http.Request) (int64, error)
-	createToken(int64) (string, error)
-	writeToken(http.ResponseWriter, int64) error
+	readToken(*http.Request) (int64, int64, error)
+	createToken(int64, int64) (string, error)
+	writeToken(http.ResponseWriter, int64, int64) error
+	publicKeys() []jsonWebKey
 }
 
 // Basic user session info
 type sessionInfo struct {
-	ID       int64  `json:"id"`
-	Name     string `json:"name"`
-	Email    string `json:"email"`
-	IsAdmin  bool   `json:"isAdmin"`
-	LoggedIn bool   `json:"loggedIn"`
+	ID            int64  `json:"id"`
+	Name          string `json:"name"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"emailVerified"`
+	IsAdmin       bool   `json:"isAdmin"`
+	LoggedIn      bool   `json:"loggedIn"`
 }
 
 func newSessionInfo(user *user) *sessionInfo {
@@ -34,69 +47,203 @@ func newSessionInfo(user *user) *sessionInfo {
 		return &sessionInfo{}
 	}
 
-	return &sessionInfo{user.ID, user.Name, user.Email, user.IsAdmin, true}
+	return &sessionInfo{user.ID, user.Name, user.Email, user.EmailVerified, user.IsAdmin, true}
 }
 
+// Keys are loaded from KEYS_DIR, where each key ID has a private key file named
+// after it and a public key file with the .pub extension. Tokens are signed with
+// the key SIGNING_KEY_ID. Keys with only a public key file are retired: they are
+// still accepted, so rotating the signing key does not log everybody out.
+// Without KEYS_DIR the PRIVATE_KEY and PUBLIC_KEY pair is the only key.
 func newSessionManager(cfg *config) (sessionManager, error) {
-	mgr := &defaultSessionManager{}
-	var err error
-	mgr.signKey, err = ioutil.ReadFile(cfg.PrivateKey)
-	if err != nil {
-		return mgr, errgo.Mask(err)
+
+	mgr := &defaultSessionManager{keys: make(map[string]*rsa.PublicKey)}
+
+	keysDir, signKeyID := cfg.KeysDir, cfg.SigningKeyID
+	privateKeyFile := cfg.PrivateKey
+
+	if keysDir == "" {
+		if cfg.PrivateKey == "" || cfg.PublicKey == "" {
+			return mgr, errgo.New("KEYS_DIR or PRIVATE_KEY and PUBLIC_KEY must be set")
+		}
+		if signKeyID == "" {
+			signKeyID = path.Base(cfg.PrivateKey)
+		}
+		key, err := readPublicKey(cfg.PublicKey)
+		if err != nil {
+			return mgr, err
+		}
+		mgr.keys[signKeyID] = key
+	} else {
+		if signKeyID == "" {
+			return mgr, errgo.New("SIGNING_KEY_ID must be set with KEYS_DIR")
+		}
+		filenames, err := filepath.Glob(filepath.Join(keysDir, "*"+publicKeyExt))
+		if err != nil {
+			return mgr, errgo.Mask(err)
+		}
+		for _, filename := range filenames {
+			key, err := readPublicKey(filename)
+			if err != nil {
+				return mgr, err
+			}
+			mgr.keys[strings.TrimSuffix(filepath.Base(filename), publicKeyExt)] = key
+		}
+		privateKeyFile = filepath.Join(keysDir, signKeyID)
 	}
-	mgr.verifyKey, err = ioutil.ReadFile(cfg.PublicKey)
+
+	signKey, err := readPrivateKey(privateKeyFile)
 	if err != nil {
-		return mgr, errgo.Mask(err)
+		return mgr, err
 	}
+
+	if key, ok := mgr.keys[signKeyID]; ok && (key.N.Cmp(signKey.N) != 0 || key.E != signKey.E) {
+		return mgr, errgo.Newf("public key %s does not match its private key", signKeyID)
+	}
+
+	mgr.keys[signKeyID] = &signKey.PublicKey
+	mgr.signKeyID = signKeyID
+	mgr.signKey = signKey
+
 	return mgr, nil
 }
 
+func readPEMBlock(filename string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errgo.Newf("no PEM data in %s", filename)
+	}
+	return block, nil
+}
+
+// reads a PKCS #1 or PKCS #8 RSA private key
+func readPrivateKey(filename string) (*rsa.PrivateKey, error) {
+	block, err := readPEMBlock(filename)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errgo.Newf("invalid private key %s", filename)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errgo.Newf("%s is not an RSA private key", filename)
+	}
+	return key, nil
+}
+
+func readPublicKey(filename string) (*rsa.PublicKey, error) {
+	block, err := readPEMBlock(filename)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errgo.Newf("invalid public key %s", filename)
+	}
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, errgo.Newf("%s is not an RSA public key", filename)
+	}
+	return key, nil
+}
+
 type defaultSessionManager struct {
-	verifyKey, signKey []byte
+	keys      map[string]*rsa.PublicKey
+	signKeyID string
+	signKey   *rsa.PrivateKey
 }
 
-func (m *defaultSessionManager) readToken(r *http.Request) (int64, error) {
+// Returns the user and session IDs, or zeros if the token is missing. An invalid or
+// expired token is an error, so the client refreshes it rather than carrying on as
+// an anonymous user.
+func (m *defaultSessionManager) readToken(r *http.Request) (int64, int64, error) {
 	tokenString := r.Header.Get(tokenHeader)
 	if tokenString == "" {
-		return 0, nil
+		return 0, 0, nil
 	}
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return m.verifyKey, nil
-	})
-	switch err.(type) {
-	case nil:
-		if !token.Valid {
-			return 0, nil
+		// Only RS256 is accepted, whatever the token header says, so a token
+		// cannot choose how it is verified
+		if token.Method != jwt.SigningMethodRS256 {
+			return nil, errgo.Newf("unexpected signing method %v", token.Header["alg"])
 		}
-		token := token.Claims["uid"].(string)
-		userID, err := strconv.ParseInt(token, 10, 0)
-		if err != nil {
-			return 0, nil
+		kid, _ := token.Header["kid"].(string)
+		key, ok := m.keys[kid]
+		if !ok {
+			return nil, errgo.Newf("unknown key %q", kid)
 		}
-		return userID, nil
-	case *jwt.ValidationError:
-		return 0, nil
-	default:
-		return 0, errgo.Mask(err)
+		return key, nil
+	})
+	if err != nil || !token.Valid {
+		return 0, 0, errInvalidSession
+	}
+	uid, _ := token.Claims["uid"].(string)
+	sid, _ := token.Claims["sid"].(string)
+	userID, err := strconv.ParseInt(uid, 10, 0)
+	if err != nil {
+		return 0, 0, errInvalidSession
 	}
+	// every token belongs to a session, so it can be revoked
+	sessionID, err := strconv.ParseInt(sid, 10, 0)
+	if err != nil {
+		return 0, 0, errInvalidSession
+	}
+	return userID, sessionID, nil
 }
 
-func (m *defaultSessionManager) createToken(userID int64) (string, error) {
-	token := jwt.New(jwt.GetSigningMethod("RS256"))
+func (m *defaultSessionManager) createToken(userID, sessionID int64) (string, error) {
+	now := time.Now()
+	token := jwt.New(jwt.SigningMethodRS256)
+	token.Header["kid"] = m.signKeyID
 	token.Claims["uid"] = strconv.FormatInt(userID, 10)
-	token.Claims["exp"] = time.Now().Add(time.Minute * expiry).Unix()
+	token.Claims["sid"] = strconv.FormatInt(sessionID, 10)
+	token.Claims["iat"] = now.Unix()
+	token.Claims["exp"] = now.Add(time.Minute * expiry).Unix()
 	tokenString, err := token.SignedString(m.signKey)
 	if err != nil {
-		return tokenString, errgo.Mask(err)
+		return "", errgo.Mask(err)
 	}
 	return tokenString, nil
 }
 
-func (m *defaultSessionManager) writeToken(w http.ResponseWriter, userID int64) error {
-	tokenString, err := m.createToken(userID)
+func (m *defaultSessionManager) writeToken(w http.ResponseWriter, userID, sessionID int64) error {
+	tokenString, err := m.createToken(userID, sessionID)
 	if err != nil {
 		return err
 	}
 	w.Header().Set(tokenHeader, tokenString)
 	return nil
 }
+
+// the keys other services can verify our tokens with, sorted by key ID
+func (m *defaultSessionManager) publicKeys() []jsonWebKey {
+	var kids []string
+	for kid := range m.keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	keys := []jsonWebKey{}
+	for _, kid := range kids {
+		keys = append(keys, newJSONWebKey(kid, jwt.SigningMethodRS256.Alg(), m.keys[kid]))
+	}
+	return keys
+}
+
+// serves the public keys as a JSON Web Key Set
+func getJWKS(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	keySet := &struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{ctx.session.publicKeys()}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	return renderJSON(w, keySet, http.StatusOK)
+}
@@ -0,0 +1,170 @@
+package photoshare
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	refreshTokenLength   = 48
+	refreshTokenExpiry   = 30 // days
+	sessionTouchInterval = time.Minute * 5
+	maxUserAgentLength   = 255
+)
+
+var errInvalidSession = httpError{http.StatusUnauthorized, "Your session has expired, please log in again"}
+
+func newUserSession(r *http.Request, userID int64) *userSession {
+	s := &userSession{UserID: userID}
+	s.update(r)
+	return s
+}
+
+// records the device the session was last used from and extends its expiry
+func (s *userSession) update(r *http.Request) {
+	s.UserAgent = r.UserAgent()
+	if len(s.UserAgent) > maxUserAgentLength {
+		s.UserAgent = s.UserAgent[:maxUserAgentLength]
+	}
+	s.IPAddress = getRemoteIP(r)
+	s.LastSeenAt = time.Now()
+	s.ExpiresAt = s.LastSeenAt.AddDate(0, 0, refreshTokenExpiry)
+}
+
+// creates a session for the user, writing the access and refresh tokens to the headers
+func startSession(ctx *context, w http.ResponseWriter, r *http.Request, user *user) error {
+
+	refreshToken, err := generateRandomString(refreshTokenLength)
+	if err != nil {
+		return err
+	}
+
+	s := newUserSession(r, user.ID)
+	s.RefreshHash = hashToken(refreshToken)
+
+	if err := ctx.datamapper.createSession(s); err != nil {
+		return err
+	}
+
+	user.SessionID = s.ID
+	return writeSessionTokens(ctx, w, s, refreshToken)
+}
+
+func writeSessionTokens(ctx *context, w http.ResponseWriter, s *userSession, refreshToken string) error {
+	if err := ctx.session.writeToken(w, s.UserID, s.ID); err != nil {
+		return err
+	}
+	w.Header().Set(refreshTokenHeader, refreshToken)
+	return nil
+}
+
+// Exchanges the refresh token for a new access token and refresh token. If an
+// old refresh token is used it may have been stolen, so the session is revoked.
+func refreshSession(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		RefreshToken string `json:"refreshToken"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	if s.RefreshToken == "" {
+		return errInvalidSession
+	}
+
+	hash := hashToken(s.RefreshToken)
+
+	session, err := ctx.datamapper.getSessionByRefreshHash(hash)
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return errInvalidSession
+		}
+		return err
+	}
+
+	if session.RefreshHash != hash {
+		if err := ctx.datamapper.revokeSession(session.ID); err != nil {
+			return err
+		}
+		return errInvalidSession
+	}
+
+	if !session.isActive() {
+		return errInvalidSession
+	}
+
+	user, err := ctx.datamapper.getActiveUser(session.UserID)
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return errInvalidSession
+		}
+		return err
+	}
+
+	refreshToken, err := generateRandomString(refreshTokenLength)
+	if err != nil {
+		return err
+	}
+
+	session.RefreshHash = hashToken(refreshToken)
+	session.update(r)
+
+	if err := ctx.datamapper.rotateSession(session, hash); err != nil {
+		if isErrSqlNoRows(err) {
+			return errInvalidSession
+		}
+		return err
+	}
+
+	if err := writeSessionTokens(ctx, w, session, refreshToken); err != nil {
+		return err
+	}
+
+	user.IsAuthenticated = true
+	user.SessionID = session.ID
+
+	return renderJSON(w, newSessionInfo(user), http.StatusOK)
+}
+
+// the user's active sessions, most recently used first
+func getSessions(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	sessions, err := ctx.datamapper.getActiveSessions(ctx.user.ID)
+	if err != nil {
+		return err
+	}
+
+	for i := range sessions {
+		sessions[i].IsCurrent = sessions[i].ID == ctx.user.SessionID
+	}
+
+	return renderJSON(w, sessions, http.StatusOK)
+}
+
+func revokeSession(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	session, err := ctx.datamapper.getSession(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	if session.UserID != ctx.user.ID {
+		return httpError{http.StatusNotFound, "Session not found"}
+	}
+
+	if err := ctx.datamapper.revokeSession(session.ID); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Session revoked")
+}
+
+// logs out all the user's other devices
+func revokeOtherSessions(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	if err := ctx.datamapper.revokeSessions(ctx.user.ID, ctx.user.SessionID); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Sessions revoked")
+}
@@ -0,0 +1,423 @@
+package photoshare
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	jwt "github.com/dgrijalva/jwt-go"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// reads the user and session IDs as if from a valid token
+type tokenSessionManager struct {
+	mockSessionManager
+	userID, sessionID int64
+}
+
+func (m *tokenSessionManager) readToken(r *http.Request) (int64, int64, error) {
+	return m.userID, m.sessionID, nil
+}
+
+type sessionDataMapper struct {
+	mockDataMapper
+	session   *userSession
+	rotated   bool
+	revokedID int64
+}
+
+func (m *sessionDataMapper) getSession(sessionID int64) (*userSession, error) {
+	if m.session == nil || m.session.ID != sessionID {
+		return nil, sql.ErrNoRows
+	}
+	return m.session, nil
+}
+
+func (m *sessionDataMapper) getSessionByRefreshHash(hash string) (*userSession, error) {
+	if m.session == nil || (m.session.RefreshHash != hash && m.session.PreviousHash != hash) {
+		return nil, sql.ErrNoRows
+	}
+	return m.session, nil
+}
+
+func (m *sessionDataMapper) getActiveUser(userID int64) (*user, error) {
+	return &user{ID: userID, Name: "tester"}, nil
+}
+
+func (m *sessionDataMapper) rotateSession(s *userSession, previousHash string) error {
+	m.rotated = true
+	s.PreviousHash = previousHash
+	return nil
+}
+
+func (m *sessionDataMapper) revokeSession(sessionID int64) error {
+	m.revokedID = sessionID
+	return nil
+}
+
+func newTestSession(refreshToken string) *userSession {
+	return &userSession{
+		ID:          3,
+		UserID:      1,
+		RefreshHash: hashToken(refreshToken),
+		LastSeenAt:  time.Now(),
+		ExpiresAt:   time.Now().Add(time.Hour),
+	}
+}
+
+func TestAuthenticateWithActiveSession(t *testing.T) {
+
+	req, _ := http.NewRequest("GET", "http://localhost/api/auth/", nil)
+
+	app := &app{
+		datamapper: &sessionDataMapper{session: newTestSession("foo")},
+		session:    &tokenSessionManager{userID: 1, sessionID: 3},
+	}
+
+	user, err := app.authenticate(req, authLevelLogin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.IsAuthenticated || user.SessionID != 3 {
+		t.Error("User should be logged in with the session")
+	}
+}
+
+func TestAuthenticateWithRevokedSession(t *testing.T) {
+
+	req, _ := http.NewRequest("GET", "http://localhost/api/auth/", nil)
+
+	now := time.Now()
+	session := newTestSession("foo")
+	session.RevokedAt = &now
+
+	app := &app{
+		datamapper: &sessionDataMapper{session: session},
+		session:    &tokenSessionManager{userID: 1, sessionID: 3},
+	}
+
+	_, err := app.authenticate(req, authLevelLogin)
+	if err, ok := err.(httpError); !ok || err.Status != http.StatusUnauthorized {
+		t.Error("Token of revoked session should not be accepted")
+	}
+}
+
+func TestAuthenticateWithSessionOfAnotherUser(t *testing.T) {
+
+	req, _ := http.NewRequest("GET", "http://localhost/api/auth/", nil)
+
+	app := &app{
+		datamapper: &sessionDataMapper{session: newTestSession("foo")},
+		session:    &tokenSessionManager{userID: 2, sessionID: 3},
+	}
+
+	_, err := app.authenticate(req, authLevelLogin)
+	if err, ok := err.(httpError); !ok || err.Status != http.StatusUnauthorized {
+		t.Error("Token should only be accepted for its own user")
+	}
+}
+
+func TestAuthenticateWithRevokedSessionIfLoginOptional(t *testing.T) {
+
+	req, _ := http.NewRequest("GET", "http://localhost/api/photos/1", nil)
+
+	now := time.Now()
+	session := newTestSession("foo")
+	session.RevokedAt = &now
+
+	app := &app{
+		datamapper: &sessionDataMapper{session: session},
+		session:    &tokenSessionManager{userID: 1, sessionID: 3},
+	}
+
+	_, err := app.authenticate(req, authLevelCheck)
+	if err != errInvalidSession {
+		t.Error("Client should be told to log in again rather than treated as anonymous")
+	}
+}
+
+func TestRefreshSessionRotatesToken(t *testing.T) {
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/auth/refresh", strings.NewReader(`{"refreshToken": "foo"}`))
+	res := httptest.NewRecorder()
+
+	datamapper := &sessionDataMapper{session: newTestSession("foo")}
+
+	c := &context{
+		app:    &app{datamapper: datamapper, session: &mockSessionManager{}},
+		params: &params{make(map[string]string)},
+		user:   &user{},
+	}
+
+	if err := refreshSession(c, res, req); err != nil {
+		t.Fatal(err)
+	}
+	if !datamapper.rotated {
+		t.Fatal("Refresh token should be replaced")
+	}
+
+	token := res.Header().Get(refreshTokenHeader)
+	if token == "" || token == "foo" || hashToken(token) != datamapper.session.RefreshHash {
+		t.Error("New refresh token should be returned")
+	}
+}
+
+func TestRefreshSessionIfTokenReused(t *testing.T) {
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/auth/refresh", strings.NewReader(`{"refreshToken": "foo"}`))
+	res := httptest.NewRecorder()
+
+	session := newTestSession("bar")
+	session.PreviousHash = hashToken("foo")
+
+	datamapper := &sessionDataMapper{session: session}
+
+	c := &context{
+		app:    &app{datamapper: datamapper, session: &mockSessionManager{}},
+		params: &params{make(map[string]string)},
+		user:   &user{},
+	}
+
+	err := refreshSession(c, res, req)
+	if err, ok := err.(httpError); !ok || err.Status != http.StatusUnauthorized {
+		t.Error("Old refresh token should not be accepted")
+	}
+	if datamapper.revokedID != session.ID {
+		t.Error("Session should be revoked if an old refresh token is used")
+	}
+}
+
+func TestRevokeSessionOfAnotherUser(t *testing.T) {
+
+	req, _ := http.NewRequest("DELETE", "http://localhost/api/me/sessions/3", nil)
+	res := httptest.NewRecorder()
+
+	datamapper := &sessionDataMapper{session: newTestSession("foo")}
+
+	c := &context{
+		app:    &app{datamapper: datamapper},
+		params: &params{map[string]string{"id": "3"}},
+		user:   &user{ID: 2, IsAuthenticated: true},
+	}
+
+	err := revokeSession(c, res, req)
+	if err, ok := err.(httpError); !ok || err.Status != http.StatusNotFound {
+		t.Error("Other users' sessions should not be found")
+	}
+	if datamapper.revokedID != 0 {
+		t.Error("Session should not be revoked")
+	}
+}
+
+func TestLogoutRevokesSession(t *testing.T) {
+
+	req, _ := http.NewRequest("DELETE", "http://localhost/api/auth/", nil)
+	res := httptest.NewRecorder()
+
+	datamapper := &sessionDataMapper{}
+
+	c := &context{
+		app:    &app{datamapper: datamapper},
+		params: &params{make(map[string]string)},
+		user:   &user{ID: 1, Name: "tester", SessionID: 3, IsAuthenticated: true},
+	}
+
+	if err := logout(c, res, req); err != nil {
+		t.Fatal(err)
+	}
+	if datamapper.revokedID != 3 {
+		t.Error("Current session should be revoked")
+	}
+}
+
+func newTestKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newTestSessionManager(kid string, key *rsa.PrivateKey) *defaultSessionManager {
+	return &defaultSessionManager{
+		keys:      map[string]*rsa.PublicKey{kid: &key.PublicKey},
+		signKeyID: kid,
+		signKey:   key,
+	}
+}
+
+func readTestToken(mgr sessionManager, token string) (int64, int64) {
+	req, _ := http.NewRequest("GET", "http://localhost/api/auth/", nil)
+	req.Header.Set(tokenHeader, token)
+	userID, sessionID, _ := mgr.readToken(req)
+	return userID, sessionID
+}
+
+func TestSessionToken(t *testing.T) {
+
+	mgr := newTestSessionManager("first", newTestKey(t))
+
+	token, err := mgr.createToken(1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if userID, sessionID := readTestToken(mgr, token); userID != 1 || sessionID != 3 {
+		t.Errorf("Token should have user and session IDs, got %d %d", userID, sessionID)
+	}
+
+	parsed, _ := jwt.Parse(token, func(*jwt.Token) (interface{}, error) { return mgr.keys["first"], nil })
+	if parsed.Header["kid"] != "first" || parsed.Header["alg"] != "RS256" {
+		t.Error("Token header should have the key ID")
+	}
+
+	if userID, _ := readTestToken(mgr, token[:len(token)-4]+"AAAA"); userID != 0 {
+		t.Error("Token with invalid signature should not be accepted")
+	}
+}
+
+func TestSessionTokenAfterKeyRotation(t *testing.T) {
+
+	oldKey := newTestKey(t)
+	oldMgr := newTestSessionManager("old", oldKey)
+
+	token, err := oldMgr.createToken(1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mgr := newTestSessionManager("new", newTestKey(t))
+
+	if userID, _ := readTestToken(mgr, token); userID != 0 {
+		t.Error("Token signed with unknown key should not be accepted")
+	}
+
+	mgr.keys["old"] = &oldKey.PublicKey
+
+	if userID, _ := readTestToken(mgr, token); userID != 1 {
+		t.Error("Token signed with retired key should be accepted")
+	}
+}
+
+func newTestToken(method jwt.SigningMethod, key interface{}, expires time.Time) string {
+	token := jwt.New(method)
+	token.Header["kid"] = "first"
+	token.Claims["uid"] = "1"
+	token.Claims["sid"] = "3"
+	token.Claims["exp"] = expires.Unix()
+	tokenString, _ := token.SignedString(key)
+	return tokenString
+}
+
+func TestSessionTokenWithOtherAlgorithm(t *testing.T) {
+
+	key := newTestKey(t)
+	mgr := newTestSessionManager("first", key)
+
+	parts := strings.Split(newTestToken(jwt.SigningMethodRS256, key, time.Now().Add(time.Hour)), ".")
+	header, _ := json.Marshal(map[string]string{"alg": "none", "typ": "JWT", "kid": "first"})
+	if userID, _ := readTestToken(mgr, jwt.EncodeSegment(header)+"."+parts[1]+"."); userID != 0 {
+		t.Error("Unsigned token should not be accepted")
+	}
+
+	// the public key is known to everyone, so must not be usable as an HMAC secret
+	publicKey, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	for _, secret := range [][]byte{publicKey, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey})} {
+		token := newTestToken(jwt.SigningMethodHS256, secret, time.Now().Add(time.Hour))
+		if userID, _ := readTestToken(mgr, token); userID != 0 {
+			t.Error("HS256 token should not be accepted")
+		}
+	}
+}
+
+func TestSessionTokenIfExpired(t *testing.T) {
+
+	key := newTestKey(t)
+	mgr := newTestSessionManager("first", key)
+
+	token := newTestToken(jwt.SigningMethodRS256, key, time.Now().Add(-time.Minute))
+
+	req, _ := http.NewRequest("GET", "http://localhost/api/auth/", nil)
+	req.Header.Set(tokenHeader, token)
+	if userID, _, err := mgr.readToken(req); userID != 0 || err != errInvalidSession {
+		t.Error("Expired token should not be accepted")
+	}
+}
+
+func writeTestKeyFile(t *testing.T, filename, kind string, data []byte) {
+	if err := ioutil.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: data}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewSessionManagerWithKeysDir(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldKey, newKey := newTestKey(t), newTestKey(t)
+
+	oldPublic, _ := x509.MarshalPKIXPublicKey(&oldKey.PublicKey)
+	newPublic, _ := x509.MarshalPKIXPublicKey(&newKey.PublicKey)
+
+	writeTestKeyFile(t, filepath.Join(dir, "2015.pub"), "PUBLIC KEY", oldPublic)
+	writeTestKeyFile(t, filepath.Join(dir, "2016.pub"), "PUBLIC KEY", newPublic)
+	writeTestKeyFile(t, filepath.Join(dir, "2016"), "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(newKey))
+
+	mgr, err := newSessionManager(&config{KeysDir: dir, SigningKeyID: "2016"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := mgr.publicKeys()
+	if len(keys) != 2 || keys[0].Kid != "2015" || keys[1].Kid != "2016" {
+		t.Fatalf("Both keys should be loaded, got %v", keys)
+	}
+
+	key, err := keys[0].rsaPublicKey()
+	if err != nil || key.N.Cmp(oldKey.N) != 0 || key.E != oldKey.E {
+		t.Error("Public key should be encoded as JSON Web Key")
+	}
+
+	if _, err := newSessionManager(&config{KeysDir: dir, SigningKeyID: "2015"}); err == nil {
+		t.Error("Signing key should have a private key")
+	}
+}
+
+func TestGetJWKS(t *testing.T) {
+
+	req, _ := http.NewRequest("GET", "http://localhost/.well-known/jwks.json", nil)
+	res := httptest.NewRecorder()
+
+	c := &context{
+		app:    &app{session: newTestSessionManager("first", newTestKey(t))},
+		params: &params{make(map[string]string)},
+		user:   &user{},
+	}
+
+	if err := getJWKS(c, res, req); err != nil {
+		t.Fatal(err)
+	}
+
+	keySet := &struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	if err := json.Unmarshal(res.Body.Bytes(), keySet); err != nil {
+		t.Fatal(err)
+	}
+	if len(keySet.Keys) != 1 || keySet.Keys[0].Kid != "first" || keySet.Keys[0].Alg != "RS256" {
+		t.Error("Key set should have the signing key")
+	}
+}
@@ -0,0 +1,171 @@
+package photoshare
+
+import (
+	"net/http"
+	"time"
+)
+
+const sharePasswordHeader = "X-Share-Password"
+
+var errSharePasswordRequired = httpError{http.StatusUnauthorized, "Password required"}
+
+// returned once on creation, as we only store a hash of the token
+type shareLink struct {
+	*share
+	Token string `json:"token"`
+	URL   string `json:"url"`
+}
+
+func createShare(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	if err := ctx.checkVerified(restrictShare); err != nil {
+		return err
+	}
+
+	s := &struct {
+		PhotoID   int64      `json:"photoId"`
+		AlbumID   int64      `json:"albumId"`
+		Password  string     `json:"password"`
+		ExpiresAt *time.Time `json:"expiresAt"`
+		MaxViews  int64      `json:"maxViews"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	share := &share{
+		OwnerID:   ctx.user.ID,
+		PhotoID:   s.PhotoID,
+		AlbumID:   s.AlbumID,
+		Password:  s.Password,
+		ExpiresAt: s.ExpiresAt,
+		MaxViews:  s.MaxViews,
+	}
+
+	if err := ctx.validate(share, r); err != nil {
+		return err
+	}
+
+	// you can only share what you can edit
+	if share.PhotoID != 0 {
+		photo, err := ctx.datamapper.getPhoto(share.PhotoID)
+		if err != nil {
+			return err
+		}
+		if !photo.canEdit(ctx.user) {
+			return httpError{http.StatusForbidden, "You're not allowed to share this photo"}
+		}
+	} else {
+		album, err := ctx.datamapper.getAlbum(share.AlbumID)
+		if err != nil {
+			return err
+		}
+		if !album.canEdit(ctx.user) {
+			return httpError{http.StatusForbidden, "You're not allowed to share this album"}
+		}
+	}
+
+	token, err := share.generateToken()
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.createShare(share); err != nil {
+		return err
+	}
+
+	// this is the only time the token is available
+	return renderJSON(w, &shareLink{
+		share,
+		token,
+		getBaseURL(r) + "/s/" + token,
+	}, http.StatusCreated)
+}
+
+func getShares(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	shares, err := ctx.datamapper.getSharesByOwnerID(getPage(r), ctx.user.ID)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, shares, http.StatusOK)
+}
+
+func deleteShare(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	share, err := ctx.datamapper.getShare(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	if !share.canDelete(ctx.user) {
+		return httpError{http.StatusForbidden, "You're not allowed to revoke this share"}
+	}
+
+	if err := ctx.datamapper.removeShare(share); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Share revoked")
+}
+
+// Renders the shared photo or album. The password is sent in a header or posted,
+// never in the URL where it would be logged, and guesses are limited like logins.
+func viewShare(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	share, err := ctx.datamapper.getShareByToken(ctx.params.get("token"))
+	if err != nil {
+		return err
+	}
+
+	if share.isExpired() {
+		return httpError{http.StatusNotFound, "This link has expired"}
+	}
+
+	if share.Password != "" {
+		if err := checkSharePassword(ctx, w, r, share); err != nil {
+			return err
+		}
+	}
+
+	ok, err := ctx.datamapper.registerShareView(share)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return httpError{http.StatusNotFound, "This link has expired"}
+	}
+
+	if share.PhotoID != 0 {
+		return renderPhotoDetail(ctx, w, share.PhotoID, share)
+	}
+	return renderAlbumDetail(ctx, w, r, share.AlbumID, share)
+}
+
+func checkSharePassword(ctx *context, w http.ResponseWriter, r *http.Request, share *share) error {
+
+	password := r.Header.Get(sharePasswordHeader)
+	if password == "" && r.Method == "POST" {
+		password = r.PostFormValue("password")
+	}
+	// nothing to guess yet, so the client is only asked for the password
+	if password == "" {
+		return errSharePasswordRequired
+	}
+
+	attempt, err := ctx.limiter.reserveShare(share.ID, getRemoteIP(r), time.Now())
+	if err != nil {
+		return err
+	}
+	if err := refuseLoginAttempt(w, attempt); err != nil {
+		return err
+	}
+
+	if !share.checkPassword(password) {
+		if err := ctx.limiter.fail(getRemoteIP(r), time.Now()); err != nil {
+			return err
+		}
+		return errSharePasswordRequired
+	}
+	return ctx.limiter.resetShare(share.ID)
+}
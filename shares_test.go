@@ -0,0 +1,132 @@
+package photoshare
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestShareIsExpired(t *testing.T) {
+	share := &share{PhotoID: 1}
+	if share.isExpired() {
+		t.Error("Share without expiry or view limit should not expire")
+	}
+
+	yesterday := time.Now().Add(-time.Hour * 24)
+	share.ExpiresAt = &yesterday
+	if !share.isExpired() {
+		t.Error("Share should have expired")
+	}
+
+	share.ExpiresAt = nil
+	share.MaxViews = 3
+	share.NumViews = 3
+	if !share.isExpired() {
+		t.Error("Share should expire once max views reached")
+	}
+}
+
+func TestShareGrants(t *testing.T) {
+	var grant *share
+	if grant.grantsPhoto(1) || grant.grantsAlbum(1) {
+		t.Error("Nil share should not grant access")
+	}
+
+	grant = &share{PhotoID: 1}
+	if !grant.grantsPhoto(1) {
+		t.Error("Share should grant access to its photo")
+	}
+	if grant.grantsPhoto(2) || grant.grantsAlbum(1) {
+		t.Error("Share should only grant access to its photo")
+	}
+}
+
+func TestShareToken(t *testing.T) {
+	share := &share{PhotoID: 1}
+	token, err := share.generateToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token) != shareTokenLength {
+		t.Errorf("Token should be %d characters, got %d", shareTokenLength, len(token))
+	}
+	if share.TokenHash == token || share.TokenHash != hashToken(token) {
+		t.Error("Only the token hash should be stored")
+	}
+}
+
+func TestViewShareIfNone(t *testing.T) {
+
+	req := &http.Request{}
+	res := httptest.NewRecorder()
+
+	app := &app{
+		datamapper: &mockDataMapper{},
+	}
+
+	c := &context{
+		app:    app,
+		params: &params{map[string]string{"token": "abc123"}},
+		user:   &user{},
+	}
+
+	err := viewShare(c, res, req)
+	if err != sql.ErrNoRows {
+		t.Fail()
+	}
+}
+
+type passwordShareDataMapper struct {
+	mockDataMapper
+	share *share
+}
+
+func (m *passwordShareDataMapper) getShareByToken(token string) (*share, error) {
+	return m.share, nil
+}
+
+func newPasswordShareContext(t *testing.T) *context {
+	share := &share{ID: 1, PhotoID: 1, Password: "secret"}
+	if err := share.PreInsert(nil); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestContext(&passwordShareDataMapper{share: share}, &user{})
+	c.params.vars["token"] = "abc123"
+	return c
+}
+
+func TestViewShareIfPasswordInURL(t *testing.T) {
+
+	req, _ := http.NewRequest("GET", "http://localhost/s/abc123?password=secret", nil)
+
+	err := viewShare(newPasswordShareContext(t), httptest.NewRecorder(), req)
+	if err != errSharePasswordRequired {
+		t.Errorf("Password in the URL should not be accepted, got %v", err)
+	}
+}
+
+func TestViewShareIfTooManyWrongPasswords(t *testing.T) {
+
+	c := newPasswordShareContext(t)
+
+	for i := 0; i < accountFreeFailures; i++ {
+		req, _ := http.NewRequest("GET", "http://localhost/s/abc123", nil)
+		req.Header.Set(sharePasswordHeader, "wrong")
+		if err := viewShare(c, httptest.NewRecorder(), req); err != errSharePasswordRequired {
+			t.Fatalf("Wrong password should be refused, got %v", err)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost/s/abc123", nil)
+	req.Header.Set(sharePasswordHeader, "secret")
+	res := httptest.NewRecorder()
+
+	if err := viewShare(c, res, req); err != errTooManyLogins {
+		t.Fatalf("Guesses should be limited, got %v", err)
+	}
+	if res.Header().Get("Retry-After") == "" {
+		t.Error("Client should be told when to retry")
+	}
+}
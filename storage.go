@@ -58,42 +58,100 @@ func generateRandomFilename(contentType string) string {
 	return uniuri.New() + ext
 }
 
+// Private files are kept outside the public directory, so they can only be
+// reached through signed media URLs.
 type fileStorage interface {
 	clean(string) error
-	store(readable, string, string) error
+	store(readable, string, string, bool) error
+	setPrivate(string, bool) error
+	path(string, bool, bool) string
 }
 
 func newFileStorage(cfg *config) fileStorage {
 	return &defaultFileStorage{
 		cfg.UploadsDir,
 		cfg.ThumbnailsDir,
+		cfg.PrivateUploadsDir,
+		cfg.PrivateThumbnailsDir,
 	}
 }
 
 type defaultFileStorage struct {
-	uploadsDir, thumbnailsDir string
+	uploadsDir, thumbnailsDir               string
+	privateUploadsDir, privateThumbnailsDir string
 }
 
+func (f *defaultFileStorage) dirs(private bool) (string, string) {
+	if private {
+		return f.privateUploadsDir, f.privateThumbnailsDir
+	}
+	return f.uploadsDir, f.thumbnailsDir
+}
+
+// returns full path of the original image or thumbnail
+func (f *defaultFileStorage) path(name string, thumbnail, private bool) string {
+	uploadsDir, thumbnailsDir := f.dirs(private)
+	if thumbnail {
+		return path.Join(thumbnailsDir, name)
+	}
+	return path.Join(uploadsDir, name)
+}
+
+// removes files from both public and private locations
 func (f *defaultFileStorage) clean(name string) error {
 
-	imagePath := path.Join(f.uploadsDir, name)
-	thumbnailPath := path.Join(f.thumbnailsDir, name)
+	var removed bool
+
+	for _, private := range []bool{false, true} {
+		for _, thumbnail := range []bool{false, true} {
+			err := os.Remove(f.path(name, thumbnail, private))
+			if err == nil {
+				removed = true
+				continue
+			}
+			if !os.IsNotExist(err) {
+				return errgo.Mask(err)
+			}
+		}
+	}
+	if !removed {
+		return errgo.Newf("no files found for %s", name)
+	}
+	return nil
+}
 
-	if err := os.Remove(imagePath); err != nil {
-		return errgo.Mask(err)
+// moves the image and thumbnail between the public and private directories
+func (f *defaultFileStorage) setPrivate(name string, private bool) error {
+
+	uploadsDir, thumbnailsDir := f.dirs(private)
+
+	for _, dir := range []string{uploadsDir, thumbnailsDir} {
+		if err := os.MkdirAll(dir, 0777); err != nil && !os.IsExist(err) {
+			return errgo.Mask(err)
+		}
 	}
-	if err := os.Remove(thumbnailPath); err != nil {
-		return errgo.Mask(err)
+
+	for _, thumbnail := range []bool{false, true} {
+		src := f.path(name, thumbnail, !private)
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			continue // already moved
+		}
+		if err := os.Rename(src, f.path(name, thumbnail, private)); err != nil {
+			return errgo.Mask(err)
+		}
 	}
 	return nil
 }
 
-func (f *defaultFileStorage) store(src readable, filename, contentType string) error {
-	if err := os.MkdirAll(f.uploadsDir, 0777); err != nil && !os.IsExist(err) {
+func (f *defaultFileStorage) store(src readable, filename, contentType string, private bool) error {
+
+	uploadsDir, thumbnailsDir := f.dirs(private)
+
+	if err := os.MkdirAll(uploadsDir, 0777); err != nil && !os.IsExist(err) {
 		return errgo.Mask(err)
 	}
 
-	if err := os.MkdirAll(f.thumbnailsDir, 0777); err != nil && !os.IsExist(err) {
+	if err := os.MkdirAll(thumbnailsDir, 0777); err != nil && !os.IsExist(err) {
 		return errgo.Mask(err)
 	}
 
@@ -127,7 +185,7 @@ func (f *defaultFileStorage) store(src readable, filename, contentType string) e
 	thumb := image.NewRGBA(image.Rect(0, 0, thumbnailWidth, thumbnailHeight))
 	graphics.Thumbnail(thumb, img)
 
-	dst, err := os.Create(path.Join(f.thumbnailsDir, filename))
+	dst, err := os.Create(path.Join(thumbnailsDir, filename))
 	if err != nil {
 		return errgo.Mask(err)
 	}
@@ -161,7 +219,7 @@ func (f *defaultFileStorage) store(src readable, filename, contentType string) e
 
 	src.Seek(0, 0)
 
-	dst, err = os.Create(path.Join(f.uploadsDir, filename))
+	dst, err = os.Create(path.Join(uploadsDir, filename))
 
 	if err != nil {
 		return errgo.Mask(err)
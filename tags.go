@@ -0,0 +1,300 @@
+package photoshare
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultTagSuggestions = 10
+	maxTagSuggestions     = 50
+)
+
+// suggests tags for autocomplete. Suggestions for logged in users
+// include their own tags first, so are not cached.
+func suggestTags(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	q := normalizeTag(strings.TrimPrefix(strings.TrimSpace(r.FormValue("q")), "#"))
+	if q == "" {
+		return renderJSON(w, []tagSuggestion{}, http.StatusOK)
+	}
+
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultTagSuggestions
+	} else if limit > maxTagSuggestions {
+		limit = maxTagSuggestions
+	}
+
+	if ctx.user.IsAuthenticated {
+		tags, err := ctx.datamapper.suggestTags(q, ctx.user.ID, limit)
+		if err != nil {
+			return err
+		}
+		return renderJSON(w, tags, http.StatusOK)
+	}
+
+	cacheKey := fmt.Sprintf("tags:suggest:%s:%d", q, limit)
+
+	return ctx.cache.render(w, http.StatusOK, cacheKey, func() (interface{}, error) {
+		tags, err := ctx.datamapper.suggestTags(q, 0, limit)
+		if err != nil {
+			return tags, err
+		}
+		return tags, nil
+	})
+}
+
+// Checks the names a tag and its descendants will get when it is renamed, or when it is
+// merged and its descendants moved under the target. When merging, the tag itself and any
+// descendant whose new name is taken are merged, so only renamed tags must not collide.
+func checkNewTagNames(ctx *context, t *tag, name string, merging bool) error {
+
+	descendants, err := ctx.datamapper.getTagDescendants(t)
+	if err != nil {
+		return err
+	}
+	if !merging {
+		descendants = append([]tag{*t}, descendants...)
+	}
+
+	for _, d := range descendants {
+		newName := name + strings.TrimPrefix(d.Name, t.Name)
+		existing, err := ctx.datamapper.getTagByName(newName)
+		if err == nil {
+			if merging {
+				continue
+			}
+			if existing.ID != d.ID {
+				return httpError{http.StatusConflict, fmt.Sprintf("A tag named %s already exists, merge the tags instead", newName)}
+			}
+		} else if !isErrSqlNoRows(err) {
+			return err
+		}
+		if blocked, err := ctx.datamapper.isTagBlocked(newName); err != nil {
+			return err
+		} else if blocked {
+			return httpError{http.StatusBadRequest, fmt.Sprintf("The tag name %s is blocked", newName)}
+		}
+		if synonym, err := ctx.datamapper.getTagSynonymByName(newName); err == nil {
+			if synonym.TagID != d.ID {
+				return httpError{http.StatusConflict, fmt.Sprintf("%s is a synonym of another tag", newName)}
+			}
+		} else if !isErrSqlNoRows(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// tag management is for admins only: changes apply to everyone's photos
+
+func renameTag(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	tag, err := ctx.datamapper.getTag(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	s := &struct {
+		Name string `json:"name"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	name := normalizeTag(s.Name)
+
+	if msg := validateTagName(name); msg != "" {
+		return validationFailure{map[string]string{"name": msg}}
+	}
+
+	if isDescendantTag(name, tag.Name) {
+		return httpError{http.StatusBadRequest, "A tag cannot be moved under itself"}
+	}
+
+	if name != tag.Name {
+		if err := checkNewTagNames(ctx, tag, name, false); err != nil {
+			return err
+		}
+		if err := ctx.datamapper.renameTag(tag, name); err != nil {
+			return err
+		}
+		if err := ctx.cache.clear(); err != nil {
+			logError(err)
+		}
+	}
+
+	return renderJSON(w, tag, http.StatusOK)
+}
+
+// moves all photos of a tag to another tag, and deletes it
+func mergeTag(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	source, err := ctx.datamapper.getTag(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	s := &struct {
+		Into int64 `json:"into"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	if s.Into == source.ID {
+		return httpError{http.StatusBadRequest, "Cannot merge a tag into itself"}
+	}
+
+	target, err := ctx.datamapper.getTag(s.Into)
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return httpError{http.StatusBadRequest, "Tag not found"}
+		}
+		return err
+	}
+
+	if isDescendantTag(target.Name, source.Name) {
+		return httpError{http.StatusBadRequest, "A tag cannot be merged into one of its descendants"}
+	}
+
+	if err := checkNewTagNames(ctx, source, target.Name, true); err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.mergeTags(source, target); err != nil {
+		return err
+	}
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	return renderJSON(w, target, http.StatusOK)
+}
+
+func getTagSynonyms(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	synonyms, err := ctx.datamapper.getTagSynonyms()
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, synonyms, http.StatusOK)
+}
+
+func addTagSynonym(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Name  string `json:"name"`
+		TagID int64  `json:"tagId"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	synonym := &tagSynonym{
+		Name:  normalizeTag(s.Name),
+		TagID: s.TagID,
+	}
+
+	if synonym.TagID != 0 {
+		tag, err := ctx.datamapper.getTag(synonym.TagID)
+		if err != nil {
+			if isErrSqlNoRows(err) {
+				return httpError{http.StatusBadRequest, "Tag not found"}
+			}
+			return err
+		}
+		synonym.TagName = tag.Name
+	}
+
+	if isDescendantTag(synonym.TagName, synonym.Name) {
+		return httpError{http.StatusBadRequest, "A tag cannot be a synonym of one of its descendants"}
+	}
+
+	if err := ctx.validate(synonym, r); err != nil {
+		return err
+	}
+	if err := ctx.datamapper.addTagSynonym(synonym); err != nil {
+		return err
+	}
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	return renderJSON(w, synonym, http.StatusCreated)
+}
+
+func removeTagSynonym(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	synonym, err := ctx.datamapper.getTagSynonym(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+	if err := ctx.datamapper.removeTagSynonym(synonym); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Synonym removed")
+}
+
+func getBlockedTags(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	blocked, err := ctx.datamapper.getBlockedTags()
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, blocked, http.StatusOK)
+}
+
+func blockTag(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Name string `json:"name"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	blocked := &blockedTag{Name: normalizeTag(s.Name)}
+
+	if err := ctx.validate(blocked, r); err != nil {
+		return err
+	}
+	if err := ctx.datamapper.blockTag(blocked); err != nil {
+		return err
+	}
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	return renderJSON(w, blocked, http.StatusCreated)
+}
+
+func unblockTag(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	blocked, err := ctx.datamapper.getBlockedTag(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+	if err := ctx.datamapper.unblockTag(blocked); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Tag unblocked")
+}
+
+// returns the tag hierarchy of tags with public photos
+func getTagTree(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	return ctx.cache.render(w, http.StatusOK, "tags:tree", func() (interface{}, error) {
+		tags, err := ctx.datamapper.getTagHierarchy()
+		if err != nil {
+			return nil, err
+		}
+		return newTagTree(tags), nil
+	})
+}
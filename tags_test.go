@@ -0,0 +1,222 @@
+package photoshare
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTag(t *testing.T) {
+	if name := normalizeTag("  NewYork "); name != "newyork" {
+		t.Errorf("Tag should be normalized, got %q", name)
+	}
+}
+
+func TestTagSynonymValidate(t *testing.T) {
+	synonym := &tagSynonym{Name: "nyc", TagID: 1, TagName: "nyc"}
+	errors := make(map[string]string)
+	if err := synonym.validate(nil, nil, errors); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := errors["name"]; !ok {
+		t.Error("Synonym should not be the same as the tag")
+	}
+
+	synonym = &tagSynonym{Name: "new york", TagID: 1, TagName: "newyork"}
+	errors = make(map[string]string)
+	synonym.validate(nil, nil, errors)
+	if _, ok := errors["name"]; !ok {
+		t.Error("Synonym should not contain spaces")
+	}
+
+	synonym = &tagSynonym{Name: "nyc", TagID: 1, TagName: "newyork"}
+	errors = make(map[string]string)
+	synonym.validate(nil, nil, errors)
+	if len(errors) != 0 {
+		t.Errorf("Synonym should be valid, got %v", errors)
+	}
+}
+
+func TestBlockedTagValidate(t *testing.T) {
+	blocked := &blockedTag{}
+	errors := make(map[string]string)
+	blocked.validate(nil, nil, errors)
+	if _, ok := errors["name"]; !ok {
+		t.Error("Blocked tag should have a name")
+	}
+}
+
+func TestSuggestTags(t *testing.T) {
+
+	req, _ := http.NewRequest("GET", "/api/tags/suggest?q=%23Travel", nil)
+	res := httptest.NewRecorder()
+
+	app := &app{
+		datamapper: &mockDataMapper{},
+		cache:      &mockCache{},
+	}
+
+	c := &context{
+		app:    app,
+		params: &params{},
+		user:   &user{},
+	}
+
+	if err := suggestTags(c, res, req); err != nil {
+		t.Fatal(err)
+	}
+	var tags []tagSuggestion
+	parseJSONBody(res, &tags)
+	if len(tags) != 1 || tags[0].Name != "travels" {
+		t.Errorf("Query should be normalized, got %v", tags)
+	}
+}
+
+func TestNormalizeHierarchicalTag(t *testing.T) {
+	if name := normalizeTag("/Travel// Europe /paris/"); name != "travel/europe/paris" {
+		t.Errorf("Tag path should be normalized, got %q", name)
+	}
+	if parent := parentTagName("travel/europe/paris"); parent != "travel/europe" {
+		t.Errorf("Wrong parent %q", parent)
+	}
+	if parent := parentTagName("travel"); parent != "" {
+		t.Errorf("Top level tag should have no parent, got %q", parent)
+	}
+	if !isDescendantTag("travel/europe", "travel") || isDescendantTag("travelling", "travel") {
+		t.Error("Descendant check failed")
+	}
+}
+
+func TestNewTagTree(t *testing.T) {
+	tags := []tag{
+		{ID: 1, Name: "travel"},
+		{ID: 2, ParentID: 1, Name: "travel/europe"},
+		{ID: 3, ParentID: 2, Name: "travel/europe/paris", NumPhotos: 2},
+		{ID: 4, ParentID: 1, Name: "travel/empty"},
+		{ID: 5, Name: "cats", NumPhotos: 1},
+	}
+
+	tree := newTagTree(tags)
+	if len(tree) != 2 {
+		t.Fatalf("There should be 2 top level tags, got %d", len(tree))
+	}
+	travel := tree[0]
+	if travel.Name != "travel" || len(travel.Children) != 1 {
+		t.Fatal("Empty branches should be pruned")
+	}
+	paris := travel.Children[0].Children[0]
+	if paris.Label != "paris" || paris.NumPhotos != 2 {
+		t.Errorf("Wrong leaf %v", paris)
+	}
+}
+
+type renameTagDataMapper struct {
+	mockDataMapper
+}
+
+func (m *renameTagDataMapper) getTag(tagID int64) (*tag, error) {
+	if tagID == 3 {
+		return &tag{ID: tagID, Name: "newyork/brooklyn", ParentID: 1}, nil
+	}
+	if tagID == 2 {
+		return &tag{ID: tagID, Name: "usa/newyork"}, nil
+	}
+	return &tag{ID: tagID, Name: "newyork"}, nil
+}
+
+func (m *renameTagDataMapper) getTagDescendants(ancestor *tag) ([]tag, error) {
+	if ancestor.ID == 1 {
+		return []tag{{ID: 3, Name: "newyork/brooklyn", ParentID: 1}}, nil
+	}
+	return []tag{}, nil
+}
+
+func (m *renameTagDataMapper) getTagByName(name string) (*tag, error) {
+	if name == "taken/brooklyn" {
+		return &tag{ID: 4, Name: name}, nil
+	}
+	return m.mockDataMapper.getTagByName(name)
+}
+
+func (m *renameTagDataMapper) isTagBlocked(name string) (bool, error) {
+	return name == "spam" || name == "blocked/brooklyn", nil
+}
+
+func (m *renameTagDataMapper) getTagSynonymByName(name string) (*tagSynonym, error) {
+	if name == "paris" {
+		return &tagSynonym{ID: 1, Name: name, TagID: 2, TagName: "france/paris"}, nil
+	}
+	return m.mockDataMapper.getTagSynonymByName(name)
+}
+
+func renameTestTag(name string) error {
+	req, _ := http.NewRequest("PATCH", "http://localhost/api/tags/1", strings.NewReader(`{"name": "`+name+`"}`))
+	res := httptest.NewRecorder()
+
+	c := &context{
+		app:    &app{datamapper: &renameTagDataMapper{}, cache: &mockCache{}},
+		params: &params{map[string]string{"id": "1"}},
+		user:   &user{ID: 1, IsAdmin: true},
+	}
+	return renameTag(c, res, req)
+}
+
+func TestRenameTagIfBlocked(t *testing.T) {
+	err := renameTestTag("spam")
+	if err, ok := err.(httpError); !ok || err.Status != http.StatusBadRequest {
+		t.Errorf("Tag should not be renamed to a blocked name, got %v", err)
+	}
+}
+
+func TestRenameTagIfSynonymOfAnotherTag(t *testing.T) {
+	err := renameTestTag("paris")
+	if err, ok := err.(httpError); !ok || err.Status != http.StatusConflict {
+		t.Errorf("Tag should not be renamed to a synonym of another tag, got %v", err)
+	}
+}
+
+func TestRenameTag(t *testing.T) {
+	if err := renameTestTag("nyc"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRenameTagIfDescendantNameTaken(t *testing.T) {
+	err := renameTestTag("taken")
+	if err, ok := err.(httpError); !ok || err.Status != http.StatusConflict {
+		t.Errorf("Tag should not be renamed if a descendant's new name is taken, got %v", err)
+	}
+}
+
+func TestRenameTagIfDescendantNameBlocked(t *testing.T) {
+	err := renameTestTag("blocked")
+	if err, ok := err.(httpError); !ok || err.Status != http.StatusBadRequest {
+		t.Errorf("Tag should not be renamed if a descendant's new name is blocked, got %v", err)
+	}
+}
+
+func mergeTestTag(into string) error {
+	req, _ := http.NewRequest("POST", "http://localhost/api/tags/1/merge", strings.NewReader(`{"into": `+into+`}`))
+	res := httptest.NewRecorder()
+
+	c := &context{
+		app:    &app{datamapper: &renameTagDataMapper{}, cache: &mockCache{}},
+		params: &params{map[string]string{"id": "1"}},
+		user:   &user{ID: 1, IsAdmin: true},
+	}
+	return mergeTag(c, res, req)
+}
+
+func TestMergeTagIntoDescendant(t *testing.T) {
+	err := mergeTestTag("3")
+	if err, ok := err.(httpError); !ok || err.Status != http.StatusBadRequest {
+		t.Errorf("Tag should not be merged into its descendant, got %v", err)
+	}
+}
+
+func TestMergeTag(t *testing.T) {
+	if err := mergeTestTag("2"); err != nil {
+		t.Error(err)
+	}
+}
@@ -20,7 +20,9 @@ type testDB struct {
 }
 
 func (tdb *testDB) clean() {
-	var tables = []string{"photo_tags", "tags", "photos", "users"}
+	var tables = []string{"api_tokens", "login_failures", "password_resets", "email_verifications", "login_challenges",
+		"recovery_codes", "sessions", "audit_log", "auth_codes", "user_identities",
+		"blocked_tags", "tag_synonyms", "shares", "favorites", "follows", "comments", "album_photos", "albums", "photo_tags", "tags", "photos", "users"}
 	for _, table := range tables {
 		if _, err := tdb.dbMap.Exec("DELETE FROM " + table); err != nil {
 			panic(err)
@@ -0,0 +1,90 @@
+package photoshare
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"github.com/juju/errgo"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// time-based one-time passwords as in RFC 6238, with the defaults authenticator
+// apps expect: HMAC-SHA1, 6 digits and a 30 second step
+const (
+	totpDigits       = 6
+	totpPeriod       = 30 // seconds
+	totpSkew         = 1  // steps either side of now, for clock drift
+	totpSecretLength = 20 // bytes, a multiple of 5 so the base32 secret has no padding
+	totpIssuer       = "photoshare"
+)
+
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, totpSecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return "", errgo.Mask(err)
+	}
+	return base32.StdEncoding.EncodeToString(secret), nil
+}
+
+// the otpauth:// URI authenticator apps scan as a QR code
+func totpProvisioningURI(secret, accountName string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", totpIssuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprintf("%d", totpDigits))
+	q.Set("period", fmt.Sprintf("%d", totpPeriod))
+	label := strings.Replace(url.QueryEscape(totpIssuer+":"+accountName), "+", "%20", -1)
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// the HOTP value of RFC 4226 for the counter
+func hotp(key []byte, counter uint64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+// Checks the code against the steps around now, returning the matching step.
+// Steps up to lastStep have been used already and are refused.
+func validateTOTP(secret, code string, lastStep int64, now time.Time) (int64, bool) {
+
+	key, err := base32.StdEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := totpStep(now)
+
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(key, uint64(step), totpDigits)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
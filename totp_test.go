@@ -0,0 +1,80 @@
+package photoshare
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the SHA1 test vectors from RFC 6238 appendix B, which use 8 digits
+func TestHOTPRFC6238Vectors(t *testing.T) {
+
+	key := []byte("12345678901234567890")
+
+	vectors := []struct {
+		time int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, v := range vectors {
+		step := totpStep(time.Unix(v.time, 0))
+		if code := hotp(key, uint64(step), 8); code != v.code {
+			t.Errorf("Code at %d should be %s, got %s", v.time, v.code, code)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111111, 0)
+
+	// the last 6 digits of the 8 digit code
+	step, ok := validateTOTP(secret, "050471", 0, now)
+	if !ok || step != totpStep(now) {
+		t.Fatal("Code for the current step should be valid")
+	}
+
+	if _, ok := validateTOTP(secret, "050471", step, now); ok {
+		t.Error("Code should not be used twice")
+	}
+
+	if _, ok := validateTOTP(secret, "050471", 0, now.Add(time.Second*totpPeriod)); !ok {
+		t.Error("Code for the previous step should be valid")
+	}
+
+	if _, ok := validateTOTP(secret, "050471", 0, now.Add(time.Second*totpPeriod*3)); ok {
+		t.Error("Old code should not be valid")
+	}
+
+	if _, ok := validateTOTP(secret, "123456", 0, now); ok {
+		t.Error("Wrong code should not be valid")
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret) != 32 || strings.Contains(secret, "=") {
+		t.Errorf("Secret should be 32 base32 characters, got %s", secret)
+	}
+
+	uri := totpProvisioningURI(secret, "dan jacob")
+	if !strings.HasPrefix(uri, "otpauth://totp/photoshare%3Adan%20jacob?") {
+		t.Errorf("URI should have issuer and account name, got %s", uri)
+	}
+	if !strings.Contains(uri, "secret="+secret) || !strings.Contains(uri, "issuer=photoshare") {
+		t.Errorf("URI should have secret and issuer, got %s", uri)
+	}
+}
@@ -0,0 +1,131 @@
+package photoshare
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	trashPurgeInterval  = time.Hour
+	trashPurgeBatchSize = 100
+)
+
+func trashRetention(cfg *config) time.Duration {
+	return time.Duration(cfg.TrashRetentionDays) * time.Hour * 24
+}
+
+// fetches a photo in the user's trash
+func getTrashedPhotoToEdit(ctx *context, w http.ResponseWriter, r *http.Request) (*photo, error) {
+
+	photo, err := ctx.datamapper.getTrashedPhoto(ctx.params.getInt("id"))
+	if err != nil {
+		return photo, err
+	}
+
+	// others cannot see what is in your trash
+	if !photo.canEdit(ctx.user) {
+		return photo, sql.ErrNoRows
+	}
+	return photo, nil
+}
+
+func getTrash(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photos, err := ctx.datamapper.getTrash(getPage(r), ctx.user.ID)
+	if err != nil {
+		return err
+	}
+	ctx.media.signList(photos)
+	return renderJSON(w, photos, http.StatusOK)
+}
+
+func restorePhoto(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := getTrashedPhotoToEdit(ctx, w, r)
+	if err != nil {
+		return err
+	}
+
+	if !photo.canRestore(ctx.user, trashRetention(ctx.cfg)) {
+		return httpError{http.StatusGone, "This photo can no longer be restored"}
+	}
+
+	photo.DeletedAt = nil
+
+	if err := savePhoto(ctx, photo, true); err != nil {
+		return err
+	}
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	ctx.media.sign(photo)
+
+	sendMessage(&socketMessage{ctx.user.Name, "", photo.ID, "photo_restored"})
+	return renderJSON(w, photo, http.StatusOK)
+}
+
+// removes the photo for good without waiting for the retention period
+func purgePhoto(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := getTrashedPhotoToEdit(ctx, w, r)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.removePhoto(photo); err != nil {
+		return err
+	}
+
+	go func() {
+		if err := ctx.filestore.clean(photo.Filename); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	return renderString(w, http.StatusOK, "Photo deleted")
+}
+
+// Removes photos which have been in the trash longer than the retention period,
+// along with their files. Photos that cannot be removed are logged and skipped, and
+// retried on the next run.
+func (app *app) purgeTrash() error {
+
+	before := time.Now().Add(-trashRetention(app.cfg))
+
+	var afterID int64
+
+	for {
+		photos, err := app.datamapper.getExpiredTrash(before, afterID, trashPurgeBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, photo := range photos {
+			afterID = photo.ID
+			if err := app.datamapper.removePhoto(&photo); err != nil {
+				logError(err)
+				continue
+			}
+			if err := app.filestore.clean(photo.Filename); err != nil {
+				logError(err)
+			}
+		}
+		if len(photos) < trashPurgeBatchSize {
+			return nil
+		}
+	}
+}
+
+// runs purgeTrash in the background at regular intervals
+func (app *app) startTrashPurger() {
+	go func() {
+		for {
+			if err := app.purgeTrash(); err != nil {
+				logError(err)
+			}
+			time.Sleep(trashPurgeInterval)
+		}
+	}()
+}
@@ -0,0 +1,99 @@
+package photoshare
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCanRestore(t *testing.T) {
+	owner := &user{ID: 1, IsAuthenticated: true}
+	other := &user{ID: 2, IsAuthenticated: true}
+	retention := time.Hour * 24 * 30
+	photo := &photo{ID: 1, OwnerID: 1}
+
+	if photo.canRestore(owner, retention) {
+		t.Error("Photo not in the trash cannot be restored")
+	}
+
+	deletedAt := time.Now().Add(-time.Hour)
+	photo.DeletedAt = &deletedAt
+
+	if !photo.canRestore(owner, retention) {
+		t.Error("Owner should be able to restore the photo")
+	}
+	if photo.canRestore(other, retention) {
+		t.Error("Others should not be able to restore the photo")
+	}
+
+	deletedAt = time.Now().Add(-retention - time.Hour)
+	if photo.canRestore(owner, retention) {
+		t.Error("Photo cannot be restored after the retention period")
+	}
+}
+
+func TestTrashedPhotoIsHidden(t *testing.T) {
+	photo := &photo{Visibility: visibilityPublic}
+	if photo.isHidden() {
+		t.Error("Public photo should not be hidden")
+	}
+	now := time.Now()
+	photo.DeletedAt = &now
+	if !photo.isHidden() {
+		t.Error("Trashed photo should be hidden")
+	}
+}
+
+func TestRestorePhotoIfNone(t *testing.T) {
+
+	req := &http.Request{}
+	res := httptest.NewRecorder()
+
+	app := &app{
+		datamapper: &mockDataMapper{},
+		cache:      &mockCache{},
+	}
+
+	c := &context{
+		app:    app,
+		params: &params{map[string]string{"id": "1"}},
+		user:   &user{ID: 1, IsAuthenticated: true},
+	}
+
+	err := restorePhoto(c, res, req)
+	if err != sql.ErrNoRows {
+		t.Fail()
+	}
+}
+
+type failingPurgeDataMapper struct {
+	mockDataMapper
+	calls int
+}
+
+func (m *failingPurgeDataMapper) getExpiredTrash(before time.Time, afterID int64, limit int) ([]photo, error) {
+	m.calls++
+	var photos []photo
+	for id := afterID + 1; id <= 150 && len(photos) < limit; id++ {
+		photos = append(photos, photo{ID: id})
+	}
+	return photos, nil
+}
+
+func (m *failingPurgeDataMapper) removePhoto(photo *photo) error {
+	return sql.ErrConnDone
+}
+
+func TestPurgeTrashSkipsFailures(t *testing.T) {
+	datamapper := &failingPurgeDataMapper{}
+	app := &app{cfg: &config{TrashRetentionDays: 30}, datamapper: datamapper}
+
+	if err := app.purgeTrash(); err != nil {
+		t.Fatal(err)
+	}
+	if datamapper.calls != 2 {
+		t.Errorf("Purge should move past photos it cannot remove, got %d batches", datamapper.calls)
+	}
+}
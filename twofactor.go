@@ -0,0 +1,355 @@
+package photoshare
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	loginChallengeLength = 32
+	loginChallengeExpiry = 5 // minutes
+	maxChallengeAttempts = 5
+	numBackupCodes       = 10
+	backupCodeLength     = 10 // recovery codes for two-factor auth, not password recovery
+)
+
+var errInvalidTwoFactorCode = httpError{http.StatusBadRequest, "Invalid code"}
+
+// returned instead of a session when the user must also send a code
+type twoFactorChallenge struct {
+	TwoFactorRequired bool   `json:"twoFactorRequired"`
+	Challenge         string `json:"challenge"`
+}
+
+type twoFactorStatus struct {
+	Enabled           bool  `json:"enabled"`
+	RecoveryCodesLeft int64 `json:"recoveryCodesLeft"`
+}
+
+// Logs in the user whose password or provider account has been checked. If the
+// user has two-factor auth enabled, a challenge is returned for the second step.
+func completeLogin(ctx *context, w http.ResponseWriter, r *http.Request, user *user) error {
+
+	if user.TOTPEnabled {
+
+		token, err := generateRandomString(loginChallengeLength)
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.datamapper.createLoginChallenge(&loginChallenge{
+			TokenHash: hashToken(token),
+			UserID:    user.ID,
+			ExpiresAt: time.Now().Add(time.Minute * loginChallengeExpiry),
+		}); err != nil {
+			return err
+		}
+
+		return renderJSON(w, &twoFactorChallenge{true, token}, http.StatusOK)
+	}
+
+	if err := ctx.limiter.reset(user.ID); err != nil {
+		return err
+	}
+	if err := startSession(ctx, w, r, user); err != nil {
+		return err
+	}
+
+	user.IsAuthenticated = true
+
+	sendMessage(&socketMessage{user.Name, "", 0, "login"})
+	return renderJSON(w, newSessionInfo(user), http.StatusCreated)
+}
+
+// the second login step, with a code from the authenticator app or a recovery code
+func loginWithTwoFactor(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	var expired = httpError{http.StatusUnauthorized, "Your login has expired, please log in again"}
+
+	if s.Challenge == "" {
+		return expired
+	}
+
+	tokenHash := hashToken(s.Challenge)
+
+	challenge, err := ctx.datamapper.attemptLoginChallenge(tokenHash, maxChallengeAttempts)
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return expired
+		}
+		return err
+	}
+
+	user, err := ctx.datamapper.getActiveUser(challenge.UserID)
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return expired
+		}
+		return err
+	}
+
+	// wrong codes count against the account, as new challenges can be requested
+	attempt, err := reserveLogin(ctx, w, r, user.ID)
+	if err != nil {
+		return err
+	}
+
+	ok, err := checkTwoFactorCode(ctx, r, user, s.Code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err := failLogin(ctx, r, user, attempt); err != nil {
+			return err
+		}
+		return errInvalidTwoFactorCode
+	}
+
+	if err := ctx.datamapper.removeLoginChallenge(tokenHash); err != nil {
+		return err
+	}
+	if err := ctx.limiter.reset(user.ID); err != nil {
+		return err
+	}
+
+	if err := startSession(ctx, w, r, user); err != nil {
+		return err
+	}
+
+	user.IsAuthenticated = true
+
+	sendMessage(&socketMessage{user.Name, "", 0, "login"})
+	return renderJSON(w, newSessionInfo(user), http.StatusCreated)
+}
+
+// Checks a code from the authenticator app, or failing that a recovery code.
+// Either can only be used once.
+func checkTwoFactorCode(ctx *context, r *http.Request, user *user, code string) (bool, error) {
+
+	code = strings.Replace(strings.TrimSpace(code), " ", "", -1)
+
+	if code == "" || !user.TOTPEnabled {
+		return false, nil
+	}
+
+	if len(code) == totpDigits {
+		step, ok := validateTOTP(user.TOTPSecret, code, user.TOTPLastStep, time.Now())
+		if !ok {
+			return false, nil
+		}
+		if err := ctx.datamapper.useTOTPStep(user.ID, step); err != nil {
+			if isErrSqlNoRows(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		user.TOTPLastStep = step
+		return true, nil
+	}
+
+	if err := ctx.datamapper.useRecoveryCode(user.ID, hashRecoveryCode(code)); err != nil {
+		if isErrSqlNoRows(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if err := ctx.datamapper.addAuditEntry(
+		newAuditEntry(r, user.ID, user.ID, auditRecoveryCodeUsed, "")); err != nil {
+		logError(err)
+	}
+	return true, nil
+}
+
+// codes are shown as two groups of five characters
+func generateRecoveryCodes() ([]string, []string, error) {
+	var codes, hashes []string
+	for i := 0; i < numBackupCodes; i++ {
+		code, err := generateRandomString(backupCodeLength)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, code[:backupCodeLength/2]+"-"+code[backupCodeLength/2:])
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	return hashToken(strings.ToLower(strings.Replace(code, "-", "", -1)))
+}
+
+func getTwoFactorStatus(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	status := &twoFactorStatus{Enabled: ctx.user.TOTPEnabled}
+
+	if status.Enabled {
+		numCodes, err := ctx.datamapper.countRecoveryCodes(ctx.user.ID)
+		if err != nil {
+			return err
+		}
+		status.RecoveryCodesLeft = numCodes
+	}
+	return renderJSON(w, status, http.StatusOK)
+}
+
+// Generates a new secret for the user to add to their authenticator app. Two-factor
+// auth is not enabled until they verify a code from the app.
+func enrollTwoFactor(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	if ctx.user.TOTPEnabled {
+		return httpError{http.StatusBadRequest, "Two-factor authentication is already enabled"}
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return err
+	}
+
+	ctx.user.TOTPSecret = secret
+
+	if err := ctx.datamapper.updateUser(ctx.user); err != nil {
+		return err
+	}
+
+	s := &struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}{secret, totpProvisioningURI(secret, ctx.user.Name)}
+
+	return renderJSON(w, s, http.StatusOK)
+}
+
+// enables two-factor auth if the code matches the enrolled secret. The recovery
+// codes are only shown this once.
+func verifyTwoFactor(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Code string `json:"code"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	if ctx.user.TOTPEnabled {
+		return httpError{http.StatusBadRequest, "Two-factor authentication is already enabled"}
+	}
+	if ctx.user.TOTPSecret == "" {
+		return httpError{http.StatusBadRequest, "Set up two-factor authentication first"}
+	}
+
+	step, ok := validateTOTP(ctx.user.TOTPSecret, strings.TrimSpace(s.Code), ctx.user.TOTPLastStep, time.Now())
+	if !ok {
+		return errInvalidTwoFactorCode
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return err
+	}
+
+	ctx.user.TOTPEnabled = true
+	ctx.user.TOTPLastStep = step
+
+	entry := newAuditEntry(r, ctx.user.ID, ctx.user.ID, auditTwoFactorEnabled, "")
+
+	if err := ctx.datamapper.enableTwoFactor(ctx.user, hashes, entry); err != nil {
+		return err
+	}
+
+	return renderJSON(w, &struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}{codes}, http.StatusOK)
+}
+
+// replaces the recovery codes, for users who have used or lost them
+func regenerateRecoveryCodes(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Code string `json:"code"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	ok, err := checkTwoFactorCode(ctx, r, ctx.user, s.Code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errInvalidTwoFactorCode
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return err
+	}
+
+	entry := newAuditEntry(r, ctx.user.ID, ctx.user.ID, auditRecoveryCodesRegenerated, "")
+
+	if err := ctx.datamapper.enableTwoFactor(ctx.user, hashes, entry); err != nil {
+		return err
+	}
+
+	return renderJSON(w, &struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}{codes}, http.StatusOK)
+}
+
+func disableTwoFactor(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Code string `json:"code"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	ok, err := checkTwoFactorCode(ctx, r, ctx.user, s.Code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errInvalidTwoFactorCode
+	}
+
+	ctx.user.resetTwoFactor()
+
+	entry := newAuditEntry(r, ctx.user.ID, ctx.user.ID, auditTwoFactorDisabled, "")
+
+	if err := ctx.datamapper.resetTwoFactor(ctx.user, entry); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Two-factor authentication disabled")
+}
+
+// lets an admin disable two-factor auth for a user who has lost their device and codes
+func resetUserTwoFactor(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	user, err := ctx.datamapper.getActiveUser(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	user.resetTwoFactor()
+
+	entry := newAuditEntry(r, user.ID, ctx.user.ID, auditTwoFactorReset, "")
+
+	if err := ctx.datamapper.resetTwoFactor(user, entry); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Two-factor authentication reset")
+}
@@ -0,0 +1,262 @@
+package photoshare
+
+import (
+	"database/sql"
+	"encoding/base32"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type twoFactorDataMapper struct {
+	mockDataMapper
+	user         *user
+	challenge    *loginChallenge
+	recoveryHash string
+	codeHashes   []string
+	removed      bool
+	session      *userSession
+	entry        *auditEntry
+	reset        *user
+}
+
+func (m *twoFactorDataMapper) getUserByNameOrEmail(identifier string) (*user, error) {
+	return m.user, nil
+}
+
+func (m *twoFactorDataMapper) getActiveUser(userID int64) (*user, error) {
+	if m.user == nil || m.user.ID != userID {
+		return nil, sql.ErrNoRows
+	}
+	return m.user, nil
+}
+
+func (m *twoFactorDataMapper) createLoginChallenge(challenge *loginChallenge) error {
+	m.challenge = challenge
+	return nil
+}
+
+func (m *twoFactorDataMapper) attemptLoginChallenge(tokenHash string, maxAttempts int) (*loginChallenge, error) {
+	if m.challenge == nil || m.challenge.TokenHash != tokenHash || m.challenge.Attempts >= maxAttempts {
+		return nil, sql.ErrNoRows
+	}
+	m.challenge.Attempts++
+	return m.challenge, nil
+}
+
+func (m *twoFactorDataMapper) removeLoginChallenge(tokenHash string) error {
+	m.removed = true
+	return nil
+}
+
+func (m *twoFactorDataMapper) useRecoveryCode(userID int64, codeHash string) error {
+	if codeHash != m.recoveryHash {
+		return sql.ErrNoRows
+	}
+	m.recoveryHash = ""
+	return nil
+}
+
+func (m *twoFactorDataMapper) createSession(s *userSession) error {
+	s.ID = 1
+	m.session = s
+	return nil
+}
+
+func (m *twoFactorDataMapper) addAuditEntry(entry *auditEntry) error {
+	m.entry = entry
+	return nil
+}
+
+func (m *twoFactorDataMapper) enableTwoFactor(user *user, codeHashes []string, entry *auditEntry) error {
+	m.codeHashes = codeHashes
+	m.entry = entry
+	return nil
+}
+
+func (m *twoFactorDataMapper) resetTwoFactor(user *user, entry *auditEntry) error {
+	m.reset = user
+	m.entry = entry
+	return nil
+}
+
+const testTOTPKey = "12345678901234567890"
+
+func newTwoFactorUser() *user {
+	u := &user{ID: 1, Name: "tester", Password: "test", IsActive: true, TOTPEnabled: true}
+	u.TOTPSecret = base32.StdEncoding.EncodeToString([]byte(testTOTPKey))
+	u.encryptPassword()
+	return u
+}
+
+func currentTOTPCode() string {
+	return hotp([]byte(testTOTPKey), uint64(totpStep(time.Now())), totpDigits)
+}
+
+func TestLoginIfTwoFactorEnabled(t *testing.T) {
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/auth/", strings.NewReader(`{"identifier": "tester", "password": "test"}`))
+	res := httptest.NewRecorder()
+
+	datamapper := &twoFactorDataMapper{user: newTwoFactorUser()}
+
+	if err := login(newTestContext(datamapper, &user{}), res, req); err != nil {
+		t.Fatal(err)
+	}
+
+	if datamapper.session != nil {
+		t.Fatal("No session should be started before the code is checked")
+	}
+
+	challenge := &twoFactorChallenge{}
+	if err := json.Unmarshal(res.Body.Bytes(), challenge); err != nil {
+		t.Fatal(err)
+	}
+	if !challenge.TwoFactorRequired || hashToken(challenge.Challenge) != datamapper.challenge.TokenHash {
+		t.Error("Challenge should be returned for the second step")
+	}
+}
+
+func TestLoginWithTwoFactorCode(t *testing.T) {
+
+	body := `{"challenge": "foo", "code": "` + currentTOTPCode() + `"}`
+	req, _ := http.NewRequest("POST", "http://localhost/api/auth/2fa", strings.NewReader(body))
+	res := httptest.NewRecorder()
+
+	datamapper := &twoFactorDataMapper{
+		user:      newTwoFactorUser(),
+		challenge: &loginChallenge{TokenHash: hashToken("foo"), UserID: 1},
+	}
+
+	if err := loginWithTwoFactor(newTestContext(datamapper, &user{}), res, req); err != nil {
+		t.Fatal(err)
+	}
+	if res.Code != http.StatusCreated || datamapper.session == nil {
+		t.Error("Session should be started")
+	}
+	if !datamapper.removed {
+		t.Error("Challenge should only be used once")
+	}
+}
+
+func TestLoginWithTwoFactorRecoveryCode(t *testing.T) {
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/auth/2fa", strings.NewReader(`{"challenge": "foo", "code": "ABCDE-fghij"}`))
+	res := httptest.NewRecorder()
+
+	datamapper := &twoFactorDataMapper{
+		user:         newTwoFactorUser(),
+		challenge:    &loginChallenge{TokenHash: hashToken("foo"), UserID: 1},
+		recoveryHash: hashToken("abcdefghij"),
+	}
+
+	if err := loginWithTwoFactor(newTestContext(datamapper, &user{}), res, req); err != nil {
+		t.Fatal(err)
+	}
+	if datamapper.session == nil || datamapper.recoveryHash != "" {
+		t.Fatal("Recovery code should be used to log in")
+	}
+	if datamapper.entry == nil || datamapper.entry.Action != auditRecoveryCodeUsed {
+		t.Error("Use of recovery code should be recorded in the audit log")
+	}
+}
+
+func TestLoginWithTwoFactorIfInvalidCode(t *testing.T) {
+
+	datamapper := &twoFactorDataMapper{
+		user:      newTwoFactorUser(),
+		challenge: &loginChallenge{TokenHash: hashToken("foo"), UserID: 1},
+	}
+
+	for i := 0; i < maxChallengeAttempts; i++ {
+		req, _ := http.NewRequest("POST", "http://localhost/api/auth/2fa", strings.NewReader(`{"challenge": "foo", "code": "000000"}`))
+		err := loginWithTwoFactor(newTestContext(datamapper, &user{}), httptest.NewRecorder(), req)
+		if err != errInvalidTwoFactorCode {
+			t.Fatalf("Invalid code should not log in, got %v", err)
+		}
+	}
+
+	body := `{"challenge": "foo", "code": "` + currentTOTPCode() + `"}`
+	req, _ := http.NewRequest("POST", "http://localhost/api/auth/2fa", strings.NewReader(body))
+	err := loginWithTwoFactor(newTestContext(datamapper, &user{}), httptest.NewRecorder(), req)
+	if err, ok := err.(httpError); !ok || err.Status != http.StatusUnauthorized {
+		t.Error("Challenge should expire after too many attempts")
+	}
+	if datamapper.session != nil {
+		t.Error("No session should be started")
+	}
+}
+
+func TestVerifyTwoFactor(t *testing.T) {
+
+	body := `{"code": "` + currentTOTPCode() + `"}`
+	req, _ := http.NewRequest("POST", "http://localhost/api/me/2fa/verify", strings.NewReader(body))
+	res := httptest.NewRecorder()
+
+	u := newTwoFactorUser()
+	u.TOTPEnabled = false
+
+	datamapper := &twoFactorDataMapper{}
+
+	if err := verifyTwoFactor(newTestContext(datamapper, u), res, req); err != nil {
+		t.Fatal(err)
+	}
+	if !u.TOTPEnabled || u.TOTPLastStep == 0 {
+		t.Error("Two-factor auth should be enabled")
+	}
+
+	result := &struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}{}
+	if err := json.Unmarshal(res.Body.Bytes(), result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.RecoveryCodes) != numBackupCodes || len(datamapper.codeHashes) != numBackupCodes {
+		t.Fatal("Recovery codes should be generated")
+	}
+	if hashRecoveryCode(result.RecoveryCodes[0]) != datamapper.codeHashes[0] {
+		t.Error("Only the hashes of the recovery codes should be stored")
+	}
+	if datamapper.entry.Action != auditTwoFactorEnabled {
+		t.Error("Change should be recorded in the audit log")
+	}
+}
+
+func TestVerifyTwoFactorIfInvalidCode(t *testing.T) {
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/me/2fa/verify", strings.NewReader(`{"code": "000000"}`))
+
+	u := newTwoFactorUser()
+	u.TOTPEnabled = false
+
+	if err := verifyTwoFactor(newTestContext(&twoFactorDataMapper{}, u), httptest.NewRecorder(), req); err != errInvalidTwoFactorCode {
+		t.Error("Invalid code should not enable two-factor auth")
+	}
+	if u.TOTPEnabled {
+		t.Error("Two-factor auth should not be enabled")
+	}
+}
+
+func TestResetUserTwoFactor(t *testing.T) {
+
+	req, _ := http.NewRequest("DELETE", "http://localhost/api/users/1/2fa", nil)
+	res := httptest.NewRecorder()
+
+	datamapper := &twoFactorDataMapper{user: newTwoFactorUser()}
+
+	c := newTestContext(datamapper, &user{ID: 2, IsAdmin: true, IsAuthenticated: true})
+	c.params = &params{map[string]string{"id": "1"}}
+
+	if err := resetUserTwoFactor(c, res, req); err != nil {
+		t.Fatal(err)
+	}
+	if datamapper.reset == nil || datamapper.reset.TOTPEnabled || datamapper.reset.TOTPSecret != "" {
+		t.Error("Two-factor auth should be reset")
+	}
+	if datamapper.entry.Action != auditTwoFactorReset || datamapper.entry.ActorID != 2 {
+		t.Error("Reset should be recorded in the audit log with the admin")
+	}
+}
@@ -3,6 +3,7 @@ import fetch from 'isomorphic-fetch';
 
 const API_URI = '/api';
 const AUTH_TOKEN = 'X-Auth-Token';
+const REFRESH_TOKEN = 'X-Refresh-Token';
 
 function getToken() {
   return window.localStorage.getItem(AUTH_TOKEN);
@@ -16,9 +17,11 @@ function setToken(token) {
 
 function deleteToken() {
   window.localStorage.removeItem(AUTH_TOKEN);
+  window.localStorage.removeItem(REFRESH_TOKEN);
 }
 
-function callAPI(endpoint, method, data) {
+// access tokens are short-lived, so on a 401 we get new tokens and try once more
+function callAPI(endpoint, method, data, retried) {
 
   method = method || "GET";
 
@@ -51,6 +54,21 @@ function callAPI(endpoint, method, data) {
   return fetch(API_URI + endpoint, args)
     .then(response => {
 
+      const refreshToken = window.localStorage.getItem(REFRESH_TOKEN);
+
+      if (response.status === 401 && refreshToken && !retried) {
+        return refreshSession(refreshToken)
+          .then(() => callAPI(endpoint, method, data, true), error => {
+            deleteToken();
+            throw error;
+          });
+      }
+
+      // the session cannot be refreshed, so carry on as an anonymous user
+      if (response.status === 401 && token) {
+        deleteToken();
+      }
+
       if(!response.ok) {
         throw new Error(response.statusText);
       }
@@ -61,6 +79,12 @@ function callAPI(endpoint, method, data) {
           setToken(token);
         }
       }
+      if (response.headers.has(REFRESH_TOKEN)) {
+        const token = response.headers.get(REFRESH_TOKEN);
+        if (token) {
+          window.localStorage.setItem(REFRESH_TOKEN, token);
+        }
+      }
       if (response.headers.get('Content-Type').match('application/json')) {
         return response.json();
       }
@@ -93,6 +117,22 @@ export function updatePhotoTags(id, tags) {
   });
 }
 
+export function updatePhotoVisibility(id, visibility) {
+  return callAPI(`/photos/${id}/visibility`, 'PATCH', {
+    visibility: visibility
+  });
+}
+
+export function updatePhotoDescription(id, description) {
+  return callAPI(`/photos/${id}/description`, 'PATCH', {
+    description: description
+  });
+}
+
+export function bulkEditPhotos(ids, op, options = {}) {
+  return callAPI('/photos/bulk', 'POST', Object.assign({ids: ids, op: op}, options));
+}
+
 export function getPhotoDetail(id) {
   return callAPI('/photos/' + id);
 }
@@ -145,11 +185,24 @@ export function getTags() {
   return callAPI('/tags/');
 }
 
-export function upload(title, tags, photo) {
+export function suggestTags(q) {
+  return callAPI(`/tags/suggest?q=${encodeURIComponent(q)}`);
+}
+
+export function getTagTree() {
+  return callAPI('/tags/tree');
+}
+
+export function upload(title, tags, photo, visibility, location) {
   const data = new window.FormData();
   data.append("photo", photo);
   data.append("title", title);
   data.append("taglist", tags);
+  data.append("visibility", visibility || "public");
+  if (location) {
+    data.append("latitude", location.latitude);
+    data.append("longitude", location.longitude);
+  }
 
   return callAPI('/photos/', 'POST', data);
 }
@@ -162,3 +215,284 @@ export function votePhotoDown(id) {
   return callAPI(`/photos/${id}/downvote`, 'PATCH');
 }
 
+
+export function getAlbums(page) {
+  return callAPI(`/albums/?page=${page}`);
+}
+
+export function searchAlbums(page, query) {
+  return callAPI(`/albums/search?page=${page}&q=${query}`);
+}
+
+export function getAlbumsForOwner(ownerID, page) {
+  return callAPI(`/albums/owner/${ownerID}?page=${page}`);
+}
+
+export function getAlbumDetail(id, page) {
+  return callAPI(`/albums/${id}?page=${page || 1}`);
+}
+
+export function createAlbum(title, description, visibility) {
+  return callAPI('/albums/', 'POST', {
+    title: title,
+    description: description,
+    visibility: visibility
+  });
+}
+
+export function updateAlbum(id, album) {
+  return callAPI(`/albums/${id}`, 'PATCH', album);
+}
+
+export function updateAlbumPhotos(id, photoIDs) {
+  return callAPI(`/albums/${id}/photos`, 'PUT', {
+    photos: photoIDs
+  });
+}
+
+export function deleteAlbum(id) {
+  return callAPI(`/albums/${id}`, 'DELETE');
+}
+
+export function getComments(photoID, page) {
+  return callAPI(`/photos/${photoID}/comments?page=${page}`);
+}
+
+export function addComment(photoID, body, parentID) {
+  return callAPI(`/photos/${photoID}/comments`, 'POST', {
+    body: body,
+    parentId: parentID || 0
+  });
+}
+
+export function updateComment(id, body) {
+  return callAPI(`/comments/${id}`, 'PATCH', {
+    body: body
+  });
+}
+
+export function deleteComment(id) {
+  return callAPI(`/comments/${id}`, 'DELETE');
+}
+
+export function getUserProfile(userID) {
+  return callAPI(`/users/${userID}`);
+}
+
+export function followUser(userID) {
+  return callAPI(`/users/${userID}/follow`, 'PUT');
+}
+
+export function unfollowUser(userID) {
+  return callAPI(`/users/${userID}/follow`, 'DELETE');
+}
+
+export function getFollowers(userID, page) {
+  return callAPI(`/users/${userID}/followers?page=${page}`);
+}
+
+export function getFollowing(userID, page) {
+  return callAPI(`/users/${userID}/following?page=${page}`);
+}
+
+export function getTimeline(cursor) {
+  return callAPI(`/timeline?cursor=${cursor || ''}`);
+}
+
+export function addFavorite(photoID) {
+  return callAPI(`/photos/${photoID}/favorite`, 'PUT');
+}
+
+export function removeFavorite(photoID) {
+  return callAPI(`/photos/${photoID}/favorite`, 'DELETE');
+}
+
+export function getFavorites(page) {
+  return callAPI(`/me/favorites?page=${page}`);
+}
+
+export function getShares(page) {
+  return callAPI(`/shares/?page=${page}`);
+}
+
+export function createShare(share) {
+  return callAPI('/shares/', 'POST', share);
+}
+
+export function deleteShare(id) {
+  return callAPI(`/shares/${id}`, 'DELETE');
+}
+
+export function getGeoPhotos(bbox, zoom) {
+  return callAPI(`/photos/geo?bbox=${bbox.join(',')}&zoom=${zoom}`);
+}
+
+export function updatePhotoLocation(id, latitude, longitude) {
+  return callAPI(`/photos/${id}/location`, 'PATCH', { latitude, longitude });
+}
+
+export function renameTag(id, name) {
+  return callAPI(`/tags/${id}`, 'PATCH', { name });
+}
+
+export function mergeTag(id, into) {
+  return callAPI(`/tags/${id}/merge`, 'POST', { into });
+}
+
+export function getTagSynonyms() {
+  return callAPI('/tags/synonyms/');
+}
+
+export function addTagSynonym(name, tagId) {
+  return callAPI('/tags/synonyms/', 'POST', { name, tagId });
+}
+
+export function removeTagSynonym(id) {
+  return callAPI(`/tags/synonyms/${id}`, 'DELETE');
+}
+
+export function getBlockedTags() {
+  return callAPI('/tags/blocked/');
+}
+
+export function blockTag(name) {
+  return callAPI('/tags/blocked/', 'POST', { name });
+}
+
+export function unblockTag(id) {
+  return callAPI(`/tags/blocked/${id}`, 'DELETE');
+}
+
+export function getRelatedPhotos(id) {
+  return callAPI(`/photos/${id}/related`);
+}
+
+export function getTrash(page) {
+  return callAPI(`/me/trash?page=${page}`);
+}
+
+export function restorePhoto(id) {
+  return callAPI(`/me/trash/${id}/restore`, 'POST');
+}
+
+export function purgePhoto(id) {
+  return callAPI(`/me/trash/${id}`, 'DELETE');
+}
+
+export function getUserProfileByName(name) {
+  return callAPI(`/users/${encodeURIComponent(name)}`);
+}
+
+export function editProfile(displayName, bio, website) {
+  return callAPI('/me/profile', 'PUT', { displayName, bio, website });
+}
+
+export function uploadAvatar(avatar) {
+  const data = new window.FormData();
+  data.append('avatar', avatar);
+  return callAPI('/me/avatar', 'POST', data);
+}
+
+export function deleteAvatar() {
+  return callAPI('/me/avatar', 'DELETE');
+}
+
+export function exchangeAuthCode(code) {
+  return callAPI('/auth/oauth2/exchange', 'POST', { code });
+}
+
+export function getAuthProviders() {
+  return callAPI('/auth/oauth2/providers');
+}
+
+export function getAuthRedirectURL(provider) {
+  return callAPI(`/auth/oauth2/${provider}/url`).then(response => response.text());
+}
+
+export function getIdentities() {
+  return callAPI('/me/identities');
+}
+
+export function getLinkIdentityURL(provider) {
+  return callAPI(`/me/identities/${provider}/url`).then(response => response.text());
+}
+
+export function linkIdentity(code) {
+  return callAPI('/me/identities', 'POST', { code });
+}
+
+export function unlinkIdentity(id) {
+  return callAPI(`/me/identities/${id}`, 'DELETE');
+}
+
+export function refreshSession(refreshToken) {
+  return callAPI('/auth/refresh', 'POST', { refreshToken }, true);
+}
+
+export function getSessions() {
+  return callAPI('/me/sessions');
+}
+
+export function revokeSession(id) {
+  return callAPI(`/me/sessions/${id}`, 'DELETE');
+}
+
+export function revokeOtherSessions() {
+  return callAPI('/me/sessions', 'DELETE');
+}
+
+export function loginWithTwoFactor(challenge, code) {
+  return callAPI('/auth/2fa', 'POST', { challenge, code });
+}
+
+export function getTwoFactorStatus() {
+  return callAPI('/me/2fa');
+}
+
+export function enrollTwoFactor() {
+  return callAPI('/me/2fa/enroll', 'POST');
+}
+
+export function verifyTwoFactor(code) {
+  return callAPI('/me/2fa/verify', 'POST', { code });
+}
+
+export function regenerateRecoveryCodes(code) {
+  return callAPI('/me/2fa/recovery-codes', 'POST', { code });
+}
+
+export function disableTwoFactor(code) {
+  return callAPI('/me/2fa', 'DELETE', { code });
+}
+
+export function resetUserTwoFactor(userID) {
+  return callAPI(`/users/${userID}/2fa`, 'DELETE');
+}
+
+export function unlockUser(userID) {
+  return callAPI(`/users/${userID}/lockout`, 'DELETE');
+}
+
+export function getAPITokens() {
+  return callAPI('/me/tokens');
+}
+
+export function createAPIToken(name, scopes) {
+  return callAPI('/me/tokens', 'POST', { name, scopes });
+}
+
+export function revokeAPIToken(tokenID) {
+  return callAPI(`/me/tokens/${tokenID}`, 'DELETE');
+}
+
+export function verifyEmail(token) {
+  return callAPI('/auth/verify-email', 'POST', { token });
+}
+
+export function resendVerificationEmail() {
+  return callAPI('/me/email/verify', 'POST');
+}
+
+export function changeEmail(email, password) {
+  return callAPI('/me/email', 'PUT', { email, password });
+}
@@ -186,7 +186,9 @@ export default class PhotoDetail extends React.Component {
     const makeHref = this.context.router.makeHref;
 
     const photo = this.props.photo;
-    const src = photo.photo ? `/uploads/thumbnails/${photo.photo}` : '/img/ajax-loader.gif';
+    // private photos come with signed URLs
+    const thumbnailUrl = photo.thumbnailUrl || `/uploads/thumbnails/${photo.photo}`;
+    const mediaUrl = photo.mediaUrl || `/uploads/${photo.photo}`;
 
     if (!this.props.isLoaded) {
       return <Loader />;
@@ -202,8 +204,8 @@ export default class PhotoDetail extends React.Component {
       {this.renderButtons()}
       <div className="row">
           <div className="col-xs-6 col-md-3">
-              <a target="_blank" className="thumbnail" title={photo.title} href={`/uploads/${photo.photo}`}>
-                  <img alt={photo.title} src={`/uploads/thumbnails/${photo.photo}`} />
+              <a target="_blank" className="thumbnail" title={photo.title} href={mediaUrl}>
+                  <img alt={photo.title} src={thumbnailUrl} />
               </a>
           </div>
           <div className="col-xs-6">
@@ -30,7 +30,7 @@ class PhotoListItem extends React.Component {
   render() {
 
     const photo = this.props.photo;
-    const src = photo.photo ? `/uploads/thumbnails/${photo.photo}` : '/img/ajax-loader.gif';
+    const src = photo.photo ? (photo.thumbnailUrl || `/uploads/thumbnails/${photo.photo}`) : '/img/ajax-loader.gif';
 
     return (
       <div className="col-xs-6 col-md-3">
@@ -48,9 +48,9 @@ export default class RecoverPassword extends React.Component {
     let msg = '';
 
     if (this.props.isError) {
-      msg = <Alert bsStyle="warning">Sorry, we were not able to find your email address.</Alert>;
+      msg = <Alert bsStyle="warning">Sorry, we were not able to send the email. Please try again later.</Alert>;
     } else if (this.props.isSuccess) {
-      msg = <Alert bsStyle="success">Please check your email inbox for instructions on how to recover your password.</Alert>;
+      msg = <Alert bsStyle="success">If an account exists for this email address, you will receive an email with instructions on how to recover your password. The link expires in one hour.</Alert>;
     } else {
       msg = <Alert bsStyle="info">Please enter your email address and we'll send you a link to recover your password.</Alert>;
     }
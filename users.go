@@ -0,0 +1,188 @@
+package photoshare
+
+import (
+	"net/http"
+	"strings"
+)
+
+func getUserProfile(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	profile, err := ctx.datamapper.getUserProfile(ctx.params.getInt("id"), ctx.user)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, profile, http.StatusOK)
+}
+
+func getUserProfileByName(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	profile, err := ctx.datamapper.getUserProfileByName(ctx.params.get("name"), ctx.user)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, profile, http.StatusOK)
+}
+
+// users can only edit their own profile
+func editProfile(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &profileUpdate{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	s.DisplayName = strings.TrimSpace(s.DisplayName)
+	s.Bio = strings.TrimSpace(s.Bio)
+	s.Website = strings.TrimSpace(s.Website)
+
+	if err := ctx.validate(s, r); err != nil {
+		return err
+	}
+
+	ctx.user.DisplayName = s.DisplayName
+	ctx.user.Bio = s.Bio
+	ctx.user.Website = s.Website
+
+	if err := ctx.datamapper.updateUser(ctx.user); err != nil {
+		return err
+	}
+	return renderProfile(ctx, w)
+}
+
+// stores the avatar with a thumbnail, which is used as the profile picture
+func uploadAvatar(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	src, hdr, err := r.FormFile("avatar")
+	if err != nil {
+		if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+			return httpError{http.StatusBadRequest, "Invalid image"}
+		}
+		return err
+	}
+	defer src.Close()
+
+	contentType := hdr.Header.Get("Content-Type")
+
+	if !isAllowedContentType(contentType) {
+		return httpError{http.StatusBadRequest, "Only JPEG, PNG or GIF files allowed"}
+	}
+
+	filename := generateRandomFilename(contentType)
+
+	if err := ctx.filestore.store(src, filename, contentType, false); err != nil {
+		return httpError{http.StatusBadRequest, "Invalid image"}
+	}
+
+	previous := ctx.user.Avatar
+	ctx.user.Avatar = filename
+
+	if err := ctx.datamapper.updateUser(ctx.user); err != nil {
+		if err := ctx.filestore.clean(filename); err != nil {
+			logError(err)
+		}
+		return err
+	}
+
+	cleanAvatar(ctx, previous)
+	return renderProfile(ctx, w)
+}
+
+func deleteAvatar(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	previous := ctx.user.Avatar
+	ctx.user.Avatar = ""
+
+	if err := ctx.datamapper.updateUser(ctx.user); err != nil {
+		return err
+	}
+
+	cleanAvatar(ctx, previous)
+	return renderProfile(ctx, w)
+}
+
+func cleanAvatar(ctx *context, filename string) {
+	if filename == "" {
+		return
+	}
+	go func() {
+		if err := ctx.filestore.clean(filename); err != nil {
+			logError(err)
+		}
+	}()
+}
+
+func renderProfile(ctx *context, w http.ResponseWriter) error {
+
+	profile, err := ctx.datamapper.getUserProfile(ctx.user.ID, ctx.user)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, profile, http.StatusOK)
+}
+
+func followUser(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	profile, err := ctx.datamapper.getUserProfile(ctx.params.getInt("id"), ctx.user)
+	if err != nil {
+		return err
+	}
+
+	if !profile.canFollow(ctx.user) {
+		return httpError{http.StatusForbidden, "You can't follow this user"}
+	}
+
+	if err := ctx.datamapper.follow(ctx.user.ID, profile.ID); err != nil {
+		return err
+	}
+
+	sendMessage(&socketMessage{ctx.user.Name, profile.Name, 0, "user_followed"})
+	return renderString(w, http.StatusOK, "Following user")
+}
+
+func unfollowUser(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	if err := ctx.datamapper.unfollow(ctx.user.ID, ctx.params.getInt("id")); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "No longer following user")
+}
+
+func getFollowers(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	users, err := ctx.datamapper.getFollowers(getPage(r), ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, users, http.StatusOK)
+}
+
+func getFollowing(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	users, err := ctx.datamapper.getFollowing(getPage(r), ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, users, http.StatusOK)
+}
+
+// recent photos from users the current user follows
+func getTimeline(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	var (
+		cursor *timelineCursor
+		err    error
+	)
+
+	if value := r.FormValue("cursor"); value != "" {
+		if cursor, err = parseTimelineCursor(value); err != nil {
+			return err
+		}
+	}
+
+	photos, err := ctx.datamapper.getTimeline(ctx.user.ID, cursor)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, photos, http.StatusOK)
+}
@@ -0,0 +1,112 @@
+package photoshare
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimelineCursor(t *testing.T) {
+	cursor := &timelineCursor{time.Date(2015, 10, 1, 12, 30, 0, 123456000, time.UTC), 42}
+
+	result, err := parseTimelineCursor(cursor.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.createdAt.Equal(cursor.createdAt) || result.id != cursor.id {
+		t.Errorf("Cursor should be %s, got %s", cursor, result)
+	}
+
+	if _, err := parseTimelineCursor("foo"); err != errInvalidCursor {
+		t.Error("Cursor should be invalid")
+	}
+}
+
+func TestCannotFollowSelf(t *testing.T) {
+	req, _ := http.NewRequest("PUT", "http://localhost/api/users/1/follow", nil)
+	res := httptest.NewRecorder()
+
+	app := &app{
+		datamapper: &mockDataMapper{},
+	}
+
+	c := &context{
+		app:    app,
+		params: &params{map[string]string{"id": "1"}},
+		user:   &user{ID: 1, IsAuthenticated: true},
+	}
+
+	err := followUser(c, res, req)
+	if err, ok := err.(httpError); !ok || err.Status != http.StatusForbidden {
+		t.Error("User should not be able to follow themselves")
+	}
+}
+
+func TestProfileUpdateValidate(t *testing.T) {
+
+	c := &context{}
+
+	update := &profileUpdate{DisplayName: "Dan", Bio: "Photographer", Website: "https://example.com"}
+	if err := c.validate(update, nil); err != nil {
+		t.Error("Profile should be valid")
+	}
+
+	update = &profileUpdate{Website: "javascript:alert(1)"}
+	if err := c.validate(update, nil); err == nil {
+		t.Error("Website should be a web address")
+	}
+
+	update = &profileUpdate{DisplayName: strings.Repeat("a", maxDisplayNameLength+1)}
+	if err := c.validate(update, nil); err == nil {
+		t.Error("Display name should not be too long")
+	}
+}
+
+func TestEditProfile(t *testing.T) {
+
+	body := `{"displayName": " Dan ", "bio": "Photographer", "website": "http://example.com"}`
+	req, _ := http.NewRequest("PUT", "http://localhost/api/me/profile", strings.NewReader(body))
+	res := httptest.NewRecorder()
+
+	app := &app{
+		datamapper: &mockDataMapper{},
+	}
+
+	c := &context{
+		app:    app,
+		params: &params{make(map[string]string)},
+		user:   &user{ID: 1, IsAuthenticated: true},
+	}
+
+	if err := editProfile(c, res, req); err != nil {
+		t.Fatal(err)
+	}
+	if c.user.DisplayName != "Dan" || c.user.Website != "http://example.com" {
+		t.Error("Profile should be updated")
+	}
+	if res.Code != http.StatusOK {
+		t.Errorf("Status should be OK, got %d", res.Code)
+	}
+}
+
+func TestGetUserProfileByNameIfNone(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://localhost/api/users/nobody", nil)
+	res := httptest.NewRecorder()
+
+	app := &app{
+		datamapper: &mockDataMapper{},
+	}
+
+	c := &context{
+		app:    app,
+		params: &params{map[string]string{"name": "nobody"}},
+		user:   &user{},
+	}
+
+	if err := getUserProfileByName(c, res, req); err != sql.ErrNoRows {
+		t.Error("Profile should not be found")
+	}
+}
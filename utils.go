@@ -1,14 +1,48 @@
 package photoshare
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/juju/errgo"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
 )
 
+const randomStringCharacters = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// Generates a cryptographically random string suitable for tokens and codes
+func generateRandomString(length int) (string, error) {
+
+	buf := bytes.Buffer{}
+	randbytes := make([]byte, length)
+
+	if _, err := rand.Read(randbytes); err != nil {
+		return "", err
+	}
+
+	numChars := len(randomStringCharacters)
+
+	for i := 0; i < length; i++ {
+		index := int(randbytes[i]) % numChars
+		char := randomStringCharacters[index]
+		buf.WriteString(string(char))
+	}
+
+	return buf.String(), nil
+}
+
+// Tokens are stored as SHA-256 hashes, so a database leak does not expose them
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func writeBody(w http.ResponseWriter, body []byte, status int, contentType string) error {
 	w.Header().Set("Content-Type", contentType+"; charset=UTF8")
 	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
@@ -40,6 +74,15 @@ func getBaseURL(r *http.Request) string {
 	return fmt.Sprintf("%s://%s", getScheme(r), r.Host)
 }
 
+// the client address without the port
+func getRemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func decodeJSON(r *http.Request, value interface{}) error {
 	return errgo.Mask(json.NewDecoder(r.Body).Decode(value))
 }
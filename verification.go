@@ -0,0 +1,192 @@
+package photoshare
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	emailTokenLength        = 32
+	emailTokenExpiry        = 48 // hours
+	emailResendInterval     = time.Minute
+	emailVerificationWindow = time.Hour
+	maxEmailVerifications   = 5 // per window
+
+	// actions that can be restricted to users with a verified email
+	restrictUpload  = "upload"
+	restrictComment = "comment"
+	restrictShare   = "share"
+)
+
+var errEmailNotVerified = httpError{http.StatusForbidden, "Please verify your email address first"}
+
+// refuses the action if the user has not verified their email and the action is restricted
+func (ctx *context) checkVerified(action string) error {
+	if !ctx.user.EmailVerified && ctx.cfg.restrictsUnverified(action) {
+		return errEmailNotVerified
+	}
+	return nil
+}
+
+// Emails a token to the address, which is the user's email or the new email they
+// want to change to. New users are welcomed in the same email. Users can only
+// request a few emails an hour.
+func sendEmailVerification(ctx *context, r *http.Request, user *user, email string, isNew bool) error {
+
+	now := time.Now()
+
+	numRecent, err := ctx.datamapper.countEmailVerifications(user.ID, now.Add(-emailResendInterval))
+	if err != nil {
+		return err
+	}
+	numInWindow, err := ctx.datamapper.countEmailVerifications(user.ID, now.Add(-emailVerificationWindow))
+	if err != nil {
+		return err
+	}
+	if numRecent > 0 || numInWindow >= maxEmailVerifications {
+		return httpError{http.StatusTooManyRequests, "Please wait before requesting another email"}
+	}
+
+	token, err := generateRandomString(emailTokenLength)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.createEmailVerification(&emailVerification{
+		TokenHash: hashToken(token),
+		UserID:    user.ID,
+		Email:     email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Hour * emailTokenExpiry),
+	}); err != nil {
+		return err
+	}
+
+	go func() {
+		if err := ctx.mailer.sendVerificationMail(user, email, token, isNew, r); err != nil {
+			logError(err)
+		}
+	}()
+
+	return nil
+}
+
+// Verifies the email with the emailed token. If the user was changing their email
+// the new address replaces the old one. The user does not need to be logged in,
+// as the link may be opened on another device.
+func verifyEmail(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Token string `json:"token"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	var invalidToken = httpError{http.StatusBadRequest, "Invalid or expired link, please request another email"}
+
+	if s.Token == "" {
+		return invalidToken
+	}
+
+	v, err := ctx.datamapper.getEmailVerification(hashToken(s.Token))
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return invalidToken
+		}
+		return err
+	}
+
+	account, err := ctx.datamapper.getActiveUser(v.UserID)
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return invalidToken
+		}
+		return err
+	}
+
+	entry := newAuditEntry(r, account.ID, account.ID, auditEmailVerified, v.Email)
+
+	if v.Email != account.Email {
+
+		// the address may have been taken since the change was requested
+		ok, err := ctx.datamapper.isUserEmailAvailable(&user{ID: account.ID, Email: v.Email})
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return httpError{http.StatusBadRequest, "Email already taken"}
+		}
+
+		entry.Action = auditEmailChanged
+		entry.Details = account.Email + " => " + v.Email
+		account.Email = v.Email
+	}
+
+	account.EmailVerified = true
+
+	if err := ctx.datamapper.verifyEmail(account, entry); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Email verified")
+}
+
+func resendVerificationEmail(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	if ctx.user.EmailVerified {
+		return httpError{http.StatusBadRequest, "Your email address is already verified"}
+	}
+
+	if err := sendEmailVerification(ctx, r, ctx.user, ctx.user.Email, false); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Verification email sent")
+}
+
+// The email is only changed once the user follows the link sent to the new address,
+// so the account cannot be moved to an address the user does not own.
+func changeEmail(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	email := strings.ToLower(strings.TrimSpace(s.Email))
+
+	// users who log in with a provider have no password to check
+	if ctx.user.Password != "" && !ctx.user.checkPassword(s.Password) {
+		return httpError{http.StatusBadRequest, "Invalid password"}
+	}
+
+	errors := make(map[string]string)
+
+	if !validateEmail(email) {
+		errors["email"] = "Invalid email address"
+	} else if email == ctx.user.Email {
+		errors["email"] = "This is already your email address"
+	} else {
+		ok, err := ctx.datamapper.isUserEmailAvailable(&user{ID: ctx.user.ID, Email: email})
+		if err != nil {
+			return err
+		}
+		if !ok {
+			errors["email"] = "Email already taken"
+		}
+	}
+
+	if len(errors) > 0 {
+		return validationFailure{errors}
+	}
+
+	if err := sendEmailVerification(ctx, r, ctx.user, email, false); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Verification email sent")
+}
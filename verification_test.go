@@ -0,0 +1,218 @@
+package photoshare
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type verificationDataMapper struct {
+	mockDataMapper
+	user         *user
+	verification *emailVerification
+	created      *emailVerification
+	numRecent    int64
+	taken        bool
+	verified     *user
+	entry        *auditEntry
+}
+
+func (m *verificationDataMapper) getActiveUser(userID int64) (*user, error) {
+	if m.user == nil || m.user.ID != userID {
+		return nil, sql.ErrNoRows
+	}
+	return m.user, nil
+}
+
+func (m *verificationDataMapper) getEmailVerification(tokenHash string) (*emailVerification, error) {
+	if m.verification == nil || m.verification.TokenHash != tokenHash {
+		return nil, sql.ErrNoRows
+	}
+	return m.verification, nil
+}
+
+func (m *verificationDataMapper) createEmailVerification(v *emailVerification) error {
+	m.created = v
+	return nil
+}
+
+func (m *verificationDataMapper) countEmailVerifications(userID int64, since time.Time) (int64, error) {
+	return m.numRecent, nil
+}
+
+func (m *verificationDataMapper) isUserEmailAvailable(user *user) (bool, error) {
+	return !m.taken, nil
+}
+
+func (m *verificationDataMapper) verifyEmail(user *user, entry *auditEntry) error {
+	m.verified = user
+	m.entry = entry
+	return nil
+}
+
+func TestCheckVerified(t *testing.T) {
+
+	c := newTestContext(&verificationDataMapper{}, &user{ID: 1})
+
+	if err := c.checkVerified(restrictUpload); err != errEmailNotVerified {
+		t.Error("Unverified user should not upload")
+	}
+	if err := c.checkVerified(restrictComment); err != nil {
+		t.Error("Unverified user should comment if not restricted")
+	}
+
+	c.user.EmailVerified = true
+
+	if err := c.checkVerified(restrictUpload); err != nil {
+		t.Error("Verified user should upload")
+	}
+}
+
+func TestVerifyEmail(t *testing.T) {
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/auth/verify-email", strings.NewReader(`{"token": "foo"}`))
+	res := httptest.NewRecorder()
+
+	datamapper := &verificationDataMapper{
+		user:         &user{ID: 1, Email: "tester@example.com"},
+		verification: &emailVerification{TokenHash: hashToken("foo"), UserID: 1, Email: "tester@example.com"},
+	}
+
+	if err := verifyEmail(newTestContext(datamapper, &user{}), res, req); err != nil {
+		t.Fatal(err)
+	}
+	if datamapper.verified == nil || !datamapper.verified.EmailVerified {
+		t.Fatal("Email should be verified")
+	}
+	if datamapper.entry.Action != auditEmailVerified {
+		t.Error("Verification should be recorded in the audit log")
+	}
+}
+
+func TestVerifyEmailChange(t *testing.T) {
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/auth/verify-email", strings.NewReader(`{"token": "foo"}`))
+	res := httptest.NewRecorder()
+
+	datamapper := &verificationDataMapper{
+		user:         &user{ID: 1, Email: "old@example.com", EmailVerified: true},
+		verification: &emailVerification{TokenHash: hashToken("foo"), UserID: 1, Email: "new@example.com"},
+	}
+
+	if err := verifyEmail(newTestContext(datamapper, &user{}), res, req); err != nil {
+		t.Fatal(err)
+	}
+	if datamapper.verified == nil || datamapper.verified.Email != "new@example.com" {
+		t.Fatal("Email should be changed")
+	}
+	if datamapper.entry.Action != auditEmailChanged || !strings.Contains(datamapper.entry.Details, "old@example.com") {
+		t.Error("Change should be recorded in the audit log")
+	}
+}
+
+func TestVerifyEmailChangeIfTaken(t *testing.T) {
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/auth/verify-email", strings.NewReader(`{"token": "foo"}`))
+	res := httptest.NewRecorder()
+
+	datamapper := &verificationDataMapper{
+		user:         &user{ID: 1, Email: "old@example.com", EmailVerified: true},
+		verification: &emailVerification{TokenHash: hashToken("foo"), UserID: 1, Email: "new@example.com"},
+		taken:        true,
+	}
+
+	err := verifyEmail(newTestContext(datamapper, &user{}), res, req)
+	if err, ok := err.(httpError); !ok || err.Status != http.StatusBadRequest {
+		t.Error("Email taken by another user should not be used")
+	}
+	if datamapper.verified != nil {
+		t.Error("Email should not be changed")
+	}
+}
+
+func TestResendVerificationEmailIfThrottled(t *testing.T) {
+
+	req, _ := http.NewRequest("POST", "http://localhost/api/me/email/verify", nil)
+	res := httptest.NewRecorder()
+
+	datamapper := &verificationDataMapper{numRecent: 1}
+
+	err := resendVerificationEmail(newTestContext(datamapper, &user{ID: 1, Email: "tester@example.com"}), res, req)
+	if err, ok := err.(httpError); !ok || err.Status != http.StatusTooManyRequests {
+		t.Error("Emails should be throttled")
+	}
+	if datamapper.created != nil {
+		t.Error("No email should be sent")
+	}
+}
+
+func TestChangeEmail(t *testing.T) {
+
+	req, _ := http.NewRequest("PUT", "http://localhost/api/me/email", strings.NewReader(`{"email": "New@example.com", "password": "test"}`))
+	res := httptest.NewRecorder()
+
+	u := &user{ID: 1, Email: "old@example.com", Password: "test", EmailVerified: true}
+	u.encryptPassword()
+
+	datamapper := &verificationDataMapper{}
+
+	if err := changeEmail(newTestContext(datamapper, u), res, req); err != nil {
+		t.Fatal(err)
+	}
+	if datamapper.created == nil || datamapper.created.Email != "new@example.com" {
+		t.Fatal("Verification should be sent to the new address")
+	}
+	if u.Email != "old@example.com" || !u.EmailVerified {
+		t.Error("Email should not change until the new address is verified")
+	}
+}
+
+func TestChangeEmailIfWrongPassword(t *testing.T) {
+
+	req, _ := http.NewRequest("PUT", "http://localhost/api/me/email", strings.NewReader(`{"email": "new@example.com", "password": "wrong"}`))
+	res := httptest.NewRecorder()
+
+	u := &user{ID: 1, Email: "old@example.com", Password: "test"}
+	u.encryptPassword()
+
+	datamapper := &verificationDataMapper{}
+
+	err := changeEmail(newTestContext(datamapper, u), res, req)
+	if err, ok := err.(httpError); !ok || err.Status != http.StatusBadRequest {
+		t.Error("Password should be checked")
+	}
+	if datamapper.created != nil {
+		t.Error("No email should be sent")
+	}
+}
+
+// an existing user with an unverified email
+func TestAuthCallbackLinksVerifiedEmail(t *testing.T) {
+
+	req, _ := http.NewRequest("GET", "http://localhost/api/auth/oauth2/google/callback/", nil)
+	res := httptest.NewRecorder()
+
+	datamapper := &existingEmailDataMapper{verified: true}
+
+	c := &context{
+		app: &app{
+			datamapper: datamapper,
+			auth:       &mockAuthenticator{&authInfo{id: "123", email: "dan@example.com"}},
+		},
+		params: &params{map[string]string{"provider": "google"}},
+		user:   &user{},
+	}
+
+	if err := authCallback(c, res, req); err != nil {
+		t.Fatal(err)
+	}
+	if datamapper.identity == nil || datamapper.identity.UserID != 2 {
+		t.Error("Provider account should be linked to the verified email")
+	}
+	if datamapper.code == nil || datamapper.code.UserID != 2 {
+		t.Error("User should be logged in")
+	}
+}